@@ -1,62 +1,302 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/lamassuiot/device-virtual/pkg/api"
+	"github.com/lamassuiot/device-virtual/pkg/api/pb"
+	"github.com/lamassuiot/device-virtual/pkg/auth"
+	"github.com/lamassuiot/device-virtual/pkg/auth/mtls"
+	"github.com/lamassuiot/device-virtual/pkg/auth/oidc"
+	"github.com/lamassuiot/device-virtual/pkg/certwatch"
+	"github.com/lamassuiot/device-virtual/pkg/client"
 	"github.com/lamassuiot/device-virtual/pkg/client/mosquitto"
 	"github.com/lamassuiot/device-virtual/pkg/configs"
+	"github.com/lamassuiot/device-virtual/pkg/discovery"
 	"github.com/lamassuiot/device-virtual/pkg/discovery/consul"
+	"github.com/lamassuiot/device-virtual/pkg/discovery/etcd"
+	"github.com/lamassuiot/device-virtual/pkg/discovery/kubernetes"
+	"github.com/lamassuiot/device-virtual/pkg/discovery/static"
+	"github.com/lamassuiot/device-virtual/pkg/events"
+	"github.com/lamassuiot/device-virtual/pkg/health"
+	"github.com/lamassuiot/device-virtual/pkg/identity"
+	"github.com/lamassuiot/device-virtual/pkg/identity/software"
+	"github.com/lamassuiot/device-virtual/pkg/identity/tpm"
+	"github.com/lamassuiot/device-virtual/pkg/impairment"
+	"github.com/lamassuiot/device-virtual/pkg/queue"
+	"github.com/lamassuiot/device-virtual/pkg/queue/disk"
+	"github.com/lamassuiot/device-virtual/pkg/queue/memory"
+	"github.com/lamassuiot/device-virtual/pkg/recording"
+	"github.com/lamassuiot/device-virtual/pkg/telemetry"
+	"github.com/lamassuiot/device-virtual/pkg/telemetry/jaeger"
+	"github.com/lamassuiot/device-virtual/pkg/telemetry/otlp"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	jaegercfg "github.com/uber/jaeger-client-go/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
 func main() {
 	var logger log.Logger
+	logLevel := newLevelFilter(log.NewJSONLogger(os.Stdout), "info")
 	{
-		logger = log.NewJSONLogger(os.Stdout)
-		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+		logger = log.With(logLevel, "ts", log.DefaultTimestampUTC)
 		logger = log.With(logger, "caller", log.DefaultCaller)
-		logger = level.NewFilter(logger, level.AllowInfo())
 	}
 
 	cfg, err := configs.NewConfig("device")
 	if err != nil {
-		level.Error(logger).Log("err", err, "msg", "Could not read environment configuration values")
+		level.Error(logger).Log("err", err, "msg", "Could not read configuration values")
+		os.Exit(1)
+	}
+	if err := cfg.Validate(); err != nil {
+		level.Error(logger).Log("err", err, "msg", "Invalid configuration")
 		os.Exit(1)
 	}
+	live := &settings{logLevel: logLevel, cors: api.NewCORS(api.CORSPolicy{})}
+	if err := live.apply(cfg); err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load API client CA")
+		os.Exit(1)
+	}
+	if cfg.ConfigFile != "" {
+		level.Info(logger).Log("msg", "Configuration read from "+cfg.ConfigFile)
+	}
 
-	client := mosquitto.NewClient(logger)
-	level.Info(logger).Log("msg", "MQTT Client created")
+	telemetryProvider, err := newTelemetry(cfg, logger)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not start "+cfg.TelemetryExporter+" telemetry exporter")
+		os.Exit(1)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := telemetryProvider.Shutdown(ctx); err != nil {
+			level.Error(logger).Log("err", err, "msg", "Could not flush telemetry")
+		}
+	}()
+	tracer := telemetryProvider.Tracer()
+	level.Info(logger).Log("msg", "Telemetry exporter "+cfg.TelemetryExporter+" started")
+
+	clientMetrics := client.Metrics{
+		Connects: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "device_virtual",
+			Subsystem: "mqtt",
+			Name:      "connect_count",
+			Help:      "Number of connection attempts to MQTT brokers by result.",
+		}, []string{"result"}),
+		Reconnects: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "device_virtual",
+			Subsystem: "mqtt",
+			Name:      "reconnect_count",
+			Help:      "Number of connections replacing a live session of the device, including automatic reconnections.",
+		}, []string{}),
+		Disconnects: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "device_virtual",
+			Subsystem: "mqtt",
+			Name:      "disconnect_count",
+			Help:      "Number of device sessions disconnected.",
+		}, []string{}),
+		Published: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "device_virtual",
+			Subsystem: "mqtt",
+			Name:      "publish_count",
+			Help:      "Number of messages published.",
+		}, []string{"topic", "qos"}),
+		PublishedBytes: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "device_virtual",
+			Subsystem: "mqtt",
+			Name:      "publish_bytes",
+			Help:      "Total payload size of the messages published in bytes.",
+		}, []string{"topic", "qos"}),
+		PublishLatency: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "device_virtual",
+			Subsystem: "mqtt",
+			Name:      "publish_latency_seconds",
+			Help:      "Time until published messages are sent, or acknowledged for QoS 1 and 2, in seconds.",
+		}, []string{"topic", "qos"}),
+		Received: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "device_virtual",
+			Subsystem: "mqtt",
+			Name:      "receive_count",
+			Help:      "Number of messages received on subscriptions.",
+		}, []string{"topic", "qos"}),
+		HandshakeDuration: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "device_virtual",
+			Subsystem: "mqtt",
+			Name:      "tls_handshake_duration_seconds",
+			Help:      "Duration of TLS handshakes with MQTT brokers in seconds.",
+		}, []string{}),
+		HandshakeFailures: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "device_virtual",
+			Subsystem: "mqtt",
+			Name:      "tls_handshake_failure_count",
+			Help:      "Number of failed TLS handshakes with MQTT brokers by reason.",
+		}, []string{"reason"}),
+		Sessions: client.NewSessionCollector("device_virtual", "mqtt", cfg.MetricsPerDevice),
+		Topics:   client.TopicLabels{Depth: cfg.MetricsTopicDepth, Max: cfg.MetricsMaxTopics},
+	}
+	stdprometheus.MustRegister(clientMetrics.Sessions)
+	newClient := mosquitto.NewFactory(logger, clientMetrics.ObserveHandshake, client.Backoff{
+		Initial:     cfg.ReconnectInitialDelay,
+		Max:         cfg.ReconnectMaxDelay,
+		Multiplier:  cfg.ReconnectMultiplier,
+		Jitter:      cfg.ReconnectJitter,
+		MaxAttempts: cfg.ReconnectMaxAttempts,
+	})
+	instrumentClient := client.InstrumentingMiddleware(clientMetrics)
+	traceClient := client.TracingMiddleware(tracer, cfg.TraceEnvelopeField)
+	clients := func() client.Client {
+		return traceClient(instrumentClient(newClient()))
+	}
+	if cfg.TraceEnvelopeField != "" {
+		level.Info(logger).Log("msg", "Trace context injected into JSON messages under "+cfg.TraceEnvelopeField)
+	}
+	level.Info(logger).Log("msg", "MQTT Client factory created")
+
+	h := health.New()
+	h.AddReadinessCheck("trust_store", health.TrustStore(cfg.CAPath))
+	h.AddReadinessCheck("server_certificate", health.CertificateExpiry(cfg.CertFile, time.Duration(cfg.CertExpiryWarningDays)*24*time.Hour))
+
+	var backend identity.Backend
+	switch cfg.KeyBackend {
+	case "", "software":
+		backend = software.NewBackend()
+	case "tpm-simulator":
+		backend, err = tpm.NewSimulatorBackend()
+		if err != nil {
+			level.Error(logger).Log("err", err, "msg", "Could not start TPM simulator key backend")
+			os.Exit(1)
+		}
+	default:
+		level.Error(logger).Log("msg", "Unknown key backend "+cfg.KeyBackend)
+		os.Exit(1)
+	}
+	defer backend.Close()
+	level.Info(logger).Log("msg", "Device key backend "+backend.Name()+" started")
 
-	jcfg, err := jaegercfg.FromEnv()
+	authn, err := newAuthenticator(cfg)
 	if err != nil {
-		level.Error(logger).Log("err", err, "msg", "Could not load Jaeger configuration values fron environment")
+		level.Error(logger).Log("err", err, "msg", "Could not set up API authentication")
 		os.Exit(1)
 	}
-	level.Info(logger).Log("msg", "Jaeger configuration values loaded")
-	tracer, closer, err := jcfg.NewTracer()
+	if cfg.APIAuth == "" {
+		level.Warn(logger).Log("msg", "API authentication disabled, every caller is granted the operator role")
+	} else {
+		level.Info(logger).Log("msg", "API authentication enabled: "+cfg.APIAuth)
+	}
+
+	certs, err := certwatch.NewLoader(cfg.CertFile, cfg.KeyFile, kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Namespace: "device_virtual",
+		Subsystem: "server",
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Expiry of the certificate served by the HTTPS and gRPC servers as a Unix timestamp.",
+	}, []string{}), log.With(logger, "component", "certificates"))
 	if err != nil {
-		level.Error(logger).Log("err", err, "msg", "Could not start Jaeger tracer")
+		level.Error(logger).Log("err", err, "msg", "Could not load server TLS configuration")
 		os.Exit(1)
 	}
-	defer closer.Close()
-	level.Info(logger).Log("msg", "Jaeger tracer started")
+	tlsConfig := live.tlsConfig(certs)
+
+	var recordings *recording.Store
+	if cfg.RecordingsDir != "" {
+		recordings = recording.NewStore(cfg.RecordingsDir)
+		level.Info(logger).Log("msg", "Traffic recordings stored in "+cfg.RecordingsDir)
+	}
+
+	var scenarios *impairment.Store
+	if cfg.ImpairmentScenariosDir != "" {
+		scenarios = impairment.NewStore(cfg.ImpairmentScenariosDir)
+		level.Info(logger).Log("msg", "Network impairment scenarios read from "+cfg.ImpairmentScenariosDir)
+	}
+
+	var queues queue.Opener
+	if cfg.OfflineQueue != "" {
+		limits := queue.Limits{
+			MaxMessages: cfg.OfflineQueueMaxMessages,
+			MaxBytes:    cfg.OfflineQueueMaxBytes,
+			MaxAge:      cfg.OfflineQueueMaxAge,
+		}
+		queueMetrics := queue.Metrics{
+			Depth: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+				Namespace: "device_virtual",
+				Subsystem: "mqtt",
+				Name:      "queue_depth",
+				Help:      "Number of messages queued by devices while reconnecting.",
+			}, []string{}),
+			Dropped: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "device_virtual",
+				Subsystem: "mqtt",
+				Name:      "queue_dropped_count",
+				Help:      "Number of queued messages dropped by reason.",
+			}, []string{"reason"}),
+		}
+		queues = func(clientID string) (*queue.Queue, error) {
+			if cfg.OfflineQueue == "disk" {
+				store, err := disk.Open(cfg.OfflineQueueDir, clientID)
+				if err != nil {
+					return nil, err
+				}
+				return queue.New(store, limits, queueMetrics), nil
+			}
+			return queue.New(memory.NewStore(), limits, queueMetrics), nil
+		}
+		level.Info(logger).Log("msg", "Messages published while reconnecting queued in "+cfg.OfflineQueue)
+	}
+
+	var devices discovery.Devices
+	if cfg.DeviceRegistry != "" {
+		registry, err := consul.NewDeviceRegistry(cfg.ConsulProtocol, cfg.ConsulHost, cfg.ConsulPort, cfg.ConsulCA, consul.DeviceRegistryConfig{
+			Store:   cfg.DeviceRegistry,
+			Prefix:  cfg.DeviceRegistryPrefix,
+			Service: cfg.DeviceRegistryService,
+			TTL:     cfg.ConsulTTL,
+		}, logger)
+		if err != nil {
+			level.Error(logger).Log("err", err, "msg", "Could not start Consul device registry")
+			os.Exit(1)
+		}
+		defer func() {
+			if err := registry.Close(); err != nil {
+				level.Error(logger).Log("err", err, "msg", "Could not remove devices from Consul")
+			}
+		}()
+		devices = registry
+		level.Info(logger).Log("msg", "Device sessions registered in Consul "+cfg.DeviceRegistry)
+	}
 
 	fieldKeys := []string{"method", "error"}
 
 	var s api.Service
+	var drain api.Shutdowner
 	{
-		s = api.NewDeviceService(cfg.CAPath, client)
+		s = api.NewDeviceService(cfg.CAPath, clients, backend, h, events.NewBus(), api.WithRecordings(recordings), api.WithDeviceRegistry(devices), api.WithOfflineQueue(queues), api.WithScenarios(scenarios), api.WithLogger(log.With(logger, "component", "service")))
+		drain = s.(api.Shutdowner)
+		s = api.RateLimitingMiddleware(
+			rateLimits(cfg),
+			kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "device_virtual",
+				Subsystem: "device_virtual_service",
+				Name:      "throttled_count",
+				Help:      "Number of requests rejected by rate limits.",
+			}, []string{"method", "scope"}),
+		)(s)
+		live.rateLimits = s.(api.RateLimitSetter)
 		s = api.LoggingMidleware(logger)(s)
 		s = api.NewInstrumentingMiddleware(
 			kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
@@ -74,61 +314,230 @@ func main() {
 		)(s)
 	}
 
-	consulsd, err := consul.NewServiceDiscovery(cfg.ConsulProtocol, cfg.ConsulHost, cfg.ConsulPort, cfg.ConsulCA, logger)
+	sd, advHost, err := newServiceDiscovery(cfg, h, logger)
 	if err != nil {
-		level.Error(logger).Log("err", err, "msg", "Could not start connection with Consul Service Discovery")
+		level.Error(logger).Log("err", err, "msg", "Could not start "+cfg.Discovery+" service discovery")
 		os.Exit(1)
 	}
-	level.Info(logger).Log("msg", "Connection established with Consul Service Discovery")
-	err = consulsd.Register("https", "device", cfg.Port)
+	level.Info(logger).Log("msg", "Service discovery "+cfg.Discovery+" started")
+	err = sd.Register("https", advHost, cfg.Port)
 	if err != nil {
-		level.Error(logger).Log("err", err, "msg", "Could not register service liveness information to Consul")
+		level.Error(logger).Log("err", err, "msg", "Could not register service liveness information to "+cfg.Discovery)
 		os.Exit(1)
 	}
-	level.Info(logger).Log("msg", "Service liveness information registered to Consul")
+	level.Info(logger).Log("msg", "Service liveness information registered to "+cfg.Discovery)
 	mux := http.NewServeMux()
 
-	mux.Handle("/v1/", api.MakeHTTPHandler(s, log.With(logger, "component", "HTTP"), tracer))
-	http.Handle("/", accessControl(mux, cfg.UIProtocol, cfg.UIHost, cfg.UIPort))
+	mux.Handle("/v1/", api.MakeHTTPHandler(s, log.With(logger, "component", "HTTP"), tracer, authn))
+	http.Handle("/", live.cors.Handler(mux))
 	http.Handle("/metrics", promhttp.Handler())
 
+	grpcListener, err := net.Listen("tcp", ":"+cfg.GRPCPort)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not listen on gRPC port")
+		os.Exit(1)
+	}
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	pb.RegisterDeviceServer(grpcServer, api.MakeGRPCServer(s, log.With(logger, "component", "gRPC"), tracer, authn))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go certs.Watch(ctx, cfg.CertReloadInterval, h.Job("certificate_reload", cfg.CertReloadInterval).Done)
+	if cfg.ConfigFile != "" {
+		running := cfg
+		go configs.Watch(ctx, "device", cfg.ConfigFile, cfg.ConfigReloadInterval, func(next configs.Config, err error) {
+			if err != nil {
+				level.Error(logger).Log("err", err, "msg", "Configuration not reloaded")
+				return
+			}
+			running = live.reload(running, next, logger)
+		}, h.Job("config_reload", cfg.ConfigReloadInterval).Done)
+	}
+
 	errs := make(chan error)
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errs <- fmt.Errorf("%s", <-c)
 	}()
 
+	server := &http.Server{Addr: ":" + cfg.Port, TLSConfig: tlsConfig}
 	go func() {
 		level.Info(logger).Log("transport", "HTTPS", "address", ":"+cfg.Port, "msg", "listening")
-		errs <- http.ListenAndServeTLS(":"+cfg.Port, cfg.CertFile, cfg.KeyFile, nil)
+		errs <- server.ListenAndServeTLS("", "")
+	}()
+
+	go func() {
+		level.Info(logger).Log("transport", "gRPC", "address", ":"+cfg.GRPCPort, "msg", "listening")
+		errs <- grpcServer.Serve(grpcListener)
 	}()
 
 	level.Info(logger).Log("exit", <-errs)
-	err = consulsd.Deregister()
+	cancel()
+
+	// Leave service discovery first, so that no new callers are sent here.
+	err = sd.Deregister()
 	if err != nil {
-		level.Error(logger).Log("err", err, "msg", "Could not deregister service liveness information from Consul")
-		os.Exit(1)
+		level.Error(logger).Log("err", err, "msg", "Could not deregister service liveness information from "+cfg.Discovery)
+	} else {
+		level.Info(logger).Log("msg", "Service liveness information deregistered from "+cfg.Discovery)
+	}
+
+	// The servers stop accepting connections and wait for the calls in
+	// progress, which the service drains before disconnecting the sessions.
+	// The deferred functions then close the device registry and the key
+	// backend, and flush telemetry.
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer shutdownCancel()
+	var servers sync.WaitGroup
+	servers.Add(2)
+	go func() {
+		defer servers.Done()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			level.Warn(logger).Log("err", err, "msg", "HTTPS calls cut by the shutdown deadline")
+			server.Close()
+		}
+	}()
+	go func() {
+		defer servers.Done()
+		stopGRPC(shutdownCtx, grpcServer)
+	}()
+	if err := drain.Shutdown(shutdownCtx); err != nil {
+		level.Warn(logger).Log("err", err, "msg", "Sessions disconnected before their publishes in flight completed")
+	}
+	servers.Wait()
+	level.Info(logger).Log("msg", "Device sessions disconnected, shutting down")
+}
+
+// stopGRPC waits for the gRPC calls in progress until ctx is done, when the
+// remaining ones are cut.
+func stopGRPC(ctx context.Context, s *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.Stop()
 	}
-	level.Info(logger).Log("msg", "Service liveness information deregistered from Consul")
 }
 
-func accessControl(h http.Handler, UIProtocol string, UIHost string, UIPort string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var uiURL string
-		if UIPort == "" {
-			uiURL = UIProtocol + "://" + UIHost
-		} else {
-			uiURL = UIProtocol + "://" + UIHost + ":" + UIPort
+// newServiceDiscovery creates the service discovery selected in the
+// configuration and returns the host to advertise in it, the hostname unless
+// configured. Kubernetes Endpoints hold the address the host resolves to,
+// which for the hostname is the address of the pod.
+func newServiceDiscovery(cfg configs.Config, h *health.Health, logger log.Logger) (discovery.Service, string, error) {
+	advHost := cfg.AdvertiseHost
+	if advHost == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, "", err
 		}
-		w.Header().Set("Access-Control-Allow-Origin", uiURL)
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization")
+		advHost = hostname
+	}
+
+	switch cfg.Discovery {
+	case "consul":
+		sd, err := consul.NewServiceDiscovery(cfg.ConsulProtocol, cfg.ConsulHost, cfg.ConsulPort, cfg.ConsulCA, consul.Registration{
+			Tags: cfg.ConsulTags,
+			Meta: map[string]string{
+				"version":      version,
+				"capabilities": strings.Join(capabilities(cfg), ","),
+			},
+			TTL:       cfg.ConsulTTL,
+			Ready:     h.Ready,
+			Heartbeat: h.Job("discovery_heartbeat", cfg.ConsulTTL/3).Done,
+		}, logger)
+		return sd, advHost, err
+	case "etcd":
+		sd, err := etcd.NewServiceDiscovery(cfg.EtcdEndpoint, cfg.EtcdCA, cfg.EtcdPrefix, logger)
+		return sd, advHost, err
+	case "kubernetes":
+		sd, err := kubernetes.NewServiceDiscovery(cfg.KubernetesService, logger)
+		return sd, advHost, err
+	case "static":
+		return static.NewServiceDiscovery(logger), advHost, nil
+	default:
+		return nil, "", fmt.Errorf("unknown service discovery %s", cfg.Discovery)
+	}
+}
+
+// capabilities lists the features the configuration enables, advertised so
+// that clients can pick an instance supporting what they need.
+func capabilities(cfg configs.Config) []string {
+	c := []string{"mqtt", "grpc", "impairment"}
+	if cfg.KeyBackend == "tpm-simulator" {
+		c = append(c, "tpm")
+	}
+	if cfg.RecordingsDir != "" {
+		c = append(c, "recording")
+	}
+	if cfg.TelemetryExporter != "none" {
+		c = append(c, "tracing")
+	}
+	return c
+}
 
-		if r.Method == "OPTIONS" {
-			return
+// newTelemetry creates the exporter of traces, and metrics for OTLP, selected
+// in the configuration.
+func newTelemetry(cfg configs.Config, logger log.Logger) (telemetry.Provider, error) {
+	switch cfg.TelemetryExporter {
+	case "jaeger":
+		return jaeger.NewProvider()
+	case "otlp":
+		otlpCfg := otlp.Config{
+			Protocol:    cfg.OTLPProtocol,
+			Endpoint:    cfg.OTLPEndpoint,
+			Insecure:    cfg.OTLPInsecure,
+			ServiceName: "device-virtual",
+		}
+		if cfg.OTLPMetrics {
+			otlpCfg.Metrics = stdprometheus.DefaultGatherer
+			otlpCfg.MetricsInterval = cfg.OTLPMetricsInterval
 		}
+		return otlp.NewProvider(context.Background(), otlpCfg, log.With(logger, "component", "OTLP"))
+	case "none":
+		return telemetry.Nop(), nil
+	default:
+		return nil, fmt.Errorf("unknown telemetry exporter %s", cfg.TelemetryExporter)
+	}
+}
 
-		h.ServeHTTP(w, r)
-	})
+// newAuthenticator chains the API authentication methods listed in the
+// configuration. Without any, every caller is let in.
+func newAuthenticator(cfg configs.Config) (auth.Authenticator, error) {
+	if cfg.APIAuth == "" {
+		return auth.Anonymous(), nil
+	}
+
+	var authenticators []auth.Authenticator
+	for _, method := range strings.Split(cfg.APIAuth, ",") {
+		switch strings.TrimSpace(method) {
+		case "mtls":
+			if cfg.APIClientCA == "" {
+				return nil, fmt.Errorf("mtls authentication requires a client CA")
+			}
+			authenticators = append(authenticators, mtls.NewAuthenticator(auth.Role(cfg.APIMTLSDefaultRole)))
+		case "oidc":
+			var keys *oidc.KeySet
+			var err error
+			switch {
+			case cfg.OIDCJWKSFile != "":
+				keys, err = oidc.NewFileKeySet(cfg.OIDCJWKSFile)
+			case cfg.OIDCJWKSURL != "":
+				keys, err = oidc.NewRemoteKeySet(cfg.OIDCJWKSURL, &http.Client{Timeout: 10 * time.Second})
+			default:
+				err = fmt.Errorf("oidc authentication requires a JWKS file or URL")
+			}
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, oidc.NewAuthenticator(keys, cfg.OIDCIssuer, cfg.OIDCAudience, cfg.OIDCRolesClaim))
+		default:
+			return nil, fmt.Errorf("unknown API authentication method %s", method)
+		}
+	}
+	return auth.Chain(authenticators...), nil
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lamassuiot/device-virtual/pkg/api"
+	"github.com/lamassuiot/device-virtual/pkg/certwatch"
+	"github.com/lamassuiot/device-virtual/pkg/configs"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// reloadable are the settings applied when the configuration file changes,
+// without dropping the device sessions. Changing any other one requires a
+// restart.
+var reloadable = map[string]bool{
+	"LogLevel":              true,
+	"UIProtocol":            true,
+	"UIHost":                true,
+	"UIPort":                true,
+	"CORSAllowedOrigins":    true,
+	"CORSAllowedMethods":    true,
+	"CORSAllowedHeaders":    true,
+	"CORSExposedHeaders":    true,
+	"CORSAllowCredentials":  true,
+	"CORSMaxAge":            true,
+	"APIClientCA":           true,
+	"RateLimitGlobal":       true,
+	"RateLimitGlobalBurst":  true,
+	"RateLimitSession":      true,
+	"RateLimitSessionBurst": true,
+}
+
+// settings holds the reloadable settings in effect.
+type settings struct {
+	logLevel   *levelFilter
+	cors       *api.CORS
+	clientCAs  atomic.Pointer[x509.CertPool]
+	rateLimits api.RateLimitSetter
+}
+
+// apply puts the reloadable settings of cfg in effect. Nothing changes when
+// one of them cannot be applied.
+func (s *settings) apply(cfg configs.Config) error {
+	var pool *x509.CertPool
+	if cfg.APIClientCA != "" {
+		var err error
+		pool, err = loadCertPool(cfg.APIClientCA)
+		if err != nil {
+			return err
+		}
+	}
+	s.clientCAs.Store(pool)
+	s.logLevel.SetLevel(cfg.LogLevel)
+	s.cors.SetPolicy(corsPolicy(cfg))
+	if s.rateLimits != nil {
+		s.rateLimits.SetRateLimits(rateLimits(cfg))
+	}
+	return nil
+}
+
+// reload applies the reloadable settings changed from running to next and
+// returns the new running configuration.
+func (s *settings) reload(running configs.Config, next configs.Config, logger log.Logger) configs.Config {
+	changed := configs.Changed(running, next)
+	if len(changed) == 0 {
+		return running
+	}
+	if err := s.apply(next); err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not apply the reloaded configuration")
+		return running
+	}
+	var restart []string
+	for _, name := range changed {
+		if !reloadable[name] {
+			restart = append(restart, name)
+		}
+	}
+	level.Info(logger).Log("msg", "Configuration reloaded", "changed", strings.Join(changed, ","))
+	if len(restart) > 0 {
+		level.Warn(logger).Log("msg", "Changed settings not applied until restart: "+strings.Join(restart, ", "))
+	}
+	return next
+}
+
+// tlsConfig returns the configuration of the servers, which present the
+// certificate in effect and verify client certificates, when given, with the
+// client CAs in effect. It lists the ALPN protocols of both servers, since
+// the configuration returned per client does not get those the servers add
+// to their own copy.
+func (s *settings) tlsConfig(certs *certwatch.Loader) *tls.Config {
+	conf := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	conf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := conf.Clone()
+		c.GetConfigForClient = nil
+		if pool := s.clientCAs.Load(); pool != nil {
+			c.ClientCAs = pool
+			c.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		return c, nil
+	}
+	return conf
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// corsPolicy allows the origins of CORSAllowedOrigins, or the UI origin when
+// none is listed.
+func corsPolicy(cfg configs.Config) api.CORSPolicy {
+	origins := cfg.CORSAllowedOrigins
+	if len(origins) == 0 && cfg.UIHost != "" {
+		origins = []string{uiURL(cfg)}
+	}
+	return api.CORSPolicy{
+		AllowedOrigins:   origins,
+		AllowedMethods:   cfg.CORSAllowedMethods,
+		AllowedHeaders:   cfg.CORSAllowedHeaders,
+		ExposedHeaders:   cfg.CORSExposedHeaders,
+		AllowCredentials: cfg.CORSAllowCredentials,
+		MaxAge:           cfg.CORSMaxAge,
+	}
+}
+
+func uiURL(cfg configs.Config) string {
+	if cfg.UIPort == "" {
+		return cfg.UIProtocol + "://" + cfg.UIHost
+	}
+	return cfg.UIProtocol + "://" + cfg.UIHost + ":" + cfg.UIPort
+}
+
+func rateLimits(cfg configs.Config) api.RateLimits {
+	return api.RateLimits{
+		Global:  api.RateLimit{Rate: cfg.RateLimitGlobal, Burst: cfg.RateLimitGlobalBurst},
+		Session: api.RateLimit{Rate: cfg.RateLimitSession, Burst: cfg.RateLimitSessionBurst},
+	}
+}
+
+// levelFilter filters log events by a level that can change at runtime.
+type levelFilter struct {
+	next     log.Logger
+	filtered atomic.Value
+}
+
+func newLevelFilter(next log.Logger, lvl string) *levelFilter {
+	f := &levelFilter{next: next}
+	f.SetLevel(lvl)
+	return f
+}
+
+func (f *levelFilter) SetLevel(lvl string) {
+	var allow level.Option
+	switch lvl {
+	case "debug":
+		allow = level.AllowDebug()
+	case "warn":
+		allow = level.AllowWarn()
+	case "error":
+		allow = level.AllowError()
+	default:
+		allow = level.AllowInfo()
+	}
+	f.filtered.Store(level.NewFilter(f.next, allow))
+}
+
+func (f *levelFilter) Log(keyvals ...interface{}) error {
+	return f.filtered.Load().(log.Logger).Log(keyvals...)
+}
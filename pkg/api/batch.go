@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/queue"
+)
+
+const (
+	// maxBatchSize bounds the messages of a single batch.
+	maxBatchSize = 1000
+	// maxBatchDelay bounds the delay of every message of a batch, so that
+	// batches finish within a reasonable request time.
+	maxBatchDelay = 5 * time.Minute
+)
+
+var (
+	ErrBatchEmpty    = &Error{Code: CodeInvalidRequest, Message: "invalid empty message batch"}
+	ErrBatchTooLarge = &Error{Code: CodeInvalidRequest, Message: "too many messages in batch"}
+	ErrBatchInvalid  = &Error{Code: CodeInvalidRequest, Message: "invalid messages in batch"}
+	ErrBatchSkipped  = &Error{Code: CodePublishFailed, Message: "message skipped as an earlier message of the ordered batch failed"}
+	ErrBatchCanceled = &Error{Code: CodePublishFailed, Message: "batch canceled before publishing the message"}
+)
+
+// BatchMessage is a message published as part of a batch, after waiting for
+// Delay.
+type BatchMessage struct {
+	Topic   string
+	Payload string
+	QoS     int
+	Retain  bool
+	Delay   time.Duration
+}
+
+// BatchStatus is the outcome of a message of a batch.
+type BatchStatus string
+
+const (
+	BatchPublished BatchStatus = "published"
+	BatchQueued    BatchStatus = "queued"
+	BatchFailed    BatchStatus = "failed"
+	BatchSkipped   BatchStatus = "skipped"
+)
+
+// BatchResult reports the outcome of the message at Index in a batch.
+type BatchResult struct {
+	Index  int         `json:"index"`
+	Topic  string      `json:"topic"`
+	Status BatchStatus `json:"status"`
+	Err    error       `json:"error,omitempty"`
+}
+
+// PostSendMessages publishes a batch of messages from a session and reports
+// the outcome of each of them.
+//
+// Ordered batches are published one message at a time, each delay counting
+// from the previous publish, and the messages following a failure are
+// skipped so that the broker never sees them out of order. Other batches are
+// published concurrently, each delay counting from the start of the batch.
+func (s *deviceService) PostSendMessages(ctx context.Context, clientID string, messages []BatchMessage, ordered bool) ([]BatchResult, error) {
+	if err := validateBatch(messages); err != nil {
+		return nil, err
+	}
+
+	done, err := s.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	sess, err := s.session(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delays end early on shutdown, unlike the publishes in flight.
+	paced, cancel := until(ctx, s.stopping)
+	defer cancel()
+
+	results := make([]BatchResult, len(messages))
+	for i, m := range messages {
+		results[i] = BatchResult{Index: i, Topic: m.Topic, Status: BatchSkipped}
+	}
+
+	if ordered {
+		for i, m := range messages {
+			if err := sleep(paced, m.Delay); err != nil {
+				skip(results[i:], ErrBatchCanceled.wrap(err))
+				break
+			}
+			s.publishBatchMessage(ctx, sess, m, &results[i])
+			if results[i].Err != nil {
+				skip(results[i+1:], ErrBatchSkipped)
+				break
+			}
+		}
+		return results, nil
+	}
+
+	var wg sync.WaitGroup
+	for i, m := range messages {
+		wg.Add(1)
+		go func(m BatchMessage, r *BatchResult) {
+			defer wg.Done()
+			if err := sleep(paced, m.Delay); err != nil {
+				r.Err = ErrBatchCanceled.wrap(err)
+				return
+			}
+			s.publishBatchMessage(ctx, sess, m, r)
+		}(m, &results[i])
+	}
+	wg.Wait()
+	return results, nil
+}
+
+func (s *deviceService) publishBatchMessage(ctx context.Context, sess *session, m BatchMessage, r *BatchResult) {
+	msg := queue.Message{Topic: m.Topic, Payload: []byte(m.Payload), QoS: byte(m.QoS), Retained: m.Retain}
+	queued, err := s.send(sess, msg, func() error {
+		return sess.client.Publish(ctx, msg.Topic, msg.Payload, msg.QoS, msg.Retained)
+	})
+	if err != nil {
+		r.Status, r.Err = BatchFailed, err
+		return
+	}
+	r.Status = BatchPublished
+	if queued {
+		r.Status = BatchQueued
+	}
+}
+
+// validateBatch lists every invalid message of a batch at once, like request
+// validation does.
+func validateBatch(messages []BatchMessage) error {
+	if len(messages) == 0 {
+		return ErrBatchEmpty
+	}
+	if len(messages) > maxBatchSize {
+		return ErrBatchTooLarge.wrap(fmt.Errorf("a batch holds up to %d messages", maxBatchSize))
+	}
+
+	var problems []string
+	for i, m := range messages {
+		at := fmt.Sprintf("messages[%d]", i)
+		if m.Topic == "" {
+			problems = append(problems, at+".topic: must not be empty")
+		}
+		if m.QoS < 0 || m.QoS > 2 {
+			problems = append(problems, at+".qos: must be 0, 1 or 2")
+		}
+		if m.Delay < 0 || m.Delay > maxBatchDelay {
+			problems = append(problems, fmt.Sprintf("%s.delay: must be between 0 and %d milliseconds", at, maxBatchDelay.Milliseconds()))
+		}
+	}
+	if len(problems) > 0 {
+		e := ErrBatchInvalid.wrap(nil)
+		e.Details = problems
+		return e
+	}
+	return nil
+}
+
+func skip(results []BatchResult, err error) {
+	for i := range results {
+		results[i].Err = err
+	}
+}
+
+// sleep waits for d unless ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
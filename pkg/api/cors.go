@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CORSPolicy lists the cross-origin requests browsers are allowed to make.
+// AllowedOrigins holds origins such as https://ui.example.com, or patterns
+// such as https://*.example.com, as matched by path.Match. The pattern *
+// allows every origin. With AllowCredentials, only the origins listed as such
+// are allowed, so that no pattern lets any website make calls on behalf of
+// the user of the browser.
+type CORSPolicy struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+func (p CORSPolicy) allows(origin string) bool {
+	for _, o := range p.AllowedOrigins {
+		if isOriginPattern(o) {
+			if p.AllowCredentials {
+				continue
+			}
+			if ok, _ := path.Match(o, origin); ok || o == "*" {
+				return true
+			}
+		} else if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func isOriginPattern(o string) bool {
+	return strings.ContainsAny(o, `*?[\`)
+}
+
+// CORS answers preflight requests and adds the CORS headers to the responses
+// of a handler, following a policy that can be replaced at runtime.
+type CORS struct {
+	policy atomic.Pointer[CORSPolicy]
+}
+
+func NewCORS(p CORSPolicy) *CORS {
+	c := &CORS{}
+	c.SetPolicy(p)
+	return c
+}
+
+func (c *CORS) SetPolicy(p CORSPolicy) {
+	c.policy.Store(&p)
+}
+
+// Handler wraps h. The matched origin is echoed back rather than the pattern,
+// so that a single origin is allowed per response as browsers require.
+// Requests from other origins are served without CORS headers, and their
+// preflight requests are rejected.
+func (c *CORS) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := c.policy.Load()
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		w.Header().Add("Vary", "Origin")
+		if origin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !p.allows(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), corsOriginKey{}, origin))
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if p.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if len(p.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+		if len(p.AllowedHeaders) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+		}
+		if p.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge/time.Second)))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+type corsOriginKey struct{}
+
+// checkOrigin accepts requests without origin, from the origin of the server
+// or from an origin the CORS policy allowed. Browsers do not apply CORS to
+// WebSocket upgrades, so the server checks the origin itself.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	allowed, _ := r.Context().Value(corsOriginKey{}).(string)
+	return allowed == origin
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	policy := CORSPolicy{
+		AllowedOrigins:   []string{"https://ui.example.com", "https://*.lab.example.com"},
+		AllowedMethods:   []string{"GET", "POST"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		ExposedHeaders:   []string{"X-Rate-Limit-Rate"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+	c := NewCORS(policy)
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	testCases := []struct {
+		name    string
+		method  string
+		origin  string
+		request string
+		status  int
+		want    map[string]string
+	}{
+		{"No origin", "GET", "", "", http.StatusTeapot, map[string]string{"Access-Control-Allow-Origin": ""}},
+		{"Allowed origin", "GET", "https://ui.example.com", "", http.StatusTeapot, map[string]string{
+			"Access-Control-Allow-Origin":      "https://ui.example.com",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Expose-Headers":    "X-Rate-Limit-Rate",
+			"Access-Control-Allow-Methods":     "",
+		}},
+		{"Pattern origin with credentials", "GET", "https://a.lab.example.com", "", http.StatusTeapot, map[string]string{"Access-Control-Allow-Origin": ""}},
+		{"Other origin", "GET", "https://evil.example.com", "", http.StatusTeapot, map[string]string{"Access-Control-Allow-Origin": ""}},
+		{"Preflight", "OPTIONS", "https://ui.example.com", "POST", http.StatusNoContent, map[string]string{
+			"Access-Control-Allow-Origin":   "https://ui.example.com",
+			"Access-Control-Allow-Methods":  "GET, POST",
+			"Access-Control-Allow-Headers":  "Content-Type, Authorization",
+			"Access-Control-Max-Age":        "600",
+			"Access-Control-Expose-Headers": "",
+		}},
+		{"Preflight from other origin", "OPTIONS", "https://evil.example.com", "POST", http.StatusForbidden, map[string]string{"Access-Control-Allow-Origin": ""}},
+		{"Options without preflight", "OPTIONS", "https://ui.example.com", "", http.StatusTeapot, map[string]string{"Access-Control-Allow-Origin": "https://ui.example.com"}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/v1/health", nil)
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			if tc.request != "" {
+				r.Header.Set("Access-Control-Request-Method", tc.request)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("Got status %d; want %d", w.Code, tc.status)
+			}
+			for k, v := range tc.want {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("Got %s %q; want %q", k, got, v)
+				}
+			}
+		})
+	}
+
+	t.Run("Testing Policy replaced", func(t *testing.T) {
+		c.SetPolicy(CORSPolicy{AllowedOrigins: []string{"*"}})
+		r := httptest.NewRequest("GET", "/v1/health", nil)
+		r.Header.Set("Origin", "https://evil.example.com")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://evil.example.com" {
+			t.Errorf("Got Access-Control-Allow-Origin %q; want the request origin", got)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+			t.Errorf("Got Access-Control-Allow-Credentials %q; want none", got)
+		}
+	})
+
+	t.Run("Testing Pattern origin", func(t *testing.T) {
+		c.SetPolicy(CORSPolicy{AllowedOrigins: []string{"https://*.lab.example.com"}})
+		r := httptest.NewRequest("GET", "/v1/health", nil)
+		r.Header.Set("Origin", "https://a.lab.example.com")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://a.lab.example.com" {
+			t.Errorf("Got Access-Control-Allow-Origin %q; want the request origin", got)
+		}
+	})
+
+	t.Run("Testing Any origin with credentials", func(t *testing.T) {
+		c.SetPolicy(CORSPolicy{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+		r := httptest.NewRequest("GET", "/v1/health", nil)
+		r.Header.Set("Origin", "https://evil.example.com")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+			t.Errorf("Got Access-Control-Allow-Credentials %q; want none", got)
+		}
+	})
+}
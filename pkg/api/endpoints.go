@@ -2,6 +2,13 @@ package api
 
 import (
 	"context"
+	"net/http"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/auth"
+	"github.com/lamassuiot/device-virtual/pkg/health"
+	"github.com/lamassuiot/device-virtual/pkg/impairment"
+	"github.com/lamassuiot/device-virtual/pkg/recording"
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/tracing/opentracing"
@@ -9,45 +16,144 @@ import (
 )
 
 type Endpoints struct {
-	HealthEndpoint  endpoint.Endpoint
-	PostSendMessage endpoint.Endpoint
-	PostConnect     endpoint.Endpoint
-	PostDisconnect  endpoint.Endpoint
+	HealthEndpoint     endpoint.Endpoint
+	ReadinessEndpoint  endpoint.Endpoint
+	PostSendMessage    endpoint.Endpoint
+	PostSendMessages   endpoint.Endpoint
+	PostConnect        endpoint.Endpoint
+	PostDisconnect     endpoint.Endpoint
+	SessionState       endpoint.Endpoint
+	PostCSR            endpoint.Endpoint
+	PostCertificate    endpoint.Endpoint
+	PostImport         endpoint.Endpoint
+	PostExport         endpoint.Endpoint
+	PostStartRecording endpoint.Endpoint
+	PostStopRecording  endpoint.Endpoint
+	PostReplay         endpoint.Endpoint
+	PostNetwork        endpoint.Endpoint
 }
 
-func MakeServerEndpoints(s Service, otTracer stdopentracing.Tracer) Endpoints {
+// MakeServerEndpoints leaves the health endpoints open, so that probes work
+// without credentials, and requires the operator role for device operations.
+func MakeServerEndpoints(s Service, otTracer stdopentracing.Tracer, authn auth.Authenticator) Endpoints {
 	var healthEndpoint endpoint.Endpoint
 	{
 		healthEndpoint = MakeHealthEndpoint(s)
 		healthEndpoint = opentracing.TraceServer(otTracer, "Health")(healthEndpoint)
 	}
+	var readinessEndpoint endpoint.Endpoint
+	{
+		readinessEndpoint = MakeReadinessEndpoint(s)
+		readinessEndpoint = opentracing.TraceServer(otTracer, "Readiness")(readinessEndpoint)
+	}
 	var postConnectEndpoint endpoint.Endpoint
 	{
 		postConnectEndpoint = MakePostConnect(s)
+		postConnectEndpoint = auth.Middleware(authn, auth.RoleOperator)(postConnectEndpoint)
 		postConnectEndpoint = opentracing.TraceServer(otTracer, "PostConnect")(postConnectEndpoint)
 	}
 	var postDisconnectEndpoint endpoint.Endpoint
 	{
 		postDisconnectEndpoint = MakePostDisconnect(s)
+		postDisconnectEndpoint = auth.Middleware(authn, auth.RoleOperator)(postDisconnectEndpoint)
 		postDisconnectEndpoint = opentracing.TraceServer(otTracer, "PostDisconnect")(postDisconnectEndpoint)
 	}
+	var sessionStateEndpoint endpoint.Endpoint
+	{
+		sessionStateEndpoint = MakeSessionState(s)
+		sessionStateEndpoint = auth.Middleware(authn, auth.RoleReadOnly)(sessionStateEndpoint)
+		sessionStateEndpoint = opentracing.TraceServer(otTracer, "SessionState")(sessionStateEndpoint)
+	}
 	var postSendMessageEndpoint endpoint.Endpoint
 	{
 		postSendMessageEndpoint = MakePostSendMessage(s)
+		postSendMessageEndpoint = auth.Middleware(authn, auth.RoleOperator)(postSendMessageEndpoint)
 		postSendMessageEndpoint = opentracing.TraceServer(otTracer, "PostSendMessage")(postSendMessageEndpoint)
 	}
+	var postSendMessagesEndpoint endpoint.Endpoint
+	{
+		postSendMessagesEndpoint = MakePostSendMessages(s)
+		postSendMessagesEndpoint = auth.Middleware(authn, auth.RoleOperator)(postSendMessagesEndpoint)
+		postSendMessagesEndpoint = opentracing.TraceServer(otTracer, "PostSendMessages")(postSendMessagesEndpoint)
+	}
+	var postCSREndpoint endpoint.Endpoint
+	{
+		postCSREndpoint = MakePostCSR(s)
+		postCSREndpoint = auth.Middleware(authn, auth.RoleOperator)(postCSREndpoint)
+		postCSREndpoint = opentracing.TraceServer(otTracer, "PostCSR")(postCSREndpoint)
+	}
+	var postCertificateEndpoint endpoint.Endpoint
+	{
+		postCertificateEndpoint = MakePostCertificate(s)
+		postCertificateEndpoint = auth.Middleware(authn, auth.RoleOperator)(postCertificateEndpoint)
+		postCertificateEndpoint = opentracing.TraceServer(otTracer, "PostCertificate")(postCertificateEndpoint)
+	}
+	var postImportEndpoint endpoint.Endpoint
+	{
+		postImportEndpoint = MakePostImport(s)
+		postImportEndpoint = auth.Middleware(authn, auth.RoleOperator)(postImportEndpoint)
+		postImportEndpoint = opentracing.TraceServer(otTracer, "PostImport")(postImportEndpoint)
+	}
+	var postExportEndpoint endpoint.Endpoint
+	{
+		postExportEndpoint = MakePostExport(s)
+		postExportEndpoint = auth.Middleware(authn, auth.RoleOperator)(postExportEndpoint)
+		postExportEndpoint = opentracing.TraceServer(otTracer, "PostExport")(postExportEndpoint)
+	}
+	var postStartRecordingEndpoint endpoint.Endpoint
+	{
+		postStartRecordingEndpoint = MakePostStartRecording(s)
+		postStartRecordingEndpoint = auth.Middleware(authn, auth.RoleOperator)(postStartRecordingEndpoint)
+		postStartRecordingEndpoint = opentracing.TraceServer(otTracer, "PostStartRecording")(postStartRecordingEndpoint)
+	}
+	var postStopRecordingEndpoint endpoint.Endpoint
+	{
+		postStopRecordingEndpoint = MakePostStopRecording(s)
+		postStopRecordingEndpoint = auth.Middleware(authn, auth.RoleOperator)(postStopRecordingEndpoint)
+		postStopRecordingEndpoint = opentracing.TraceServer(otTracer, "PostStopRecording")(postStopRecordingEndpoint)
+	}
+	var postReplayEndpoint endpoint.Endpoint
+	{
+		postReplayEndpoint = MakePostReplay(s)
+		postReplayEndpoint = auth.Middleware(authn, auth.RoleOperator)(postReplayEndpoint)
+		postReplayEndpoint = opentracing.TraceServer(otTracer, "PostReplay")(postReplayEndpoint)
+	}
+	var postNetworkEndpoint endpoint.Endpoint
+	{
+		postNetworkEndpoint = MakePostNetwork(s)
+		postNetworkEndpoint = auth.Middleware(authn, auth.RoleOperator)(postNetworkEndpoint)
+		postNetworkEndpoint = opentracing.TraceServer(otTracer, "PostNetwork")(postNetworkEndpoint)
+	}
 	return Endpoints{
-		HealthEndpoint:  healthEndpoint,
-		PostConnect:     postConnectEndpoint,
-		PostDisconnect:  postDisconnectEndpoint,
-		PostSendMessage: postSendMessageEndpoint,
+		HealthEndpoint:     healthEndpoint,
+		ReadinessEndpoint:  readinessEndpoint,
+		PostConnect:        postConnectEndpoint,
+		PostDisconnect:     postDisconnectEndpoint,
+		SessionState:       sessionStateEndpoint,
+		PostSendMessage:    postSendMessageEndpoint,
+		PostSendMessages:   postSendMessagesEndpoint,
+		PostCSR:            postCSREndpoint,
+		PostCertificate:    postCertificateEndpoint,
+		PostImport:         postImportEndpoint,
+		PostExport:         postExportEndpoint,
+		PostStartRecording: postStartRecordingEndpoint,
+		PostStopRecording:  postStopRecordingEndpoint,
+		PostReplay:         postReplayEndpoint,
+		PostNetwork:        postNetworkEndpoint,
 	}
 }
 
 func MakeHealthEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		healthy := s.Health(ctx)
-		return healthResponse{Healthy: healthy}, nil
+		report := s.Health(ctx)
+		return healthResponse{Report: report}, nil
+	}
+}
+
+func MakeReadinessEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		report := s.Readiness(ctx)
+		return healthResponse{Report: report}, nil
 	}
 }
 
@@ -61,51 +167,293 @@ func MakePostConnect(s Service) endpoint.Endpoint {
 
 func MakePostDisconnect(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		_ = request.(postDisconnectRequest)
-		s.PostDisconnect(ctx)
-		return postDisconnectResponse{}, nil
+		req := request.(postDisconnectRequest)
+		err = s.PostDisconnect(ctx, req.ClientID)
+		return postDisconnectResponse{Err: err}, nil
+	}
+}
+
+func MakeSessionState(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(sessionStateRequest)
+		state, err := s.SessionState(ctx, req.ClientID)
+		return sessionStateResponse{SessionState: state, Err: err}, nil
 	}
 }
 
 func MakePostSendMessage(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(postSendMessageRequest)
-		err = s.PostSendMessage(ctx, req.Message, req.Topic)
+		err = s.PostSendMessage(ctx, req.ClientID, req.Message, req.Topic)
 		return postSendMessageResponse{Err: err}, nil
 	}
 }
 
+func MakePostSendMessages(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postSendMessagesRequest)
+		messages := make([]BatchMessage, len(req.Messages))
+		for i, m := range req.Messages {
+			messages[i] = BatchMessage{
+				Topic:   m.Topic,
+				Payload: m.Payload,
+				QoS:     m.QoS,
+				Retain:  m.Retain,
+				Delay:   time.Duration(m.Delay) * time.Millisecond,
+			}
+		}
+		results, err := s.PostSendMessages(ctx, req.ClientID, messages, req.Ordered)
+		return postSendMessagesResponse{Results: results, Err: err}, nil
+	}
+}
+
+func MakePostCSR(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postCSRRequest)
+		csr, err := s.PostCSR(ctx, req.ClientID, req.KeyType, req.CommonName)
+		return postCSRResponse{CSR: csr, Err: err}, nil
+	}
+}
+
+func MakePostCertificate(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postCertificateRequest)
+		err = s.PostCertificate(ctx, req.ClientID, req.CRT)
+		return postCertificateResponse{Err: err}, nil
+	}
+}
+
+func MakePostImport(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postImportRequest)
+		err = s.PostImport(ctx, req.ClientID, req.Bundle, req.Password)
+		return postImportResponse{Err: err}, nil
+	}
+}
+
+func MakePostExport(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postExportRequest)
+		bundle, err := s.PostExport(ctx, req.ClientID, req.Password)
+		return postExportResponse{PKCS12: bundle, Err: err}, nil
+	}
+}
+
+func MakePostStartRecording(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postStartRecordingRequest)
+		err = s.PostStartRecording(ctx, req.ClientID, req.Recording)
+		return postStartRecordingResponse{Err: err}, nil
+	}
+}
+
+func MakePostStopRecording(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postStopRecordingRequest)
+		err = s.PostStopRecording(ctx, req.ClientID)
+		return postStopRecordingResponse{Err: err}, nil
+	}
+}
+
+func MakePostReplay(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postReplayRequest)
+		opts := recording.Options{Speed: req.Speed, TopicRewrites: req.TopicRewrites}
+		report, err := s.PostReplay(ctx, req.ClientID, req.Recording, opts, req.SubstituteClientID)
+		return postReplayResponse{Report: report, Err: err}, nil
+	}
+}
+
+func MakePostNetwork(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(postNetworkRequest)
+		var profile *impairment.Profile
+		if req.Profile != nil {
+			p := req.Profile.profile()
+			profile = &p
+		}
+		status, err := s.PostNetwork(ctx, req.ClientID, profile, req.Scenario, req.Reset)
+		return postNetworkResponse{NetworkStatus: networkStatus(status), Err: err}, nil
+	}
+}
+
 type healthRequest struct{}
 
 type healthResponse struct {
-	Healthy bool  `json:"healthy,omitempty"`
-	Err     error `json:"err,omitempty"`
+	health.Report
+}
+
+// StatusCode makes failing health reports answer 503, so that load balancers
+// and Consul checks can rely on the status code alone.
+func (r healthResponse) StatusCode() int {
+	if r.Status == health.StatusFail {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
 }
 
 type postConnectRequest struct {
 	AuthKey   string `json:"authKey"`
 	AuthCRT   string `json:"authCRT"`
-	BrokerURL string `json:"brokerURL"`
-	ClientID  string `json:"clientID"`
+	BrokerURL string `json:"brokerURL" validate:"required"`
+	ClientID  string `json:"clientID" validate:"required"`
 }
 
 type postConnectResponse struct {
-	Err error `json:"error"`
+	Err error `json:"error,omitempty"`
 }
 
 func (r postConnectResponse) error() error { return r.Err }
 
-type postDisconnectRequest struct{}
+type postDisconnectRequest struct {
+	ClientID string `json:"clientID"`
+}
+
+type postDisconnectResponse struct {
+	Err error `json:"error,omitempty"`
+}
+
+func (r postDisconnectResponse) error() error { return r.Err }
+
+type sessionStateRequest struct {
+	ClientID string `json:"clientID"`
+}
+
+type sessionStateResponse struct {
+	SessionState
+	Err error `json:"error,omitempty"`
+}
 
-type postDisconnectResponse struct{}
+func (r sessionStateResponse) error() error { return r.Err }
 
 type postSendMessageRequest struct {
-	Message string `json:"message"`
-	Topic   string `json:"topic"`
+	ClientID string `json:"clientID"`
+	Message  string `json:"message"`
+	Topic    string `json:"topic" validate:"required"`
 }
 
 type postSendMessageResponse struct {
-	Err error `json:"error"`
+	Err error `json:"error,omitempty"`
 }
 
 func (r postSendMessageResponse) error() error { return r.Err }
+
+type postSendMessagesRequest struct {
+	ClientID string                `json:"clientID"`
+	Ordered  bool                  `json:"ordered"`
+	Messages []batchMessageRequest `json:"messages" validate:"required"`
+}
+
+type batchMessageRequest struct {
+	Topic   string `json:"topic" validate:"required"`
+	Payload string `json:"payload"`
+	QoS     int    `json:"qos"`
+	Retain  bool   `json:"retain"`
+	// Delay is in milliseconds.
+	Delay int64 `json:"delay"`
+}
+
+type postSendMessagesResponse struct {
+	Results []BatchResult `json:"results,omitempty"`
+	Err     error         `json:"error,omitempty"`
+}
+
+func (r postSendMessagesResponse) error() error { return r.Err }
+
+type postCSRRequest struct {
+	ClientID   string `json:"clientID" validate:"required"`
+	KeyType    string `json:"keyType"`
+	CommonName string `json:"commonName"`
+}
+
+type postCSRResponse struct {
+	CSR string `json:"csr,omitempty"`
+	Err error  `json:"error,omitempty"`
+}
+
+func (r postCSRResponse) error() error { return r.Err }
+
+type postCertificateRequest struct {
+	ClientID string `json:"clientID" validate:"required"`
+	CRT      string `json:"crt" validate:"required"`
+}
+
+type postCertificateResponse struct {
+	Err error `json:"error,omitempty"`
+}
+
+func (r postCertificateResponse) error() error { return r.Err }
+
+type postImportRequest struct {
+	ClientID string `json:"clientID" validate:"required"`
+	Bundle   []byte `json:"bundle" validate:"required"`
+	Password string `json:"password"`
+}
+
+type postImportResponse struct {
+	Err error `json:"error,omitempty"`
+}
+
+func (r postImportResponse) error() error { return r.Err }
+
+type postExportRequest struct {
+	ClientID string `json:"clientID" validate:"required"`
+	Password string `json:"password"`
+}
+
+type postExportResponse struct {
+	PKCS12 []byte `json:"pkcs12,omitempty"`
+	Err    error  `json:"error,omitempty"`
+}
+
+func (r postExportResponse) error() error { return r.Err }
+
+type postStartRecordingRequest struct {
+	ClientID  string `json:"clientID"`
+	Recording string `json:"recording" validate:"required"`
+}
+
+type postStartRecordingResponse struct {
+	Err error `json:"error,omitempty"`
+}
+
+func (r postStartRecordingResponse) error() error { return r.Err }
+
+type postStopRecordingRequest struct {
+	ClientID string `json:"clientID"`
+}
+
+type postStopRecordingResponse struct {
+	Err error `json:"error,omitempty"`
+}
+
+func (r postStopRecordingResponse) error() error { return r.Err }
+
+type postReplayRequest struct {
+	ClientID           string                   `json:"clientID"`
+	Recording          string                   `json:"recording" validate:"required"`
+	Speed              float64                  `json:"speed"`
+	TopicRewrites      []recording.TopicRewrite `json:"topicRewrites"`
+	SubstituteClientID bool                     `json:"substituteClientID"`
+}
+
+type postReplayResponse struct {
+	recording.Report
+	Err error `json:"error,omitempty"`
+}
+
+func (r postReplayResponse) error() error { return r.Err }
+
+type postNetworkRequest struct {
+	ClientID string          `json:"clientID"`
+	Profile  *NetworkProfile `json:"profile"`
+	Scenario string          `json:"scenario"`
+	Reset    bool            `json:"reset"`
+}
+
+type postNetworkResponse struct {
+	NetworkStatus
+	Err error `json:"error,omitempty"`
+}
+
+func (r postNetworkResponse) error() error { return r.Err }
@@ -0,0 +1,195 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/auth"
+	"github.com/lamassuiot/device-virtual/pkg/identity"
+	"github.com/lamassuiot/device-virtual/pkg/impairment"
+	"github.com/lamassuiot/device-virtual/pkg/recording"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorCode is the machine readable identifier of an API error.
+type ErrorCode string
+
+const (
+	CodeInvalidRequest     ErrorCode = "INVALID_REQUEST"
+	CodeRequestTooLarge    ErrorCode = "REQUEST_TOO_LARGE"
+	CodeInvalidCredentials ErrorCode = "INVALID_CREDENTIALS"
+	CodeUnauthenticated    ErrorCode = "UNAUTHENTICATED"
+	CodeForbidden          ErrorCode = "FORBIDDEN"
+	CodeIdentityNotFound   ErrorCode = "IDENTITY_NOT_FOUND"
+	CodeKeyNotExportable   ErrorCode = "KEY_NOT_EXPORTABLE"
+	CodeRouteNotFound      ErrorCode = "ROUTE_NOT_FOUND"
+	CodeMethodNotAllowed   ErrorCode = "METHOD_NOT_ALLOWED"
+	CodeNotConnected       ErrorCode = "NOT_CONNECTED"
+	CodeCertExpired        ErrorCode = "CERT_EXPIRED"
+	CodeBrokerUnreachable  ErrorCode = "BROKER_UNREACHABLE"
+	CodeTLSHandshakeFailed ErrorCode = "TLS_HANDSHAKE_FAILED"
+	CodeBrokerRefused      ErrorCode = "BROKER_REFUSED"
+	CodePublishFailed      ErrorCode = "PUBLISH_FAILED"
+	CodeRateLimited        ErrorCode = "RATE_LIMITED"
+	CodeSubscribeFailed    ErrorCode = "SUBSCRIBE_FAILED"
+	CodeRecordingNotFound  ErrorCode = "RECORDING_NOT_FOUND"
+	CodeRecordingConflict  ErrorCode = "RECORDING_CONFLICT"
+	CodeRecordingInvalid   ErrorCode = "RECORDING_INVALID"
+	CodeRecordingDisabled  ErrorCode = "RECORDING_DISABLED"
+	CodeScenarioNotFound   ErrorCode = "SCENARIO_NOT_FOUND"
+	CodeScenarioInvalid    ErrorCode = "SCENARIO_INVALID"
+	CodeScenariosDisabled  ErrorCode = "SCENARIOS_DISABLED"
+	CodeUnavailable        ErrorCode = "UNAVAILABLE"
+	CodeInternal           ErrorCode = "INTERNAL"
+)
+
+var statusCodes = map[ErrorCode]int{
+	CodeInvalidRequest:     http.StatusBadRequest,
+	CodeRequestTooLarge:    http.StatusRequestEntityTooLarge,
+	CodeInvalidCredentials: http.StatusBadRequest,
+	CodeUnauthenticated:    http.StatusUnauthorized,
+	CodeForbidden:          http.StatusForbidden,
+	CodeIdentityNotFound:   http.StatusNotFound,
+	CodeRouteNotFound:      http.StatusNotFound,
+	CodeMethodNotAllowed:   http.StatusMethodNotAllowed,
+	CodeKeyNotExportable:   http.StatusConflict,
+	CodeNotConnected:       http.StatusConflict,
+	CodeCertExpired:        http.StatusUnprocessableEntity,
+	CodeBrokerUnreachable:  http.StatusBadGateway,
+	CodeTLSHandshakeFailed: http.StatusBadGateway,
+	CodeBrokerRefused:      http.StatusBadGateway,
+	CodePublishFailed:      http.StatusBadGateway,
+	CodeRateLimited:        http.StatusTooManyRequests,
+	CodeSubscribeFailed:    http.StatusBadGateway,
+	CodeRecordingNotFound:  http.StatusNotFound,
+	CodeRecordingConflict:  http.StatusConflict,
+	CodeRecordingInvalid:   http.StatusUnprocessableEntity,
+	CodeRecordingDisabled:  http.StatusNotImplemented,
+	CodeScenarioNotFound:   http.StatusNotFound,
+	CodeScenarioInvalid:    http.StatusUnprocessableEntity,
+	CodeScenariosDisabled:  http.StatusNotImplemented,
+	CodeUnavailable:        http.StatusServiceUnavailable,
+	CodeInternal:           http.StatusInternalServerError,
+}
+
+// Error is returned by every endpoint. Errors with the same code and message
+// match with errors.Is regardless of their cause and details.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Cause   error
+	Details []string
+	// RetryAfter tells callers when to retry throttled requests.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Cause == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Cause.Error()
+}
+
+func (e *Error) Unwrap() error { return e.Cause }
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code && t.Message == e.Message
+}
+
+func (e *Error) StatusCode() int {
+	if code, ok := statusCodes[e.Code]; ok {
+		return code
+	}
+	return http.StatusInternalServerError
+}
+
+func (e *Error) MarshalJSON() ([]byte, error) {
+	body := struct {
+		Code    ErrorCode `json:"code"`
+		Message string    `json:"message"`
+		Cause   string    `json:"cause,omitempty"`
+		Details []string  `json:"details,omitempty"`
+	}{Code: e.Code, Message: e.Message, Details: e.Details}
+	if e.Cause != nil {
+		body.Cause = e.Cause.Error()
+	}
+	return json.Marshal(body)
+}
+
+func (e *Error) wrap(cause error) *Error {
+	return &Error{Code: e.Code, Message: e.Message, Cause: cause}
+}
+
+var (
+	ErrMalformedRequest = &Error{Code: CodeInvalidRequest, Message: "malformed request body"}
+	ErrInvalidRequest   = &Error{Code: CodeInvalidRequest, Message: "request body does not match the API schema"}
+	ErrMissingQuery     = &Error{Code: CodeInvalidRequest, Message: "missing query parameter"}
+	ErrRequestTooLarge  = &Error{Code: CodeRequestTooLarge, Message: "request body too large"}
+	ErrRouteNotFound    = &Error{Code: CodeRouteNotFound, Message: "route not found"}
+	ErrMethodNotAllowed = &Error{Code: CodeMethodNotAllowed, Message: "method not allowed"}
+	ErrInternal         = &Error{Code: CodeInternal, Message: "internal error"}
+)
+
+// identityErrors maps the errors of the identity package to API errors. They
+// carry no cause, but are also recognized when wrapped.
+var identityErrors = map[error]ErrorCode{
+	identity.ErrKeyTypeUnsupported: CodeInvalidRequest,
+	identity.ErrCertificateParsing: CodeInvalidCredentials,
+	identity.ErrCertificateKey:     CodeInvalidCredentials,
+	identity.ErrBundleDecoding:     CodeInvalidCredentials,
+	identity.ErrBundleKeyMissing:   CodeInvalidCredentials,
+	identity.ErrBundleCertMissing:  CodeInvalidCredentials,
+	identity.ErrIncorrectPassword:  CodeInvalidCredentials,
+	identity.ErrKeyNotExportable:   CodeKeyNotExportable,
+}
+
+// authErrors maps the errors of the auth package to API errors. Their causes
+// are kept, as invalid tokens are wrapped with the reason.
+var authErrors = map[error]ErrorCode{
+	auth.ErrUnauthenticated: CodeUnauthenticated,
+	auth.ErrInvalidToken:    CodeUnauthenticated,
+	auth.ErrForbidden:       CodeForbidden,
+}
+
+// recordingErrors maps the errors of the recording package to API errors.
+// Their causes are kept, as they are wrapped with the offending record or
+// option.
+var recordingErrors = map[error]ErrorCode{
+	recording.ErrNameInvalid:    CodeInvalidRequest,
+	recording.ErrExists:         CodeRecordingConflict,
+	recording.ErrNotFound:       CodeRecordingNotFound,
+	recording.ErrDecoding:       CodeRecordingInvalid,
+	recording.ErrOptionsInvalid: CodeInvalidRequest,
+}
+
+// impairmentErrors maps the errors of the impairment package to API errors.
+// Their causes are kept, as they are wrapped with the offending value or step.
+var impairmentErrors = map[error]ErrorCode{
+	impairment.ErrProfileInvalid: CodeInvalidRequest,
+	impairment.ErrNameInvalid:    CodeInvalidRequest,
+	impairment.ErrNotFound:       CodeScenarioNotFound,
+	impairment.ErrDecoding:       CodeScenarioInvalid,
+}
+
+// toError converts any error returned by the service or the transport into an
+// API error.
+func toError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	for _, known := range []map[error]ErrorCode{identityErrors, authErrors, recordingErrors, impairmentErrors} {
+		for knownErr, code := range known {
+			if err == knownErr {
+				return &Error{Code: code, Message: err.Error()}
+			}
+			if errors.Is(err, knownErr) {
+				return &Error{Code: code, Message: knownErr.Error(), Cause: err}
+			}
+		}
+	}
+	return ErrInternal.wrap(err)
+}
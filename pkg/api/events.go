@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/auth"
+	"github.com/lamassuiot/device-virtual/pkg/events"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// eventsHeartbeat keeps idle event streams open through proxies.
+	eventsHeartbeat = 15 * time.Second
+	eventsWriteWait = 10 * time.Second
+)
+
+var ErrEventTypeUnknown = &Error{Code: CodeInvalidRequest, Message: "unknown event type"}
+
+// upgrader accepts WebSocket connections from the origins allowed by the CORS
+// policy, like the UI, besides the origin of the server.
+var upgrader = websocket.Upgrader{CheckOrigin: checkOrigin}
+
+// serveEvents streams the events matching the clientID and type query
+// parameters as Server-Sent Events, or over a WebSocket when the client asks
+// to upgrade the connection.
+func serveEvents(s Service, logger log.Logger, authn auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := auth.Authorize(auth.HTTPToContext()(r.Context(), r), authn, auth.RoleReadOnly)
+		if err != nil {
+			encodeError(r.Context(), err, w)
+			return
+		}
+		r = r.WithContext(ctx)
+
+		filter, err := decodeEventsFilter(r)
+		if err != nil {
+			encodeError(r.Context(), err, w)
+			return
+		}
+		if websocket.IsWebSocketUpgrade(r) {
+			serveEventsWebSocket(s, logger, filter, w, r)
+			return
+		}
+		serveEventsSSE(s, filter, w, r)
+	}
+}
+
+// decodeEventsFilter accepts repeated or comma separated query parameters.
+func decodeEventsFilter(r *http.Request) (events.Filter, error) {
+	var filter events.Filter
+	q := r.URL.Query()
+	filter.ClientIDs = splitQuery(q["clientID"])
+	for _, t := range splitQuery(q["type"]) {
+		if !knownEventType(events.Type(t)) {
+			return events.Filter{}, ErrEventTypeUnknown.wrap(fmt.Errorf("%s", t))
+		}
+		filter.Types = append(filter.Types, events.Type(t))
+	}
+	return filter, nil
+}
+
+func splitQuery(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+func knownEventType(t events.Type) bool {
+	for _, known := range events.Types {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+func serveEventsSSE(s Service, filter events.Filter, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		encodeError(r.Context(), ErrInternal.wrap(fmt.Errorf("response writer does not support streaming")), w)
+		return
+	}
+
+	// Listen before answering, so that clients get every event published once
+	// they see the response.
+	stream := s.Events(r.Context(), filter)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-stream:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func serveEventsWebSocket(s Service, logger log.Logger, filter events.Filter, w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stream := s.Events(ctx, filter)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already answered the client.
+		logger.Log("err", err, "msg", "Could not upgrade events connection to WebSocket")
+		return
+	}
+	defer conn.Close()
+
+	// Read until the client goes away, so that control frames are handled.
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-stream:
+			if !ok {
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(eventsWriteWait))
+			if err := conn.WriteJSON(e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventsWriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
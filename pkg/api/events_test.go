@@ -0,0 +1,164 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/auth"
+	"github.com/lamassuiot/device-virtual/pkg/events"
+	"github.com/lamassuiot/device-virtual/pkg/health"
+	"github.com/lamassuiot/device-virtual/pkg/mocks"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/websocket"
+	stdopentracing "github.com/opentracing/opentracing-go"
+)
+
+func TestEventsSSE(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	ts := httptest.NewServer(MakeHTTPHandler(srv, log.NewNopLogger(), stdopentracing.NoopTracer{}, auth.Anonymous()))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/v1/events?clientID=lamassu-client", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unable to open event stream: %s", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Got content type %s; want text/event-stream", ct)
+	}
+
+	stu.connect(t, srv, "other-client")
+	stu.connect(t, srv, "lamassu-client")
+
+	lines := bufio.NewScanner(resp.Body)
+	var name string
+	var e events.Event
+	for lines.Scan() {
+		line := lines.Text()
+		if strings.HasPrefix(line, "event: ") {
+			name = strings.TrimPrefix(line, "event: ")
+		}
+		if strings.HasPrefix(line, "data: ") {
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				t.Fatalf("Event data is not JSON: %s", err)
+			}
+			break
+		}
+	}
+	if name != string(events.SessionConnected) || e.Type != events.SessionConnected {
+		t.Errorf("Got event %s %s; want %s", name, e.Type, events.SessionConnected)
+	}
+	if e.ClientID != "lamassu-client" {
+		t.Errorf("Got event of %s; want lamassu-client only", e.ClientID)
+	}
+	if e.Certificate == nil || e.Certificate.Subject == "" {
+		t.Errorf("Connected event does not describe the certificate")
+	}
+}
+
+func TestEventsWebSocket(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	ts := httptest.NewServer(MakeHTTPHandler(srv, log.NewNopLogger(), stdopentracing.NoopTracer{}, auth.Anonymous()))
+	defer ts.Close()
+
+	stu.client.(*mocks.MockClient).SendMessageFn = func(ctx context.Context, message string, topic string) error {
+		if topic == "lamassu-offline" {
+			return fmt.Errorf("connection lost")
+		}
+		return nil
+	}
+	stu.connect(t, srv, "lamassu-client")
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1/events?type=message.published,message.publish_failed"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Unable to open WebSocket: %s", err)
+	}
+	defer conn.Close()
+
+	srv.PostSendMessage(context.Background(), "lamassu-client", "hello", "lamassu-sample")
+	srv.PostSendMessage(context.Background(), "lamassu-client", "hello", "lamassu-offline")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	testCases := []struct {
+		typ   events.Type
+		topic string
+	}{
+		{events.MessagePublished, "lamassu-sample"},
+		{events.MessagePublishFailed, "lamassu-offline"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.typ), func(t *testing.T) {
+			var e events.Event
+			if err := conn.ReadJSON(&e); err != nil {
+				t.Fatalf("Unable to read event: %s", err)
+			}
+			if e.Type != tc.typ || e.Topic != tc.topic || e.Message != "hello" {
+				t.Errorf("Got event %+v; want %s on %s", e, tc.typ, tc.topic)
+			}
+		})
+	}
+}
+
+func TestEventsWebSocketOrigin(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	cors := NewCORS(CORSPolicy{AllowedOrigins: []string{"https://deviceui"}})
+	ts := httptest.NewServer(cors.Handler(MakeHTTPHandler(srv, log.NewNopLogger(), stdopentracing.NoopTracer{}, auth.Anonymous())))
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1/events"
+	testCases := []struct {
+		name   string
+		origin string
+		status int
+	}{
+		{"No origin", "", http.StatusSwitchingProtocols},
+		{"Same origin", ts.URL, http.StatusSwitchingProtocols},
+		{"UI origin", "https://deviceui", http.StatusSwitchingProtocols},
+		{"Other origin", "https://evil.example.com", http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			header := http.Header{}
+			if tc.origin != "" {
+				header.Set("Origin", tc.origin)
+			}
+			conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+			if conn != nil {
+				conn.Close()
+			}
+			if resp == nil {
+				t.Fatalf("Unable to open WebSocket: %s", err)
+			}
+			if resp.StatusCode != tc.status {
+				t.Errorf("Got status %d; want %d", resp.StatusCode, tc.status)
+			}
+		})
+	}
+}
+
+func TestEventsFilter(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	h := MakeHTTPHandler(srv, log.NewNopLogger(), stdopentracing.NoopTracer{}, auth.Anonymous())
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/events?type=session.unknown", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got status code %d; want %d", w.Code, http.StatusBadRequest)
+	}
+}
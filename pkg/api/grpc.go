@@ -0,0 +1,292 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/lamassuiot/device-virtual/pkg/api/pb"
+	"github.com/lamassuiot/device-virtual/pkg/auth"
+	"github.com/lamassuiot/device-virtual/pkg/health"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/tracing/opentracing"
+	"github.com/go-kit/kit/transport"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type grpcServer struct {
+	pb.UnimplementedDeviceServer
+
+	health     grpctransport.Handler
+	readiness  grpctransport.Handler
+	connect    grpctransport.Handler
+	disconnect grpctransport.Handler
+	publish    grpctransport.Handler
+
+	service  Service
+	authn    auth.Authenticator
+	logger   log.Logger
+	otTracer stdopentracing.Tracer
+}
+
+// MakeGRPCServer serves the endpoints of s over gRPC. Subscribe streams are
+// served by s directly, as go-kit endpoints do not stream.
+func MakeGRPCServer(s Service, logger log.Logger, otTracer stdopentracing.Tracer, authn auth.Authenticator) pb.DeviceServer {
+	e := MakeServerEndpoints(s, otTracer, authn)
+
+	options := []grpctransport.ServerOption{
+		grpctransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
+		grpctransport.ServerBefore(auth.GRPCToContext(), rateLimitGRPCToContext),
+	}
+
+	return &grpcServer{
+		health: grpctransport.NewServer(
+			e.HealthEndpoint,
+			decodeGRPCHealthRequest,
+			encodeGRPCHealthResponse,
+			append(options, grpctransport.ServerBefore(opentracing.GRPCToContext(otTracer, "Health", logger)))...,
+		),
+		readiness: grpctransport.NewServer(
+			e.ReadinessEndpoint,
+			decodeGRPCHealthRequest,
+			encodeGRPCHealthResponse,
+			append(options, grpctransport.ServerBefore(opentracing.GRPCToContext(otTracer, "Readiness", logger)))...,
+		),
+		connect: grpctransport.NewServer(
+			e.PostConnect,
+			decodeGRPCConnectRequest,
+			encodeGRPCConnectResponse,
+			append(options, grpctransport.ServerBefore(opentracing.GRPCToContext(otTracer, "PostConnect", logger)))...,
+		),
+		disconnect: grpctransport.NewServer(
+			e.PostDisconnect,
+			decodeGRPCDisconnectRequest,
+			encodeGRPCDisconnectResponse,
+			append(options, grpctransport.ServerBefore(opentracing.GRPCToContext(otTracer, "PostDisconnect", logger)))...,
+		),
+		publish: grpctransport.NewServer(
+			e.PostSendMessage,
+			decodeGRPCPublishRequest,
+			encodeGRPCPublishResponse,
+			append(options, grpctransport.ServerBefore(opentracing.GRPCToContext(otTracer, "PostSendMessage", logger)))...,
+		),
+		service:  s,
+		authn:    authn,
+		logger:   logger,
+		otTracer: otTracer,
+	}
+}
+
+func (g *grpcServer) Health(ctx context.Context, req *pb.HealthRequest) (*pb.HealthReply, error) {
+	_, rep, err := g.health.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.HealthReply), nil
+}
+
+func (g *grpcServer) Readiness(ctx context.Context, req *pb.HealthRequest) (*pb.HealthReply, error) {
+	_, rep, err := g.readiness.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.HealthReply), nil
+}
+
+func (g *grpcServer) Connect(ctx context.Context, req *pb.ConnectRequest) (*pb.ConnectReply, error) {
+	_, rep, err := g.connect.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.ConnectReply), nil
+}
+
+func (g *grpcServer) Disconnect(ctx context.Context, req *pb.DisconnectRequest) (*pb.DisconnectReply, error) {
+	_, rep, err := g.disconnect.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.DisconnectReply), nil
+}
+
+func (g *grpcServer) Publish(ctx context.Context, req *pb.PublishRequest) (*pb.PublishReply, error) {
+	_, rep, err := g.publish.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.PublishReply), nil
+}
+
+// Subscribe ends without error when the session disconnects. Subscribing
+// changes the session on the broker, so it requires the operator role.
+func (g *grpcServer) Subscribe(req *pb.SubscribeRequest, stream pb.Device_SubscribeServer) error {
+	ctx := stream.Context()
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = opentracing.GRPCToContext(g.otTracer, "Subscribe", g.logger)(ctx, md)
+	if span := stdopentracing.SpanFromContext(ctx); span != nil {
+		defer span.Finish()
+	}
+	ctx, err := auth.Authorize(auth.GRPCToContext()(ctx, md), g.authn, auth.RoleOperator)
+	if err != nil {
+		return grpcError(err)
+	}
+
+	messages, err := g.service.Subscribe(ctx, req.ClientId, req.Topic, int(req.Qos))
+	if err != nil {
+		return grpcError(err)
+	}
+	for m := range messages {
+		err := stream.Send(&pb.Message{
+			Topic:      m.Topic,
+			Payload:    m.Payload,
+			Qos:        int32(m.QoS),
+			Retained:   m.Retained,
+			ReceivedAt: timestamppb.New(m.ReceivedAt),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return nil
+}
+
+func decodeGRPCHealthRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	return healthRequest{}, nil
+}
+
+func encodeGRPCHealthResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(healthResponse)
+	rep := &pb.HealthReply{Status: string(resp.Status)}
+	for _, c := range resp.Checks {
+		details, err := checkDetails(c)
+		if err != nil {
+			return nil, ErrInternal.wrap(err)
+		}
+		rep.Checks = append(rep.Checks, &pb.Check{
+			Name:    c.Name,
+			Status:  string(c.Status),
+			Message: c.Message,
+			Details: details,
+		})
+	}
+	return rep, nil
+}
+
+// checkDetails converts the details of a check through JSON, as structpb only
+// accepts generic slices and maps.
+func checkDetails(c health.Check) (*structpb.Struct, error) {
+	if len(c.Details) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(c.Details)
+	if err != nil {
+		return nil, err
+	}
+	var details map[string]interface{}
+	if err := json.Unmarshal(data, &details); err != nil {
+		return nil, err
+	}
+	return structpb.NewStruct(details)
+}
+
+func decodeGRPCConnectRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.ConnectRequest)
+	return postConnectRequest{
+		AuthKey:   req.AuthKey,
+		AuthCRT:   req.AuthCrt,
+		BrokerURL: req.BrokerUrl,
+		ClientID:  req.ClientId,
+	}, nil
+}
+
+func encodeGRPCConnectResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(postConnectResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.ConnectReply{}, nil
+}
+
+func decodeGRPCDisconnectRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.DisconnectRequest)
+	return postDisconnectRequest{ClientID: req.ClientId}, nil
+}
+
+func encodeGRPCDisconnectResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(postDisconnectResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.DisconnectReply{}, nil
+}
+
+func decodeGRPCPublishRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.PublishRequest)
+	return postSendMessageRequest{
+		ClientID: req.ClientId,
+		Message:  req.Message,
+		Topic:    req.Topic,
+	}, nil
+}
+
+func encodeGRPCPublishResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(postSendMessageResponse)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &pb.PublishReply{}, nil
+}
+
+var grpcCodes = map[ErrorCode]codes.Code{
+	CodeInvalidRequest:     codes.InvalidArgument,
+	CodeRequestTooLarge:    codes.ResourceExhausted,
+	CodeInvalidCredentials: codes.InvalidArgument,
+	CodeUnauthenticated:    codes.Unauthenticated,
+	CodeForbidden:          codes.PermissionDenied,
+	CodeIdentityNotFound:   codes.NotFound,
+	CodeRouteNotFound:      codes.Unimplemented,
+	CodeMethodNotAllowed:   codes.Unimplemented,
+	CodeKeyNotExportable:   codes.FailedPrecondition,
+	CodeNotConnected:       codes.FailedPrecondition,
+	CodeCertExpired:        codes.FailedPrecondition,
+	CodeBrokerUnreachable:  codes.Unavailable,
+	CodeTLSHandshakeFailed: codes.Unavailable,
+	CodeBrokerRefused:      codes.PermissionDenied,
+	CodePublishFailed:      codes.Unavailable,
+	CodeRateLimited:        codes.ResourceExhausted,
+	CodeSubscribeFailed:    codes.Unavailable,
+	CodeUnavailable:        codes.Unavailable,
+	CodeInternal:           codes.Internal,
+}
+
+// grpcError converts err into a gRPC status carrying the API error as detail.
+func grpcError(err error) error {
+	e := toError(err)
+	code, ok := grpcCodes[e.Code]
+	if !ok {
+		code = codes.Internal
+	}
+	detail := &pb.Error{Code: string(e.Code), Message: e.Message, Details: e.Details}
+	if e.Cause != nil {
+		detail.Cause = e.Cause.Error()
+	}
+	if e.RetryAfter > 0 {
+		detail.RetryAfter = durationpb.New(e.RetryAfter)
+	}
+	st, werr := status.New(code, e.Error()).WithDetails(detail)
+	if werr != nil {
+		return status.Error(code, e.Error())
+	}
+	return st.Err()
+}
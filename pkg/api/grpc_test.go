@@ -0,0 +1,187 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/lamassuiot/device-virtual/pkg/api/pb"
+	"github.com/lamassuiot/device-virtual/pkg/auth"
+	"github.com/lamassuiot/device-virtual/pkg/auth/mtls"
+	"github.com/lamassuiot/device-virtual/pkg/client"
+	"github.com/lamassuiot/device-virtual/pkg/events"
+	"github.com/lamassuiot/device-virtual/pkg/health"
+	"github.com/lamassuiot/device-virtual/pkg/identity"
+	"github.com/lamassuiot/device-virtual/pkg/mocks"
+
+	"github.com/go-kit/kit/log"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCErrors(t *testing.T) {
+	stu := setup(t)
+	c := stu.grpcClient(t, auth.Anonymous())
+	ctx := context.Background()
+	key, cert := stu.keyPair(t, identity.KeyTypeECDSAP256)
+
+	testCases := []struct {
+		name   string
+		call   func() error
+		status codes.Code
+		code   ErrorCode
+	}{
+		{"Broker URL empty", func() error {
+			_, err := c.Connect(ctx, &pb.ConnectRequest{AuthKey: key, AuthCrt: cert, ClientId: "lamassu-client"})
+			return err
+		}, codes.InvalidArgument, CodeInvalidRequest},
+		{"Unknown session", func() error {
+			_, err := c.Publish(ctx, &pb.PublishRequest{ClientId: "unknown-client", Topic: "lamassu-sample"})
+			return err
+		}, codes.FailedPrecondition, CodeNotConnected},
+		{"Subscribe without session", func() error {
+			stream, err := c.Subscribe(ctx, &pb.SubscribeRequest{ClientId: "unknown-client", Topic: "lamassu-sample"})
+			if err != nil {
+				return err
+			}
+			_, err = stream.Recv()
+			return err
+		}, codes.FailedPrecondition, CodeNotConnected},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			st := status.Convert(tc.call())
+			if st.Code() != tc.status {
+				t.Errorf("Got status %s; want %s", st.Code(), tc.status)
+			}
+			var detail *pb.Error
+			for _, d := range st.Details() {
+				if e, ok := d.(*pb.Error); ok {
+					detail = e
+				}
+			}
+			if detail == nil || detail.Code != string(tc.code) {
+				t.Errorf("Got error detail %v; want code %s", detail, tc.code)
+			}
+		})
+	}
+}
+
+func TestGRPCSession(t *testing.T) {
+	stu := setup(t)
+	c := stu.grpcClient(t, auth.Anonymous())
+	ctx := context.Background()
+
+	subscribed := make(chan client.MessageHandler, 1)
+	mc := stu.client.(*mocks.MockClient)
+	mc.ConnectFn = func(ctx context.Context, URL string, clientID string, conf *tls.Config) error { return nil }
+	mc.IsConnectedFn = func() bool { return true }
+	mc.SendMessageFn = func(ctx context.Context, message string, topic string) error { return nil }
+	mc.SubscribeFn = func(ctx context.Context, topic string, qos byte, handler client.MessageHandler) error {
+		subscribed <- handler
+		return nil
+	}
+
+	key, cert := stu.keyPair(t, identity.KeyTypeECDSAP256)
+	if _, err := c.Connect(ctx, &pb.ConnectRequest{AuthKey: key, AuthCrt: cert, BrokerUrl: "ssl://mosquitto:1883", ClientId: "lamassu-client"}); err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	if _, err := c.Publish(ctx, &pb.PublishRequest{ClientId: "lamassu-client", Topic: "lamassu-sample", Message: "hello"}); err != nil {
+		t.Errorf("Unable to publish: %s", err)
+	}
+
+	stream, err := c.Subscribe(ctx, &pb.SubscribeRequest{ClientId: "lamassu-client", Topic: "lamassu-sample", Qos: 1})
+	if err != nil {
+		t.Fatalf("Unable to subscribe: %s", err)
+	}
+	handler := <-subscribed
+	handler(client.Message{Topic: "lamassu-sample", Payload: []byte("hello"), QoS: 1})
+	m, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Unable to receive message: %s", err)
+	}
+	if m.Topic != "lamassu-sample" || string(m.Payload) != "hello" || m.Qos != 1 {
+		t.Errorf("Got message %v", m)
+	}
+
+	rep, err := c.Readiness(ctx, &pb.HealthRequest{})
+	if err != nil {
+		t.Fatalf("Unable to get readiness: %s", err)
+	}
+	if rep.Status != string(health.StatusPass) || len(rep.Checks) == 0 {
+		t.Errorf("Got readiness %v", rep)
+	}
+
+	if _, err := c.Disconnect(ctx, &pb.DisconnectRequest{ClientId: "lamassu-client"}); err != nil {
+		t.Fatalf("Unable to disconnect: %s", err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("Got %v at the end of the stream; want EOF", err)
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	stu := setup(t)
+	c := stu.grpcClient(t, mtls.NewAuthenticator(auth.RoleReadOnly))
+	ctx := context.Background()
+
+	if _, err := c.Health(ctx, &pb.HealthRequest{}); err != nil {
+		t.Errorf("Health requires credentials: %s", err)
+	}
+	_, err := c.Connect(ctx, &pb.ConnectRequest{BrokerUrl: "ssl://mosquitto:1883", ClientId: "lamassu-client"})
+	if code := status.Code(err); code != codes.Unauthenticated {
+		t.Errorf("Got status %s for Connect; want %s", code, codes.Unauthenticated)
+	}
+	stream, err := c.Subscribe(ctx, &pb.SubscribeRequest{ClientId: "lamassu-client", Topic: "lamassu-sample"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if code := status.Code(err); code != codes.Unauthenticated {
+		t.Errorf("Got status %s for Subscribe; want %s", code, codes.Unauthenticated)
+	}
+
+	c = stu.grpcClient(t, roles{auth.RoleReadOnly})
+	stream, err = c.Subscribe(ctx, &pb.SubscribeRequest{ClientId: "lamassu-client", Topic: "lamassu-sample"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("Got status %s for Subscribe as read-only; want %s", code, codes.PermissionDenied)
+	}
+}
+
+// roles authenticates every caller with the same roles.
+type roles []auth.Role
+
+func (r roles) Authenticate(ctx context.Context) (auth.Principal, error) {
+	return auth.Principal{Subject: "test", Method: "test", Roles: r}, nil
+}
+
+// grpcClient serves the device service over an in-memory gRPC connection.
+func (stu *serviceSetUp) grpcClient(t *testing.T, authn auth.Authenticator) pb.DeviceClient {
+	t.Helper()
+
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	pb.RegisterDeviceServer(gs, MakeGRPCServer(srv, log.NewNopLogger(), stdopentracing.NoopTracer{}, authn))
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Unable to dial gRPC server: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewDeviceClient(conn)
+}
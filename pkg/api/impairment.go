@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/impairment"
+)
+
+var (
+	ErrScenariosDisabled = &Error{Code: CodeScenariosDisabled, Message: "network impairment scenarios are disabled"}
+	ErrNetworkConflict   = &Error{Code: CodeInvalidRequest, Message: "set either a network profile or a scenario, not both"}
+)
+
+// NetworkProfile is the impairment of the broker connections of a session,
+// with durations in milliseconds and the bandwidth in bytes per second.
+type NetworkProfile struct {
+	Latency       int64 `json:"latency"`
+	Jitter        int64 `json:"jitter"`
+	Bandwidth     int   `json:"bandwidth"`
+	StallInterval int64 `json:"stallInterval"`
+	StallDuration int64 `json:"stallDuration"`
+	ResetInterval int64 `json:"resetInterval"`
+}
+
+// NetworkStatus is the current impairment of a session, and the scenario
+// setting it, if any, with the index of its current step.
+type NetworkStatus struct {
+	Profile  NetworkProfile `json:"profile"`
+	Scenario string         `json:"scenario,omitempty"`
+	Step     int            `json:"step,omitempty"`
+}
+
+func networkProfile(p impairment.Profile) NetworkProfile {
+	return NetworkProfile{
+		Latency:       p.Latency.Milliseconds(),
+		Jitter:        p.Jitter.Milliseconds(),
+		Bandwidth:     p.Bandwidth,
+		StallInterval: p.StallInterval.Milliseconds(),
+		StallDuration: p.StallDuration.Milliseconds(),
+		ResetInterval: p.ResetInterval.Milliseconds(),
+	}
+}
+
+func (p NetworkProfile) profile() impairment.Profile {
+	return impairment.Profile{
+		Latency:       time.Duration(p.Latency) * time.Millisecond,
+		Jitter:        time.Duration(p.Jitter) * time.Millisecond,
+		Bandwidth:     p.Bandwidth,
+		StallInterval: time.Duration(p.StallInterval) * time.Millisecond,
+		StallDuration: time.Duration(p.StallDuration) * time.Millisecond,
+		ResetInterval: time.Duration(p.ResetInterval) * time.Millisecond,
+	}
+}
+
+func networkStatus(s impairment.Status) NetworkStatus {
+	return NetworkStatus{Profile: networkProfile(s.Profile), Scenario: s.Scenario, Step: s.Step}
+}
+
+// PostNetwork impairs the broker connections of a session with profile, or
+// with the scenario of that name, replacing the impairment set before. With
+// reset, the live connections are reset afterwards, so that the session
+// reconnects. Without profile nor scenario, the impairment is left as is.
+func (s *deviceService) PostNetwork(ctx context.Context, clientID string, profile *impairment.Profile, scenario string, reset bool) (impairment.Status, error) {
+	if profile != nil && scenario != "" {
+		return impairment.Status{}, ErrNetworkConflict
+	}
+	if scenario != "" && s.scenarios == nil {
+		return impairment.Status{}, ErrScenariosDisabled
+	}
+	if profile != nil {
+		if err := profile.Validate(); err != nil {
+			return impairment.Status{}, err
+		}
+	}
+
+	done, err := s.enter()
+	if err != nil {
+		return impairment.Status{}, err
+	}
+	defer done()
+
+	sess, err := s.session(clientID)
+	if err != nil {
+		return impairment.Status{}, err
+	}
+
+	switch {
+	case profile != nil:
+		sess.shaper.Set(*profile)
+	case scenario != "":
+		sc, err := s.scenarios.Open(scenario)
+		if err != nil {
+			return impairment.Status{}, err
+		}
+		sess.shaper.Run(sc)
+	}
+	if reset {
+		sess.shaper.Reset()
+	}
+	return sess.shaper.Status(), nil
+}
@@ -5,6 +5,12 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/lamassuiot/device-virtual/pkg/client"
+	"github.com/lamassuiot/device-virtual/pkg/events"
+	"github.com/lamassuiot/device-virtual/pkg/health"
+	"github.com/lamassuiot/device-virtual/pkg/impairment"
+	"github.com/lamassuiot/device-virtual/pkg/recording"
+
 	"github.com/go-kit/kit/metrics"
 )
 
@@ -24,7 +30,7 @@ func NewInstrumentingMiddleware(counter metrics.Counter, latency metrics.Histogr
 	}
 }
 
-func (mw *instrumentingMiddleware) Health(ctx context.Context) bool {
+func (mw *instrumentingMiddleware) Health(ctx context.Context) health.Report {
 	defer func(begin time.Time) {
 		lvs := []string{"method", "Health", "error", "false"}
 		mw.requestCount.With(lvs...).Add(1)
@@ -34,14 +40,34 @@ func (mw *instrumentingMiddleware) Health(ctx context.Context) bool {
 	return mw.next.Health(ctx)
 }
 
-func (mw *instrumentingMiddleware) PostSendMessage(ctx context.Context, message string, topic string) (err error) {
+func (mw *instrumentingMiddleware) Readiness(ctx context.Context) health.Report {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "Readiness", "error", "false"}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.Readiness(ctx)
+}
+
+func (mw *instrumentingMiddleware) PostSendMessage(ctx context.Context, clientID string, message string, topic string) (err error) {
 	defer func(begin time.Time) {
 		lvs := []string{"method", "PostSendMessage", "error", fmt.Sprint(err != nil)}
 		mw.requestCount.With(lvs...).Add(1)
 		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return mw.next.PostSendMessage(ctx, message, topic)
+	return mw.next.PostSendMessage(ctx, clientID, message, topic)
+}
+
+func (mw *instrumentingMiddleware) PostSendMessages(ctx context.Context, clientID string, messages []BatchMessage, ordered bool) (results []BatchResult, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "PostSendMessages", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.PostSendMessages(ctx, clientID, messages, ordered)
 }
 
 func (mw *instrumentingMiddleware) PostConnect(ctx context.Context, authKey string, authCRT string, brokerURL string, clientID string) (err error) {
@@ -54,12 +80,122 @@ func (mw *instrumentingMiddleware) PostConnect(ctx context.Context, authKey stri
 	return mw.next.PostConnect(ctx, authKey, authCRT, brokerURL, clientID)
 }
 
-func (mw *instrumentingMiddleware) PostDisconnect(ctx context.Context) {
+func (mw *instrumentingMiddleware) PostDisconnect(ctx context.Context, clientID string) (err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "PostDisconnect", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.PostDisconnect(ctx, clientID)
+}
+
+func (mw *instrumentingMiddleware) SessionState(ctx context.Context, clientID string) (state SessionState, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "SessionState", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.SessionState(ctx, clientID)
+}
+
+func (mw *instrumentingMiddleware) PostCSR(ctx context.Context, clientID string, keyType string, commonName string) (csr string, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "PostCSR", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.PostCSR(ctx, clientID, keyType, commonName)
+}
+
+func (mw *instrumentingMiddleware) PostCertificate(ctx context.Context, clientID string, crt string) (err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "PostCertificate", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.PostCertificate(ctx, clientID, crt)
+}
+
+func (mw *instrumentingMiddleware) PostImport(ctx context.Context, clientID string, bundle []byte, password string) (err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "PostImport", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.PostImport(ctx, clientID, bundle, password)
+}
+
+func (mw *instrumentingMiddleware) PostExport(ctx context.Context, clientID string, password string) (bundle []byte, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "PostExport", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.PostExport(ctx, clientID, password)
+}
+
+func (mw *instrumentingMiddleware) PostStartRecording(ctx context.Context, clientID string, name string) (err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "PostStartRecording", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.PostStartRecording(ctx, clientID, name)
+}
+
+func (mw *instrumentingMiddleware) PostStopRecording(ctx context.Context, clientID string) (err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "PostStopRecording", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.PostStopRecording(ctx, clientID)
+}
+
+func (mw *instrumentingMiddleware) PostReplay(ctx context.Context, clientID string, name string, opts recording.Options, substituteClientID bool) (report recording.Report, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "PostReplay", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.PostReplay(ctx, clientID, name, opts, substituteClientID)
+}
+
+func (mw *instrumentingMiddleware) PostNetwork(ctx context.Context, clientID string, profile *impairment.Profile, scenario string, reset bool) (status impairment.Status, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "PostNetwork", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.PostNetwork(ctx, clientID, profile, scenario, reset)
+}
+
+func (mw *instrumentingMiddleware) Subscribe(ctx context.Context, clientID string, topic string, qos int) (messages <-chan client.Message, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "Subscribe", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.Subscribe(ctx, clientID, topic, qos)
+}
+
+func (mw *instrumentingMiddleware) Events(ctx context.Context, filter events.Filter) <-chan events.Event {
 	defer func(begin time.Time) {
-		lvs := []string{"method", "PostDisconnect", "error", "false"}
+		lvs := []string{"method", "Events", "error", "false"}
 		mw.requestCount.With(lvs...).Add(1)
 		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	mw.next.PostDisconnect(ctx)
+	return mw.next.Events(ctx, filter)
 }
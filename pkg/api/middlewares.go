@@ -4,6 +4,12 @@ import (
 	"context"
 	"time"
 
+	"github.com/lamassuiot/device-virtual/pkg/client"
+	"github.com/lamassuiot/device-virtual/pkg/events"
+	"github.com/lamassuiot/device-virtual/pkg/health"
+	"github.com/lamassuiot/device-virtual/pkg/impairment"
+	"github.com/lamassuiot/device-virtual/pkg/recording"
+
 	"github.com/go-kit/kit/log"
 )
 
@@ -23,28 +29,66 @@ type loggingMidleware struct {
 	logger log.Logger
 }
 
-func (mw loggingMidleware) Health(ctx context.Context) (healthy bool) {
+func (mw loggingMidleware) Health(ctx context.Context) (report health.Report) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "Health",
 			"took", time.Since(begin),
-			"healthy", healthy,
+			"status", report.Status,
 		)
 	}(time.Now())
 	return mw.next.Health(ctx)
 }
 
-func (mw loggingMidleware) PostSendMessage(ctx context.Context, message string, topic string) (err error) {
+func (mw loggingMidleware) Readiness(ctx context.Context) (report health.Report) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Readiness",
+			"took", time.Since(begin),
+			"status", report.Status,
+		)
+	}(time.Now())
+	return mw.next.Readiness(ctx)
+}
+
+func (mw loggingMidleware) PostSendMessage(ctx context.Context, clientID string, message string, topic string) (err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "PostSendMessage",
+			"client_id", clientID,
 			"message", message,
 			"topic", topic,
 			"took", time.Since(begin),
 			"err", err,
 		)
 	}(time.Now())
-	return mw.next.PostSendMessage(ctx, message, topic)
+	return mw.next.PostSendMessage(ctx, clientID, message, topic)
+}
+
+func (mw loggingMidleware) PostSendMessages(ctx context.Context, clientID string, messages []BatchMessage, ordered bool) (results []BatchResult, err error) {
+	defer func(begin time.Time) {
+		failed, queued := 0, 0
+		for _, r := range results {
+			switch r.Status {
+			case BatchPublished:
+			case BatchQueued:
+				queued++
+			default:
+				failed++
+			}
+		}
+		mw.logger.Log(
+			"method", "PostSendMessages",
+			"client_id", clientID,
+			"messages", len(messages),
+			"ordered", ordered,
+			"queued", queued,
+			"failed", failed,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.PostSendMessages(ctx, clientID, messages, ordered)
 }
 
 func (mw loggingMidleware) PostConnect(ctx context.Context, authKey string, authCRT string, brokerURL string, clientID string) (err error) {
@@ -60,12 +104,161 @@ func (mw loggingMidleware) PostConnect(ctx context.Context, authKey string, auth
 	return mw.next.PostConnect(ctx, authKey, authCRT, brokerURL, clientID)
 }
 
-func (mw loggingMidleware) PostDisconnect(ctx context.Context) {
+func (mw loggingMidleware) PostDisconnect(ctx context.Context, clientID string) (err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "PostDisconnect",
+			"client_id", clientID,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.PostDisconnect(ctx, clientID)
+}
+
+func (mw loggingMidleware) SessionState(ctx context.Context, clientID string) (state SessionState, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "SessionState",
+			"client_id", clientID,
+			"state", state.State,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.SessionState(ctx, clientID)
+}
+
+func (mw loggingMidleware) PostCSR(ctx context.Context, clientID string, keyType string, commonName string) (csr string, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PostCSR",
+			"client_id", clientID,
+			"key_type", keyType,
+			"common_name", commonName,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.PostCSR(ctx, clientID, keyType, commonName)
+}
+
+func (mw loggingMidleware) PostCertificate(ctx context.Context, clientID string, crt string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PostCertificate",
+			"client_id", clientID,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.PostCertificate(ctx, clientID, crt)
+}
+
+func (mw loggingMidleware) PostImport(ctx context.Context, clientID string, bundle []byte, password string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PostImport",
+			"client_id", clientID,
+			"bundle_size", len(bundle),
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.PostImport(ctx, clientID, bundle, password)
+}
+
+func (mw loggingMidleware) PostExport(ctx context.Context, clientID string, password string) (bundle []byte, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PostExport",
+			"client_id", clientID,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.PostExport(ctx, clientID, password)
+}
+
+func (mw loggingMidleware) PostStartRecording(ctx context.Context, clientID string, name string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PostStartRecording",
+			"client_id", clientID,
+			"recording", name,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.PostStartRecording(ctx, clientID, name)
+}
+
+func (mw loggingMidleware) PostStopRecording(ctx context.Context, clientID string) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PostStopRecording",
+			"client_id", clientID,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.PostStopRecording(ctx, clientID)
+}
+
+func (mw loggingMidleware) PostReplay(ctx context.Context, clientID string, name string, opts recording.Options, substituteClientID bool) (report recording.Report, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PostReplay",
+			"client_id", clientID,
+			"recording", name,
+			"speed", opts.Speed,
+			"published", report.Published,
+			"failed", report.Failed,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.PostReplay(ctx, clientID, name, opts, substituteClientID)
+}
+
+func (mw loggingMidleware) PostNetwork(ctx context.Context, clientID string, profile *impairment.Profile, scenario string, reset bool) (status impairment.Status, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "PostNetwork",
+			"client_id", clientID,
+			"scenario", scenario,
+			"reset", reset,
+			"latency", status.Profile.Latency,
+			"bandwidth", status.Profile.Bandwidth,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.PostNetwork(ctx, clientID, profile, scenario, reset)
+}
+
+func (mw loggingMidleware) Subscribe(ctx context.Context, clientID string, topic string, qos int) (messages <-chan client.Message, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Subscribe",
+			"client_id", clientID,
+			"topic", topic,
+			"qos", qos,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.Subscribe(ctx, clientID, topic, qos)
+}
+
+func (mw loggingMidleware) Events(ctx context.Context, filter events.Filter) <-chan events.Event {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Events",
+			"client_ids", filter.ClientIDs,
+			"types", filter.Types,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	mw.next.PostDisconnect(ctx)
+	return mw.next.Events(ctx, filter)
 }
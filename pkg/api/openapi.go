@@ -0,0 +1,277 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lamassuiot/device-virtual/pkg/events"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+const openAPIVersion = "3.0.3"
+
+// operation documents one route of MakeHTTPHandler. The request and response
+// schemas are generated from the same types the decoders and endpoints use.
+type operation struct {
+	Method    string
+	Path      string
+	ID        string
+	Summary   string
+	Request   interface{}
+	Response  interface{}
+	Multipart bool
+	// Query lists the repeatable string query parameters of the operation.
+	Query []string
+	// Params lists the required string query parameters of the operation.
+	Params []string
+	// Stream operations answer with a stream of Server-Sent Events.
+	Stream bool
+	decode httptransport.DecodeRequestFunc
+}
+
+var operations = []operation{
+	{Method: "GET", Path: "/v1/health", ID: "Health", Summary: "Liveness report (alias of /v1/health/live)", Response: healthResponse{}, decode: decodeHealthRequest},
+	{Method: "GET", Path: "/v1/health/live", ID: "HealthLive", Summary: "Liveness report", Response: healthResponse{}, decode: decodeHealthRequest},
+	{Method: "GET", Path: "/v1/health/ready", ID: "HealthReady", Summary: "Readiness report", Response: healthResponse{}, decode: decodeHealthRequest},
+	{Method: "POST", Path: "/v1/device/connect", ID: "PostConnect", Summary: "Connect a device session to an MQTT broker", Request: postConnectRequest{}, Response: postConnectResponse{}, decode: decodePostConnectRequest},
+	{Method: "POST", Path: "/v1/device/disconnect", ID: "PostDisconnect", Summary: "Disconnect a device session", Request: postDisconnectRequest{}, Response: postDisconnectResponse{}, decode: decodePostDisconnectRequest},
+	{Method: "GET", Path: "/v1/device/state", ID: "SessionState", Summary: "Connection state of a device session and its recent transitions", Response: sessionStateResponse{}, Params: []string{"clientID"}, decode: decodeSessionStateRequest},
+	{Method: "POST", Path: "/v1/device/message", ID: "PostSendMessage", Summary: "Publish a message from a device session", Request: postSendMessageRequest{}, Response: postSendMessageResponse{}, decode: decodePostSendMessageRequest},
+	{Method: "POST", Path: "/v1/device/messages:batch", ID: "PostSendMessages", Summary: "Publish a batch of messages from a device session, optionally in order", Request: postSendMessagesRequest{}, Response: postSendMessagesResponse{}, decode: decodePostSendMessagesRequest},
+	{Method: "POST", Path: "/v1/device/csr", ID: "PostCSR", Summary: "Generate a device key and return a CSR signed by it", Request: postCSRRequest{}, Response: postCSRResponse{}, decode: decodePostCSRRequest},
+	{Method: "POST", Path: "/v1/device/certificate", ID: "PostCertificate", Summary: "Attach an issued certificate to a device identity", Request: postCertificateRequest{}, Response: postCertificateResponse{}, decode: decodePostCertificateRequest},
+	{Method: "POST", Path: "/v1/device/import", ID: "PostImport", Summary: "Import a PKCS#12 or PEM device identity", Request: postImportRequest{}, Response: postImportResponse{}, Multipart: true, decode: decodePostImportRequest},
+	{Method: "POST", Path: "/v1/device/export", ID: "PostExport", Summary: "Export a device identity as PKCS#12", Request: postExportRequest{}, Response: postExportResponse{}, decode: decodePostExportRequest},
+	{Method: "POST", Path: "/v1/device/recording/start", ID: "PostStartRecording", Summary: "Record the messages published and received by a device session", Request: postStartRecordingRequest{}, Response: postStartRecordingResponse{}, decode: decodePostStartRecordingRequest},
+	{Method: "POST", Path: "/v1/device/recording/stop", ID: "PostStopRecording", Summary: "Stop recording a device session", Request: postStopRecordingRequest{}, Response: postStopRecordingResponse{}, decode: decodePostStopRecordingRequest},
+	{Method: "POST", Path: "/v1/device/replay", ID: "PostReplay", Summary: "Publish the messages of a recording from a device session", Request: postReplayRequest{}, Response: postReplayResponse{}, decode: decodePostReplayRequest},
+	{Method: "POST", Path: "/v1/device/network", ID: "PostNetwork", Summary: "Impair the broker connections of a device session with a profile or a scenario", Request: postNetworkRequest{}, Response: postNetworkResponse{}, decode: decodePostNetworkRequest},
+	{Method: "GET", Path: "/v1/events", ID: "Events", Summary: "Stream device events as Server-Sent Events, or over a WebSocket on upgrade", Response: events.Event{}, Query: []string{"clientID", "type"}, Stream: true},
+	{Method: "GET", Path: "/v1/openapi.json", ID: "OpenAPI", Summary: "This document"},
+}
+
+// Schema is the subset of the OpenAPI schema object generated from Go types.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+}
+
+type openAPI struct {
+	OpenAPI    string                            `json:"openapi"`
+	Info       map[string]string                 `json:"info"`
+	Paths      map[string]map[string]interface{} `json:"paths"`
+	Components struct {
+		Schemas map[string]*Schema `json:"schemas"`
+	} `json:"components"`
+
+	// requests indexes the JSON request body schemas by method and path.
+	requests map[string]*Schema
+}
+
+// spec is built once from operations, it is both served and used to validate
+// incoming requests.
+var spec = newOpenAPI(operations)
+
+func newOpenAPI(ops []operation) *openAPI {
+	doc := &openAPI{
+		OpenAPI:  openAPIVersion,
+		Info:     map[string]string{"title": "Lamassu Device Virtual API", "version": "1"},
+		Paths:    make(map[string]map[string]interface{}),
+		requests: make(map[string]*Schema),
+	}
+	doc.Components.Schemas = map[string]*Schema{"Error": errorSchema()}
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content":     jsonContent(&Schema{Type: "object", Properties: map[string]*Schema{"error": {Ref: "#/components/schemas/Error"}}}),
+	}
+
+	for _, op := range ops {
+		o := map[string]interface{}{
+			"operationId": op.ID,
+			"summary":     op.Summary,
+			"responses": map[string]interface{}{
+				"200":     map[string]interface{}{"description": "OK"},
+				"default": errorResponse,
+			},
+		}
+		if op.Request != nil {
+			schema := doc.schemaOf(reflect.TypeOf(op.Request))
+			doc.requests[op.Method+" "+op.Path] = schema
+			content := jsonContent(schema)
+			if op.Multipart {
+				content["multipart/form-data"] = map[string]interface{}{"schema": importMultipartSchema()}
+			}
+			o["requestBody"] = map[string]interface{}{"required": true, "content": content}
+		}
+		var params []interface{}
+		for _, name := range op.Params {
+			params = append(params, map[string]interface{}{
+				"name":     name,
+				"in":       "query",
+				"required": true,
+				"schema":   &Schema{Type: "string"},
+			})
+		}
+		for _, name := range op.Query {
+			params = append(params, map[string]interface{}{
+				"name":    name,
+				"in":      "query",
+				"explode": true,
+				"schema":  &Schema{Type: "array", Items: &Schema{Type: "string"}},
+			})
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+		if op.Response != nil {
+			content := jsonContent(doc.schemaOf(reflect.TypeOf(op.Response)))
+			if op.Stream {
+				content = map[string]interface{}{"text/event-stream": content["application/json"]}
+			}
+			o["responses"].(map[string]interface{})["200"] = map[string]interface{}{
+				"description": "OK",
+				"content":     content,
+			}
+		}
+		if doc.Paths[op.Path] == nil {
+			doc.Paths[op.Path] = make(map[string]interface{})
+		}
+		doc.Paths[op.Path][strings.ToLower(op.Method)] = o
+	}
+	return doc
+}
+
+// schemaOf returns a reference to the component schema of a named struct, or
+// an inline schema for any other type.
+func (doc *openAPI) schemaOf(t reflect.Type) *Schema {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == errorType {
+		return &Schema{Ref: "#/components/schemas/Error"}
+	}
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+	if t.Kind() == reflect.Struct && t.Name() != "" {
+		name := componentName(t)
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			s := &Schema{Type: "object", Properties: map[string]*Schema{}, AdditionalProperties: new(bool)}
+			doc.Components.Schemas[name] = s
+			doc.addFields(s, t)
+			sort.Strings(s.Required)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: doc.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	default:
+		return &Schema{}
+	}
+}
+
+func (doc *openAPI) addFields(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			doc.addFields(s, f.Type)
+			continue
+		}
+		name, ok := jsonName(f)
+		if !ok {
+			continue
+		}
+		s.Properties[name] = doc.schemaOf(f.Type)
+		if f.Tag.Get("validate") == "required" {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+func jsonName(f reflect.StructField) (string, bool) {
+	if f.PkgPath != "" {
+		return "", false
+	}
+	tag := strings.Split(f.Tag.Get("json"), ",")[0]
+	if tag == "-" {
+		return "", false
+	}
+	if tag == "" {
+		return f.Name, true
+	}
+	return tag, true
+}
+
+func componentName(t reflect.Type) string {
+	r := []rune(t.Name())
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+var (
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	timeType  = reflect.TypeOf(time.Time{})
+)
+
+func errorSchema() *Schema {
+	return &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"code":    {Type: "string"},
+			"message": {Type: "string"},
+			"cause":   {Type: "string"},
+			"details": {Type: "array", Items: &Schema{Type: "string"}},
+		},
+		Required: []string{"code", "message"},
+	}
+}
+
+func importMultipartSchema() *Schema {
+	return &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"clientID": {Type: "string"},
+			"password": {Type: "string"},
+			"bundle":   {Type: "string", Format: "binary"},
+			"key":      {Type: "string", Format: "binary"},
+			"crt":      {Type: "string", Format: "binary"},
+		},
+		Required: []string{"clientID"},
+	}
+}
+
+func jsonContent(s *Schema) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": s}}
+}
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(spec)
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lamassuiot/device-virtual/pkg/auth"
+	"github.com/lamassuiot/device-virtual/pkg/events"
+	"github.com/lamassuiot/device-virtual/pkg/health"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	stdopentracing "github.com/opentracing/opentracing-go"
+)
+
+func TestOpenAPIRoutes(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	r := MakeHTTPHandler(srv, log.NewNopLogger(), stdopentracing.NoopTracer{}, auth.Anonymous()).(*mux.Router)
+
+	var routes []string
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		for _, m := range methods {
+			routes = append(routes, m+" "+path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to walk router: %s", err)
+	}
+
+	var documented []string
+	for path, ops := range spec.Paths {
+		for method := range ops {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(routes)
+	sort.Strings(documented)
+	if !reflect.DeepEqual(routes, documented) {
+		t.Errorf("Router and OpenAPI document differ\nrouter:  %v\ndocument: %v", routes, documented)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/v1/openapi.json", nil))
+	var doc struct {
+		OpenAPI string                            `json:"openapi"`
+		Paths   map[string]map[string]interface{} `json:"paths"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+		t.Fatalf("OpenAPI document is not JSON: %s", err)
+	}
+	if doc.OpenAPI != openAPIVersion || len(doc.Paths) != len(spec.Paths) {
+		t.Errorf("Served OpenAPI document does not match the generated one")
+	}
+}
+
+func TestOpenAPIDecoders(t *testing.T) {
+	for _, op := range operations {
+		if op.Request == nil {
+			continue
+		}
+		t.Run(fmt.Sprintf("Testing %s", op.ID), func(t *testing.T) {
+			schema := spec.requests[op.Method+" "+op.Path]
+			body := sample(spec, schema)
+			if problems := spec.validate(schema, body, ""); len(problems) > 0 {
+				t.Fatalf("Sample body does not validate: %v", problems)
+			}
+
+			data, _ := json.Marshal(body)
+			req := httptest.NewRequest(op.Method, op.Path, bytes.NewReader(data))
+			req.Header.Set("Content-Type", "application/json")
+			decoded, err := op.decode(context.Background(), req)
+			if err != nil {
+				t.Fatalf("Decoder rejects a body valid for the schema: %s", err)
+			}
+			if reflect.TypeOf(decoded) != reflect.TypeOf(op.Request) {
+				t.Errorf("Decoder returned %T; document describes %T", decoded, op.Request)
+			}
+
+			// Every documented field must reach the decoded request.
+			got, _ := json.Marshal(decoded)
+			var fields map[string]interface{}
+			json.Unmarshal(got, &fields)
+			for name := range body.(map[string]interface{}) {
+				if _, ok := fields[name]; !ok {
+					t.Errorf("Field %s is documented but not decoded", name)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	h := MakeHTTPHandler(srv, log.NewNopLogger(), stdopentracing.NoopTracer{}, auth.Anonymous())
+
+	testCases := []struct {
+		name    string
+		path    string
+		body    string
+		details []string
+	}{
+		{"Missing required fields", "/v1/device/connect", `{}`, []string{"brokerURL: is required", "clientID: is required"}},
+		{"Unknown field", "/v1/device/disconnect", `{"clientId": "lamassu-client"}`, []string{"clientId: unknown field"}},
+		{"Wrong type", "/v1/device/message", `{"topic": 1, "message": true}`, []string{"message: must be a string", "topic: must be a string"}},
+		{"Invalid base64", "/v1/device/import", `{"clientID": "lamassu-client", "bundle": "%%%"}`, []string{"bundle: must be base64 encoded"}},
+		{"Not an object", "/v1/device/csr", `[]`, []string{"body: must be an object"}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", tc.path, strings.NewReader(tc.body)))
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Got status code %d; want %d", w.Code, http.StatusBadRequest)
+			}
+			var body struct {
+				Error struct {
+					Code    ErrorCode `json:"code"`
+					Details []string  `json:"details"`
+				} `json:"error"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("Error response is not JSON: %s", err)
+			}
+			if body.Error.Code != CodeInvalidRequest {
+				t.Errorf("Got error code %s; want %s", body.Error.Code, CodeInvalidRequest)
+			}
+			if !reflect.DeepEqual(body.Error.Details, tc.details) {
+				t.Errorf("Got details %v; want %v", body.Error.Details, tc.details)
+			}
+		})
+	}
+}
+
+// sample builds a value that sets every property of s.
+func sample(doc *openAPI, s *Schema) interface{} {
+	if s.Ref != "" {
+		s = doc.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	switch s.Type {
+	case "object":
+		obj := make(map[string]interface{})
+		for name, prop := range s.Properties {
+			obj[name] = sample(doc, prop)
+		}
+		return obj
+	case "array":
+		return []interface{}{sample(doc, s.Items)}
+	case "string":
+		if s.Format == "byte" {
+			return "bGFtYXNzdQ=="
+		}
+		return "lamassu"
+	case "boolean":
+		return true
+	case "integer":
+		return json.Number("1")
+	case "number":
+		return json.Number("1.5")
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/client"
+	"github.com/lamassuiot/device-virtual/pkg/events"
+	"github.com/lamassuiot/device-virtual/pkg/queue"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// forwardTimeout bounds the publish of each queued message, as the broker may
+// drop the connection again while forwarding.
+const forwardTimeout = 30 * time.Second
+
+// forwardRetryDelay spaces the attempts to forward a message whose publish
+// failed while the session stayed connected, like on a slow link.
+var forwardRetryDelay = 5 * time.Second
+
+var (
+	ErrQueueOpen = &Error{Code: CodeInternal, Message: "unable to open offline queue"}
+	ErrQueue     = &Error{Code: CodePublishFailed, Message: "unable to queue message"}
+)
+
+// outbox is the offline queue of a device. It outlives the sessions of the
+// device, so that a new session forwards what the previous one queued. Its
+// mutex orders queueing and forwarding, device by device. A message published
+// but not removed from the queue, because its store failed, is pending
+// removal, so that it is not published again.
+type outbox struct {
+	mtx        sync.Mutex
+	queue      *queue.Queue
+	forwarding bool
+	pending    *uint64
+}
+
+// outbox returns the offline queue of clientID, opening it on first use. It
+// is nil when queueing is disabled. Callers hold s.mtx.
+func (s *deviceService) outbox(clientID string) (*outbox, error) {
+	if s.queues == nil {
+		return nil, nil
+	}
+	if o, ok := s.outboxes[clientID]; ok {
+		return o, nil
+	}
+	q, err := s.queues(clientID)
+	if err != nil {
+		return nil, ErrQueueOpen.wrap(err)
+	}
+	o := &outbox{queue: q}
+	s.outboxes[clientID] = o
+	return o, nil
+}
+
+// send publishes m with publish, or queues it while the session reconnects,
+// and reports the outcome as published does. It reports whether m was queued.
+func (s *deviceService) send(sess *session, m queue.Message, publish func() error) (bool, error) {
+	queued, err := s.hold(sess, m)
+	if !queued {
+		err = publish()
+		// The connection may be lost while publishing.
+		if errors.Is(err, client.ErrNotConnected) && sess.client.State() == client.StateReconnecting {
+			queued, err = s.hold(sess, m)
+		}
+	}
+	if !queued {
+		return false, s.published(sess, m.Topic, string(m.Payload), m.QoS, m.Retained, err)
+	}
+
+	if err != nil {
+		s.events.Publish(events.Event{Type: events.MessagePublishFailed, ClientID: sess.clientID, Topic: m.Topic, Message: string(m.Payload), Error: err.Error()})
+		return true, ErrQueue.wrap(err)
+	}
+	s.events.Publish(events.Event{Type: events.MessageQueued, ClientID: sess.clientID, Topic: m.Topic, Message: string(m.Payload)})
+	return true, nil
+}
+
+// hold queues m if the session is reconnecting, or if messages queued before
+// are still to be forwarded, so that the broker receives them in order.
+func (s *deviceService) hold(sess *session, m queue.Message) (bool, error) {
+	o := sess.outbox
+	if o == nil {
+		return false, nil
+	}
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	switch sess.client.State() {
+	case client.StateReconnecting:
+	case client.StateConnected:
+		if !o.forwarding && o.queue.Len() == 0 {
+			return false, nil
+		}
+	default:
+		return false, nil
+	}
+	_, err := o.queue.Push(m)
+	return true, err
+}
+
+// forwardStep is the outcome of forwarding a message.
+type forwardStep int
+
+const (
+	forwardNext forwardStep = iota
+	forwardLater
+	forwardStop
+)
+
+// forward publishes the messages queued for clientID in order, through its
+// current session, until the queue is empty, the connection is lost again or
+// the service shuts down. Messages are only dropped once published, or when
+// the broker definitively rejects them, which is reported as it would be if
+// published live. Other failures are retried.
+func (s *deviceService) forward(clientID string) {
+	s.mtx.RLock()
+	o := s.outboxes[clientID]
+	s.mtx.RUnlock()
+	if o == nil {
+		return
+	}
+	o.mtx.Lock()
+	if o.forwarding {
+		o.mtx.Unlock()
+		return
+	}
+	o.forwarding = true
+	o.mtx.Unlock()
+
+	for {
+		switch s.forwardOne(clientID, o) {
+		case forwardStop:
+			return
+		case forwardLater:
+			t := time.NewTimer(forwardRetryDelay)
+			select {
+			case <-t.C:
+			case <-s.stopping:
+				t.Stop()
+				o.mtx.Lock()
+				o.forwarding = false
+				o.mtx.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// forwardOne forwards the oldest message of o. Forwarding stops with the
+// queue found empty under the mutex of o, so that hold never queues a message
+// that nobody forwards.
+func (s *deviceService) forwardOne(clientID string, o *outbox) forwardStep {
+	stop := func() forwardStep {
+		o.mtx.Lock()
+		o.forwarding = false
+		o.mtx.Unlock()
+		return forwardStop
+	}
+
+	done, err := s.enter()
+	if err != nil {
+		return stop()
+	}
+	defer done()
+
+	sess, err := s.session(clientID)
+	if err != nil || sess.client.State() != client.StateConnected {
+		return stop()
+	}
+
+	o.mtx.Lock()
+	if o.pending != nil {
+		if err := o.queue.Remove(*o.pending); err != nil {
+			o.mtx.Unlock()
+			return s.storeFailed(clientID, o, err)
+		}
+		o.pending = nil
+	}
+	m, ok, err := o.queue.Front()
+	if err != nil {
+		o.mtx.Unlock()
+		return s.storeFailed(clientID, o, err)
+	}
+	if !ok {
+		o.forwarding = false
+		o.mtx.Unlock()
+		return forwardStop
+	}
+	o.mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	err = sess.client.Publish(ctx, m.Topic, m.Payload, m.QoS, m.Retained)
+	cancel()
+	if err != nil && !errors.Is(err, client.ErrPublishRejected) {
+		// Kept for the next attempt, or the next reconnection.
+		if sess.client.State() != client.StateConnected {
+			return stop()
+		}
+		return forwardLater
+	}
+	o.mtx.Lock()
+	removeErr := o.queue.Remove(m.Seq)
+	more := removeErr == nil && o.queue.Len() > 0
+	if removeErr != nil {
+		o.pending = &m.Seq
+	} else {
+		o.forwarding = more
+	}
+	o.mtx.Unlock()
+	s.published(sess, m.Topic, string(m.Payload), m.QoS, m.Retained, err)
+	if removeErr != nil {
+		return s.storeFailed(clientID, o, removeErr)
+	}
+	if !more {
+		return forwardStop
+	}
+	return forwardNext
+}
+
+// storeFailed logs a failure of the queue store of clientID and retries later,
+// still forwarding, so that hold keeps queueing behind the messages left.
+// Closed queues are not retried, the service is stopping.
+func (s *deviceService) storeFailed(clientID string, o *outbox, err error) forwardStep {
+	if errors.Is(err, queue.ErrClosed) {
+		o.mtx.Lock()
+		o.forwarding = false
+		o.mtx.Unlock()
+		return forwardStop
+	}
+	level.Error(s.logger).Log("err", err, "client_id", clientID, "msg", "Offline queue store failed, retrying")
+	return forwardLater
+}
+
+// closeOutboxes closes the offline queues once the sessions are disconnected.
+// Persistent queues keep their messages for the next run.
+func (s *deviceService) closeOutboxes() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, o := range s.outboxes {
+		o.mtx.Lock()
+		o.queue.Close()
+		o.mtx.Unlock()
+	}
+	s.outboxes = make(map[string]*outbox)
+}
@@ -0,0 +1,384 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/client"
+	"github.com/lamassuiot/device-virtual/pkg/events"
+	"github.com/lamassuiot/device-virtual/pkg/health"
+	"github.com/lamassuiot/device-virtual/pkg/impairment"
+	"github.com/lamassuiot/device-virtual/pkg/recording"
+
+	"github.com/go-kit/kit/metrics"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	rateLimitRateHeader  = "X-Rate-Limit-Rate"
+	rateLimitBurstHeader = "X-Rate-Limit-Burst"
+)
+
+var (
+	ErrRateLimited      = &Error{Code: CodeRateLimited, Message: "too many messages, retry later"}
+	ErrRateLimitInvalid = &Error{Code: CodeInvalidRequest, Message: "invalid rate limit override"}
+	ErrBurstExceeded    = &Error{Code: CodeInvalidRequest, Message: "batch larger than the rate limit burst"}
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second and
+// holding up to Burst tokens. A zero rate does not limit anything.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) limiter() *rate.Limiter {
+	if l.Rate <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(l.Rate), l.burst())
+}
+
+// burst defaults to a second worth of tokens.
+func (l RateLimit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return int(math.Max(1, math.Ceil(l.Rate)))
+}
+
+// cost is the number of tokens of a bucket limited by l that n messages take
+// under the override o, if any. A lower override rate makes each message
+// take proportionally more tokens, up to a full bucket, so that the requests
+// carrying it slow down to its rate. Higher override rates do not lower the
+// cost.
+func (l RateLimit) cost(n int, o *RateLimit) int {
+	if o == nil || l.Rate <= 0 || o.Rate >= l.Rate {
+		return n
+	}
+	return max(n, min(int(math.Ceil(float64(n)*l.Rate/o.Rate)), l.burst()))
+}
+
+// RateLimits bounds the messages published by all the sessions together and
+// by each of them.
+type RateLimits struct {
+	Global  RateLimit
+	Session RateLimit
+}
+
+// RateLimitingMiddleware rejects publishes over the limits with
+// ErrRateLimited, and batches that can never fit in a bucket with
+// ErrBurstExceeded. A request can lower the limit of its session for itself
+// through the X-Rate-Limit-Rate and X-Rate-Limit-Burst headers, or gRPC
+// metadata.
+func RateLimitingMiddleware(limits RateLimits, throttled metrics.Counter) Middleware {
+	return func(next Service) Service {
+		return &rateLimitingMiddleware{
+			next:      next,
+			throttled: throttled,
+			now:       time.Now,
+			limits:    limits,
+			global:    limits.Global.limiter(),
+			sessions:  make(map[string]*rate.Limiter),
+		}
+	}
+}
+
+// RateLimitSetter is implemented by the services returned by
+// RateLimitingMiddleware, whose limits can be replaced while they run.
+type RateLimitSetter interface {
+	SetRateLimits(limits RateLimits)
+}
+
+// rateLimitingMiddleware keeps a bucket per live session, under the client
+// ID of the session rather than the one of the request, which may be empty.
+type rateLimitingMiddleware struct {
+	next      Service
+	throttled metrics.Counter
+	now       func() time.Time
+	mtx       sync.Mutex
+	limits    RateLimits
+	global    *rate.Limiter
+	sessions  map[string]*rate.Limiter
+}
+
+// SetRateLimits replaces the limits. The buckets start full again.
+func (mw *rateLimitingMiddleware) SetRateLimits(limits RateLimits) {
+	mw.mtx.Lock()
+	defer mw.mtx.Unlock()
+	mw.limits = limits
+	mw.global = limits.Global.limiter()
+	mw.sessions = make(map[string]*rate.Limiter)
+}
+
+// buckets returns the session and global buckets of the session of clientID,
+// and the limit of the session bucket.
+func (mw *rateLimitingMiddleware) buckets(ctx context.Context, clientID string) (*rate.Limiter, *rate.Limiter, RateLimit, error) {
+	state, err := mw.next.SessionState(ctx, clientID)
+	if err != nil {
+		return nil, nil, RateLimit{}, err
+	}
+
+	mw.mtx.Lock()
+	defer mw.mtx.Unlock()
+	l, ok := mw.sessions[state.ClientID]
+	if !ok {
+		l = mw.limits.Session.limiter()
+		mw.sessions[state.ClientID] = l
+	}
+	return l, mw.global, mw.limits.Session, nil
+}
+
+// forget drops the bucket of a session once it ends.
+func (mw *rateLimitingMiddleware) forget(clientID string) {
+	mw.mtx.Lock()
+	defer mw.mtx.Unlock()
+	delete(mw.sessions, clientID)
+}
+
+// exceeds reports whether n messages can never fit in bucket.
+func exceeds(bucket *rate.Limiter, n int) bool {
+	return bucket.Limit() != rate.Inf && n > bucket.Burst()
+}
+
+// allow takes n messages worth of tokens from the session and global
+// buckets, or none of them when either would have to wait. The override of
+// the request, if any, only applies to it.
+func (mw *rateLimitingMiddleware) allow(ctx context.Context, method string, clientID string, n int) error {
+	override, err := rateLimitFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	session, global, limit, err := mw.buckets(ctx, clientID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case override != nil && n > override.burst():
+		return ErrBurstExceeded.wrap(fmt.Errorf("%d messages, the request burst is %d", n, override.burst()))
+	case exceeds(session, n):
+		return ErrBurstExceeded.wrap(fmt.Errorf("%d messages, the session burst is %d", n, session.Burst()))
+	case exceeds(global, n):
+		return ErrBurstExceeded.wrap(fmt.Errorf("%d messages, the global burst is %d", n, global.Burst()))
+	}
+
+	now := mw.now()
+	sr := session.ReserveN(now, limit.cost(n, override))
+	if delay := sr.DelayFrom(now); delay > 0 {
+		sr.CancelAt(now)
+		return mw.reject(method, "session", delay)
+	}
+	gr := global.ReserveN(now, n)
+	if delay := gr.DelayFrom(now); delay > 0 {
+		gr.CancelAt(now)
+		sr.CancelAt(now)
+		return mw.reject(method, "global", delay)
+	}
+	return nil
+}
+
+// wait takes a message worth of tokens from the session and global buckets,
+// waiting for them to refill if needed, until ctx is done.
+func (mw *rateLimitingMiddleware) wait(ctx context.Context, clientID string) error {
+	override, err := rateLimitFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	session, global, limit, err := mw.buckets(ctx, clientID)
+	if err != nil {
+		return err
+	}
+
+	now := mw.now()
+	sr := session.ReserveN(now, limit.cost(1, override))
+	gr := global.ReserveN(now, 1)
+	delay := max(sr.DelayFrom(now), gr.DelayFrom(now))
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		sr.CancelAt(now)
+		gr.CancelAt(now)
+		return ctx.Err()
+	}
+}
+
+func (mw *rateLimitingMiddleware) reject(method string, scope string, retryAfter time.Duration) error {
+	mw.throttled.With("method", method, "scope", scope).Add(1)
+	e := ErrRateLimited.wrap(nil)
+	e.RetryAfter = retryAfter
+	return e
+}
+
+func (mw *rateLimitingMiddleware) Health(ctx context.Context) health.Report {
+	return mw.next.Health(ctx)
+}
+
+func (mw *rateLimitingMiddleware) Readiness(ctx context.Context) health.Report {
+	return mw.next.Readiness(ctx)
+}
+
+func (mw *rateLimitingMiddleware) PostSendMessage(ctx context.Context, clientID string, message string, topic string) error {
+	if err := mw.allow(ctx, "PostSendMessage", clientID, 1); err != nil {
+		return err
+	}
+	return mw.next.PostSendMessage(ctx, clientID, message, topic)
+}
+
+// PostSendMessages takes a token per message of the batch, so batches larger
+// than the burst of a bucket are rejected as invalid, as they never fit.
+func (mw *rateLimitingMiddleware) PostSendMessages(ctx context.Context, clientID string, messages []BatchMessage, ordered bool) ([]BatchResult, error) {
+	if err := mw.allow(ctx, "PostSendMessages", clientID, len(messages)); err != nil {
+		return nil, err
+	}
+	return mw.next.PostSendMessages(ctx, clientID, messages, ordered)
+}
+
+// PostConnect gives the new session a full bucket, rather than the one of
+// the session it replaces.
+func (mw *rateLimitingMiddleware) PostConnect(ctx context.Context, authKey string, authCRT string, brokerURL string, clientID string) error {
+	if err := mw.next.PostConnect(ctx, authKey, authCRT, brokerURL, clientID); err != nil {
+		return err
+	}
+	mw.forget(clientID)
+	return nil
+}
+
+func (mw *rateLimitingMiddleware) PostDisconnect(ctx context.Context, clientID string) error {
+	state, err := mw.next.SessionState(ctx, clientID)
+	if err != nil {
+		return mw.next.PostDisconnect(ctx, clientID)
+	}
+	err = mw.next.PostDisconnect(ctx, state.ClientID)
+	if err == nil {
+		mw.forget(state.ClientID)
+	}
+	return err
+}
+
+func (mw *rateLimitingMiddleware) SessionState(ctx context.Context, clientID string) (SessionState, error) {
+	return mw.next.SessionState(ctx, clientID)
+}
+
+func (mw *rateLimitingMiddleware) PostCSR(ctx context.Context, clientID string, keyType string, commonName string) (string, error) {
+	return mw.next.PostCSR(ctx, clientID, keyType, commonName)
+}
+
+func (mw *rateLimitingMiddleware) PostCertificate(ctx context.Context, clientID string, crt string) error {
+	return mw.next.PostCertificate(ctx, clientID, crt)
+}
+
+func (mw *rateLimitingMiddleware) PostImport(ctx context.Context, clientID string, bundle []byte, password string) error {
+	return mw.next.PostImport(ctx, clientID, bundle, password)
+}
+
+func (mw *rateLimitingMiddleware) PostExport(ctx context.Context, clientID string, password string) ([]byte, error) {
+	return mw.next.PostExport(ctx, clientID, password)
+}
+
+func (mw *rateLimitingMiddleware) PostStartRecording(ctx context.Context, clientID string, name string) error {
+	return mw.next.PostStartRecording(ctx, clientID, name)
+}
+
+func (mw *rateLimitingMiddleware) PostStopRecording(ctx context.Context, clientID string) error {
+	return mw.next.PostStopRecording(ctx, clientID)
+}
+
+// PostReplay takes a token per replayed message, waiting for the buckets to
+// refill rather than failing, so that fast replays slow down to the limits.
+func (mw *rateLimitingMiddleware) PostReplay(ctx context.Context, clientID string, name string, opts recording.Options, substituteClientID bool) (recording.Report, error) {
+	ctx = context.WithValue(ctx, replayLimitContextKey{}, func(ctx context.Context) error {
+		return mw.wait(ctx, clientID)
+	})
+	return mw.next.PostReplay(ctx, clientID, name, opts, substituteClientID)
+}
+
+func (mw *rateLimitingMiddleware) PostNetwork(ctx context.Context, clientID string, profile *impairment.Profile, scenario string, reset bool) (impairment.Status, error) {
+	return mw.next.PostNetwork(ctx, clientID, profile, scenario, reset)
+}
+
+func (mw *rateLimitingMiddleware) Subscribe(ctx context.Context, clientID string, topic string, qos int) (<-chan client.Message, error) {
+	return mw.next.Subscribe(ctx, clientID, topic, qos)
+}
+
+func (mw *rateLimitingMiddleware) Events(ctx context.Context, filter events.Filter) <-chan events.Event {
+	return mw.next.Events(ctx, filter)
+}
+
+type rateLimitContextKey struct{}
+
+type rateLimitOverride struct {
+	limit *RateLimit
+	err   error
+}
+
+// rateLimitHTTPToContext stores the rate limit override of a request, if
+// any, in its context.
+func rateLimitHTTPToContext(ctx context.Context, r *http.Request) context.Context {
+	return rateLimitToContext(ctx, r.Header.Get(rateLimitRateHeader), r.Header.Get(rateLimitBurstHeader))
+}
+
+// rateLimitGRPCToContext is rateLimitHTTPToContext for gRPC metadata.
+func rateLimitGRPCToContext(ctx context.Context, md metadata.MD) context.Context {
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	return rateLimitToContext(ctx, first(rateLimitRateHeader), first(rateLimitBurstHeader))
+}
+
+func rateLimitToContext(ctx context.Context, rateValue string, burstValue string) context.Context {
+	if rateValue == "" && burstValue == "" {
+		return ctx
+	}
+	l, err := parseRateLimit(rateValue, burstValue)
+	if err != nil {
+		return context.WithValue(ctx, rateLimitContextKey{}, rateLimitOverride{err: err})
+	}
+	return context.WithValue(ctx, rateLimitContextKey{}, rateLimitOverride{limit: &l})
+}
+
+func parseRateLimit(rateValue string, burstValue string) (RateLimit, error) {
+	var l RateLimit
+	var err error
+	l.Rate, err = strconv.ParseFloat(rateValue, 64)
+	if err != nil || l.Rate <= 0 || math.IsNaN(l.Rate) || math.IsInf(l.Rate, 0) {
+		return RateLimit{}, ErrRateLimitInvalid.wrap(fmt.Errorf("%s must be a positive number of messages per second", rateLimitRateHeader))
+	}
+	if burstValue != "" {
+		l.Burst, err = strconv.Atoi(burstValue)
+		if err != nil || l.Burst <= 0 {
+			return RateLimit{}, ErrRateLimitInvalid.wrap(fmt.Errorf("%s must be a positive number of messages", rateLimitBurstHeader))
+		}
+	}
+	return l, nil
+}
+
+func rateLimitFromContext(ctx context.Context) (*RateLimit, error) {
+	o, _ := ctx.Value(rateLimitContextKey{}).(rateLimitOverride)
+	return o.limit, o.err
+}
+
+type replayLimitContextKey struct{}
+
+// waitReplayLimit waits until the rate limits allow a replayed message, when
+// the service is rate limited.
+func waitReplayLimit(ctx context.Context) error {
+	if wait, ok := ctx.Value(replayLimitContextKey{}).(func(context.Context) error); ok {
+		return wait(ctx)
+	}
+	return nil
+}
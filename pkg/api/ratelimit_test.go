@@ -0,0 +1,250 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/auth"
+	"github.com/lamassuiot/device-virtual/pkg/events"
+	"github.com/lamassuiot/device-virtual/pkg/health"
+	"github.com/lamassuiot/device-virtual/pkg/mocks"
+	"github.com/lamassuiot/device-virtual/pkg/recording"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	stdopentracing "github.com/opentracing/opentracing-go"
+)
+
+// throttledCounter counts throttled calls by scope.
+type throttledCounter struct {
+	counts map[string]float64
+	lvs    []string
+}
+
+func (c *throttledCounter) With(labelValues ...string) metrics.Counter {
+	return &throttledCounter{counts: c.counts, lvs: labelValues}
+}
+
+func (c *throttledCounter) Add(delta float64) {
+	c.counts[c.lvs[3]] += delta
+}
+
+func TestRateLimiting(t *testing.T) {
+	stu := setup(t)
+	stu.client.(*mocks.MockClient).SendMessageFn = func(ctx context.Context, message string, topic string) error { return nil }
+	counter := &throttledCounter{counts: make(map[string]float64)}
+	limits := RateLimits{
+		Global:  RateLimit{Rate: 1, Burst: 4},
+		Session: RateLimit{Rate: 1, Burst: 2},
+	}
+	srv := RateLimitingMiddleware(limits, counter)(NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus()))
+	now := time.Now()
+	srv.(*rateLimitingMiddleware).now = func() time.Time { return now }
+	stu.connect(t, srv, "lamassu-client")
+	stu.connect(t, srv, "other-client")
+	stu.connect(t, srv, "third-client")
+	ctx := context.Background()
+
+	testCases := []struct {
+		name     string
+		ctx      context.Context
+		clientID string
+		ret      error
+	}{
+		{"Within session burst", ctx, "lamassu-client", nil},
+		{"Session burst exhausted", ctx, "lamassu-client", nil},
+		{"Over session limit", ctx, "lamassu-client", ErrRateLimited},
+		{"Other session", ctx, "other-client", nil},
+		{"Global burst exhausted", ctx, "other-client", nil},
+		{"Over global limit", ctx, "third-client", ErrRateLimited},
+		{"Invalid override", rateLimitToContext(ctx, "fast", ""), "third-client", ErrRateLimitInvalid},
+		{"Unlimited override", rateLimitToContext(ctx, "0", ""), "third-client", ErrRateLimitInvalid},
+		{"Unknown session", ctx, "unknown-client", ErrNotConnected},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			err := srv.PostSendMessage(tc.ctx, tc.clientID, "this is a message", "lamassu-sample")
+			if !errors.Is(err, tc.ret) {
+				t.Fatalf("Got result is %v; want %v", err, tc.ret)
+			}
+			if tc.ret == ErrRateLimited && toError(err).RetryAfter != time.Second {
+				t.Errorf("Got retry after %s; want %s", toError(err).RetryAfter, time.Second)
+			}
+		})
+	}
+
+	if counter.counts["session"] != 1 || counter.counts["global"] != 1 {
+		t.Errorf("Got throttled counts %v; want one per scope", counter.counts)
+	}
+
+	now = now.Add(time.Second)
+	if err := srv.PostSendMessage(ctx, "lamassu-client", "this is a message", "lamassu-sample"); err != nil {
+		t.Errorf("Bucket not refilled after a second: %s", err)
+	}
+
+	batch := make([]BatchMessage, limits.Session.Burst+1)
+	if _, err := srv.PostSendMessages(ctx, "lamassu-client", batch, false); !errors.Is(err, ErrBurstExceeded) {
+		t.Errorf("Got result is %v for a batch over the session burst; want %v", err, ErrBurstExceeded)
+	}
+	if counter.counts["session"] != 1 {
+		t.Errorf("Got %v session throttled calls; want the batch over the burst not counted", counter.counts["session"])
+	}
+}
+
+func TestRateLimitOverride(t *testing.T) {
+	stu := setup(t)
+	stu.client.(*mocks.MockClient).SendMessageFn = func(ctx context.Context, message string, topic string) error { return nil }
+	stu.client.(*mocks.MockClient).PublishFn = func(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error { return nil }
+	srv := RateLimitingMiddleware(RateLimits{Session: RateLimit{Rate: 1, Burst: 2}}, &throttledCounter{counts: make(map[string]float64)})(NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus()))
+	now := time.Now()
+	srv.(*rateLimitingMiddleware).now = func() time.Time { return now }
+	stu.connect(t, srv, "lamassu-client")
+	ctx := context.Background()
+
+	testCases := []struct {
+		name     string
+		ctx      context.Context
+		messages int
+		ret      error
+	}{
+		{"Higher override", rateLimitToContext(ctx, "100", "10"), 1, nil},
+		{"Lower override", rateLimitToContext(ctx, "0.5", ""), 1, ErrRateLimited},
+		{"Override not kept", ctx, 1, nil},
+		{"Batch over override burst", rateLimitToContext(ctx, "100", "1"), 2, ErrBurstExceeded},
+		{"Session burst exhausted", ctx, 1, ErrRateLimited},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			batch := make([]BatchMessage, tc.messages)
+			for i := range batch {
+				batch[i] = BatchMessage{Topic: "lamassu-sample", Payload: "this is a message"}
+			}
+			_, err := srv.PostSendMessages(tc.ctx, "lamassu-client", batch, false)
+			if !errors.Is(err, tc.ret) {
+				t.Errorf("Got result is %v; want %v", err, tc.ret)
+			}
+		})
+	}
+
+	// A lower override takes a full bucket per message here.
+	now = now.Add(2 * time.Second)
+	lower := rateLimitToContext(ctx, "0.5", "1")
+	if err := srv.PostSendMessage(lower, "", "this is a message", "lamassu-sample"); err != nil {
+		t.Fatalf("Unable to send with a lower override: %s", err)
+	}
+	if err := srv.PostSendMessage(ctx, "lamassu-client", "this is a message", "lamassu-sample"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Got result is %v after a lower override; want %v", err, ErrRateLimited)
+	}
+
+	mw := srv.(*rateLimitingMiddleware)
+	stu.client.(*mocks.MockClient).DisconnectFn = func(ctx context.Context) {}
+	if err := srv.PostDisconnect(ctx, ""); err != nil {
+		t.Fatalf("Unable to disconnect: %s", err)
+	}
+	if len(mw.sessions) != 0 {
+		t.Errorf("Got %d buckets after disconnecting; want none", len(mw.sessions))
+	}
+}
+
+func TestSetRateLimits(t *testing.T) {
+	stu := setup(t)
+	stu.client.(*mocks.MockClient).SendMessageFn = func(ctx context.Context, message string, topic string) error { return nil }
+	srv := RateLimitingMiddleware(RateLimits{Session: RateLimit{Rate: 1, Burst: 1}}, &throttledCounter{counts: make(map[string]float64)})(NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus()))
+	now := time.Now()
+	srv.(*rateLimitingMiddleware).now = func() time.Time { return now }
+	stu.connect(t, srv, "lamassu-client")
+	stu.connect(t, srv, "other-client")
+	ctx := context.Background()
+
+	send := func(ctx context.Context, clientID string) error {
+		return srv.PostSendMessage(ctx, clientID, "this is a message", "lamassu-sample")
+	}
+	send(ctx, "lamassu-client")
+	send(ctx, "other-client")
+	srv.(RateLimitSetter).SetRateLimits(RateLimits{Session: RateLimit{Rate: 10, Burst: 10}})
+
+	testCases := []struct {
+		name     string
+		clientID string
+		ret      error
+	}{
+		{"New limits", "lamassu-client", nil},
+		{"Within new burst", "lamassu-client", nil},
+		{"Other session refilled", "other-client", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			if err := send(ctx, tc.clientID); !errors.Is(err, tc.ret) {
+				t.Errorf("Got result is %v; want %v", err, tc.ret)
+			}
+		})
+	}
+}
+
+func TestReplayRateLimited(t *testing.T) {
+	stu := setup(t)
+	stu.client.(*mocks.MockClient).PublishFn = func(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error { return nil }
+	recordings := recording.NewStore(t.TempDir())
+	r, err := recordings.Create("lamassu-sample")
+	if err != nil {
+		t.Fatalf("Unable to create recording: %s", err)
+	}
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		r.Record(recording.Record{Time: start.Add(time.Duration(i) * time.Millisecond), Direction: recording.Published, Topic: "lamassu-sample", Payload: []byte("hello")})
+	}
+	r.Close()
+
+	limits := RateLimits{Session: RateLimit{Rate: 20, Burst: 1}}
+	srv := RateLimitingMiddleware(limits, &throttledCounter{counts: make(map[string]float64)})(NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus(), WithRecordings(recordings)))
+	stu.connect(t, srv, "lamassu-client")
+
+	begin := time.Now()
+	report, err := srv.PostReplay(context.Background(), "lamassu-client", "lamassu-sample", recording.Options{Speed: 1000}, false)
+	if err != nil {
+		t.Fatalf("Unable to replay: %s", err)
+	}
+	if report.Published != 4 {
+		t.Errorf("Got %d messages published; want 4", report.Published)
+	}
+	if took, want := time.Since(begin), 150*time.Millisecond; took < want {
+		t.Errorf("Replay took %s; want at least %s at 20 messages per second", took, want)
+	}
+}
+
+func TestHTTPRateLimited(t *testing.T) {
+	stu := setup(t)
+	stu.client.(*mocks.MockClient).SendMessageFn = func(ctx context.Context, message string, topic string) error { return nil }
+	limits := RateLimits{Session: RateLimit{Rate: 0.5, Burst: 1}}
+	srv := RateLimitingMiddleware(limits, &throttledCounter{counts: make(map[string]float64)})(NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus()))
+	stu.connect(t, srv, "lamassu-client")
+	h := MakeHTTPHandler(srv, log.NewNopLogger(), stdopentracing.NoopTracer{}, auth.Anonymous())
+
+	body := `{"clientID": "lamassu-client", "topic": "lamassu-sample", "message": "hello"}`
+	testCases := []struct {
+		name       string
+		status     int
+		retryAfter string
+	}{
+		{"First message", http.StatusOK, ""},
+		{"Second message", http.StatusTooManyRequests, "2"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/device/message", strings.NewReader(body)))
+			if w.Code != tc.status {
+				t.Errorf("Got status code %d; want %d", w.Code, tc.status)
+			}
+			if got := w.Header().Get("Retry-After"); got != tc.retryAfter {
+				t.Errorf("Got Retry-After %q; want %q", got, tc.retryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"context"
+
+	"github.com/lamassuiot/device-virtual/pkg/client"
+	"github.com/lamassuiot/device-virtual/pkg/queue"
+	"github.com/lamassuiot/device-virtual/pkg/recording"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrRecordingDisabled = &Error{Code: CodeRecordingDisabled, Message: "traffic recording is disabled"}
+	ErrRecordingActive   = &Error{Code: CodeRecordingConflict, Message: "session is already being recorded"}
+	ErrRecordingInactive = &Error{Code: CodeRecordingConflict, Message: "session is not being recorded"}
+	ErrReplayCanceled    = &Error{Code: CodePublishFailed, Message: "replay canceled before publishing every record"}
+)
+
+// PostStartRecording records every message published and received by a
+// session under name, until the recording is stopped or the session ends.
+func (s *deviceService) PostStartRecording(ctx context.Context, clientID string, name string) error {
+	if s.recordings == nil {
+		return ErrRecordingDisabled
+	}
+
+	done, err := s.enter()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	sess, err := s.session(clientID)
+	if err != nil {
+		return err
+	}
+
+	// Check first to avoid leaving an empty recording behind, starting it
+	// checks again for concurrent requests.
+	if sess.recording() {
+		return ErrRecordingActive
+	}
+	r, err := s.recordings.Create(name)
+	if err != nil {
+		return err
+	}
+	err = sess.startRecording(r)
+	if err != nil {
+		r.Close()
+	}
+	if errors.Is(err, client.ErrNotConnected) {
+		return ErrNotConnected
+	}
+	return err
+}
+
+func (s *deviceService) PostStopRecording(ctx context.Context, clientID string) error {
+	if s.recordings == nil {
+		return ErrRecordingDisabled
+	}
+
+	sess, err := s.session(clientID)
+	if err != nil {
+		return err
+	}
+	return sess.stopRecording()
+}
+
+// PostReplay publishes the messages of a recording from a session. With
+// substituteClientID, the recorded client ID is replaced by the one of the
+// session in topics and payloads. The replay stops early when ctx is done, the
+// session ends or the service shuts down.
+func (s *deviceService) PostReplay(ctx context.Context, clientID string, name string, opts recording.Options, substituteClientID bool) (recording.Report, error) {
+	if s.recordings == nil {
+		return recording.Report{}, ErrRecordingDisabled
+	}
+
+	done, err := s.enter()
+	if err != nil {
+		return recording.Report{}, err
+	}
+	defer done()
+
+	sess, err := s.session(clientID)
+	if err != nil {
+		return recording.Report{}, err
+	}
+	if substituteClientID {
+		opts.ClientID = sess.clientID
+	}
+	replayer, err := recording.NewReplayer(opts)
+	if err != nil {
+		return recording.Report{}, err
+	}
+	records, err := s.recordings.Open(name)
+	if err != nil {
+		return recording.Report{}, err
+	}
+
+	paced, cancel := until(ctx, s.stopping)
+	defer cancel()
+	go func() {
+		select {
+		case <-paced.Done():
+		case <-sess.done:
+			cancel()
+		}
+	}()
+
+	// Publishes in flight are not cut by a shutdown, which waits for them.
+	report, err := replayer.Replay(paced, records, func(rec recording.Record) error {
+		if err := waitReplayLimit(paced); err != nil {
+			return err
+		}
+		_, err := s.send(sess, queue.Message{Topic: rec.Topic, Payload: rec.Payload, QoS: rec.QoS, Retained: rec.Retained}, func() error {
+			return sess.client.Publish(ctx, rec.Topic, rec.Payload, rec.QoS, rec.Retained)
+		})
+		return err
+	})
+	if err != nil {
+		return report, ErrReplayCanceled.wrap(err)
+	}
+	return report, nil
+}
@@ -5,61 +5,249 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"io/ioutil"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/lamassuiot/device-virtual/pkg/client"
+	"github.com/lamassuiot/device-virtual/pkg/discovery"
+	"github.com/lamassuiot/device-virtual/pkg/events"
+	"github.com/lamassuiot/device-virtual/pkg/health"
+	"github.com/lamassuiot/device-virtual/pkg/identity"
+	"github.com/lamassuiot/device-virtual/pkg/impairment"
+	"github.com/lamassuiot/device-virtual/pkg/queue"
+	"github.com/lamassuiot/device-virtual/pkg/recording"
 
+	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
 
 const (
 	certificatePEMBlockType = "CERTIFICATE"
+
+	tlsAlertCertificateExpired tls.AlertError = 45
 )
 
 type Service interface {
-	Health(ctx context.Context) bool
-	PostSendMessage(ctx context.Context, message string, topic string) error
+	Health(ctx context.Context) health.Report
+	Readiness(ctx context.Context) health.Report
+	PostSendMessage(ctx context.Context, clientID string, message string, topic string) error
+	PostSendMessages(ctx context.Context, clientID string, messages []BatchMessage, ordered bool) ([]BatchResult, error)
 	PostConnect(ctx context.Context, authKey string, authCRT string, brokerURL string, clientID string) error
-	PostDisconnect(ctx context.Context)
+	PostDisconnect(ctx context.Context, clientID string) error
+	SessionState(ctx context.Context, clientID string) (SessionState, error)
+	PostCSR(ctx context.Context, clientID string, keyType string, commonName string) (string, error)
+	PostCertificate(ctx context.Context, clientID string, crt string) error
+	PostImport(ctx context.Context, clientID string, bundle []byte, password string) error
+	PostExport(ctx context.Context, clientID string, password string) ([]byte, error)
+	PostStartRecording(ctx context.Context, clientID string, name string) error
+	PostStopRecording(ctx context.Context, clientID string) error
+	PostReplay(ctx context.Context, clientID string, name string, opts recording.Options, substituteClientID bool) (recording.Report, error)
+	PostNetwork(ctx context.Context, clientID string, profile *impairment.Profile, scenario string, reset bool) (impairment.Status, error)
+	Subscribe(ctx context.Context, clientID string, topic string, qos int) (<-chan client.Message, error)
+	Events(ctx context.Context, filter events.Filter) <-chan events.Event
 }
 
 type deviceService struct {
-	mtx    sync.RWMutex
-	client client.Client
-	CAPath string
+	mtx        sync.RWMutex
+	clients    client.Factory
+	sessions   map[string]*session
+	backend    identity.Backend
+	identities map[string]*identity.Identity
+	health     *health.Health
+	events     *events.Bus
+	recordings *recording.Store
+	devices    discovery.Devices
+	queues     queue.Opener
+	outboxes   map[string]*outbox
+	scenarios  *impairment.Store
+	logger     log.Logger
+	CAPath     string
+
+	draining bool
+	inflight sync.WaitGroup
+	stopping chan struct{}
+	closed   chan struct{}
+}
+
+// Option enables an optional feature of the device service.
+type Option func(*deviceService)
+
+// WithRecordings records the traffic of sessions in recordings.
+func WithRecordings(recordings *recording.Store) Option {
+	return func(s *deviceService) { s.recordings = recordings }
+}
+
+// WithDeviceRegistry registers the live sessions in devices.
+func WithDeviceRegistry(devices discovery.Devices) Option {
+	return func(s *deviceService) { s.devices = devices }
+}
+
+// WithOfflineQueue queues publishes while sessions reconnect, in the queues
+// opened by queues.
+func WithOfflineQueue(queues queue.Opener) Option {
+	return func(s *deviceService) { s.queues = queues }
 }
 
-func NewDeviceService(CAPath string, client client.Client) Service {
-	return &deviceService{CAPath: CAPath, client: client}
+// WithScenarios reads network impairment scenarios from scenarios.
+func WithScenarios(scenarios *impairment.Store) Option {
+	return func(s *deviceService) { s.scenarios = scenarios }
+}
+
+// WithLogger logs the failures of background work, like forwarding queued
+// messages, with logger.
+func WithLogger(logger log.Logger) Option {
+	return func(s *deviceService) { s.logger = logger }
+}
+
+// NewDeviceService creates the device service. Traffic recording, device
+// registration, offline queueing and impairment scenarios are disabled
+// unless enabled by opts.
+func NewDeviceService(CAPath string, clients client.Factory, backend identity.Backend, h *health.Health, bus *events.Bus, opts ...Option) Service {
+	s := &deviceService{
+		CAPath:     CAPath,
+		clients:    clients,
+		sessions:   make(map[string]*session),
+		backend:    backend,
+		identities: make(map[string]*identity.Identity),
+		health:     h,
+		events:     bus,
+		outboxes:   make(map[string]*outbox),
+		logger:     log.NewNopLogger(),
+		stopping:   make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	h.AddReadinessCheck("sessions", s.sessionsCheck)
+	return s
 }
 
 var (
-	ErrSendMessage    = errors.New("error sending message")
-	ErrDeviceAuth     = errors.New("error authenticating device")
-	ErrCACertLoading  = errors.New("unable to read CA certificate")
-	ErrTLSConfLoading = errors.New("unable to read client TLS configuration")
-	ErrBrokerURLEmpty = errors.New("invalid empty broker URL")
-	ErrClientIDEmpty  = errors.New("invalid empty client ID")
-	ErrTopicEmpty     = errors.New("invalid empty topic")
+	ErrSendMessage    = &Error{Code: CodePublishFailed, Message: "error sending message"}
+	ErrNotConnected   = &Error{Code: CodeNotConnected, Message: "device is not connected to an MQTT broker"}
+	ErrDeviceAuth     = &Error{Code: CodeBrokerRefused, Message: "error authenticating device"}
+	ErrBrokerReach    = &Error{Code: CodeBrokerUnreachable, Message: "unable to reach MQTT broker"}
+	ErrTLSHandshake   = &Error{Code: CodeTLSHandshakeFailed, Message: "TLS handshake with MQTT broker failed"}
+	ErrCertExpired    = &Error{Code: CodeCertExpired, Message: "certificate has expired"}
+	ErrCACertLoading  = &Error{Code: CodeInternal, Message: "unable to read CA certificate"}
+	ErrTLSConfLoading = &Error{Code: CodeInvalidCredentials, Message: "unable to read client TLS configuration"}
+	ErrBrokerURLEmpty = &Error{Code: CodeInvalidRequest, Message: "invalid empty broker URL"}
+	ErrClientIDEmpty  = &Error{Code: CodeInvalidRequest, Message: "invalid empty client ID"}
+	ErrTopicEmpty     = &Error{Code: CodeInvalidRequest, Message: "invalid empty topic"}
+	ErrKeyGeneration  = &Error{Code: CodeInternal, Message: "unable to generate device key"}
+	ErrCSRCreation    = &Error{Code: CodeInternal, Message: "unable to create certificate signing request"}
+	ErrIdentityEmpty  = &Error{Code: CodeIdentityNotFound, Message: "no device identity enrolled for client ID"}
+	ErrBundleEmpty    = &Error{Code: CodeInvalidRequest, Message: "invalid empty credentials bundle"}
+	ErrQoSInvalid     = &Error{Code: CodeInvalidRequest, Message: "invalid QoS, must be 0, 1 or 2"}
+	ErrSubscribe      = &Error{Code: CodeSubscribeFailed, Message: "error subscribing to topic"}
 )
 
-func (s *deviceService) Health(ctx context.Context) bool {
-	return true
+func (s *deviceService) Health(ctx context.Context) health.Report {
+	return s.health.Live(ctx)
+}
+
+func (s *deviceService) Readiness(ctx context.Context) health.Report {
+	return s.health.Ready(ctx)
+}
+
+// sessionsCheck reports the live sessions and warns about those that lost
+// their broker connection. It fails once the service is shutting down.
+func (s *deviceService) sessionsCheck(ctx context.Context) health.Check {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.draining {
+		return health.Check{Status: health.StatusFail, Message: "shutting down"}
+	}
+
+	var unreachable []string
+	for clientID, sess := range s.sessions {
+		if !sess.client.IsConnected() {
+			unreachable = append(unreachable, clientID)
+		}
+	}
+	sort.Strings(unreachable)
+
+	c := health.Check{
+		Status: health.StatusPass,
+		Details: map[string]interface{}{
+			"active":      len(s.sessions),
+			"unreachable": unreachable,
+		},
+	}
+	if len(unreachable) > 0 {
+		c.Status = health.StatusWarn
+		c.Message = "some sessions lost their broker connection"
+	}
+	return c
+}
+
+// session returns the live session of clientID. When clientID is empty and
+// only one session is live, that session is used.
+func (s *deviceService) session(clientID string) (*session, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if clientID == "" && len(s.sessions) == 1 {
+		for _, sess := range s.sessions {
+			return sess, nil
+		}
+	}
+	sess, ok := s.sessions[clientID]
+	if !ok {
+		return nil, ErrNotConnected
+	}
+	return sess, nil
 }
 
-func (s *deviceService) PostSendMessage(ctx context.Context, message string, topic string) error {
+func (s *deviceService) PostSendMessage(ctx context.Context, clientID string, message string, topic string) error {
 	if topic == "" {
 		return ErrTopicEmpty
 	}
 
-	err := s.client.SendMessage(message, topic)
+	done, err := s.enter()
 	if err != nil {
-		return ErrSendMessage
+		return err
 	}
+	defer done()
+
+	sess, err := s.session(clientID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.send(sess, queue.Message{Topic: topic, Payload: []byte(message)}, func() error {
+		return sess.client.SendMessage(ctx, message, topic)
+	})
+	return err
+}
+
+// published reports the outcome of a publish as an event, records it and
+// converts the client error, if any, into an API error.
+func (s *deviceService) published(sess *session, topic string, message string, qos byte, retained bool, err error) error {
+	if err != nil {
+		s.events.Publish(events.Event{Type: events.MessagePublishFailed, ClientID: sess.clientID, Topic: topic, Message: message, Error: err.Error()})
+	}
+	if errors.Is(err, client.ErrNotConnected) {
+		return ErrNotConnected
+	} else if err != nil {
+		return ErrSendMessage.wrap(err)
+	}
+	s.events.Publish(events.Event{Type: events.MessagePublished, ClientID: sess.clientID, Topic: topic, Message: message})
+	sess.record(recording.Record{
+		Time:      time.Now(),
+		Direction: recording.Published,
+		Topic:     topic,
+		Payload:   []byte(message),
+		QoS:       qos,
+		Retained:  retained,
+	})
 	return nil
 }
 
-func (s *deviceService) PostConnect(ctx context.Context, authKey string, authCRT string, brokerURL string, clientID string) error {
+func (s *deviceService) PostConnect(ctx context.Context, authKey string, authCRT string, brokerURL string, clientID string) (err error) {
 	if brokerURL == "" {
 		return ErrBrokerURLEmpty
 	}
@@ -68,31 +256,285 @@ func (s *deviceService) PostConnect(ctx context.Context, authKey string, authCRT
 		return ErrClientIDEmpty
 	}
 
-	conf, err := newTLSConfig(s.CAPath, authKey, authCRT)
+	done, err := s.enter()
 	if err != nil {
 		return err
 	}
+	defer done()
+
+	defer func() {
+		if err != nil {
+			s.events.Publish(events.Event{Type: events.SessionConnectFailed, ClientID: clientID, Error: err.Error()})
+		}
+	}()
+
+	var cert tls.Certificate
+	if authKey == "" && authCRT == "" {
+		s.mtx.RLock()
+		id, ok := s.identities[clientID]
+		s.mtx.RUnlock()
+		if !ok || id.Certificate == nil {
+			return ErrIdentityEmpty
+		}
+		cert = id.TLSCertificate()
+	} else {
+		cert, err = tls.X509KeyPair([]byte(authCRT), []byte(authKey))
+		if err != nil {
+			return ErrTLSConfLoading.wrap(err)
+		}
+	}
 
-	err = s.client.Connect(brokerURL, clientID, conf)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
-		return ErrDeviceAuth
+		return ErrTLSConfLoading.wrap(err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return ErrCertExpired.wrap(errors.New("device certificate expired at " + leaf.NotAfter.Format(time.RFC3339)))
+	}
+
+	conf, err := newTLSConfig(s.CAPath, cert)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	o, err := s.outbox(clientID)
+	s.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	c := s.clients()
+	c.OnStateChange(func(t client.Transition) {
+		s.events.Publish(events.Event{Type: events.SessionStateChanged, ClientID: clientID, Time: t.Time, State: string(t.State), Error: t.Error})
+		if o != nil && t.State == client.StateConnected && t.Attempt > 0 {
+			go s.forward(clientID)
+		}
+	})
+	// The shaper impairs the connections of the session, reconnections
+	// included, and starts unimpaired.
+	shaper := impairment.NewShaper()
+	err = c.Connect(impairment.NewContext(ctx, shaper), brokerURL, clientID, conf)
+	if err != nil {
+		return connectError(err)
+	}
+
+	s.mtx.Lock()
+	previous := s.sessions[clientID]
+	s.sessions[clientID] = newSession(clientID, brokerURL, c, leaf, s.events, o, shaper)
+	s.mtx.Unlock()
+
+	if previous != nil {
+		previous.close()
+		previous.client.Disconnect(ctx)
+	}
+	if s.devices != nil {
+		s.devices.Register(discovery.Device{
+			ClientID:     clientID,
+			Broker:       brokerURL,
+			SerialNumber: leaf.SerialNumber.String(),
+			Connected:    c.IsConnected,
+		})
+	}
+	s.events.Publish(events.Event{Type: events.SessionConnected, ClientID: clientID, Certificate: certificateEvent(leaf)})
+	if o != nil && o.queue.Len() > 0 {
+		go s.forward(clientID)
 	}
 	return nil
 }
 
-func (s *deviceService) PostDisconnect(ctx context.Context) {
-	s.client.Disconnect()
+// connectError classifies a failed broker connection. Expired certificates
+// are reported whether it is the broker or the device certificate that expired.
+func connectError(err error) error {
+	var certErr x509.CertificateInvalidError
+	if errors.As(err, &certErr) && certErr.Reason == x509.Expired {
+		return ErrCertExpired.wrap(err)
+	}
+	var alert tls.AlertError
+	if errors.As(err, &alert) && alert == tlsAlertCertificateExpired {
+		return ErrCertExpired.wrap(err)
+	}
+	switch {
+	case errors.Is(err, client.ErrBrokerUnreachable):
+		return ErrBrokerReach.wrap(err)
+	case errors.Is(err, client.ErrTLSHandshake):
+		return ErrTLSHandshake.wrap(err)
+	default:
+		return ErrDeviceAuth.wrap(err)
+	}
 }
 
-func newTLSConfig(CAPath string, authKey string, authCRT string) (*tls.Config, error) {
-	caCertPool, err := createCACertPool(CAPath)
+func (s *deviceService) PostDisconnect(ctx context.Context, clientID string) error {
+	sess, err := s.session(clientID)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	if s.sessions[sess.clientID] == sess {
+		delete(s.sessions, sess.clientID)
+	}
+	s.mtx.Unlock()
+
+	s.disconnect(ctx, sess)
+	return nil
+}
+
+// SessionState reports the state of the broker connection of a session,
+// which reconnects on its own when the broker drops it.
+func (s *deviceService) SessionState(ctx context.Context, clientID string) (SessionState, error) {
+	sess, err := s.session(clientID)
+	if err != nil {
+		return SessionState{}, err
+	}
+	return sess.state(), nil
+}
+
+func (s *deviceService) PostCSR(ctx context.Context, clientID string, keyType string, commonName string) (string, error) {
+	if clientID == "" {
+		return "", ErrClientIDEmpty
+	}
+	if keyType == "" {
+		keyType = string(identity.KeyTypeRSA2048)
+	}
+	if commonName == "" {
+		commonName = clientID
+	}
+
+	id, err := identity.New(s.backend, clientID, identity.KeyType(keyType))
+	if err == identity.ErrKeyTypeUnsupported {
+		return "", err
+	} else if err != nil {
+		return "", ErrKeyGeneration.wrap(err)
+	}
+
+	csr, err := id.CSR(commonName)
+	if err != nil {
+		return "", ErrCSRCreation.wrap(err)
+	}
+
+	s.mtx.Lock()
+	s.identities[clientID] = id
+	s.mtx.Unlock()
+	s.events.Publish(events.Event{Type: events.CertificateRequested, ClientID: clientID})
+	return csr, nil
+}
+
+func (s *deviceService) PostCertificate(ctx context.Context, clientID string, crt string) error {
+	if clientID == "" {
+		return ErrClientIDEmpty
+	}
+
+	s.mtx.Lock()
+	id, ok := s.identities[clientID]
+	if !ok {
+		s.mtx.Unlock()
+		return ErrIdentityEmpty
+	}
+	if err := id.SetCertificate(crt); err != nil {
+		s.mtx.Unlock()
+		return err
+	}
+	installed := certificateEvent(id.Certificate)
+	s.mtx.Unlock()
+	s.events.Publish(events.Event{Type: events.CertificateInstalled, ClientID: clientID, Certificate: installed})
+	return nil
+}
+
+func (s *deviceService) PostImport(ctx context.Context, clientID string, bundle []byte, password string) error {
+	if clientID == "" {
+		return ErrClientIDEmpty
+	}
+	if len(bundle) == 0 {
+		return ErrBundleEmpty
+	}
+
+	id, err := identity.Import(clientID, bundle, password)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	s.identities[clientID] = id
+	s.mtx.Unlock()
+	s.events.Publish(events.Event{Type: events.CertificateImported, ClientID: clientID, Certificate: certificateEvent(id.Certificate)})
+	return nil
+}
+
+func (s *deviceService) PostExport(ctx context.Context, clientID string, password string) ([]byte, error) {
+	if clientID == "" {
+		return nil, ErrClientIDEmpty
+	}
+
+	s.mtx.RLock()
+	id, ok := s.identities[clientID]
+	s.mtx.RUnlock()
+	if !ok || id.Certificate == nil {
+		return nil, ErrIdentityEmpty
+	}
+	return id.PKCS12(password)
+}
+
+// Subscribe streams the messages received by a session on topic until ctx is
+// done or the session ends, when the returned channel is closed. Subscribers
+// that do not keep up lose messages rather than stalling the session.
+func (s *deviceService) Subscribe(ctx context.Context, clientID string, topic string, qos int) (<-chan client.Message, error) {
+	if topic == "" {
+		return nil, ErrTopicEmpty
+	}
+	if qos < 0 || qos > 2 {
+		return nil, ErrQoSInvalid
+	}
+
+	done, err := s.enter()
 	if err != nil {
 		return nil, err
 	}
+	defer done()
 
-	cert, err := tls.X509KeyPair([]byte(authCRT), []byte(authKey))
+	sess, err := s.session(clientID)
 	if err != nil {
-		return nil, ErrTLSConfLoading
+		return nil, err
+	}
+
+	ch, err := sess.subscribe(ctx, topic, byte(qos))
+	if errors.Is(err, client.ErrNotConnected) {
+		return nil, ErrNotConnected
+	} else if err != nil {
+		return nil, ErrSubscribe.wrap(err)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-sess.done:
+		}
+		// Unsubscribe within the trace of the request it outlives.
+		sess.unsubscribe(context.WithoutCancel(ctx), topic, ch)
+	}()
+	return ch, nil
+}
+
+// Events streams the events matching filter until ctx is done or the service
+// is shut down.
+func (s *deviceService) Events(ctx context.Context, filter events.Filter) <-chan events.Event {
+	// The stream context ends with ctx at the latest, no need to cancel it.
+	ctx, _ = until(ctx, s.closed)
+	return s.events.Listen(ctx, filter)
+}
+
+func certificateEvent(c *x509.Certificate) *events.Certificate {
+	return &events.Certificate{
+		Subject:      c.Subject.String(),
+		SerialNumber: c.SerialNumber.String(),
+		NotAfter:     c.NotAfter,
+	}
+}
+
+func newTLSConfig(CAPath string, cert tls.Certificate) (*tls.Config, error) {
+	caCertPool, err := createCACertPool(CAPath)
+	if err != nil {
+		return nil, err
 	}
 
 	conf := &tls.Config{
@@ -109,7 +551,7 @@ func newTLSConfig(CAPath string, authKey string, authCRT string) (*tls.Config, e
 func createCACertPool(CAPath string) (*x509.CertPool, error) {
 	caCert, err := ioutil.ReadFile(CAPath)
 	if err != nil {
-		return nil, ErrCACertLoading
+		return nil, ErrCACertLoading.wrap(err)
 	}
 
 	caCertPool := x509.NewCertPool()
@@ -2,99 +2,1158 @@ package api
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/lamassuiot/device-virtual/pkg/client"
 	"github.com/lamassuiot/device-virtual/pkg/configs"
+	"github.com/lamassuiot/device-virtual/pkg/discovery"
+	"github.com/lamassuiot/device-virtual/pkg/events"
+	"github.com/lamassuiot/device-virtual/pkg/health"
+	"github.com/lamassuiot/device-virtual/pkg/identity"
+	"github.com/lamassuiot/device-virtual/pkg/identity/identitytest"
+	"github.com/lamassuiot/device-virtual/pkg/identity/software"
+	"github.com/lamassuiot/device-virtual/pkg/impairment"
 	"github.com/lamassuiot/device-virtual/pkg/mocks"
+	"github.com/lamassuiot/device-virtual/pkg/queue"
+	"github.com/lamassuiot/device-virtual/pkg/queue/memory"
+	"github.com/lamassuiot/device-virtual/pkg/recording"
+
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 type serviceSetUp struct {
-	client client.Client
-	CAPath string
+	client  client.Client
+	clients client.Factory
+	backend identity.Backend
+	ca      *identitytest.CA
+	CAPath  string
 }
 
 func TestPostConnect(t *testing.T) {
 	stu := setup(t)
-	srv := NewDeviceService(stu.CAPath, stu.client)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
 	ctx := context.Background()
 
-	stu.client.(*mocks.MockClient).ConnectFn = func(URL string, clientID string, conf *tls.Config) error {
+	stu.client.(*mocks.MockClient).ConnectFn = func(ctx context.Context, URL string, clientID string, conf *tls.Config) error {
 		return nil
 	}
 
-	validKey, err := ioutil.ReadFile("testdata/valid.key")
-	if err != nil {
-		t.Fatal("Unable to read valid key")
-	}
-	validCert, err := ioutil.ReadFile("testdata/valid.crt")
-	if err != nil {
-		t.Fatal("Unable to read valid certificate")
-	}
+	validKey, validCert := stu.keyPair(t, identity.KeyTypeRSA2048)
 
-	testCases := []struct {
+	type testCase struct {
 		name      string
 		authKey   string
 		authCRT   string
 		brokerURL string
 		clientID  string
 		ret       error
-	}{
-		{"Authentication key invalid", "thisIsNotAKey", string(validCert), "ssl://mosquitto:1883", "lamassu-client", ErrTLSConfLoading},
-		{"Authentication certificate invalid", string(validKey), "thisIsNotACert", "ssl://mosquitto:1883", "lamassu-client", ErrTLSConfLoading},
-		{"Broker URL empty", string(validKey), string(validCert), "", "lamassu-client", ErrBrokerURLEmpty},
-		{"ClientID empty", string(validKey), string(validCert), "ssl://mosquitto:1883", "", ErrClientIDEmpty},
-		{"Valid request", string(validKey), string(validCert), "ssl://mosquitto:1883", "lamassu-client", nil},
+	}
+	testCases := []testCase{
+		{"Authentication key invalid", "thisIsNotAKey", validCert, "ssl://mosquitto:1883", "lamassu-client", ErrTLSConfLoading},
+		{"Authentication certificate invalid", validKey, "thisIsNotACert", "ssl://mosquitto:1883", "lamassu-client", ErrTLSConfLoading},
+		{"Broker URL empty", validKey, validCert, "", "lamassu-client", ErrBrokerURLEmpty},
+		{"ClientID empty", validKey, validCert, "ssl://mosquitto:1883", "", ErrClientIDEmpty},
+		{"Certificate expired", validKey, stu.expiredCert(t, validKey), "ssl://mosquitto:1883", "lamassu-client", ErrCertExpired},
+	}
+	for _, keyType := range identity.KeyTypes {
+		key, cert := stu.keyPair(t, keyType)
+		testCases = append(testCases, testCase{"Valid " + string(keyType) + " request", key, cert, "ssl://mosquitto:1883", "lamassu-client", nil})
 	}
 	for _, tc := range testCases {
 		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
 			err := srv.PostConnect(ctx, tc.authKey, tc.authCRT, tc.brokerURL, tc.clientID)
-			if tc.ret != err {
+			if !errors.Is(err, tc.ret) {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+		})
+	}
+}
+
+func TestPostConnectErrors(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	ctx := context.Background()
+	validKey, validCert := stu.keyPair(t, identity.KeyTypeECDSAP256)
+
+	testCases := []struct {
+		name   string
+		cause  error
+		ret    error
+		status int
+	}{
+		{"Broker unreachable", fmt.Errorf("%w: dial tcp: connection refused", client.ErrBrokerUnreachable), ErrBrokerReach, http.StatusBadGateway},
+		{"TLS handshake failed", fmt.Errorf("%w: %w", client.ErrTLSHandshake, x509.UnknownAuthorityError{}), ErrTLSHandshake, http.StatusBadGateway},
+		{"Broker certificate expired", fmt.Errorf("%w: %w", client.ErrTLSHandshake, x509.CertificateInvalidError{Reason: x509.Expired}), ErrCertExpired, http.StatusUnprocessableEntity},
+		{"Device certificate expired", fmt.Errorf("%w: %w", client.ErrTLSHandshake, tls.AlertError(45)), ErrCertExpired, http.StatusUnprocessableEntity},
+		{"Connection refused", fmt.Errorf("%w: not Authorized", client.ErrConnectRefused), ErrDeviceAuth, http.StatusBadGateway},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			stu.client.(*mocks.MockClient).ConnectFn = func(ctx context.Context, URL string, clientID string, conf *tls.Config) error {
+				return tc.cause
+			}
+			err := srv.PostConnect(ctx, validKey, validCert, "ssl://mosquitto:1883", "lamassu-client")
+			if !errors.Is(err, tc.ret) {
 				t.Errorf("Got result is %s; want %s", err, tc.ret)
 			}
+			if !errors.Is(err, tc.cause) {
+				t.Errorf("Error %s does not keep its cause", err)
+			}
+			if status := toError(err).StatusCode(); status != tc.status {
+				t.Errorf("Got status code %d; want %d", status, tc.status)
+			}
 		})
 	}
 }
 
 func TestPostSendMessage(t *testing.T) {
 	stu := setup(t)
-	srv := NewDeviceService(stu.CAPath, stu.client)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	ctx := context.Background()
+
+	stu.client.(*mocks.MockClient).SendMessageFn = func(ctx context.Context, message string, topic string) error {
+		if topic == "lamassu-offline" {
+			return client.ErrNotConnected
+		}
+		return nil
+	}
+	stu.connect(t, srv, "lamassu-client")
+
+	testCases := []struct {
+		name     string
+		clientID string
+		message  string
+		topic    string
+		ret      error
+	}{
+		{"Topic empty", "lamassu-client", "this is a message", "", ErrTopicEmpty},
+		{"Unknown session", "unknown-client", "this is a message", "lamassu-sample", ErrNotConnected},
+		{"Broker connection lost", "lamassu-client", "this is a message", "lamassu-offline", ErrNotConnected},
+		{"Correct topic", "lamassu-client", "this is a message", "lamassu-sample", nil},
+		{"Only session", "", "this is a message", "lamassu-sample", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			err := srv.PostSendMessage(ctx, tc.clientID, tc.message, tc.topic)
+			if !errors.Is(err, tc.ret) {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+		})
+	}
+}
+
+func TestPostSendMessages(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	ctx := context.Background()
+
+	var published []string
+	stu.client.(*mocks.MockClient).PublishFn = func(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error {
+		if topic == "lamassu-denied" {
+			return errors.New("not authorized")
+		}
+		published = append(published, topic)
+		return nil
+	}
+	stu.connect(t, srv, "lamassu-client")
+
+	msg := func(topic string) BatchMessage {
+		return BatchMessage{Topic: topic, Payload: "this is a message", QoS: 1}
+	}
+
+	testCases := []struct {
+		name     string
+		clientID string
+		messages []BatchMessage
+		ordered  bool
+		ret      error
+		statuses []BatchStatus
+	}{
+		{"Batch empty", "lamassu-client", nil, false, ErrBatchEmpty, nil},
+		{"Batch too large", "lamassu-client", make([]BatchMessage, maxBatchSize+1), false, ErrBatchTooLarge, nil},
+		{"Invalid message", "lamassu-client", []BatchMessage{msg("lamassu-sample"), {QoS: 3, Delay: -time.Second}}, false, ErrBatchInvalid, nil},
+		{"Unknown session", "unknown-client", []BatchMessage{msg("lamassu-sample")}, false, ErrNotConnected, nil},
+		{"Unordered", "lamassu-client", []BatchMessage{msg("lamassu-sample"), msg("lamassu-denied"), msg("lamassu-other")}, false, nil,
+			[]BatchStatus{BatchPublished, BatchFailed, BatchPublished}},
+		{"Ordered", "lamassu-client", []BatchMessage{msg("lamassu-sample"), msg("lamassu-denied"), msg("lamassu-other")}, true, nil,
+			[]BatchStatus{BatchPublished, BatchFailed, BatchSkipped}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			results, err := srv.PostSendMessages(ctx, tc.clientID, tc.messages, tc.ordered)
+			if !errors.Is(err, tc.ret) {
+				t.Fatalf("Got result is %s; want %s", err, tc.ret)
+			}
+			if len(results) != len(tc.statuses) {
+				t.Fatalf("Got %d results; want %d", len(results), len(tc.statuses))
+			}
+			for i, r := range results {
+				if r.Index != i || r.Status != tc.statuses[i] {
+					t.Errorf("Got result %d with status %s; want %s", r.Index, r.Status, tc.statuses[i])
+				}
+				if (r.Err == nil) != (r.Status == BatchPublished) {
+					t.Errorf("Got result %d with status %s and error %v", r.Index, r.Status, r.Err)
+				}
+			}
+		})
+	}
+
+	t.Run("Testing Invalid message details", func(t *testing.T) {
+		_, err := srv.PostSendMessages(ctx, "lamassu-client", []BatchMessage{msg("lamassu-sample"), {QoS: 3}}, false)
+		want := []string{"messages[1].topic: must not be empty", "messages[1].qos: must be 0, 1 or 2"}
+		if e := toError(err); fmt.Sprint(e.Details) != fmt.Sprint(want) {
+			t.Errorf("Got details %q; want %q", e.Details, want)
+		}
+	})
+
+	t.Run("Testing Ordered delays", func(t *testing.T) {
+		published = nil
+		messages := []BatchMessage{msg("lamassu-first"), msg("lamassu-second")}
+		messages[0].Delay = 20 * time.Millisecond
+		begin := time.Now()
+		if _, err := srv.PostSendMessages(ctx, "lamassu-client", messages, true); err != nil {
+			t.Fatalf("Unable to publish batch: %s", err)
+		}
+		if took := time.Since(begin); took < messages[0].Delay {
+			t.Errorf("Batch took %s; want at least %s", took, messages[0].Delay)
+		}
+		if fmt.Sprint(published) != "[lamassu-first lamassu-second]" {
+			t.Errorf("Got messages published in order %v", published)
+		}
+	})
+
+	t.Run("Testing Canceled", func(t *testing.T) {
+		cancelCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		messages := []BatchMessage{msg("lamassu-sample")}
+		messages[0].Delay = time.Minute
+		results, err := srv.PostSendMessages(cancelCtx, "lamassu-client", messages, false)
+		if err != nil {
+			t.Fatalf("Unable to publish batch: %s", err)
+		}
+		if r := results[0]; r.Status != BatchSkipped || !errors.Is(r.Err, ErrBatchCanceled) {
+			t.Errorf("Got status %s and error %v; want %s and %s", r.Status, r.Err, BatchSkipped, ErrBatchCanceled)
+		}
+	})
+}
+
+func TestRecording(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus(), WithRecordings(recording.NewStore(t.TempDir())))
+	ctx := context.Background()
+
+	var handler client.MessageHandler
+	var published []string
+	mc := stu.client.(*mocks.MockClient)
+	mc.SendMessageFn = func(ctx context.Context, message string, topic string) error { return nil }
+	mc.SubscribeFn = func(ctx context.Context, topic string, qos byte, h client.MessageHandler) error {
+		handler = h
+		return nil
+	}
+	mc.UnsubscribeFn = func(ctx context.Context, topic string) error { return nil }
+	mc.PublishFn = func(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error {
+		published = append(published, topic+" "+string(payload))
+		return nil
+	}
+	stu.connect(t, srv, "real-device")
+
+	testCases := []struct {
+		name     string
+		clientID string
+		start    string
+		ret      error
+	}{
+		{"Unknown session", "unknown-client", "lamassu-sample", ErrNotConnected},
+		{"Invalid name", "real-device", "../lamassu-sample", recording.ErrNameInvalid},
+		{"Start", "real-device", "lamassu-sample", nil},
+		{"Already recording", "real-device", "lamassu-other", ErrRecordingActive},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			err := srv.PostStartRecording(ctx, tc.clientID, tc.start)
+			if !errors.Is(err, tc.ret) {
+				t.Errorf("Got result is %v; want %v", err, tc.ret)
+			}
+		})
+	}
+
+	if err := srv.PostSendMessage(ctx, "real-device", "hello from real-device", "devices/real-device/telemetry"); err != nil {
+		t.Fatalf("Unable to send message: %s", err)
+	}
+	if _, err := srv.Subscribe(ctx, "real-device", "devices/real-device/commands", 1); err != nil {
+		t.Fatalf("Unable to subscribe: %s", err)
+	}
+	handler(client.Message{Topic: "devices/real-device/commands", Payload: []byte("reboot"), ReceivedAt: time.Now()})
+	if err := srv.PostStopRecording(ctx, "real-device"); err != nil {
+		t.Fatalf("Unable to stop recording: %s", err)
+	}
+	if err := srv.PostStopRecording(ctx, "real-device"); !errors.Is(err, ErrRecordingInactive) {
+		t.Errorf("Got result is %v when not recording; want %v", err, ErrRecordingInactive)
+	}
+	if err := srv.PostStartRecording(ctx, "real-device", "lamassu-sample"); !errors.Is(err, recording.ErrExists) {
+		t.Errorf("Got result is %v for an existing recording; want %v", err, recording.ErrExists)
+	}
+
+	t.Run("Testing Replay", func(t *testing.T) {
+		stu.connect(t, srv, "virtual-device")
+		opts := recording.Options{Speed: 10, TopicRewrites: []recording.TopicRewrite{{Pattern: "^devices/", Replacement: "staging/"}}}
+		report, err := srv.PostReplay(ctx, "virtual-device", "lamassu-sample", opts, true)
+		if err != nil {
+			t.Fatalf("Unable to replay: %s", err)
+		}
+		if want := (recording.Report{Published: 1, Ignored: 1}); report != want {
+			t.Errorf("Got report %+v; want %+v", report, want)
+		}
+		if want := "[staging/virtual-device/telemetry hello from virtual-device]"; fmt.Sprint(published) != want {
+			t.Errorf("Got published %v; want %s", published, want)
+		}
+	})
+
+	t.Run("Testing Unknown recording", func(t *testing.T) {
+		_, err := srv.PostReplay(ctx, "virtual-device", "unknown", recording.Options{}, false)
+		if e := toError(err); e.Code != CodeRecordingNotFound {
+			t.Errorf("Got error code %s; want %s", e.Code, CodeRecordingNotFound)
+		}
+	})
+
+	t.Run("Testing Disabled", func(t *testing.T) {
+		srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+		if err := srv.PostStartRecording(ctx, "real-device", "lamassu-sample"); !errors.Is(err, ErrRecordingDisabled) {
+			t.Errorf("Got result is %v; want %v", err, ErrRecordingDisabled)
+		}
+	})
+}
+
+func TestNetwork(t *testing.T) {
+	stu := setup(t)
+	dir := t.TempDir()
+	scenario := `{"steps": [{"duration": 60000, "profile": {"latency": 300, "bandwidth": 2000}}, {"profile": {"resetInterval": 30000}}]}`
+	if err := os.WriteFile(filepath.Join(dir, "tunnel"+impairment.Extension), []byte(scenario), 0o600); err != nil {
+		t.Fatalf("Unable to write scenario: %s", err)
+	}
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus(), WithScenarios(impairment.NewStore(dir)))
+	ctx := context.Background()
+	stu.connect(t, srv, "lamassu-client")
+
+	latency := &impairment.Profile{Latency: 200 * time.Millisecond, Jitter: 50 * time.Millisecond}
+	testCases := []struct {
+		name     string
+		clientID string
+		profile  *impairment.Profile
+		scenario string
+		status   impairment.Status
+		code     ErrorCode
+	}{
+		{"Unknown session", "unknown-client", latency, "", impairment.Status{}, CodeNotConnected},
+		{"Profile", "lamassu-client", latency, "", impairment.Status{Profile: *latency}, ""},
+		{"Invalid profile", "lamassu-client", &impairment.Profile{Latency: -time.Second}, "", impairment.Status{}, CodeInvalidRequest},
+		{"Profile and scenario", "lamassu-client", latency, "tunnel", impairment.Status{}, CodeInvalidRequest},
+		{"Scenario", "lamassu-client", nil, "tunnel", impairment.Status{Profile: impairment.Profile{Latency: 300 * time.Millisecond, Bandwidth: 2000}, Scenario: "tunnel"}, ""},
+		{"Unknown scenario", "lamassu-client", nil, "unknown", impairment.Status{}, CodeScenarioNotFound},
+		{"Unchanged", "lamassu-client", nil, "", impairment.Status{Profile: impairment.Profile{Latency: 300 * time.Millisecond, Bandwidth: 2000}, Scenario: "tunnel"}, ""},
+		{"Unimpaired", "lamassu-client", &impairment.Profile{}, "", impairment.Status{}, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			status, err := srv.PostNetwork(ctx, tc.clientID, tc.profile, tc.scenario, false)
+			if tc.code != "" {
+				if e := toError(err); e.Code != tc.code {
+					t.Errorf("Got error %v; want code %s", err, tc.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unable to impair network: %s", err)
+			}
+			if status != tc.status {
+				t.Errorf("Got status %+v; want %+v", status, tc.status)
+			}
+		})
+	}
+
+	t.Run("Testing Session state", func(t *testing.T) {
+		if _, err := srv.PostNetwork(ctx, "lamassu-client", latency, "", true); err != nil {
+			t.Fatalf("Unable to impair network: %s", err)
+		}
+		state, err := srv.SessionState(ctx, "lamassu-client")
+		if err != nil {
+			t.Fatalf("Unable to get session state: %s", err)
+		}
+		if want := (NetworkStatus{Profile: NetworkProfile{Latency: 200, Jitter: 50}}); state.Network != want {
+			t.Errorf("Got network %+v; want %+v", state.Network, want)
+		}
+	})
+
+	t.Run("Testing Scenarios disabled", func(t *testing.T) {
+		srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+		stu.connect(t, srv, "lamassu-client")
+		if _, err := srv.PostNetwork(ctx, "lamassu-client", nil, "tunnel", false); !errors.Is(err, ErrScenariosDisabled) {
+			t.Errorf("Got result is %v; want %v", err, ErrScenariosDisabled)
+		}
+	})
+}
+
+func TestPostDisconnect(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	ctx := context.Background()
+
+	stu.client.(*mocks.MockClient).DisconnectFn = func(ctx context.Context) {}
+	stu.connect(t, srv, "lamassu-client")
+
+	testCases := []struct {
+		name     string
+		clientID string
+		ret      error
+	}{
+		{"Unknown session", "unknown-client", ErrNotConnected},
+		{"Live session", "lamassu-client", nil},
+		{"Already disconnected", "lamassu-client", ErrNotConnected},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			err := srv.PostDisconnect(ctx, tc.clientID)
+			if !errors.Is(err, tc.ret) {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+		})
+	}
+}
+
+// fakeDevices records the devices registered by the service.
+type fakeDevices struct {
+	devices map[string]discovery.Device
+}
+
+func (f *fakeDevices) Register(d discovery.Device) { f.devices[d.ClientID] = d }
+func (f *fakeDevices) Deregister(clientID string)  { delete(f.devices, clientID) }
+func (f *fakeDevices) Close() error                { return nil }
+
+func TestDevicesRegistration(t *testing.T) {
+	stu := setup(t)
+	devices := &fakeDevices{devices: make(map[string]discovery.Device)}
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus(), WithDeviceRegistry(devices))
 	ctx := context.Background()
 
-	stu.client.(*mocks.MockClient).SendMessageFn = func(message string, topic string) error {
+	mc := stu.client.(*mocks.MockClient)
+	mc.DisconnectFn = func(ctx context.Context) {}
+	connected := true
+	mc.IsConnectedFn = func() bool { return connected }
+	stu.connect(t, srv, "lamassu-client")
+
+	d, ok := devices.devices["lamassu-client"]
+	if !ok {
+		t.Fatalf("Connected device was not registered")
+	}
+	if d.Broker == "" || d.SerialNumber == "" {
+		t.Errorf("Got device %+v; want its broker and certificate serial number", d)
+	}
+	connected = false
+	if d.Connected() {
+		t.Errorf("Got device connected; want the state of its MQTT client")
+	}
+
+	if err := srv.PostDisconnect(ctx, "lamassu-client"); err != nil {
+		t.Fatalf("Unable to disconnect: %s", err)
+	}
+	if _, ok := devices.devices["lamassu-client"]; ok {
+		t.Errorf("Disconnected device is still registered")
+	}
+}
+
+func TestSessionState(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mc := stu.client.(*mocks.MockClient)
+	mc.IsConnectedFn = func() bool { return true }
+	stream := srv.Events(ctx, events.Filter{Types: []events.Type{events.SessionStateChanged}})
+	stu.connect(t, srv, "lamassu-client")
+	mc.Set(client.StateConnecting, 0, nil)
+	mc.Set(client.StateConnected, 0, nil)
+	mc.Set(client.StateReconnecting, 0, errors.New("EOF"))
+
+	testCases := []struct {
+		name     string
+		clientID string
+		state    client.State
+		ret      error
+	}{
+		{"Unknown session", "unknown-client", "", ErrNotConnected},
+		{"Connection lost", "lamassu-client", client.StateReconnecting, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			state, err := srv.SessionState(ctx, tc.clientID)
+			if !errors.Is(err, tc.ret) {
+				t.Fatalf("Got result is %v; want %v", err, tc.ret)
+			}
+			if state.State != tc.state {
+				t.Errorf("Got state %q; want %q", state.State, tc.state)
+			}
+			if tc.ret == nil && len(state.History) != 3 {
+				t.Errorf("Got %d transitions; want 3", len(state.History))
+			}
+		})
+	}
+
+	for _, want := range []client.State{client.StateConnecting, client.StateConnected, client.StateReconnecting} {
+		e := <-stream
+		if e.ClientID != "lamassu-client" || e.State != string(want) {
+			t.Errorf("Got event %+v; want state %s", e, want)
+		}
+	}
+}
+
+func TestOfflineQueue(t *testing.T) {
+	stu := setup(t)
+	queues := func(clientID string) (*queue.Queue, error) {
+		return queue.New(memory.NewStore(), queue.Limits{MaxMessages: 10}, queue.Metrics{Depth: generic.NewGauge("depth"), Dropped: generic.NewCounter("dropped")}), nil
+	}
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus(), WithOfflineQueue(queues))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mc := stu.client.(*mocks.MockClient)
+	mc.IsConnectedFn = func() bool { return true }
+	var published []string
+	mc.PublishFn = func(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error {
+		published = append(published, topic)
+		return nil
+	}
+	mc.SendMessageFn = func(ctx context.Context, message string, topic string) error {
+		return mc.PublishFn(ctx, topic, []byte(message), 0, false)
+	}
+	stream := srv.Events(ctx, events.Filter{Types: []events.Type{events.MessageQueued, events.MessagePublished}})
+	stu.connect(t, srv, "lamassu-client")
+	mc.Set(client.StateConnecting, 0, nil)
+	mc.Set(client.StateConnected, 0, nil)
+	mc.Set(client.StateReconnecting, 0, errors.New("EOF"))
+
+	if err := srv.PostSendMessage(ctx, "lamassu-client", "1", "first"); err != nil {
+		t.Fatalf("Got error %v publishing while reconnecting; want the message queued", err)
+	}
+	results, err := srv.PostSendMessages(ctx, "lamassu-client", []BatchMessage{{Topic: "second", QoS: 1}, {Topic: "third", QoS: 1}}, true)
+	if err != nil {
+		t.Fatalf("Got error %v; want none", err)
+	}
+	for _, r := range results {
+		if r.Status != BatchQueued {
+			t.Errorf("Got status %s for %s; want %s", r.Status, r.Topic, BatchQueued)
+		}
+	}
+	state, _ := srv.SessionState(ctx, "lamassu-client")
+	if state.Queue == nil || state.Queue.Messages != 3 {
+		t.Fatalf("Got queue %+v; want 3 messages", state.Queue)
+	}
+	if len(published) != 0 {
+		t.Fatalf("Got %v published while reconnecting; want none", published)
+	}
+
+	mc.Set(client.StateConnected, 1, nil)
+	for i := 0; i < 6; i++ {
+		select {
+		case e := <-stream:
+			want := events.MessageQueued
+			if i >= 3 {
+				want = events.MessagePublished
+			}
+			if e.Type != want {
+				t.Errorf("Got event %s for %s; want %s", e.Type, e.Topic, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Got %d events; want the queue forwarded after reconnecting", i)
+		}
+	}
+	if fmt.Sprint(published) != "[first second third]" {
+		t.Errorf("Got messages forwarded %v; want them in order", published)
+	}
+
+	if err := srv.PostSendMessage(ctx, "lamassu-client", "4", "fourth"); err != nil {
+		t.Fatalf("Got error %v; want none", err)
+	}
+	if state, _ := srv.SessionState(ctx, "lamassu-client"); state.Queue.Messages != 0 || len(published) != 4 {
+		t.Errorf("Got %d messages queued and %d published; want the message published once the queue is empty", state.Queue.Messages, len(published))
+	}
+}
+
+func TestOfflineQueueRetry(t *testing.T) {
+	delay := forwardRetryDelay
+	forwardRetryDelay = 10 * time.Millisecond
+	t.Cleanup(func() { forwardRetryDelay = delay })
+
+	stu := setup(t)
+	queues := func(clientID string) (*queue.Queue, error) {
+		return queue.New(memory.NewStore(), queue.Limits{MaxMessages: 10}, queue.Metrics{Depth: generic.NewGauge("depth"), Dropped: generic.NewCounter("dropped")}), nil
+	}
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus(), WithOfflineQueue(queues))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mc := stu.client.(*mocks.MockClient)
+	mc.IsConnectedFn = func() bool { return true }
+	var attempts []string
+	mc.PublishFn = func(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error {
+		attempts = append(attempts, topic)
+		switch {
+		case topic == "rejected":
+			return client.ErrPublishRejected
+		case len(attempts) == 1:
+			return context.DeadlineExceeded
+		}
 		return nil
 	}
+	mc.SendMessageFn = func(ctx context.Context, message string, topic string) error {
+		return mc.PublishFn(ctx, topic, []byte(message), 0, false)
+	}
+	stream := srv.Events(ctx, events.Filter{Types: []events.Type{events.MessagePublished, events.MessagePublishFailed}})
+	stu.connect(t, srv, "lamassu-client")
+	mc.Set(client.StateConnecting, 0, nil)
+	mc.Set(client.StateConnected, 0, nil)
+	mc.Set(client.StateReconnecting, 0, errors.New("EOF"))
+	srv.PostSendMessage(ctx, "lamassu-client", "1", "slow")
+	srv.PostSendMessage(ctx, "lamassu-client", "2", "rejected")
+	mc.Set(client.StateConnected, 1, nil)
 
+	testCases := []struct {
+		typ   events.Type
+		topic string
+	}{
+		{events.MessagePublished, "slow"},
+		{events.MessagePublishFailed, "rejected"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.topic), func(t *testing.T) {
+			select {
+			case e := <-stream:
+				if e.Type != tc.typ || e.Topic != tc.topic {
+					t.Errorf("Got event %s for %s; want %s", e.Type, e.Topic, tc.typ)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Got no event; want %s for %s", tc.typ, tc.topic)
+			}
+		})
+	}
+	if fmt.Sprint(attempts) != "[slow slow rejected]" {
+		t.Errorf("Got attempts %v; want the timed out message retried and the rejected one dropped", attempts)
+	}
+	if state, _ := srv.SessionState(ctx, "lamassu-client"); state.Queue.Messages != 0 {
+		t.Errorf("Got %d messages queued; want none", state.Queue.Messages)
+	}
+}
+
+// failingStore fails to remove its oldest message the first failures times.
+type failingStore struct {
+	queue.Store
+	failures int
+}
+
+func (s *failingStore) Pop() error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("disk full")
+	}
+	return s.Store.Pop()
+}
+
+func TestOfflineQueueStoreFailure(t *testing.T) {
+	delay := forwardRetryDelay
+	forwardRetryDelay = 10 * time.Millisecond
+	t.Cleanup(func() { forwardRetryDelay = delay })
+
+	stu := setup(t)
+	queues := func(clientID string) (*queue.Queue, error) {
+		return queue.New(&failingStore{Store: memory.NewStore(), failures: 2}, queue.Limits{MaxMessages: 10}, queue.Metrics{Depth: generic.NewGauge("depth"), Dropped: generic.NewCounter("dropped")}), nil
+	}
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus(), WithOfflineQueue(queues))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mc := stu.client.(*mocks.MockClient)
+	mc.IsConnectedFn = func() bool { return true }
+	var attempts []string
+	mc.PublishFn = func(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error {
+		attempts = append(attempts, topic)
+		return nil
+	}
+	mc.SendMessageFn = func(ctx context.Context, message string, topic string) error {
+		return mc.PublishFn(ctx, topic, []byte(message), 0, false)
+	}
+	stream := srv.Events(ctx, events.Filter{Types: []events.Type{events.MessagePublished}})
+	stu.connect(t, srv, "lamassu-client")
+	mc.Set(client.StateConnecting, 0, nil)
+	mc.Set(client.StateConnected, 0, nil)
+	mc.Set(client.StateReconnecting, 0, errors.New("EOF"))
+	srv.PostSendMessage(ctx, "lamassu-client", "1", "first")
+	srv.PostSendMessage(ctx, "lamassu-client", "2", "second")
+	mc.Set(client.StateConnected, 1, nil)
+	srv.PostSendMessage(ctx, "lamassu-client", "3", "third")
+
+	for _, topic := range []string{"first", "second", "third"} {
+		t.Run(fmt.Sprintf("Testing %s", topic), func(t *testing.T) {
+			select {
+			case e := <-stream:
+				if e.Topic != topic {
+					t.Errorf("Got message published on %s; want %s", e.Topic, topic)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Got no event; want the message published on %s", topic)
+			}
+		})
+	}
+	if fmt.Sprint(attempts) != "[first second third]" {
+		t.Errorf("Got attempts %v; want every message published once, in order", attempts)
+	}
+	if state, _ := srv.SessionState(ctx, "lamassu-client"); state.Queue.Messages != 0 {
+		t.Errorf("Got %d messages queued; want none", state.Queue.Messages)
+	}
+}
+
+func TestShutdown(t *testing.T) {
 	testCases := []struct {
 		name    string
-		message string
-		topic   string
+		timeout time.Duration
 		ret     error
 	}{
-		{"Topic empty", "this is a message", "", ErrTopicEmpty},
-		{"Correct topic", "this is a message", "lamassu-sample", nil},
+		{"Publish flushed", time.Second, nil},
+		{"Deadline exceeded", 50 * time.Millisecond, context.DeadlineExceeded},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			stu := setup(t)
+			devices := &fakeDevices{devices: make(map[string]discovery.Device)}
+			h := health.New()
+			srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, h, events.NewBus(), WithDeviceRegistry(devices))
+			ctx := context.Background()
+
+			mc := stu.client.(*mocks.MockClient)
+			mc.IsConnectedFn = func() bool { return true }
+			stu.connect(t, srv, "lamassu-client")
+
+			published := make(chan struct{})
+			release := make(chan struct{})
+			mc.SendMessageFn = func(ctx context.Context, message string, topic string) error {
+				close(published)
+				<-release
+				return nil
+			}
+			disconnected := make(chan struct{})
+			mc.DisconnectFn = func(ctx context.Context) { close(disconnected) }
+			stream := srv.Events(ctx, events.Filter{})
+
+			go srv.PostSendMessage(ctx, "lamassu-client", "hello", "telemetry")
+			<-published
+
+			ctx, cancel := context.WithTimeout(ctx, tc.timeout)
+			defer cancel()
+			ret := make(chan error)
+			go func() { ret <- srv.(Shutdowner).Shutdown(ctx) }()
+
+			for srv.Readiness(context.Background()).Status != health.StatusFail {
+				time.Sleep(time.Millisecond)
+			}
+			if err := srv.PostSendMessage(context.Background(), "lamassu-client", "hello", "telemetry"); !errors.Is(err, ErrShuttingDown) {
+				t.Errorf("Got result is %v while shutting down; want %s", err, ErrShuttingDown)
+			}
+			if tc.ret == nil {
+				select {
+				case <-disconnected:
+					t.Fatalf("Session disconnected before the publish in flight completed")
+				case <-time.After(20 * time.Millisecond):
+				}
+				close(release)
+			} else {
+				defer close(release)
+			}
+
+			if err := <-ret; !errors.Is(err, tc.ret) {
+				t.Errorf("Got result is %v; want %v", err, tc.ret)
+			}
+			select {
+			case <-disconnected:
+			default:
+				t.Errorf("Session not disconnected")
+			}
+			if len(devices.devices) > 0 {
+				t.Errorf("Got devices %v registered; want none", devices.devices)
+			}
+			for range stream {
+			}
+		})
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	ctx := context.Background()
+
+	var handler client.MessageHandler
+	var unsubscribed []string
+	mc := stu.client.(*mocks.MockClient)
+	mc.SubscribeFn = func(ctx context.Context, topic string, qos byte, h client.MessageHandler) error {
+		if topic == "lamassu-denied" {
+			return errors.New("not authorized")
+		}
+		handler = h
+		return nil
+	}
+	mc.UnsubscribeFn = func(ctx context.Context, topic string) error {
+		unsubscribed = append(unsubscribed, topic)
+		return nil
+	}
+	stu.connect(t, srv, "lamassu-client")
+
+	testCases := []struct {
+		name     string
+		clientID string
+		topic    string
+		qos      int
+		ret      error
+	}{
+		{"Topic empty", "lamassu-client", "", 0, ErrTopicEmpty},
+		{"QoS invalid", "lamassu-client", "lamassu-sample", 3, ErrQoSInvalid},
+		{"Unknown session", "unknown-client", "lamassu-sample", 0, ErrNotConnected},
+		{"Broker refused", "lamassu-client", "lamassu-denied", 1, ErrSubscribe},
 	}
 	for _, tc := range testCases {
 		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
-			err := srv.PostSendMessage(ctx, tc.message, tc.topic)
-			if tc.ret != err {
+			_, err := srv.Subscribe(ctx, tc.clientID, tc.topic, tc.qos)
+			if !errors.Is(err, tc.ret) {
 				t.Errorf("Got result is %s; want %s", err, tc.ret)
 			}
 		})
 	}
+
+	t.Run("Testing Fan out", func(t *testing.T) {
+		subCtx, cancel := context.WithCancel(ctx)
+		first, err := srv.Subscribe(subCtx, "lamassu-client", "lamassu-sample", 1)
+		if err != nil {
+			t.Fatalf("Unable to subscribe: %s", err)
+		}
+		second, err := srv.Subscribe(ctx, "lamassu-client", "lamassu-sample", 1)
+		if err != nil {
+			t.Fatalf("Unable to subscribe: %s", err)
+		}
+
+		handler(client.Message{Topic: "lamassu-sample", Payload: []byte("hello")})
+		for _, messages := range []<-chan client.Message{first, second} {
+			if m := <-messages; string(m.Payload) != "hello" {
+				t.Errorf("Got payload %q; want %q", m.Payload, "hello")
+			}
+		}
+
+		cancel()
+		if _, ok := <-first; ok {
+			t.Errorf("Subscription not closed when its context is done")
+		}
+		if len(unsubscribed) != 0 {
+			t.Errorf("Broker subscription dropped while still in use")
+		}
+
+		if err := srv.PostDisconnect(ctx, "lamassu-client"); err != nil {
+			t.Fatalf("Unable to disconnect: %s", err)
+		}
+		if _, ok := <-second; ok {
+			t.Errorf("Subscription not closed when the session disconnects")
+		}
+	})
 }
 
-func TestPostDisconnect(t *testing.T) {
+func TestReadiness(t *testing.T) {
 	stu := setup(t)
-	srv := NewDeviceService(stu.CAPath, stu.client)
+	h := health.New()
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, h, events.NewBus())
 	ctx := context.Background()
 
-	stu.client.(*mocks.MockClient).DisconnectFn = func() {}
+	connected := true
+	stu.client.(*mocks.MockClient).IsConnectedFn = func() bool { return connected }
+	h.AddReadinessCheck("trust_store", health.TrustStore(stu.CAPath))
+
+	if report := srv.Readiness(ctx); report.Status != health.StatusPass {
+		t.Errorf("Got readiness %s; want %s", report.Status, health.StatusPass)
+	}
+
+	stu.connect(t, srv, "lamassu-client")
+	connected = false
+	report := srv.Readiness(ctx)
+	if report.Status != health.StatusWarn {
+		t.Errorf("Got readiness %s; want %s", report.Status, health.StatusWarn)
+	}
+	for _, c := range report.Checks {
+		if c.Name == "sessions" && c.Details["active"] != 1 {
+			t.Errorf("Got %v active sessions; want 1", c.Details["active"])
+		}
+	}
 
-	srv.PostDisconnect(ctx)
+	h.AddReadinessCheck("trust_store", health.TrustStore("/nonexistent/ca.crt"))
+	if report := srv.Readiness(ctx); report.Status != health.StatusFail {
+		t.Errorf("Got readiness %s; want %s", report.Status, health.StatusFail)
+	}
+	if report := srv.Health(ctx); report.Status != health.StatusPass {
+		t.Errorf("Got liveness %s; want %s", report.Status, health.StatusPass)
+	}
+}
+
+func TestPostCSR(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	ctx := context.Background()
+
+	testCases := []struct {
+		name     string
+		clientID string
+		keyType  string
+		ret      error
+	}{
+		{"ClientID empty", "", "RSA2048", ErrClientIDEmpty},
+		{"Key type unsupported", "lamassu-client", "DSA1024", identity.ErrKeyTypeUnsupported},
+		{"Default key type", "lamassu-client", "", nil},
+		{"ECDSA P-384 key type", "lamassu-client", "ECDSAP384", nil},
+		{"Ed25519 key type", "lamassu-client", "Ed25519", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			csr, err := srv.PostCSR(ctx, tc.clientID, tc.keyType, "")
+			if !errors.Is(err, tc.ret) {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err == nil {
+				block, _ := pem.Decode([]byte(csr))
+				if block == nil {
+					t.Fatal("CSR is not PEM encoded")
+				}
+				req, err := x509.ParseCertificateRequest(block.Bytes)
+				if err != nil {
+					t.Fatalf("Unable to parse CSR: %s", err)
+				}
+				if err := req.CheckSignature(); err != nil {
+					t.Errorf("CSR signature is not valid: %s", err)
+				}
+				if req.Subject.CommonName != tc.clientID {
+					t.Errorf("Got CSR common name %s; want %s", req.Subject.CommonName, tc.clientID)
+				}
+			}
+		})
+	}
+}
+
+func TestPostCertificate(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	ctx := context.Background()
+
+	var connectConf *tls.Config
+	stu.client.(*mocks.MockClient).ConnectFn = func(ctx context.Context, URL string, clientID string, conf *tls.Config) error {
+		connectConf = conf
+		return nil
+	}
+
+	csr, err := srv.PostCSR(ctx, "lamassu-client", "ECDSAP256", "")
+	if err != nil {
+		t.Fatalf("Unable to create CSR: %s", err)
+	}
+	_, otherCert := stu.keyPair(t, identity.KeyTypeECDSAP256)
+
+	testCases := []struct {
+		name     string
+		clientID string
+		crt      string
+		ret      error
+	}{
+		{"ClientID empty", "", stu.ca.SignCSR(t, csr), ErrClientIDEmpty},
+		{"Unknown client ID", "unknown-client", stu.ca.SignCSR(t, csr), ErrIdentityEmpty},
+		{"Certificate invalid", "lamassu-client", "thisIsNotACert", identity.ErrCertificateParsing},
+		{"Certificate for another key", "lamassu-client", otherCert, identity.ErrCertificateKey},
+		{"Valid certificate", "lamassu-client", stu.ca.SignCSR(t, csr), nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			err := srv.PostCertificate(ctx, tc.clientID, tc.crt)
+			if !errors.Is(err, tc.ret) {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+		})
+	}
+
+	err = srv.PostConnect(ctx, "", "", "ssl://mosquitto:1883", "unknown-client")
+	if !errors.Is(err, ErrIdentityEmpty) {
+		t.Errorf("Got result is %s; want %s", err, ErrIdentityEmpty)
+	}
+	err = srv.PostConnect(ctx, "", "", "ssl://mosquitto:1883", "lamassu-client")
+	if err != nil {
+		t.Fatalf("Unable to connect with enrolled identity: %s", err)
+	}
+	if len(connectConf.Certificates) != 1 {
+		t.Errorf("Got %d client certificates; want 1", len(connectConf.Certificates))
+	}
+}
+
+func TestPostImport(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	ctx := context.Background()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate key")
+	}
+	crt := stu.ca.Issue(t, key.Public(), "lamassu-client")
+	p12, err := pkcs12.Modern.Encode(key, crt, nil, "secret")
+	if err != nil {
+		t.Fatal("Unable to encode PKCS#12 bundle")
+	}
+	encryptedDER, err := pkcs8.MarshalPrivateKey(key, []byte("secret"), nil)
+	if err != nil {
+		t.Fatal("Unable to encrypt PKCS#8 key")
+	}
+	crtPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})
+	encryptedPEM := append(pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: encryptedDER}), crtPEM...)
+	ecDER, _ := x509.MarshalECPrivateKey(key)
+	legacyBlock, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", ecDER, []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal("Unable to encrypt legacy PEM key")
+	}
+	legacyPEM := append(pem.EncodeToMemory(legacyBlock), crtPEM...)
+
+	testCases := []struct {
+		name     string
+		clientID string
+		bundle   []byte
+		password string
+		ret      error
+	}{
+		{"ClientID empty", "", p12, "secret", ErrClientIDEmpty},
+		{"Bundle empty", "lamassu-client", nil, "secret", ErrBundleEmpty},
+		{"Bundle invalid", "lamassu-client", []byte("thisIsNotABundle"), "secret", identity.ErrBundleDecoding},
+		{"PKCS#12 incorrect password", "lamassu-client", p12, "wrong", identity.ErrIncorrectPassword},
+		{"PKCS#8 incorrect password", "lamassu-client", encryptedPEM, "wrong", identity.ErrIncorrectPassword},
+		{"PEM without key", "lamassu-client", crtPEM, "", identity.ErrBundleKeyMissing},
+		{"Valid PKCS#12", "lamassu-client", p12, "secret", nil},
+		{"Valid encrypted PKCS#8", "lamassu-client", encryptedPEM, "secret", nil},
+		{"Valid legacy encrypted PEM", "lamassu-client", legacyPEM, "secret", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			err := srv.PostImport(ctx, tc.clientID, tc.bundle, tc.password)
+			if !errors.Is(err, tc.ret) {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+		})
+	}
+}
+
+func TestPostExport(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	ctx := context.Background()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate key")
+	}
+	crt := stu.ca.Issue(t, key.Public(), "lamassu-client")
+	p12, err := pkcs12.Modern.Encode(key, crt, nil, "secret")
+	if err != nil {
+		t.Fatal("Unable to encode PKCS#12 bundle")
+	}
+	if err := srv.PostImport(ctx, "lamassu-client", p12, "secret"); err != nil {
+		t.Fatalf("Unable to import identity: %s", err)
+	}
+
+	testCases := []struct {
+		name     string
+		clientID string
+		ret      error
+	}{
+		{"ClientID empty", "", ErrClientIDEmpty},
+		{"Unknown client ID", "unknown-client", ErrIdentityEmpty},
+		{"Imported identity", "lamassu-client", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			bundle, err := srv.PostExport(ctx, tc.clientID, "other-secret")
+			if !errors.Is(err, tc.ret) {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+			if err == nil {
+				_, exported, err := pkcs12.Decode(bundle, "other-secret")
+				if err != nil {
+					t.Fatalf("Unable to decode exported bundle: %s", err)
+				}
+				if !exported.Equal(crt) {
+					t.Errorf("Exported certificate does not match imported certificate")
+				}
+			}
+		})
+	}
+}
+
+// expiredCert returns a certificate for key that expired an hour ago.
+func (stu *serviceSetUp) expiredCert(t *testing.T, key string) string {
+	t.Helper()
+
+	block, _ := pem.Decode([]byte(key))
+	signer, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal("Unable to parse key")
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "lamassu-client"},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     time.Now().Add(-time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, stu.ca.Certificate, signer.(crypto.Signer).Public(), stu.ca.Key)
+	if err != nil {
+		t.Fatal("Unable to create expired certificate")
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// connect opens a session for clientID through the mock client.
+func (stu *serviceSetUp) connect(t *testing.T, srv Service, clientID string) {
+	t.Helper()
+
+	stu.client.(*mocks.MockClient).ConnectFn = func(ctx context.Context, URL string, clientID string, conf *tls.Config) error {
+		return nil
+	}
+	key, cert := stu.keyPair(t, identity.KeyTypeECDSAP256)
+	if err := srv.PostConnect(context.Background(), key, cert, "ssl://mosquitto:1883", clientID); err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+}
+
+// keyPair returns a PEM key of the given type and a certificate for it issued
+// by the test CA.
+func (stu *serviceSetUp) keyPair(t *testing.T, keyType identity.KeyType) (string, string) {
+	t.Helper()
+
+	key, err := stu.backend.GenerateKey(keyType)
+	if err != nil {
+		t.Fatalf("Unable to generate %s key", keyType)
+	}
+	cert := stu.ca.Issue(t, key.Public(), "lamassu-client")
+	return identitytest.KeyPEM(t, key), identitytest.CertificatePEM(cert)
 }
 
 func setup(t *testing.T) *serviceSetUp {
@@ -104,7 +1163,17 @@ func setup(t *testing.T) *serviceSetUp {
 	if err != nil {
 		t.Fatal("Unable to get configuration variables")
 	}
-	client := &mocks.MockClient{}
+	mc := &mocks.MockClient{DisconnectFn: func(ctx context.Context) {}}
+	ca := identitytest.NewCA(t)
+	if cfg.CAPath == "" {
+		cfg.CAPath = ca.WriteFile(t)
+	}
 
-	return &serviceSetUp{CAPath: cfg.CAPath, client: client}
+	return &serviceSetUp{
+		CAPath:  cfg.CAPath,
+		client:  mc,
+		clients: func() client.Client { return mc },
+		backend: software.NewBackend(),
+		ca:      ca,
+	}
 }
@@ -0,0 +1,240 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/client"
+	"github.com/lamassuiot/device-virtual/pkg/events"
+	"github.com/lamassuiot/device-virtual/pkg/impairment"
+	"github.com/lamassuiot/device-virtual/pkg/queue"
+	"github.com/lamassuiot/device-virtual/pkg/recording"
+)
+
+// subscriberBuffer is the number of messages kept for a subscriber before
+// new ones are dropped.
+const subscriberBuffer = 64
+
+// session is a device connected to an MQTT broker, identified by its client ID.
+type session struct {
+	clientID    string
+	brokerURL   string
+	client      client.Client
+	certificate *x509.Certificate
+	connectedAt time.Time
+	events      *events.Bus
+	outbox      *outbox
+	shaper      *impairment.Shaper
+
+	mtx         sync.Mutex
+	subscribers map[string]map[chan client.Message]struct{}
+	recorder    *recording.Recorder
+	done        chan struct{}
+}
+
+// SessionState describes the broker connection of a session. History holds
+// its recent transitions, oldest first, Queue the messages waiting to be
+// forwarded when offline queueing is enabled and Network the impairment of
+// the connection.
+type SessionState struct {
+	ClientID      string              `json:"clientID"`
+	BrokerURL     string              `json:"brokerURL"`
+	ConnectedAt   time.Time           `json:"connectedAt"`
+	State         client.State        `json:"state"`
+	Subscriptions []string            `json:"subscriptions"`
+	History       []client.Transition `json:"history"`
+	Queue         *queue.Stats        `json:"queue,omitempty"`
+	Network       NetworkStatus       `json:"network"`
+}
+
+func newSession(clientID string, brokerURL string, c client.Client, certificate *x509.Certificate, bus *events.Bus, o *outbox, shaper *impairment.Shaper) *session {
+	return &session{
+		clientID:    clientID,
+		brokerURL:   brokerURL,
+		client:      c,
+		certificate: certificate,
+		connectedAt: time.Now(),
+		events:      bus,
+		outbox:      o,
+		shaper:      shaper,
+		subscribers: make(map[string]map[chan client.Message]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+func (sess *session) state() SessionState {
+	sess.mtx.Lock()
+	topics := make([]string, 0, len(sess.subscribers))
+	for topic := range sess.subscribers {
+		topics = append(topics, topic)
+	}
+	sess.mtx.Unlock()
+	sort.Strings(topics)
+
+	state := SessionState{
+		ClientID:      sess.clientID,
+		BrokerURL:     sess.brokerURL,
+		ConnectedAt:   sess.connectedAt,
+		State:         sess.client.State(),
+		Subscriptions: topics,
+		History:       sess.client.History(),
+		Network:       networkStatus(sess.shaper.Status()),
+	}
+	if sess.outbox != nil {
+		stats := sess.outbox.queue.Stats()
+		state.Queue = &stats
+	}
+	return state
+}
+
+// subscribe adds a subscriber to topic. The broker subscription is shared by
+// all the subscribers of a topic and made with the QoS of the first one.
+func (sess *session) subscribe(ctx context.Context, topic string, qos byte) (chan client.Message, error) {
+	sess.mtx.Lock()
+	defer sess.mtx.Unlock()
+
+	select {
+	case <-sess.done:
+		return nil, client.ErrNotConnected
+	default:
+	}
+
+	if _, ok := sess.subscribers[topic]; !ok {
+		err := sess.client.Subscribe(ctx, topic, qos, func(m client.Message) {
+			sess.dispatch(topic, m)
+		})
+		if err != nil {
+			return nil, err
+		}
+		sess.subscribers[topic] = make(map[chan client.Message]struct{})
+	}
+	ch := make(chan client.Message, subscriberBuffer)
+	sess.subscribers[topic][ch] = struct{}{}
+	return ch, nil
+}
+
+// unsubscribe removes a subscriber and closes its channel. The broker
+// subscription is dropped with the last subscriber of a live session.
+func (sess *session) unsubscribe(ctx context.Context, topic string, ch chan client.Message) {
+	sess.mtx.Lock()
+	defer sess.mtx.Unlock()
+
+	subscribers, ok := sess.subscribers[topic]
+	if !ok {
+		return
+	}
+	if _, ok := subscribers[ch]; !ok {
+		return
+	}
+	delete(subscribers, ch)
+	close(ch)
+
+	if len(subscribers) == 0 {
+		delete(sess.subscribers, topic)
+		select {
+		case <-sess.done:
+		default:
+			sess.client.Unsubscribe(ctx, topic)
+		}
+	}
+}
+
+func (sess *session) dispatch(topic string, m client.Message) {
+	sess.events.Publish(events.Event{
+		Type:     events.MessageReceived,
+		ClientID: sess.clientID,
+		Time:     m.ReceivedAt,
+		Topic:    m.Topic,
+		Message:  string(m.Payload),
+	})
+	sess.record(recording.Record{
+		Time:      m.ReceivedAt,
+		Direction: recording.Received,
+		Topic:     m.Topic,
+		Payload:   m.Payload,
+		QoS:       m.QoS,
+		Retained:  m.Retained,
+	})
+
+	sess.mtx.Lock()
+	defer sess.mtx.Unlock()
+
+	for ch := range sess.subscribers[topic] {
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+}
+
+// startRecording records the traffic of the session with r until
+// stopRecording is called or the session ends.
+func (sess *session) startRecording(r *recording.Recorder) error {
+	sess.mtx.Lock()
+	defer sess.mtx.Unlock()
+
+	select {
+	case <-sess.done:
+		return client.ErrNotConnected
+	default:
+	}
+	if sess.recorder != nil {
+		return ErrRecordingActive
+	}
+	sess.recorder = r
+	return nil
+}
+
+func (sess *session) recording() bool {
+	sess.mtx.Lock()
+	defer sess.mtx.Unlock()
+	return sess.recorder != nil
+}
+
+func (sess *session) stopRecording() error {
+	sess.mtx.Lock()
+	defer sess.mtx.Unlock()
+
+	if sess.recorder == nil {
+		return ErrRecordingInactive
+	}
+	err := sess.recorder.Close()
+	sess.recorder = nil
+	return err
+}
+
+// record adds rec to the recording of the session, if any. Recordings that
+// fail to write are stopped rather than failing the traffic they capture.
+func (sess *session) record(rec recording.Record) {
+	sess.mtx.Lock()
+	defer sess.mtx.Unlock()
+
+	if sess.recorder == nil {
+		return
+	}
+	rec.ClientID = sess.clientID
+	if err := sess.recorder.Record(rec); err != nil {
+		sess.recorder.Close()
+		sess.recorder = nil
+	}
+}
+
+// close ends every subscription and the recording of the session.
+func (sess *session) close() {
+	sess.mtx.Lock()
+	defer sess.mtx.Unlock()
+
+	select {
+	case <-sess.done:
+	default:
+		close(sess.done)
+	}
+	sess.shaper.Stop()
+	if sess.recorder != nil {
+		sess.recorder.Close()
+		sess.recorder = nil
+	}
+}
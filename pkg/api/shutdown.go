@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+
+	"github.com/lamassuiot/device-virtual/pkg/events"
+)
+
+var ErrShuttingDown = &Error{Code: CodeUnavailable, Message: "service is shutting down"}
+
+// Shutdowner ends the device sessions of a service before the process exits.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// Shutdown drains the service. Calls using the broker connections are
+// rejected with ErrShuttingDown, and batch delays and replays are canceled.
+// Publishes in flight are waited for, until acknowledged for QoS 1 and 2,
+// then every session is disconnected cleanly, so that brokers do not publish
+// the will of the devices. Recordings and offline queues are closed and the
+// devices deregistered.
+// Event streams end last, once they carried the disconnections.
+//
+// When ctx is done before the publishes in flight, the sessions are
+// disconnected anyway and ctx.Err() is returned.
+func (s *deviceService) Shutdown(ctx context.Context) error {
+	s.mtx.Lock()
+	if s.draining {
+		s.mtx.Unlock()
+		return nil
+	}
+	s.draining = true
+	close(s.stopping)
+	s.mtx.Unlock()
+
+	flushed := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(flushed)
+	}()
+	var err error
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mtx.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[string]*session)
+	s.mtx.Unlock()
+	for _, sess := range sessions {
+		s.disconnect(ctx, sess)
+	}
+	s.closeOutboxes()
+	close(s.closed)
+	return err
+}
+
+// enter registers a call using the broker connections, so that Shutdown waits
+// for it, or rejects it once Shutdown started. The returned function must be
+// called when the call returns.
+func (s *deviceService) enter() (func(), error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.draining {
+		return nil, ErrShuttingDown
+	}
+	s.inflight.Add(1)
+	return s.inflight.Done, nil
+}
+
+// disconnect ends a session that is no longer listed.
+func (s *deviceService) disconnect(ctx context.Context, sess *session) {
+	sess.close()
+	sess.client.Disconnect(ctx)
+	if s.devices != nil {
+		s.devices.Deregister(sess.clientID)
+	}
+	s.events.Publish(events.Event{Type: events.SessionDisconnected, ClientID: sess.clientID})
+}
+
+// until returns a context that is also done when done is closed.
+func until(ctx context.Context, done <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			cancel()
+		}
+	}()
+	return ctx, cancel
+}
@@ -3,7 +3,13 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"io/ioutil"
+	"math"
+	"mime"
 	"net/http"
+	"strconv"
+
+	"github.com/lamassuiot/device-virtual/pkg/auth"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/tracing/opentracing"
@@ -15,14 +21,27 @@ import (
 	stdopentracing "github.com/opentracing/opentracing-go"
 )
 
-func MakeHTTPHandler(s Service, logger log.Logger, otTracer stdopentracing.Tracer) http.Handler {
+func MakeHTTPHandler(s Service, logger log.Logger, otTracer stdopentracing.Tracer, authn auth.Authenticator) http.Handler {
 	r := mux.NewRouter()
-	e := MakeServerEndpoints(s, otTracer)
+	e := MakeServerEndpoints(s, otTracer, authn)
 
 	options := []httptransport.ServerOption{
 		httptransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerBefore(auth.HTTPToContext(), rateLimitHTTPToContext),
 	}
 
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodeError(r.Context(), ErrRouteNotFound, w)
+	})
+	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodeError(r.Context(), ErrMethodNotAllowed, w)
+	})
+	r.Use(validateRequests)
+
+	r.Methods("GET").Path("/v1/openapi.json").HandlerFunc(serveOpenAPI)
+	r.Methods("GET").Path("/v1/events").HandlerFunc(serveEvents(s, logger, authn))
+
 	r.Methods("GET").Path("/v1/health").Handler(httptransport.NewServer(
 		e.HealthEndpoint,
 		decodeHealthRequest,
@@ -30,6 +49,20 @@ func MakeHTTPHandler(s Service, logger log.Logger, otTracer stdopentracing.Trace
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "Health", logger)))...,
 	))
 
+	r.Methods("GET").Path("/v1/health/live").Handler(httptransport.NewServer(
+		e.HealthEndpoint,
+		decodeHealthRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "Health", logger)))...,
+	))
+
+	r.Methods("GET").Path("/v1/health/ready").Handler(httptransport.NewServer(
+		e.ReadinessEndpoint,
+		decodeHealthRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "Readiness", logger)))...,
+	))
+
 	r.Methods("POST").Path("/v1/device/connect").Handler(httptransport.NewServer(
 		e.PostConnect,
 		decodePostConnectRequest,
@@ -44,15 +77,87 @@ func MakeHTTPHandler(s Service, logger log.Logger, otTracer stdopentracing.Trace
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostDisconnect", logger)))...,
 	))
 
+	r.Methods("GET").Path("/v1/device/state").Handler(httptransport.NewServer(
+		e.SessionState,
+		decodeSessionStateRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "SessionState", logger)))...,
+	))
+
 	r.Methods("POST").Path("/v1/device/message").Handler(httptransport.NewServer(
 		e.PostSendMessage,
 		decodePostSendMessageRequest,
 		encodeResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostSendMessage", logger)))...,
 	))
+
+	r.Methods("POST").Path("/v1/device/messages:batch").Handler(httptransport.NewServer(
+		e.PostSendMessages,
+		decodePostSendMessagesRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostSendMessages", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/device/csr").Handler(httptransport.NewServer(
+		e.PostCSR,
+		decodePostCSRRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostCSR", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/device/certificate").Handler(httptransport.NewServer(
+		e.PostCertificate,
+		decodePostCertificateRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostCertificate", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/device/import").Handler(httptransport.NewServer(
+		e.PostImport,
+		decodePostImportRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostImport", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/device/export").Handler(httptransport.NewServer(
+		e.PostExport,
+		decodePostExportRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostExport", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/device/recording/start").Handler(httptransport.NewServer(
+		e.PostStartRecording,
+		decodePostStartRecordingRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostStartRecording", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/device/recording/stop").Handler(httptransport.NewServer(
+		e.PostStopRecording,
+		decodePostStopRecordingRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostStopRecording", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/device/replay").Handler(httptransport.NewServer(
+		e.PostReplay,
+		decodePostReplayRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostReplay", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/device/network").Handler(httptransport.NewServer(
+		e.PostNetwork,
+		decodePostNetworkRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostNetwork", logger)))...,
+	))
 	return r
 }
 
+const maxImportSize = 1 << 20
+
 type errorer interface {
 	error() error
 }
@@ -65,7 +170,15 @@ func decodeHealthRequest(ctx context.Context, r *http.Request) (request interfac
 func decodePostSendMessageRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
 	var reqData postSendMessageRequest
 	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
-		return nil, err
+		return nil, ErrMalformedRequest.wrap(err)
+	}
+	return reqData, nil
+}
+
+func decodePostSendMessagesRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var reqData postSendMessagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		return nil, ErrMalformedRequest.wrap(err)
 	}
 	return reqData, nil
 }
@@ -73,7 +186,7 @@ func decodePostSendMessageRequest(ctx context.Context, r *http.Request) (request
 func decodePostConnectRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
 	var reqData postConnectRequest
 	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
-		return nil, err
+		return nil, ErrMalformedRequest.wrap(err)
 	}
 	return reqData, nil
 }
@@ -81,7 +194,111 @@ func decodePostConnectRequest(ctx context.Context, r *http.Request) (request int
 func decodePostDisconnectRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
 	var reqData postDisconnectRequest
 	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
-		return nil, err
+		return nil, ErrMalformedRequest.wrap(err)
+	}
+	return reqData, nil
+}
+
+func decodeSessionStateRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	clientID := r.URL.Query().Get("clientID")
+	if clientID == "" {
+		e := ErrMissingQuery.wrap(nil)
+		e.Details = []string{"clientID: is required"}
+		return nil, e
+	}
+	return sessionStateRequest{ClientID: clientID}, nil
+}
+
+func decodePostCSRRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var reqData postCSRRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		return nil, ErrMalformedRequest.wrap(err)
+	}
+	return reqData, nil
+}
+
+func decodePostCertificateRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var reqData postCertificateRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		return nil, ErrMalformedRequest.wrap(err)
+	}
+	return reqData, nil
+}
+
+// decodePostImportRequest accepts either a JSON body with a base64 encoded
+// bundle or a multipart upload with a "bundle" file, or "key" and "crt" files.
+func decodePostImportRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var reqData postImportRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+			return nil, ErrMalformedRequest.wrap(err)
+		}
+		return reqData, nil
+	}
+
+	if err := r.ParseMultipartForm(maxImportSize); err != nil {
+		return nil, ErrMalformedRequest.wrap(err)
+	}
+	reqData.ClientID = r.FormValue("clientID")
+	reqData.Password = r.FormValue("password")
+	for _, field := range []string{"bundle", "key", "crt"} {
+		f, _, err := r.FormFile(field)
+		if err == http.ErrMissingFile {
+			continue
+		} else if err != nil {
+			return nil, ErrMalformedRequest.wrap(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, ErrMalformedRequest.wrap(err)
+		}
+		if field != "bundle" {
+			// Keep PEM blocks from separate files on their own lines.
+			data = append(data, '\n')
+		}
+		reqData.Bundle = append(reqData.Bundle, data...)
+	}
+	return reqData, nil
+}
+
+func decodePostExportRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var reqData postExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		return nil, ErrMalformedRequest.wrap(err)
+	}
+	return reqData, nil
+}
+
+func decodePostStartRecordingRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var reqData postStartRecordingRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		return nil, ErrMalformedRequest.wrap(err)
+	}
+	return reqData, nil
+}
+
+func decodePostStopRecordingRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var reqData postStopRecordingRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		return nil, ErrMalformedRequest.wrap(err)
+	}
+	return reqData, nil
+}
+
+func decodePostReplayRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var reqData postReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		return nil, ErrMalformedRequest.wrap(err)
+	}
+	return reqData, nil
+}
+
+func decodePostNetworkRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var reqData postNetworkRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		return nil, ErrMalformedRequest.wrap(err)
 	}
 	return reqData, nil
 }
@@ -95,21 +312,30 @@ func encodeResponse(ctx context.Context, w http.ResponseWriter, response interfa
 		return nil
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if sc, ok := response.(httptransport.StatusCoder); ok {
+		w.WriteHeader(sc.StatusCode())
+	}
 	return json.NewEncoder(w).Encode(response)
 }
 
+type errorResponse struct {
+	Err *Error `json:"error"`
+}
+
+// encodeError writes every business-logic and transport error as a JSON
+// document with its machine readable code.
 func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 	if err == nil {
 		panic("encodeError with nil error")
 	}
-	http.Error(w, err.Error(), codeFrom(err))
-}
-
-func codeFrom(err error) int {
-	switch err {
-	case ErrDeviceAuth, ErrTLSConfLoading, ErrSendMessage:
-		return http.StatusBadRequest
-	default:
-		return http.StatusInternalServerError
+	e := toError(err)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if e.Code == CodeUnauthenticated {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
 	}
+	w.WriteHeader(e.StatusCode())
+	json.NewEncoder(w).Encode(errorResponse{Err: e})
 }
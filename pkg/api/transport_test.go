@@ -0,0 +1,260 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lamassuiot/device-virtual/pkg/auth"
+	"github.com/lamassuiot/device-virtual/pkg/auth/mtls"
+	"github.com/lamassuiot/device-virtual/pkg/client"
+	"github.com/lamassuiot/device-virtual/pkg/events"
+	"github.com/lamassuiot/device-virtual/pkg/health"
+	"github.com/lamassuiot/device-virtual/pkg/identity"
+	"github.com/lamassuiot/device-virtual/pkg/mocks"
+
+	"github.com/go-kit/kit/log"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestHTTPErrors(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	stu.client.(*mocks.MockClient).SendMessageFn = func(ctx context.Context, message string, topic string) error {
+		return client.ErrNotConnected
+	}
+	h := MakeHTTPHandler(srv, log.NewNopLogger(), stdopentracing.NoopTracer{}, auth.Anonymous())
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   ErrorCode
+	}{
+		{"Malformed body", "POST", "/v1/device/connect", "{", http.StatusBadRequest, CodeInvalidRequest},
+		{"Missing field", "POST", "/v1/device/connect", `{"clientID": "lamassu-client"}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"Unknown identity", "POST", "/v1/device/export", `{"clientID": "lamassu-client"}`, http.StatusNotFound, CodeIdentityNotFound},
+		{"Unsupported key type", "POST", "/v1/device/csr", `{"clientID": "lamassu-client", "keyType": "DSA1024"}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"Not connected", "POST", "/v1/device/message", `{"topic": "lamassu-sample"}`, http.StatusConflict, CodeNotConnected},
+		{"Invalid batch", "POST", "/v1/device/messages:batch", `{"messages": [{"topic": "lamassu-sample", "qos": 3}]}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"Batch not connected", "POST", "/v1/device/messages:batch", `{"messages": [{"topic": "lamassu-sample"}]}`, http.StatusConflict, CodeNotConnected},
+		{"Null optional field", "POST", "/v1/device/network", `{"clientID": "lamassu-client", "profile": null}`, http.StatusConflict, CodeNotConnected},
+		{"Null required field", "POST", "/v1/device/connect", `{"brokerURL": null, "clientID": "lamassu-client"}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"Body too large", "POST", "/v1/device/message", `{"topic": "lamassu-sample", "message": "` + strings.Repeat("a", maxRequestSize) + `"}`, http.StatusRequestEntityTooLarge, CodeRequestTooLarge},
+		{"Unknown route", "GET", "/v1/device/unknown", "", http.StatusNotFound, CodeRouteNotFound},
+		{"Wrong method", "GET", "/v1/device/connect", "", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+
+			if w.Code != tc.status {
+				t.Errorf("Got status code %d; want %d", w.Code, tc.status)
+			}
+			var body struct {
+				Error struct {
+					Code    ErrorCode `json:"code"`
+					Message string    `json:"message"`
+				} `json:"error"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("Error response is not JSON: %s", err)
+			}
+			if body.Error.Code != tc.code {
+				t.Errorf("Got error code %s; want %s", body.Error.Code, tc.code)
+			}
+			if body.Error.Message == "" {
+				t.Errorf("Error response has no message")
+			}
+		})
+	}
+}
+
+// unhashableError cannot be used as a map key.
+type unhashableError []string
+
+func (e unhashableError) Error() string { return strings.Join(e, ": ") }
+
+func TestToError(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		code ErrorCode
+	}{
+		{"Identity error", identity.ErrIncorrectPassword, CodeInvalidCredentials},
+		{"Wrapped identity error", fmt.Errorf("%w: bundle.p12", identity.ErrKeyNotExportable), CodeKeyNotExportable},
+		{"Unhashable error", unhashableError{"broker", "gone"}, CodeInternal},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			if e := toError(tc.err); e.Code != tc.code {
+				t.Errorf("Got error code %s; want %s", e.Code, tc.code)
+			}
+		})
+	}
+}
+
+func TestHTTPSendMessages(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	stu.client.(*mocks.MockClient).PublishFn = func(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error {
+		if qos != 1 || !retained {
+			t.Errorf("Got QoS %d and retained %t; want 1 and true", qos, retained)
+		}
+		if topic == "lamassu-denied" {
+			return errors.New("not authorized")
+		}
+		return nil
+	}
+	stu.connect(t, srv, "lamassu-client")
+	h := MakeHTTPHandler(srv, log.NewNopLogger(), stdopentracing.NoopTracer{}, auth.Anonymous())
+
+	body := `{"clientID": "lamassu-client", "ordered": true, "messages": [
+		{"topic": "lamassu-sample", "payload": "hello", "qos": 1, "retain": true, "delay": 1},
+		{"topic": "lamassu-denied", "payload": "hello", "qos": 1, "retain": true},
+		{"topic": "lamassu-sample", "payload": "hello", "qos": 1, "retain": true}
+	]}`
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/device/messages:batch", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status code %d; want %d", w.Code, http.StatusOK)
+	}
+
+	var resp struct {
+		Results []struct {
+			Index  int         `json:"index"`
+			Status BatchStatus `json:"status"`
+			Error  *struct {
+				Code ErrorCode `json:"code"`
+			} `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Response is not JSON: %s", err)
+	}
+	want := []BatchStatus{BatchPublished, BatchFailed, BatchSkipped}
+	if len(resp.Results) != len(want) {
+		t.Fatalf("Got %d results; want %d", len(resp.Results), len(want))
+	}
+	for i, r := range resp.Results {
+		if r.Index != i || r.Status != want[i] {
+			t.Errorf("Got result %d with status %s; want %s", r.Index, r.Status, want[i])
+		}
+		if (r.Error == nil) != (r.Status == BatchPublished) {
+			t.Errorf("Got result %d with status %s and error %v", r.Index, r.Status, r.Error)
+		}
+	}
+	if code := resp.Results[1].Error.Code; code != CodePublishFailed {
+		t.Errorf("Got error code %s; want %s", code, CodePublishFailed)
+	}
+}
+
+func TestHTTPTraceContext(t *testing.T) {
+	stu := setup(t)
+	tracer := mocktracer.New()
+	traced := client.TracingMiddleware(tracer, "trace")(stu.client)
+	srv := NewDeviceService(stu.CAPath, func() client.Client { return traced }, stu.backend, health.New(), events.NewBus())
+	var sent string
+	stu.client.(*mocks.MockClient).SendMessageFn = func(ctx context.Context, message string, topic string) error {
+		sent = message
+		return nil
+	}
+	stu.connect(t, srv, "lamassu-client")
+	h := MakeHTTPHandler(srv, log.NewNopLogger(), tracer, auth.Anonymous())
+
+	caller := tracer.StartSpan("caller")
+	r := httptest.NewRequest("POST", "/v1/device/message", strings.NewReader(`{"clientID": "lamassu-client", "topic": "lamassu-sample", "message": "{\"temperature\": 21.5}"}`))
+	tracer.Inject(caller.Context(), stdopentracing.HTTPHeaders, stdopentracing.HTTPHeadersCarrier(r.Header))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status code %d; want %d", w.Code, http.StatusOK)
+	}
+
+	var payload struct {
+		Temperature float64                       `json:"temperature"`
+		Trace       stdopentracing.TextMapCarrier `json:"trace"`
+	}
+	if err := json.Unmarshal([]byte(sent), &payload); err != nil {
+		t.Fatalf("Published message %s is not JSON: %s", sent, err)
+	}
+	if payload.Temperature != 21.5 {
+		t.Errorf("Published message %s lost its fields", sent)
+	}
+	spanCtx, err := tracer.Extract(stdopentracing.TextMap, payload.Trace)
+	if err != nil {
+		t.Fatalf("Unable to extract the trace context of %s: %s", sent, err)
+	}
+	if got, want := spanCtx.(mocktracer.MockSpanContext).TraceID, caller.(*mocktracer.MockSpan).SpanContext.TraceID; got != want {
+		t.Errorf("Got message in trace %d; want %d", got, want)
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	stu := setup(t)
+	srv := NewDeviceService(stu.CAPath, stu.clients, stu.backend, health.New(), events.NewBus())
+	h := MakeHTTPHandler(srv, log.NewNopLogger(), stdopentracing.NoopTracer{}, mtls.NewAuthenticator(auth.RoleReadOnly))
+	connect := `{"brokerURL": "ssl://mosquitto:1883", "clientID": "lamassu-client"}`
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		units  []string
+		status int
+		code   ErrorCode
+	}{
+		{"Health without credentials", "GET", "/v1/health/ready", "", nil, http.StatusOK, ""},
+		{"Connect without credentials", "POST", "/v1/device/connect", connect, nil, http.StatusUnauthorized, CodeUnauthenticated},
+		{"Events without credentials", "GET", "/v1/events", "", nil, http.StatusUnauthorized, CodeUnauthenticated},
+		{"Connect as read-only", "POST", "/v1/device/connect", connect, []string{}, http.StatusForbidden, CodeForbidden},
+		{"Connect as operator", "POST", "/v1/device/connect", connect, []string{"operator"}, http.StatusNotFound, CodeIdentityNotFound},
+		{"State as read-only", "GET", "/v1/device/state?clientID=lamassu-client", "", []string{}, http.StatusConflict, CodeNotConnected},
+		{"State without client ID", "GET", "/v1/device/state", "", []string{}, http.StatusBadRequest, CodeInvalidRequest},
+		{"State with POST", "POST", "/v1/device/state", `{"clientID": "lamassu-client"}`, []string{}, http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			r.TLS = &tls.ConnectionState{}
+			if tc.units != nil {
+				cert := &x509.Certificate{Subject: pkix.Name{CommonName: "orchestrator", OrganizationalUnit: tc.units}}
+				r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tc.status {
+				t.Errorf("Got status code %d; want %d", w.Code, tc.status)
+			}
+			if tc.code == "" {
+				return
+			}
+			var body struct {
+				Error struct {
+					Code ErrorCode `json:"code"`
+				} `json:"error"`
+			}
+			json.NewDecoder(w.Body).Decode(&body)
+			if body.Error.Code != tc.code {
+				t.Errorf("Got error code %s; want %s", body.Error.Code, tc.code)
+			}
+			if tc.code == CodeUnauthenticated && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("Unauthenticated response has no WWW-Authenticate header")
+			}
+		})
+	}
+}
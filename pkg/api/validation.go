@@ -0,0 +1,170 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maxRequestSize is the largest request body accepted, multipart uploads
+// included.
+const maxRequestSize = 4 << 20
+
+// validateRequests rejects JSON request bodies that do not match the schema
+// published for their route, listing every problem found. Multipart uploads
+// and requests without a body schema are passed through. Every body is
+// limited to maxRequestSize, before the caller is even authenticated.
+func validateRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+		schema := requestSchema(r)
+		if schema == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			encodeError(r.Context(), ErrRequestTooLarge.wrap(err), w)
+			return
+		}
+		if err != nil {
+			encodeError(r.Context(), ErrMalformedRequest.wrap(err), w)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var doc interface{}
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.UseNumber()
+		if err := d.Decode(&doc); err != nil {
+			// Leave syntax errors to the decoders, they report them already.
+			next.ServeHTTP(w, r)
+			return
+		}
+		if problems := spec.validate(schema, doc, ""); len(problems) > 0 {
+			e := ErrInvalidRequest.wrap(nil)
+			e.Details = problems
+			encodeError(r.Context(), e, w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestSchema returns the request body schema of the operation matched by
+// the router, if any.
+func requestSchema(r *http.Request) *Schema {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return nil
+	}
+	path, err := route.GetPathTemplate()
+	if err != nil {
+		return nil
+	}
+	return spec.requests[r.Method+" "+path]
+}
+
+// validate checks v against s and returns one message per problem, prefixed
+// with the JSON path of the offending value. Optional properties set to null
+// are taken as absent, as the decoders do.
+func (doc *openAPI) validate(s *Schema, v interface{}, path string) []string {
+	if s.Ref != "" {
+		s = doc.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	at := path
+	if at == "" {
+		at = "body"
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: must be an object", at)}
+		}
+		var problems []string
+		required := make(map[string]bool, len(s.Required))
+		for _, name := range s.Required {
+			required[name] = true
+			if _, ok := obj[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: is required", joinPath(path, name)))
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					problems = append(problems, fmt.Sprintf("%s: unknown field", joinPath(path, name)))
+				}
+				continue
+			}
+			if obj[name] == nil && !required[name] {
+				continue
+			}
+			problems = append(problems, doc.validate(prop, obj[name], joinPath(path, name))...)
+		}
+		return problems
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: must be an array", at)}
+		}
+		var problems []string
+		for i, item := range arr {
+			problems = append(problems, doc.validate(s.Items, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return problems
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s: must be a string", at)}
+		}
+		if s.Format == "byte" {
+			if _, err := base64.StdEncoding.DecodeString(str); err != nil {
+				return []string{fmt.Sprintf("%s: must be base64 encoded", at)}
+			}
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return []string{fmt.Sprintf("%s: must be a boolean", at)}
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if _, err := n.Int64(); !ok || err != nil {
+			return []string{fmt.Sprintf("%s: must be an integer", at)}
+		}
+	case "number":
+		if _, ok := v.(json.Number); !ok {
+			return []string{fmt.Sprintf("%s: must be a number", at)}
+		}
+	}
+	return nil
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,187 @@
+// Package auth authenticates API callers and authorizes them by role.
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Role is granted to authenticated callers. Operators can also do everything
+// read-only callers can.
+type Role string
+
+const (
+	RoleReadOnly Role = "read-only"
+	RoleOperator Role = "operator"
+)
+
+var (
+	// ErrNoCredentials is returned by authenticators when the caller did not
+	// present the credentials they handle.
+	ErrNoCredentials   = errors.New("no credentials")
+	ErrUnauthenticated = errors.New("authentication required")
+	ErrInvalidToken    = errors.New("invalid bearer token")
+	ErrForbidden       = errors.New("caller is not allowed to perform this operation")
+)
+
+// Principal is an authenticated caller.
+type Principal struct {
+	Subject string
+	Method  string
+	Roles   []Role
+}
+
+func (p Principal) Has(role Role) bool {
+	for _, r := range p.Roles {
+		if r == role || r == RoleOperator {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator identifies the caller from the credentials stored in ctx by
+// HTTPToContext or GRPCToContext.
+type Authenticator interface {
+	Authenticate(ctx context.Context) (Principal, error)
+}
+
+// ParseRoles keeps the known roles among values.
+func ParseRoles(values []string) []Role {
+	var roles []Role
+	for _, v := range values {
+		switch r := Role(v); r {
+		case RoleReadOnly, RoleOperator:
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
+
+type anonymous struct{}
+
+// Anonymous lets every caller in as an operator, for deployments where the
+// API is protected otherwise.
+func Anonymous() Authenticator {
+	return anonymous{}
+}
+
+func (anonymous) Authenticate(ctx context.Context) (Principal, error) {
+	return Principal{Subject: "anonymous", Method: "none", Roles: []Role{RoleOperator}}, nil
+}
+
+type chain []Authenticator
+
+// Chain tries each authenticator in order. Callers are rejected by the first
+// authenticator whose credentials they presented but failed to verify.
+func Chain(authenticators ...Authenticator) Authenticator {
+	return chain(authenticators)
+}
+
+func (c chain) Authenticate(ctx context.Context) (Principal, error) {
+	for _, a := range c {
+		p, err := a.Authenticate(ctx)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return p, err
+	}
+	return Principal{}, ErrUnauthenticated
+}
+
+// Middleware rejects callers that are not authenticated or lack role, and
+// stores the principal in the context of the next endpoint.
+func Middleware(a Authenticator, role Role) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			ctx, err := Authorize(ctx, a, role)
+			if err != nil {
+				return nil, err
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// Authorize is Middleware for handlers that are not go-kit endpoints.
+func Authorize(ctx context.Context, a Authenticator, role Role) (context.Context, error) {
+	p, err := a.Authenticate(ctx)
+	if errors.Is(err, ErrNoCredentials) {
+		return ctx, ErrUnauthenticated
+	} else if err != nil {
+		return ctx, err
+	}
+	if !p.Has(role) {
+		return ctx, ErrForbidden
+	}
+	return context.WithValue(ctx, principalKey, p), nil
+}
+
+type contextKey int
+
+const (
+	credentialsKey contextKey = iota
+	principalKey
+)
+
+// Credentials are presented by the caller of a request.
+type Credentials struct {
+	BearerToken string
+	// VerifiedChains are the client certificate chains verified during the
+	// TLS handshake.
+	VerifiedChains [][]*x509.Certificate
+}
+
+func CredentialsFromContext(ctx context.Context) Credentials {
+	c, _ := ctx.Value(credentialsKey).(Credentials)
+	return c
+}
+
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey).(Principal)
+	return p, ok
+}
+
+// HTTPToContext stores the credentials of an HTTP request in its context.
+func HTTPToContext() func(ctx context.Context, r *http.Request) context.Context {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		var c Credentials
+		c.BearerToken = bearerToken(r.Header.Get("Authorization"))
+		if r.TLS != nil {
+			c.VerifiedChains = r.TLS.VerifiedChains
+		}
+		return context.WithValue(ctx, credentialsKey, c)
+	}
+}
+
+// GRPCToContext stores the credentials of a gRPC call in its context.
+func GRPCToContext() func(ctx context.Context, md metadata.MD) context.Context {
+	return func(ctx context.Context, md metadata.MD) context.Context {
+		var c Credentials
+		if values := md.Get("authorization"); len(values) > 0 {
+			c.BearerToken = bearerToken(values[0])
+		}
+		if p, ok := peer.FromContext(ctx); ok {
+			if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+				c.VerifiedChains = info.State.VerifiedChains
+			}
+		}
+		return context.WithValue(ctx, credentialsKey, c)
+	}
+}
+
+func bearerToken(header string) string {
+	const prefix = "bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
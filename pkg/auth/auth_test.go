@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+type staticAuthenticator struct {
+	principal Principal
+	err       error
+}
+
+func (a staticAuthenticator) Authenticate(ctx context.Context) (Principal, error) {
+	return a.principal, a.err
+}
+
+func TestMiddleware(t *testing.T) {
+	reader := staticAuthenticator{principal: Principal{Subject: "ui", Roles: []Role{RoleReadOnly}}}
+	operator := staticAuthenticator{principal: Principal{Subject: "orchestrator", Roles: []Role{RoleOperator}}}
+	none := staticAuthenticator{err: ErrNoCredentials}
+	invalid := staticAuthenticator{err: ErrInvalidToken}
+
+	testCases := []struct {
+		name string
+		a    Authenticator
+		role Role
+		ret  error
+	}{
+		{"No credentials", Chain(none, none), RoleReadOnly, ErrUnauthenticated},
+		{"Invalid credentials", Chain(none, invalid, operator), RoleReadOnly, ErrInvalidToken},
+		{"Read-only reads", Chain(none, reader), RoleReadOnly, nil},
+		{"Read-only operates", Chain(reader), RoleOperator, ErrForbidden},
+		{"Operator reads", Chain(operator), RoleReadOnly, nil},
+		{"Anonymous operates", Anonymous(), RoleOperator, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			var got Principal
+			e := Middleware(tc.a, tc.role)(func(ctx context.Context, request interface{}) (interface{}, error) {
+				got, _ = PrincipalFromContext(ctx)
+				return nil, nil
+			})
+			_, err := e(context.Background(), nil)
+			if !errors.Is(err, tc.ret) {
+				t.Fatalf("Got result is %v; want %v", err, tc.ret)
+			}
+			if err == nil && !got.Has(tc.role) {
+				t.Errorf("Endpoint got principal %+v without role %s", got, tc.role)
+			}
+		})
+	}
+}
+
+func TestHTTPToContext(t *testing.T) {
+	testCases := []struct {
+		header string
+		token  string
+	}{
+		{"Bearer abc.def.ghi", "abc.def.ghi"},
+		{"bearer abc.def.ghi", "abc.def.ghi"},
+		{"Basic dXNlcjpwYXNz", ""},
+		{"", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %q", tc.header), func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", tc.header)
+			c := CredentialsFromContext(HTTPToContext()(context.Background(), r))
+			if c.BearerToken != tc.token {
+				t.Errorf("Got token %q; want %q", c.BearerToken, tc.token)
+			}
+		})
+	}
+}
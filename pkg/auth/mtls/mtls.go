@@ -0,0 +1,38 @@
+// Package mtls authenticates callers by the client certificate they presented
+// during the TLS handshake.
+package mtls
+
+import (
+	"context"
+
+	"github.com/lamassuiot/device-virtual/pkg/auth"
+)
+
+type authenticator struct {
+	defaultRole auth.Role
+}
+
+// NewAuthenticator grants callers the roles named by the organizational units
+// of their certificate, or defaultRole when none names a role. The TLS server
+// must verify client certificates against the trusted CA.
+func NewAuthenticator(defaultRole auth.Role) auth.Authenticator {
+	return &authenticator{defaultRole: defaultRole}
+}
+
+func (a *authenticator) Authenticate(ctx context.Context) (auth.Principal, error) {
+	chains := auth.CredentialsFromContext(ctx).VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return auth.Principal{}, auth.ErrNoCredentials
+	}
+	leaf := chains[0][0]
+
+	roles := auth.ParseRoles(leaf.Subject.OrganizationalUnit)
+	if len(roles) == 0 && a.defaultRole != "" {
+		roles = []auth.Role{a.defaultRole}
+	}
+	return auth.Principal{
+		Subject: leaf.Subject.CommonName,
+		Method:  "mtls",
+		Roles:   roles,
+	}, nil
+}
@@ -0,0 +1,52 @@
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/lamassuiot/device-virtual/pkg/auth"
+)
+
+func TestAuthenticate(t *testing.T) {
+	a := NewAuthenticator(auth.RoleReadOnly)
+
+	testCases := []struct {
+		name  string
+		chain []*x509.Certificate
+		roles []auth.Role
+		ret   error
+	}{
+		{"No certificate", nil, nil, auth.ErrNoCredentials},
+		{"Default role", []*x509.Certificate{certificate("orchestrator")}, []auth.Role{auth.RoleReadOnly}, nil},
+		{"Operator unit", []*x509.Certificate{certificate("orchestrator", "lab", "operator")}, []auth.Role{auth.RoleOperator}, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/events", nil)
+			r.TLS = &tls.ConnectionState{}
+			if tc.chain != nil {
+				r.TLS.VerifiedChains = [][]*x509.Certificate{tc.chain}
+			}
+			ctx := auth.HTTPToContext()(context.Background(), r)
+
+			p, err := a.Authenticate(ctx)
+			if !errors.Is(err, tc.ret) {
+				t.Fatalf("Got result is %v; want %v", err, tc.ret)
+			}
+			if err == nil && (p.Subject != "orchestrator" || !reflect.DeepEqual(p.Roles, tc.roles)) {
+				t.Errorf("Got principal %+v; want orchestrator with roles %v", p, tc.roles)
+			}
+		})
+	}
+}
+
+func certificate(cn string, units ...string) *x509.Certificate {
+	return &x509.Certificate{Subject: pkix.Name{CommonName: cn, OrganizationalUnit: units}}
+}
@@ -0,0 +1,112 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	jose "github.com/go-jose/go-jose/v3"
+)
+
+var ErrKeySetLoading = errors.New("unable to load JSON Web Key Set")
+
+// minRefreshInterval bounds how often an unknown key ID triggers a refresh of
+// the key set, failed or not, so that forged tokens cannot hammer the
+// identity provider.
+const minRefreshInterval = time.Minute
+
+// KeySet holds the JSON Web Keys that sign bearer tokens. Keys are reloaded
+// when a token refers to a key ID that is not known yet, by one caller at a
+// time and without holding the lock, so that the other callers are served
+// the known keys meanwhile.
+type KeySet struct {
+	mtx         sync.Mutex
+	fetch       func() ([]byte, error)
+	keys        jose.JSONWebKeySet
+	attemptedAt time.Time
+	refreshing  bool
+	now         func() time.Time
+}
+
+// NewFileKeySet reads the key set from a local JWKS document.
+func NewFileKeySet(path string) (*KeySet, error) {
+	return newKeySet(func() ([]byte, error) {
+		return ioutil.ReadFile(path)
+	})
+}
+
+// NewRemoteKeySet downloads the key set from the JWKS URL of an identity
+// provider.
+func NewRemoteKeySet(url string, client *http.Client) (*KeySet, error) {
+	return newKeySet(func() ([]byte, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	})
+}
+
+func newKeySet(fetch func() ([]byte, error)) (*KeySet, error) {
+	ks := &KeySet{fetch: fetch, now: time.Now}
+	keys, err := ks.load()
+	if err != nil {
+		return nil, err
+	}
+	ks.keys = keys
+	ks.attemptedAt = ks.now()
+	return ks, nil
+}
+
+func (ks *KeySet) load() (jose.JSONWebKeySet, error) {
+	data, err := ks.fetch()
+	if err != nil {
+		return jose.JSONWebKeySet{}, fmt.Errorf("%w: %w", ErrKeySetLoading, err)
+	}
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return jose.JSONWebKeySet{}, fmt.Errorf("%w: %w", ErrKeySetLoading, err)
+	}
+	return keys, nil
+}
+
+// lookup returns the public keys with the given key ID, or every key when
+// the token does not name one.
+func (ks *KeySet) lookup(kid string) []jose.JSONWebKey {
+	ks.mtx.Lock()
+	keys := ks.find(kid)
+	if len(keys) > 0 || ks.refreshing || ks.now().Sub(ks.attemptedAt) < minRefreshInterval {
+		ks.mtx.Unlock()
+		return keys
+	}
+	ks.refreshing = true
+	ks.attemptedAt = ks.now()
+	ks.mtx.Unlock()
+
+	loaded, err := ks.load()
+
+	ks.mtx.Lock()
+	defer ks.mtx.Unlock()
+	ks.refreshing = false
+	// Keep the known keys if the provider cannot be reached.
+	if err == nil {
+		ks.keys = loaded
+	}
+	return ks.find(kid)
+}
+
+func (ks *KeySet) find(kid string) []jose.JSONWebKey {
+	if kid == "" {
+		return ks.keys.Keys
+	}
+	return ks.keys.Key(kid)
+}
@@ -0,0 +1,113 @@
+// Package oidc authenticates callers by the OpenID Connect bearer token they
+// present, verified against the JSON Web Key Set of the identity provider.
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/auth"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+// leeway tolerates clock skew with the identity provider.
+const leeway = time.Minute
+
+// algorithms are the accepted signature algorithms. Symmetric algorithms are
+// left out, as the keys come from a public key set.
+var algorithms = map[string]bool{
+	string(jose.RS256): true, string(jose.RS384): true, string(jose.RS512): true,
+	string(jose.PS256): true, string(jose.PS384): true, string(jose.PS512): true,
+	string(jose.ES256): true, string(jose.ES384): true, string(jose.ES512): true,
+	string(jose.EdDSA): true,
+}
+
+type authenticator struct {
+	keys       *KeySet
+	issuer     string
+	audience   string
+	rolesClaim string
+	now        func() time.Time
+}
+
+// NewAuthenticator accepts tokens signed by keys and issued by issuer for
+// audience. Empty issuer or audience are not checked. Callers get the roles
+// listed in rolesClaim, either as an array or a space separated string.
+func NewAuthenticator(keys *KeySet, issuer string, audience string, rolesClaim string) auth.Authenticator {
+	return &authenticator{
+		keys:       keys,
+		issuer:     issuer,
+		audience:   audience,
+		rolesClaim: rolesClaim,
+		now:        time.Now,
+	}
+}
+
+func (a *authenticator) Authenticate(ctx context.Context) (auth.Principal, error) {
+	raw := auth.CredentialsFromContext(ctx).BearerToken
+	if raw == "" {
+		return auth.Principal{}, auth.ErrNoCredentials
+	}
+
+	token, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return auth.Principal{}, fmt.Errorf("%w: %w", auth.ErrInvalidToken, err)
+	}
+	if len(token.Headers) != 1 || !algorithms[token.Headers[0].Algorithm] {
+		return auth.Principal{}, fmt.Errorf("%w: unsupported signature algorithm", auth.ErrInvalidToken)
+	}
+
+	var claims jwt.Claims
+	var extra map[string]interface{}
+	verified := false
+	for _, key := range a.keys.lookup(token.Headers[0].KeyID) {
+		if key.Algorithm != "" && key.Algorithm != token.Headers[0].Algorithm {
+			continue
+		}
+		if err := token.Claims(key.Public().Key, &claims, &extra); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return auth.Principal{}, fmt.Errorf("%w: signature not verified by any trusted key", auth.ErrInvalidToken)
+	}
+
+	if claims.Expiry == nil {
+		return auth.Principal{}, fmt.Errorf("%w: token does not expire", auth.ErrInvalidToken)
+	}
+	expected := jwt.Expected{Issuer: a.issuer, Time: a.now()}
+	if a.audience != "" {
+		expected.Audience = jwt.Audience{a.audience}
+	}
+	if err := claims.ValidateWithLeeway(expected, leeway); err != nil {
+		return auth.Principal{}, fmt.Errorf("%w: %w", auth.ErrInvalidToken, err)
+	}
+
+	return auth.Principal{
+		Subject: claims.Subject,
+		Method:  "oidc",
+		Roles:   auth.ParseRoles(claimValues(extra[a.rolesClaim])),
+	}, nil
+}
+
+func claimValues(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
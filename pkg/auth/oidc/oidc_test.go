@@ -0,0 +1,219 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/auth"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	issuer   = "https://idp.lamassu.test"
+	audience = "device-virtual"
+)
+
+func TestAuthenticate(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rogueKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	path := writeKeySet(t,
+		jose.JSONWebKey{Key: rsaKey.Public(), KeyID: "rsa", Algorithm: string(jose.RS256), Use: "sig"},
+		jose.JSONWebKey{Key: ecKey.Public(), KeyID: "ec", Algorithm: string(jose.ES256), Use: "sig"},
+	)
+	keys, err := NewFileKeySet(path)
+	if err != nil {
+		t.Fatalf("Unable to load key set: %s", err)
+	}
+	a := NewAuthenticator(keys, issuer, audience, "roles")
+
+	valid := func() claims {
+		return claims{
+			Claims: jwt.Claims{
+				Issuer:   issuer,
+				Subject:  "orchestrator",
+				Audience: jwt.Audience{audience},
+				Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+			Roles: []string{"operator"},
+		}
+	}
+	with := func(f func(*claims)) claims {
+		c := valid()
+		f(&c)
+		return c
+	}
+
+	testCases := []struct {
+		name  string
+		token string
+		roles []auth.Role
+		ret   error
+	}{
+		{"No token", "", nil, auth.ErrNoCredentials},
+		{"Malformed token", "not.a.token", nil, auth.ErrInvalidToken},
+		{"RSA operator", sign(t, rsaKey, jose.RS256, "rsa", valid()), []auth.Role{auth.RoleOperator}, nil},
+		{"ECDSA read-only", sign(t, ecKey, jose.ES256, "ec", with(func(c *claims) { c.Roles = "read-only" })), []auth.Role{auth.RoleReadOnly}, nil},
+		{"Unknown roles", sign(t, rsaKey, jose.RS256, "rsa", with(func(c *claims) { c.Roles = []string{"admin"} })), nil, nil},
+		{"Expired", sign(t, rsaKey, jose.RS256, "rsa", with(func(c *claims) { c.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour)) })), nil, auth.ErrInvalidToken},
+		{"No expiry", sign(t, rsaKey, jose.RS256, "rsa", with(func(c *claims) { c.Expiry = nil })), nil, auth.ErrInvalidToken},
+		{"Wrong issuer", sign(t, rsaKey, jose.RS256, "rsa", with(func(c *claims) { c.Issuer = "https://evil.test" })), nil, auth.ErrInvalidToken},
+		{"Wrong audience", sign(t, rsaKey, jose.RS256, "rsa", with(func(c *claims) { c.Audience = jwt.Audience{"other"} })), nil, auth.ErrInvalidToken},
+		{"Unknown key", sign(t, rogueKey, jose.RS256, "rogue", valid()), nil, auth.ErrInvalidToken},
+		{"Forged signature", sign(t, rogueKey, jose.RS256, "rsa", valid()), nil, auth.ErrInvalidToken},
+		{"Algorithm mismatch", sign(t, rsaKey, jose.PS256, "rsa", valid()), nil, auth.ErrInvalidToken},
+		{"Symmetric algorithm", sign(t, []byte("0123456789abcdef0123456789abcdef"), jose.HS256, "rsa", valid()), nil, auth.ErrInvalidToken},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			md := metadata.Pairs("authorization", "Bearer "+tc.token)
+			ctx := auth.GRPCToContext()(context.Background(), md)
+			p, err := a.Authenticate(ctx)
+			if !errors.Is(err, tc.ret) {
+				t.Fatalf("Got result is %v; want %v", err, tc.ret)
+			}
+			if err == nil && !reflect.DeepEqual(p.Roles, tc.roles) {
+				t.Errorf("Got roles %v; want %v", p.Roles, tc.roles)
+			}
+		})
+	}
+}
+
+func TestKeySetRefresh(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	path := writeKeySet(t, jose.JSONWebKey{Key: oldKey.Public(), KeyID: "old"})
+	keys, err := NewFileKeySet(path)
+	if err != nil {
+		t.Fatalf("Unable to load key set: %s", err)
+	}
+	now := time.Now()
+	keys.now = func() time.Time { return now }
+
+	writeKeySetTo(t, path, jose.JSONWebKey{Key: oldKey.Public(), KeyID: "old"}, jose.JSONWebKey{Key: newKey.Public(), KeyID: "new"})
+	if len(keys.lookup("new")) != 0 {
+		t.Errorf("Key set refreshed before the minimum interval")
+	}
+	now = now.Add(minRefreshInterval)
+	if len(keys.lookup("new")) != 1 {
+		t.Errorf("Key set not refreshed for an unknown key ID")
+	}
+
+	if _, err := NewFileKeySet(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, ErrKeySetLoading) {
+		t.Errorf("Got result is %v; want %v", err, ErrKeySetLoading)
+	}
+}
+
+func TestKeySetRefreshFailure(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	data, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "old"}}})
+	var mtx sync.Mutex
+	fetches := 0
+	release := make(chan struct{})
+	keys, err := newKeySet(func() ([]byte, error) {
+		mtx.Lock()
+		fetches++
+		n := fetches
+		mtx.Unlock()
+		if n == 1 {
+			return data, nil
+		}
+		<-release
+		return nil, errors.New("identity provider unreachable")
+	})
+	if err != nil {
+		t.Fatalf("Unable to load key set: %s", err)
+	}
+	now := time.Now().Add(minRefreshInterval)
+	keys.now = func() time.Time { return now }
+
+	done := make(chan []jose.JSONWebKey)
+	go func() { done <- keys.lookup("unknown") }()
+	for {
+		keys.mtx.Lock()
+		refreshing := keys.refreshing
+		keys.mtx.Unlock()
+		if refreshing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(keys.lookup("old")) != 1 {
+		t.Errorf("Known keys not served during a refresh")
+	}
+	if len(keys.lookup("other")) != 0 {
+		t.Errorf("Got keys for an unknown key ID during a refresh")
+	}
+	close(release)
+	<-done
+
+	for i := 0; i < 10; i++ {
+		keys.lookup("unknown")
+	}
+	if fetches != 2 {
+		t.Errorf("Got %d fetches; want a failed refresh to wait for the minimum interval", fetches)
+	}
+	if len(keys.lookup("old")) != 1 {
+		t.Errorf("Known keys lost after a failed refresh")
+	}
+}
+
+type claims struct {
+	jwt.Claims
+	Roles interface{} `json:"roles,omitempty"`
+}
+
+func sign(t *testing.T, key interface{}, alg jose.SignatureAlgorithm, kid string, c claims) string {
+	t.Helper()
+
+	if signer, ok := key.(crypto.Signer); ok {
+		key = jose.JSONWebKey{Key: signer, KeyID: kid}
+	} else {
+		key = jose.JSONWebKey{Key: key, KeyID: kid}
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, nil)
+	if err != nil {
+		t.Fatalf("Unable to create signer: %s", err)
+	}
+	token, err := jwt.Signed(signer).Claims(c).CompactSerialize()
+	if err != nil {
+		t.Fatalf("Unable to sign token: %s", err)
+	}
+	return token
+}
+
+func writeKeySet(t *testing.T, keys ...jose.JSONWebKey) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeKeySetTo(t, path, keys...)
+	return path
+}
+
+func writeKeySetTo(t *testing.T, path string, keys ...jose.JSONWebKey) {
+	t.Helper()
+
+	data, err := json.Marshal(jose.JSONWebKeySet{Keys: keys})
+	if err != nil {
+		t.Fatalf("Unable to encode key set: %s", err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Unable to write key set: %s", err)
+	}
+}
@@ -0,0 +1,110 @@
+// Package certwatch serves a TLS certificate read from files and swaps it
+// when the files change, like when cert-manager renews a Kubernetes secret,
+// without restarting the servers using it.
+package certwatch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+)
+
+// Loader holds the certificate key pair of certFile and keyFile.
+type Loader struct {
+	certFile string
+	keyFile  string
+	expiry   metrics.Gauge
+	logger   log.Logger
+
+	cert atomic.Pointer[tls.Certificate]
+	mtx  sync.Mutex
+	hash []byte
+}
+
+// NewLoader reads the key pair and reports the expiry of the certificate,
+// as a Unix timestamp, to expiry.
+func NewLoader(certFile string, keyFile string, expiry metrics.Gauge, logger log.Logger) (*Loader, error) {
+	l := &Loader{certFile: certFile, keyFile: keyFile, expiry: expiry, logger: logger}
+	if _, err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// GetCertificate returns the certificate in effect, to be used as the
+// tls.Config hook of the same name.
+func (l *Loader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return l.cert.Load(), nil
+}
+
+// Reload reads the key pair again when the files changed and reports whether
+// it did. The certificate in effect is kept when they cannot be read or do not
+// match, like while they are being replaced.
+func (l *Loader) Reload() (bool, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	certPEM, err := os.ReadFile(l.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := os.ReadFile(l.keyFile)
+	if err != nil {
+		return false, err
+	}
+	hash := sha256.Sum256(append(certPEM, keyPEM...))
+	if bytes.Equal(hash[:], l.hash) {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+	cert.Leaf = leaf
+	l.cert.Store(&cert)
+	l.hash = hash[:]
+	l.expiry.Set(float64(leaf.NotAfter.Unix()))
+	return true, nil
+}
+
+// Watch checks the files every interval until ctx is done, calling done,
+// when not nil, with the result of every check.
+func (l *Loader) Watch(ctx context.Context, interval time.Duration, done func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := l.Reload()
+		if done != nil {
+			done(err)
+		}
+		if err != nil {
+			level.Warn(l.logger).Log("err", err, "msg", "Could not reload server certificate, keeping the current one")
+			continue
+		}
+		if reloaded {
+			leaf := l.cert.Load().Leaf
+			level.Info(l.logger).Log("msg", "Server certificate reloaded", "serial_number", leaf.SerialNumber.String(), "not_after", leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package certwatch
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/identity/identitytest"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+)
+
+// gauge keeps the last value set.
+type gauge struct {
+	mtx   sync.Mutex
+	value float64
+}
+
+func (g *gauge) With(labelValues ...string) metrics.Gauge { return g }
+func (g *gauge) Add(delta float64)                        {}
+func (g *gauge) Set(value float64) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.value = value
+}
+
+func (g *gauge) get() float64 {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.value
+}
+
+type pair struct {
+	ca       *identitytest.CA
+	certFile string
+	keyFile  string
+}
+
+func newPair(t *testing.T) *pair {
+	dir := t.TempDir()
+	return &pair{
+		ca:       identitytest.NewCA(t),
+		certFile: filepath.Join(dir, "tls.crt"),
+		keyFile:  filepath.Join(dir, "tls.key"),
+	}
+}
+
+func newKey(t *testing.T) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+	return key
+}
+
+// write issues a certificate for key and stores it, and the key unless nil.
+func (p *pair) write(t *testing.T, key crypto.Signer, certKey crypto.Signer) *x509.Certificate {
+	cert := p.ca.Issue(t, certKey.Public(), "device-virtual")
+	if err := os.WriteFile(p.certFile, []byte(identitytest.CertificatePEM(cert)), 0600); err != nil {
+		t.Fatalf("Unable to write certificate: %s", err)
+	}
+	if key != nil {
+		if err := os.WriteFile(p.keyFile, []byte(identitytest.KeyPEM(t, key)), 0600); err != nil {
+			t.Fatalf("Unable to write key: %s", err)
+		}
+	}
+	return cert
+}
+
+func TestReload(t *testing.T) {
+	p := newPair(t)
+	key := newKey(t)
+	first := p.write(t, key, key)
+	expiry := &gauge{}
+	l, err := NewLoader(p.certFile, p.keyFile, expiry, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to load certificate: %s", err)
+	}
+
+	var current *x509.Certificate
+	testCases := []struct {
+		name     string
+		prepare  func() *x509.Certificate
+		reloaded bool
+		err      bool
+	}{
+		{"Unchanged", func() *x509.Certificate { return first }, false, false},
+		{"Renewed", func() *x509.Certificate {
+			key := newKey(t)
+			return p.write(t, key, key)
+		}, true, false},
+		{"Key not written yet", func() *x509.Certificate {
+			p.write(t, nil, newKey(t))
+			return current
+		}, false, true},
+		{"Key missing", func() *x509.Certificate {
+			os.Remove(p.keyFile)
+			return current
+		}, false, true},
+	}
+	current = first
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			want := tc.prepare()
+			reloaded, err := l.Reload()
+			if reloaded != tc.reloaded || (err != nil) != tc.err {
+				t.Fatalf("Got reloaded %t and error %v; want %t and error %t", reloaded, err, tc.reloaded, tc.err)
+			}
+			cert, _ := l.GetCertificate(nil)
+			if cert.Leaf.SerialNumber.Cmp(want.SerialNumber) != 0 {
+				t.Errorf("Got certificate %s; want %s", cert.Leaf.SerialNumber, want.SerialNumber)
+			}
+			if expiry.get() != float64(want.NotAfter.Unix()) {
+				t.Errorf("Got expiry %f; want %d", expiry.get(), want.NotAfter.Unix())
+			}
+			current = want
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	p := newPair(t)
+	key := newKey(t)
+	p.write(t, key, key)
+	l, err := NewLoader(p.certFile, p.keyFile, &gauge{}, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to load certificate: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Watch(ctx, 10*time.Millisecond, nil)
+
+	// served returns the serial number of the certificate a server using the
+	// loader presents.
+	served := func() string {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			defer server.Close()
+			tls.Server(server, &tls.Config{GetCertificate: l.GetCertificate}).Handshake()
+		}()
+		conn := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+		if err := conn.Handshake(); err != nil {
+			t.Fatalf("Unable to handshake: %s", err)
+		}
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.String()
+	}
+
+	key = newKey(t)
+	renewed := p.write(t, key, key)
+	deadline := time.Now().Add(time.Second)
+	for served() != renewed.SerialNumber.String() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Renewed certificate not served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
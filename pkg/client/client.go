@@ -1,9 +1,52 @@
 package client
 
-import "crypto/tls"
+import (
+	"context"
+	"crypto/tls"
+	"time"
 
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrBrokerUnreachable = errors.New("unable to reach MQTT broker")
+	ErrTLSHandshake      = errors.New("TLS handshake with MQTT broker failed")
+	ErrConnectRefused    = errors.New("MQTT broker refused the connection")
+	ErrNotConnected      = errors.New("client is not connected to an MQTT broker")
+	// ErrPublishRejected reports messages that can never be published, unlike
+	// those lost with the connection or timed out.
+	ErrPublishRejected = errors.New("MQTT message rejected")
+)
+
+// Client is the MQTT connection of a device session. Contexts carry the
+// trace of the request and bound how long calls wait for the broker. Clients
+// reconnect on their own when the broker drops the connection, and report
+// the state of the connection.
 type Client interface {
-	Connect(URL string, clientID string, conf *tls.Config) error
-	Disconnect()
-	SendMessage(message string, topic string) error
+	Connect(ctx context.Context, URL string, clientID string, conf *tls.Config) error
+	Disconnect(ctx context.Context)
+	SendMessage(ctx context.Context, message string, topic string) error
+	Publish(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error
+	Subscribe(ctx context.Context, topic string, qos byte, handler MessageHandler) error
+	Unsubscribe(ctx context.Context, topic string) error
+	IsConnected() bool
+	State() State
+	History() []Transition
+	OnStateChange(handler StateHandler)
+}
+
+// Message is an MQTT message received on a subscription.
+type Message struct {
+	Topic      string
+	Payload    []byte
+	QoS        byte
+	Retained   bool
+	ReceivedAt time.Time
 }
+
+// MessageHandler is called for every message received on a subscription. It
+// must not block, as it runs on the client's receive loop.
+type MessageHandler func(Message)
+
+// Factory creates a new client for every device session.
+type Factory func() Client
@@ -0,0 +1,408 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Middleware decorates the client of every device session.
+type Middleware func(Client) Client
+
+// HandshakeObserver is told the duration and outcome of every TLS handshake
+// with a broker.
+type HandshakeObserver func(d time.Duration, err error)
+
+// TopicLabels bounds the topic label values of the metrics, so that large
+// fleets publishing to per-device topics do not explode their cardinality.
+type TopicLabels struct {
+	// Depth is the number of topic levels kept, zero reports every topic as
+	// "#". Levels equal to the client ID of the session are reported as "+".
+	Depth int
+	// Max is the number of distinct topic label values, further topics are
+	// reported as "other". Zero does not bound them.
+	Max int
+}
+
+// Metrics are the MQTT level metrics of device sessions. Topic and QoS
+// labels are named "topic" and "qos".
+type Metrics struct {
+	Connects          metrics.Counter // by "result"
+	Reconnects        metrics.Counter
+	Disconnects       metrics.Counter
+	Published         metrics.Counter   // by topic and QoS
+	PublishedBytes    metrics.Counter   // by topic and QoS
+	PublishLatency    metrics.Histogram // by topic and QoS, in seconds
+	Received          metrics.Counter   // by topic and QoS
+	HandshakeDuration metrics.Histogram // in seconds
+	HandshakeFailures metrics.Counter   // by "reason"
+	Sessions          *SessionCollector
+
+	Topics TopicLabels
+}
+
+// ObserveHandshake is a HandshakeObserver.
+func (m Metrics) ObserveHandshake(d time.Duration, err error) {
+	m.HandshakeDuration.Observe(d.Seconds())
+	if err != nil {
+		m.HandshakeFailures.With("reason", handshakeFailureReason(err)).Add(1)
+	}
+}
+
+// InstrumentingMiddleware reports the traffic of every client to m.
+func InstrumentingMiddleware(m Metrics) Middleware {
+	st := &instrumenting{
+		Metrics: m,
+		live:    make(map[string]int),
+		topics:  make(map[string]struct{}),
+	}
+	return func(next Client) Client {
+		return &instrumentingClient{next: next, st: st}
+	}
+}
+
+// instrumenting is shared by the clients of all the sessions.
+type instrumenting struct {
+	Metrics
+
+	mtx    sync.Mutex
+	live   map[string]int // live sessions by client ID
+	topics map[string]struct{}
+}
+
+// connected records a live session of clientID and tells whether another one
+// was live already, which the new session replaces.
+func (st *instrumenting) connected(clientID string) bool {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	n := st.live[clientID]
+	st.live[clientID] = n + 1
+	return n > 0
+}
+
+// disconnected forgets a live session of clientID, so that client IDs are
+// only tracked while they are connected.
+func (st *instrumenting) disconnected(clientID string) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	if st.live[clientID] <= 1 {
+		delete(st.live, clientID)
+		return
+	}
+	st.live[clientID]--
+}
+
+func (st *instrumenting) topic(clientID string, topic string) string {
+	if st.Topics.Depth <= 0 {
+		return "#"
+	}
+	levels := strings.Split(topic, "/")
+	truncated := len(levels) > st.Topics.Depth
+	if truncated {
+		levels = levels[:st.Topics.Depth]
+	}
+	for i, level := range levels {
+		if clientID != "" && level == clientID {
+			levels[i] = "+"
+		}
+	}
+	label := strings.Join(levels, "/")
+	if truncated {
+		label += "/#"
+	}
+
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	if _, ok := st.topics[label]; !ok {
+		if st.Topics.Max > 0 && len(st.topics) >= st.Topics.Max {
+			return "other"
+		}
+		st.topics[label] = struct{}{}
+	}
+	return label
+}
+
+type instrumentingClient struct {
+	next     Client
+	st       *instrumenting
+	clientID string
+	live     bool
+}
+
+func (c *instrumentingClient) Connect(ctx context.Context, URL string, clientID string, conf *tls.Config) error {
+	err := c.next.Connect(ctx, URL, clientID, conf)
+	c.st.Connects.With("result", connectResult(err)).Add(1)
+	if err != nil {
+		return err
+	}
+
+	reconnect := c.live
+	if c.live {
+		c.st.disconnected(c.clientID)
+	}
+	c.clientID = clientID
+	c.live = true
+	if c.st.connected(clientID) || reconnect {
+		c.st.Reconnects.Add(1)
+	}
+	if c.st.Sessions != nil {
+		c.st.Sessions.add(c, clientID, certificateNotAfter(conf))
+	}
+	return nil
+}
+
+func (c *instrumentingClient) Disconnect(ctx context.Context) {
+	c.next.Disconnect(ctx)
+	if !c.live {
+		return
+	}
+	c.live = false
+	c.st.disconnected(c.clientID)
+	c.st.Disconnects.Add(1)
+	if c.st.Sessions != nil {
+		c.st.Sessions.remove(c)
+	}
+}
+
+func (c *instrumentingClient) SendMessage(ctx context.Context, message string, topic string) error {
+	begin := time.Now()
+	err := c.next.SendMessage(ctx, message, topic)
+	if err == nil {
+		c.published(topic, 0, len(message), begin)
+	}
+	return err
+}
+
+// Publish reports the latency of successful publishes only, which for QoS 1
+// and 2 is the time until the broker acknowledged them.
+func (c *instrumentingClient) Publish(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error {
+	begin := time.Now()
+	err := c.next.Publish(ctx, topic, payload, qos, retained)
+	if err == nil {
+		c.published(topic, qos, len(payload), begin)
+	}
+	return err
+}
+
+func (c *instrumentingClient) published(topic string, qos byte, size int, begin time.Time) {
+	lvs := []string{"topic", c.st.topic(c.clientID, topic), "qos", strconv.Itoa(int(qos))}
+	c.st.Published.With(lvs...).Add(1)
+	c.st.PublishedBytes.With(lvs...).Add(float64(size))
+	c.st.PublishLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+}
+
+func (c *instrumentingClient) Subscribe(ctx context.Context, topic string, qos byte, handler MessageHandler) error {
+	return c.next.Subscribe(ctx, topic, qos, func(m Message) {
+		c.st.Received.With("topic", c.st.topic(c.clientID, m.Topic), "qos", strconv.Itoa(int(m.QoS))).Add(1)
+		handler(m)
+	})
+}
+
+func (c *instrumentingClient) Unsubscribe(ctx context.Context, topic string) error {
+	return c.next.Unsubscribe(ctx, topic)
+}
+
+func (c *instrumentingClient) IsConnected() bool {
+	return c.next.IsConnected()
+}
+
+func (c *instrumentingClient) State() State {
+	return c.next.State()
+}
+
+func (c *instrumentingClient) History() []Transition {
+	return c.next.History()
+}
+
+// OnStateChange also counts the automatic reconnections.
+func (c *instrumentingClient) OnStateChange(handler StateHandler) {
+	c.next.OnStateChange(func(t Transition) {
+		if t.State == StateConnected && t.Attempt > 0 {
+			c.st.Reconnects.Add(1)
+		}
+		if handler != nil {
+			handler(t)
+		}
+	})
+}
+
+func connectResult(err error) string {
+	switch {
+	case err == nil:
+		return "connected"
+	case errors.Is(err, ErrBrokerUnreachable):
+		return "broker_unreachable"
+	case errors.Is(err, ErrTLSHandshake):
+		return "tls_handshake_failed"
+	case errors.Is(err, ErrConnectRefused):
+		return "broker_refused"
+	default:
+		return "error"
+	}
+}
+
+// tlsAlerts names the alerts brokers usually send when refusing a handshake.
+var tlsAlerts = map[tls.AlertError]string{
+	40: "alert_handshake_failure",
+	42: "alert_bad_certificate",
+	44: "alert_certificate_revoked",
+	45: "alert_certificate_expired",
+	46: "alert_certificate_unknown",
+	48: "alert_unknown_ca",
+}
+
+// handshakeFailureReason classifies TLS handshake errors into a small set of
+// label values.
+func handshakeFailureReason(err error) string {
+	var certErr x509.CertificateInvalidError
+	if errors.As(err, &certErr) {
+		if certErr.Reason == x509.Expired {
+			return "certificate_expired"
+		}
+		return "certificate_invalid"
+	}
+	var authorityErr x509.UnknownAuthorityError
+	if errors.As(err, &authorityErr) {
+		return "unknown_authority"
+	}
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &hostnameErr) {
+		return "hostname_mismatch"
+	}
+	var alert tls.AlertError
+	if errors.As(err, &alert) {
+		if reason, ok := tlsAlerts[alert]; ok {
+			return reason
+		}
+		return "alert_other"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "other"
+}
+
+func certificateNotAfter(conf *tls.Config) time.Time {
+	if conf == nil || len(conf.Certificates) == 0 || len(conf.Certificates[0].Certificate) == 0 {
+		return time.Time{}
+	}
+	leaf := conf.Certificates[0].Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(conf.Certificates[0].Certificate[0]); err != nil {
+			return time.Time{}
+		}
+	}
+	return leaf.NotAfter
+}
+
+// SessionCollector is a Prometheus collector of the live sessions and the
+// days until their certificates expire. Unlike go-kit gauges, it drops the
+// series of a session when it disconnects and computes the days left when
+// scraped.
+type SessionCollector struct {
+	perDevice bool
+	sessions  *prometheus.Desc
+	expiry    *prometheus.Desc
+	now       func() time.Time
+
+	mtx  sync.Mutex
+	live map[*instrumentingClient]liveSession
+}
+
+type liveSession struct {
+	clientID string
+	notAfter time.Time
+}
+
+// NewSessionCollector reports the certificate expiry of every session with
+// perDevice, or the earliest one only without it.
+func NewSessionCollector(namespace string, subsystem string, perDevice bool) *SessionCollector {
+	c := &SessionCollector{
+		perDevice: perDevice,
+		sessions: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "sessions"),
+			"Number of live device sessions.",
+			nil, nil,
+		),
+		now:  time.Now,
+		live: make(map[*instrumentingClient]liveSession),
+	}
+	if perDevice {
+		c.expiry = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "certificate_expiry_days"),
+			"Days until the certificate of a device session expires.",
+			[]string{"client_id"}, nil,
+		)
+	} else {
+		c.expiry = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "certificate_expiry_days"),
+			"Days until the first certificate of the device sessions expires.",
+			nil, nil,
+		)
+	}
+	return c
+}
+
+func (c *SessionCollector) add(owner *instrumentingClient, clientID string, notAfter time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.live[owner] = liveSession{clientID: clientID, notAfter: notAfter}
+}
+
+func (c *SessionCollector) remove(owner *instrumentingClient) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.live, owner)
+}
+
+func (c *SessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sessions
+	ch <- c.expiry
+}
+
+func (c *SessionCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// A session replaced by a new connection of the same device is briefly
+	// live twice, report the newest certificate only.
+	expiries := make(map[string]time.Time)
+	for _, s := range c.live {
+		if s.notAfter.IsZero() {
+			continue
+		}
+		if t, ok := expiries[s.clientID]; !ok || s.notAfter.After(t) {
+			expiries[s.clientID] = s.notAfter
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.sessions, prometheus.GaugeValue, float64(len(c.live)))
+	now := c.now()
+	days := func(t time.Time) float64 { return t.Sub(now).Hours() / 24 }
+	if c.perDevice {
+		for clientID, t := range expiries {
+			ch <- prometheus.MustNewConstMetric(c.expiry, prometheus.GaugeValue, days(t), clientID)
+		}
+		return
+	}
+	var first time.Time
+	for _, t := range expiries {
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+	}
+	if !first.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.expiry, prometheus.GaugeValue, days(first))
+	}
+}
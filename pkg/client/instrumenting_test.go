@@ -0,0 +1,226 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeClient connects to any broker but "unreachable" and delivers every
+// publish to its subscription handler.
+type fakeClient struct {
+	Connection
+	handler MessageHandler
+}
+
+func (c *fakeClient) Connect(ctx context.Context, URL string, clientID string, conf *tls.Config) error {
+	if URL == "unreachable" {
+		return errors.Wrap(ErrBrokerUnreachable, "connection refused")
+	}
+	return nil
+}
+
+func (c *fakeClient) Disconnect(ctx context.Context) {}
+
+func (c *fakeClient) SendMessage(ctx context.Context, message string, topic string) error {
+	return c.Publish(ctx, topic, []byte(message), 0, false)
+}
+
+func (c *fakeClient) Publish(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error {
+	if c.handler != nil {
+		c.handler(Message{Topic: topic, Payload: payload, QoS: qos})
+	}
+	return nil
+}
+
+func (c *fakeClient) Subscribe(ctx context.Context, topic string, qos byte, handler MessageHandler) error {
+	c.handler = handler
+	return nil
+}
+
+func (c *fakeClient) Unsubscribe(ctx context.Context, topic string) error { return nil }
+
+func (c *fakeClient) IsConnected() bool { return true }
+
+type metricsSetUp struct {
+	connects, reconnects, disconnects        *prometheus.CounterVec
+	published, publishedBytes, received, tls *prometheus.CounterVec
+	metrics                                  Metrics
+}
+
+func newMetrics(topics TopicLabels, perDevice bool) *metricsSetUp {
+	counter := func(name string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name}, labels)
+	}
+	histogram := func(name string, labels ...string) *kitprometheus.Histogram {
+		return kitprometheus.NewHistogram(prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name}, labels))
+	}
+	m := &metricsSetUp{
+		connects:       counter("connects", "result"),
+		reconnects:     counter("reconnects"),
+		disconnects:    counter("disconnects"),
+		published:      counter("published", "topic", "qos"),
+		publishedBytes: counter("published_bytes", "topic", "qos"),
+		received:       counter("received", "topic", "qos"),
+		tls:            counter("tls_failures", "reason"),
+	}
+	m.metrics = Metrics{
+		Connects:          kitprometheus.NewCounter(m.connects),
+		Reconnects:        kitprometheus.NewCounter(m.reconnects),
+		Disconnects:       kitprometheus.NewCounter(m.disconnects),
+		Published:         kitprometheus.NewCounter(m.published),
+		PublishedBytes:    kitprometheus.NewCounter(m.publishedBytes),
+		PublishLatency:    histogram("publish_latency", "topic", "qos"),
+		Received:          kitprometheus.NewCounter(m.received),
+		HandshakeDuration: histogram("handshake_duration"),
+		HandshakeFailures: kitprometheus.NewCounter(m.tls),
+		Sessions:          NewSessionCollector("device_virtual", "mqtt", perDevice),
+		Topics:            topics,
+	}
+	return m
+}
+
+func TestInstrumentingMiddleware(t *testing.T) {
+	ctx := context.Background()
+	m := newMetrics(TopicLabels{Depth: 2, Max: 3}, false)
+	mw := InstrumentingMiddleware(m.metrics)
+
+	c := mw(&fakeClient{})
+	if err := c.Connect(ctx, "unreachable", "lamassu-client", nil); err == nil {
+		t.Fatalf("Connected to an unreachable broker")
+	}
+	if err := c.Connect(ctx, "ssl://broker", "lamassu-client", nil); err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	c.Subscribe(ctx, "devices/lamassu-client/commands", 1, func(Message) {})
+	for _, topic := range []string{"devices/lamassu-client/telemetry", "devices/lamassu-client/status", "lamassu", "fleet/a/b", "fleet/c"} {
+		c.Publish(ctx, topic, []byte("hello"), 1, false)
+	}
+
+	// A second session of the device replaces the live one.
+	replacement := mw(&fakeClient{})
+	replacement.Connect(ctx, "ssl://broker", "lamassu-client", nil)
+	c.Disconnect(ctx)
+	c.Disconnect(ctx)
+	replacement.Disconnect(ctx)
+
+	// No session of the device is live anymore.
+	c = mw(&fakeClient{})
+	c.Connect(ctx, "ssl://broker", "lamassu-client", nil)
+
+	testCases := []struct {
+		name   string
+		metric prometheus.Collector
+		want   float64
+	}{
+		{"Connected", m.connects.WithLabelValues("connected"), 3},
+		{"Broker unreachable", m.connects.WithLabelValues("broker_unreachable"), 1},
+		{"Reconnects", m.reconnects.WithLabelValues(), 1},
+		{"Disconnects", m.disconnects.WithLabelValues(), 2},
+		{"Client ID replaced and truncated", m.published.WithLabelValues("devices/+/#", "1"), 2},
+		{"Bytes", m.publishedBytes.WithLabelValues("devices/+/#", "1"), 10},
+		{"Short topic", m.published.WithLabelValues("lamassu", "1"), 1},
+		{"Truncated", m.published.WithLabelValues("fleet/a/#", "1"), 1},
+		{"Over max topics", m.published.WithLabelValues("other", "1"), 1},
+		{"Received", m.received.WithLabelValues("devices/+/#", "1"), 2},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			if got := testutil.ToFloat64(tc.metric); got != tc.want {
+				t.Errorf("Got %v; want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandshakeFailures(t *testing.T) {
+	m := newMetrics(TopicLabels{}, false)
+
+	testCases := []struct {
+		name   string
+		err    error
+		reason string
+	}{
+		{"Expired", x509.CertificateInvalidError{Reason: x509.Expired}, "certificate_expired"},
+		{"Unknown authority", &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, "unknown_authority"},
+		{"Hostname", x509.HostnameError{Host: "broker"}, "hostname_mismatch"},
+		{"Alert", fmt.Errorf("remote error: %w", tls.AlertError(48)), "alert_unknown_ca"},
+		{"Timeout", &net.OpError{Op: "read", Err: timeoutError{}}, "timeout"},
+		{"Other", errors.New("unexpected EOF"), "other"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			m.metrics.ObserveHandshake(time.Millisecond, tc.err)
+			if got := testutil.ToFloat64(m.tls.WithLabelValues(tc.reason)); got != 1 {
+				t.Errorf("Got %v failures with reason %s; want 1", got, tc.reason)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestSessionCollector(t *testing.T) {
+	now := time.Now()
+	conf := func(days int) *tls.Config {
+		leaf := &x509.Certificate{NotAfter: now.Add(time.Duration(days) * 24 * time.Hour)}
+		return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{{0}}, Leaf: leaf}}}
+	}
+
+	testCases := []struct {
+		name      string
+		perDevice bool
+		want      string
+	}{
+		{"Earliest expiry", false, `
+			# HELP device_virtual_mqtt_certificate_expiry_days Days until the first certificate of the device sessions expires.
+			# TYPE device_virtual_mqtt_certificate_expiry_days gauge
+			device_virtual_mqtt_certificate_expiry_days 10
+			# HELP device_virtual_mqtt_sessions Number of live device sessions.
+			# TYPE device_virtual_mqtt_sessions gauge
+			device_virtual_mqtt_sessions 2
+		`},
+		{"Per device", true, `
+			# HELP device_virtual_mqtt_certificate_expiry_days Days until the certificate of a device session expires.
+			# TYPE device_virtual_mqtt_certificate_expiry_days gauge
+			device_virtual_mqtt_certificate_expiry_days{client_id="first-client"} 10
+			device_virtual_mqtt_certificate_expiry_days{client_id="second-client"} 30
+			# HELP device_virtual_mqtt_sessions Number of live device sessions.
+			# TYPE device_virtual_mqtt_sessions gauge
+			device_virtual_mqtt_sessions 2
+		`},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			ctx := context.Background()
+			m := newMetrics(TopicLabels{}, tc.perDevice)
+			m.metrics.Sessions.now = func() time.Time { return now }
+			mw := InstrumentingMiddleware(m.metrics)
+
+			mw(&fakeClient{}).Connect(ctx, "ssl://broker", "first-client", conf(10))
+			second := mw(&fakeClient{})
+			second.Connect(ctx, "ssl://broker", "second-client", conf(20))
+			// The second device reconnects with a renewed certificate.
+			mw(&fakeClient{}).Connect(ctx, "ssl://broker", "second-client", conf(30))
+			second.Disconnect(ctx)
+
+			if err := testutil.CollectAndCompare(m.metrics.Sessions, strings.NewReader(tc.want)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
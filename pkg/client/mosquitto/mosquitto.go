@@ -1,51 +1,370 @@
 package mosquitto
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/lamassuiot/device-virtual/pkg/client"
+	"github.com/lamassuiot/device-virtual/pkg/impairment"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
+// connectTimeout bounds each reconnection attempt, like paho does by default.
+const connectTimeout = 30 * time.Second
+
 type mosquitto struct {
-	client MQTT.Client
-	logger log.Logger
+	client.Connection
+
+	client     MQTT.Client
+	logger     log.Logger
+	handshakes client.HandshakeObserver
+	backoff    client.Backoff
+	url        string
+	dialer     *dialer
+	stop       chan struct{}
+
+	mtx           sync.Mutex
+	subscriptions map[string]subscription
+}
+
+// subscription is kept to subscribe again after reconnecting, as sessions
+// are clean.
+type subscription struct {
+	qos      byte
+	callback MQTT.MessageHandler
 }
 
 func NewClient(logger log.Logger) client.Client {
-	return &mosquitto{logger: logger}
+	return &mosquitto{logger: logger, backoff: client.DefaultBackoff}
+}
+
+// NewFactory creates clients that reconnect spaced by backoff and report
+// their TLS handshakes to handshakes, when not nil.
+func NewFactory(logger log.Logger, handshakes client.HandshakeObserver, backoff client.Backoff) client.Factory {
+	return func() client.Client {
+		return &mosquitto{logger: logger, handshakes: handshakes, backoff: backoff}
+	}
 }
 
-func (m *mosquitto) Connect(URL string, clientID string, conf *tls.Config) error {
+// Connect dials the broker with ctx, so that its deadline bounds the TCP
+// connection and the TLS handshake and its span parents the handshake span.
+// The connection is not retried when the first attempt fails, but it is
+// reconnected when the broker drops it later on. Connections, reconnections
+// included, are impaired by the shaper of ctx, if any.
+func (m *mosquitto) Connect(ctx context.Context, URL string, clientID string, conf *tls.Config) error {
+	m.Set(client.StateConnecting, 0, nil)
+	m.url = URL
+	m.dialer = &dialer{ctx: ctx, conf: conf, observe: m.handshakes, shaper: impairment.FromContext(ctx)}
+	m.stop = make(chan struct{})
+	m.subscriptions = make(map[string]subscription)
 	opts := MQTT.NewClientOptions()
 	opts.AddBroker(URL)
 	opts.SetClientID(clientID).SetTLSConfig(conf)
+	opts.SetCustomOpenConnectionFn(m.dialer.open)
+	opts.SetAutoReconnect(false)
+	opts.SetConnectionLostHandler(m.connectionLost)
 
 	m.client = MQTT.NewClient(opts)
-	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
-		err := token.Error()
+	if token := m.client.Connect(); wait(ctx, token) != nil {
+		if ctx.Err() != nil {
+			// Abort the attempt paho keeps making in the background.
+			m.client.Disconnect(0)
+		}
+		err := m.dialer.classify(ctx, token)
+		m.Set(client.StateFailed, 0, err)
 		level.Error(m.logger).Log("err", err, "msg", "Could not connect with MQTT broker in URL "+URL)
 		return err
 	}
+	m.Set(client.StateConnected, 0, nil)
 	level.Info(m.logger).Log("msg", "Client connected with MQTT broker in URL "+URL)
 	return nil
 }
 
-func (m *mosquitto) Disconnect() {
-	m.client.Disconnect(250)
+func (m *mosquitto) connectionLost(_ MQTT.Client, err error) {
+	if !m.Set(client.StateReconnecting, 0, err) {
+		return
+	}
+	level.Warn(m.logger).Log("err", err, "msg", "Connection with MQTT broker in URL "+m.url+" lost, reconnecting")
+	go m.reconnect()
 }
 
-func (m *mosquitto) SendMessage(message string, topic string) error {
-	if token := m.client.Publish(topic, 0, false, message); token.Wait() && token.Error() != nil {
-		err := token.Error()
-		level.Error(m.logger).Log("err", err, "msg", "Could not send message: "+message+" to MQTT broker in topic: "+topic)
+// reconnect retries until connected, disconnected or out of attempts.
+func (m *mosquitto) reconnect() {
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(m.backoff.Delay(attempt)):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		m.dialer.setContext(ctx)
+		token := m.client.Connect()
+		err := wait(ctx, token)
+		if err != nil {
+			err = m.dialer.classify(ctx, token)
+		} else {
+			m.resubscribe(ctx)
+		}
+		cancel()
+
+		if err == nil {
+			if !m.Set(client.StateConnected, attempt, nil) {
+				// Disconnected meanwhile.
+				m.client.Disconnect(0)
+				return
+			}
+			level.Info(m.logger).Log("msg", "Client reconnected with MQTT broker in URL "+m.url, "attempt", attempt)
+			return
+		}
+		if m.backoff.MaxAttempts > 0 && attempt >= m.backoff.MaxAttempts {
+			if m.Set(client.StateFailed, attempt, err) {
+				level.Error(m.logger).Log("err", err, "msg", "Could not reconnect with MQTT broker in URL "+m.url+", giving up", "attempt", attempt)
+			}
+			return
+		}
+		if !m.Set(client.StateReconnecting, attempt, err) {
+			return
+		}
+	}
+}
+
+func (m *mosquitto) resubscribe(ctx context.Context) {
+	m.mtx.Lock()
+	subscriptions := make(map[string]subscription, len(m.subscriptions))
+	for topic, sub := range m.subscriptions {
+		subscriptions[topic] = sub
+	}
+	m.mtx.Unlock()
+
+	for topic, sub := range subscriptions {
+		if err := wait(ctx, m.client.Subscribe(topic, sub.qos, sub.callback)); err != nil {
+			level.Error(m.logger).Log("err", err, "msg", "Could not subscribe again to topic: "+topic)
+		}
+	}
+}
+
+// Disconnect waits up to 250ms for pending work to complete, less if ctx
+// expires sooner. It stops reconnecting, if the connection was lost.
+func (m *mosquitto) Disconnect(ctx context.Context) {
+	if m.client == nil {
+		return
+	}
+	if m.Set(client.StateDisconnected, 0, nil) {
+		close(m.stop)
+	}
+	quiesce := 250 * time.Millisecond
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < quiesce {
+		quiesce = time.Until(deadline)
+	}
+	if quiesce < 0 {
+		quiesce = 0
+	}
+	m.client.Disconnect(uint(quiesce.Milliseconds()))
+}
+
+func (m *mosquitto) IsConnected() bool {
+	return m.client != nil && m.client.IsConnectionOpen()
+}
+
+func (m *mosquitto) SendMessage(ctx context.Context, message string, topic string) error {
+	return m.Publish(ctx, topic, []byte(message), 0, false)
+}
+
+// Publish waits for the broker to acknowledge QoS 1 and 2 messages, unless
+// ctx is done first.
+func (m *mosquitto) Publish(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error {
+	if topic == "" || strings.ContainsAny(topic, "+#") || qos > 2 {
+		return fmt.Errorf("%w: invalid topic %q or QoS %d", client.ErrPublishRejected, topic, qos)
+	}
+	if !m.IsConnected() {
+		return client.ErrNotConnected
+	}
+	if err := wait(ctx, m.client.Publish(topic, qos, retained, payload)); err != nil {
+		level.Error(m.logger).Log("err", err, "msg", "Could not send message: "+string(payload)+" to MQTT broker in topic: "+topic)
 		return err
 	}
-	level.Info(m.logger).Log("msg", "Message: "+message+" succesfully sent to MQTT broker in topic: "+topic)
+	level.Info(m.logger).Log("msg", "Message: "+string(payload)+" succesfully sent to MQTT broker in topic: "+topic)
 
 	return nil
 }
+
+func (m *mosquitto) Subscribe(ctx context.Context, topic string, qos byte, handler client.MessageHandler) error {
+	if !m.IsConnected() {
+		return client.ErrNotConnected
+	}
+	callback := func(_ MQTT.Client, msg MQTT.Message) {
+		handler(client.Message{
+			Topic:      msg.Topic(),
+			Payload:    msg.Payload(),
+			QoS:        msg.Qos(),
+			Retained:   msg.Retained(),
+			ReceivedAt: time.Now(),
+		})
+	}
+	if err := wait(ctx, m.client.Subscribe(topic, qos, callback)); err != nil {
+		level.Error(m.logger).Log("err", err, "msg", "Could not subscribe to topic: "+topic)
+		return err
+	}
+	m.mtx.Lock()
+	m.subscriptions[topic] = subscription{qos: qos, callback: callback}
+	m.mtx.Unlock()
+	level.Info(m.logger).Log("msg", "Subscribed to topic: "+topic)
+	return nil
+}
+
+func (m *mosquitto) Unsubscribe(ctx context.Context, topic string) error {
+	if !m.IsConnected() {
+		return client.ErrNotConnected
+	}
+	m.mtx.Lock()
+	delete(m.subscriptions, topic)
+	m.mtx.Unlock()
+	if err := wait(ctx, m.client.Unsubscribe(topic)); err != nil {
+		level.Error(m.logger).Log("err", err, "msg", "Could not unsubscribe from topic: "+topic)
+		return err
+	}
+	level.Info(m.logger).Log("msg", "Unsubscribed from topic: "+topic)
+	return nil
+}
+
+// wait waits for token to complete or ctx to be done, whichever happens
+// first. paho keeps working on abandoned tokens in the background.
+func wait(ctx context.Context, token MQTT.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dialer opens broker connections itself so that the typed network and TLS
+// errors are kept, as paho only reports them as strings.
+type dialer struct {
+	mtx     sync.Mutex
+	ctx     context.Context
+	conf    *tls.Config
+	observe client.HandshakeObserver
+	shaper  *impairment.Shaper
+	err     error
+}
+
+// setContext sets the context of the next connection attempts.
+func (d *dialer) setContext(ctx context.Context) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.ctx = ctx
+	d.err = nil
+}
+
+func (d *dialer) open(uri *url.URL, options MQTT.ClientOptions) (net.Conn, error) {
+	d.mtx.Lock()
+	ctx := d.ctx
+	d.mtx.Unlock()
+	conn, err := d.dial(ctx, uri, options)
+	d.mtx.Lock()
+	d.err = err
+	d.mtx.Unlock()
+	return conn, err
+}
+
+func (d *dialer) dial(ctx context.Context, uri *url.URL, options MQTT.ClientOptions) (net.Conn, error) {
+	switch uri.Scheme {
+	case "tcp", "mqtt":
+		return d.dialTCP(ctx, uri, options)
+	case "ssl", "tls", "tcps", "mqtts":
+		conn, err := d.dialTCP(ctx, uri, options)
+		if err != nil {
+			return nil, err
+		}
+		conf := d.conf.Clone()
+		if conf == nil {
+			conf = &tls.Config{}
+		}
+		if conf.ServerName == "" {
+			conf.ServerName = uri.Hostname()
+		}
+		tlsConn := tls.Client(conn, conf)
+		span := handshakeSpan(ctx, conf.ServerName)
+		begin := time.Now()
+		err = tlsConn.HandshakeContext(ctx)
+		if d.observe != nil {
+			d.observe(time.Since(begin), err)
+		}
+		if err != nil {
+			ext.Error.Set(span, true)
+			span.LogKV("event", "error", "error.object", err)
+		} else {
+			span.SetTag("tls.version", tls.VersionName(tlsConn.ConnectionState().Version))
+		}
+		span.Finish()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w: %w", client.ErrTLSHandshake, err)
+		}
+		return tlsConn, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported scheme %s", client.ErrBrokerUnreachable, uri.Scheme)
+	}
+}
+
+// dialTCP opens the network connection under TLS, impaired by the shaper, if
+// any.
+func (d *dialer) dialTCP(ctx context.Context, uri *url.URL, options MQTT.ClientOptions) (net.Conn, error) {
+	nd := &net.Dialer{Timeout: options.ConnectTimeout}
+	conn, err := nd.DialContext(ctx, "tcp", uri.Host)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", client.ErrBrokerUnreachable, err)
+	}
+	if d.shaper != nil {
+		conn = d.shaper.Wrap(conn)
+	}
+	return conn, nil
+}
+
+// handshakeSpan starts a child of the span of ctx, or a no-op span when ctx
+// is not traced.
+func handshakeSpan(ctx context.Context, serverName string) stdopentracing.Span {
+	tracer := stdopentracing.Tracer(stdopentracing.NoopTracer{})
+	var opts []stdopentracing.StartSpanOption
+	if parent := stdopentracing.SpanFromContext(ctx); parent != nil {
+		tracer = parent.Tracer()
+		opts = append(opts, stdopentracing.ChildOf(parent.Context()))
+	}
+	span := tracer.StartSpan("mqtt.tls_handshake", opts...)
+	ext.SpanKindRPCClient.Set(span)
+	ext.PeerHostname.Set(span, serverName)
+	return span
+}
+
+// classify returns the dial error behind a failed connection attempt, or
+// reports the broker refusing the MQTT connection.
+func (d *dialer) classify(ctx context.Context, token MQTT.Token) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %w", client.ErrBrokerUnreachable, ctx.Err())
+	}
+	if t, ok := token.(*MQTT.ConnectToken); ok && t.ReturnCode() != packets.ErrNetworkError {
+		return fmt.Errorf("%w: %w", client.ErrConnectRefused, token.Error())
+	}
+	return fmt.Errorf("%w: %w", client.ErrBrokerUnreachable, token.Error())
+}
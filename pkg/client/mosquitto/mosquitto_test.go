@@ -1,16 +1,28 @@
 package mosquitto
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/lamassuiot/device-virtual/pkg/client"
 	"github.com/lamassuiot/device-virtual/pkg/configs"
+	"github.com/lamassuiot/device-virtual/pkg/impairment"
 
+	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/go-kit/kit/log"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
 )
 
 func TestConnect(t *testing.T) {
@@ -40,14 +52,14 @@ func TestConnect(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
-			err := mq.Connect(tc.URL, tc.clientID, tc.conf)
+			err := mq.Connect(context.Background(), tc.URL, tc.clientID, tc.conf)
 			if err != nil && !tc.retErr {
 				t.Errorf("Client returned an unexpected error: %s", err)
 			}
 		})
 	}
 
-	mq.Disconnect()
+	mq.Disconnect(context.Background())
 }
 
 func TestDisconnect(t *testing.T) {
@@ -64,14 +76,14 @@ func TestDisconnect(t *testing.T) {
 	}
 
 	validConf := TLSConf(t, cfg.CAPath, "testdata/valid.crt", "testdata/valid.key")
-	err = mq.Connect("ssl://mosquitto:1883", "lamassu-client", validConf)
+	err = mq.Connect(context.Background(), "ssl://mosquitto:1883", "lamassu-client", validConf)
 	if err != nil {
 		t.Fatal("Unable to connect to the broker")
 	}
 
-	mq.Disconnect()
+	mq.Disconnect(context.Background())
 
-	err = mq.SendMessage("this is a message", "lamassu-sample")
+	err = mq.SendMessage(context.Background(), "this is a message", "lamassu-sample")
 	if err == nil {
 		t.Errorf("Client was expected to return an error")
 	}
@@ -91,7 +103,7 @@ func TestSendMessage(t *testing.T) {
 	}
 
 	validConf := TLSConf(t, cfg.CAPath, "testdata/valid.crt", "testdata/valid.key")
-	err = mq.Connect("ssl://mosquitto:1883", "lamassu-client", validConf)
+	err = mq.Connect(context.Background(), "ssl://mosquitto:1883", "lamassu-client", validConf)
 	if err != nil {
 		t.Fatal("Unable to connect to the broker")
 	}
@@ -108,14 +120,250 @@ func TestSendMessage(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
-			err := mq.SendMessage(tc.message, tc.topic)
+			err := mq.SendMessage(context.Background(), tc.message, tc.topic)
 			if err != nil && !tc.retErr {
 				t.Errorf("Client returned an unexpected error: %s", err)
 			}
 		})
 	}
 
-	mq.Disconnect()
+	mq.Disconnect(context.Background())
+}
+
+func TestConnectErrors(t *testing.T) {
+	mq := NewClient(log.NewNopLogger())
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unable to listen")
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	untrusted := httptest.NewTLSServer(http.NotFoundHandler())
+	defer untrusted.Close()
+	untrustedURL, _ := url.Parse(untrusted.URL)
+
+	testCases := []struct {
+		name string
+		URL  string
+		err  error
+	}{
+		{"Broker unreachable", "ssl://" + closedAddr, client.ErrBrokerUnreachable},
+		{"Untrusted broker certificate", "ssl://" + untrustedURL.Host, client.ErrTLSHandshake},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			err := mq.Connect(context.Background(), tc.URL, "lamassu-client", &tls.Config{})
+			if !errors.Is(err, tc.err) {
+				t.Errorf("Got result is %s; want %s", err, tc.err)
+			}
+		})
+	}
+
+	if err := mq.SendMessage(context.Background(), "this is a message", "lamassu-sample"); !errors.Is(err, client.ErrNotConnected) {
+		t.Errorf("Got result is %s; want %s", err, client.ErrNotConnected)
+	}
+}
+
+func TestConnectContext(t *testing.T) {
+	mq := NewClient(log.NewNopLogger())
+
+	// The listener accepts connections but never completes a handshake.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unable to listen")
+	}
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	err = mq.Connect(ctx, "ssl://"+silent.Addr().String(), "lamassu-client", &tls.Config{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Got result is %s; want %s", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Errorf("Connect returned after %s, ignoring the context deadline", elapsed)
+	}
+}
+
+func TestHandshakeSpan(t *testing.T) {
+	mq := NewClient(log.NewNopLogger())
+	untrusted := httptest.NewTLSServer(http.NotFoundHandler())
+	defer untrusted.Close()
+	untrustedURL, _ := url.Parse(untrusted.URL)
+
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("connect")
+	ctx := stdopentracing.ContextWithSpan(context.Background(), parent)
+	mq.Connect(ctx, "ssl://"+untrustedURL.Host, "lamassu-client", &tls.Config{})
+	parent.Finish()
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Got %d finished spans; want 2", len(spans))
+	}
+	handshake := spans[0]
+	if handshake.OperationName != "mqtt.tls_handshake" {
+		t.Errorf("Got span %s; want mqtt.tls_handshake", handshake.OperationName)
+	}
+	if handshake.ParentID != parent.(*mocktracer.MockSpan).SpanContext.SpanID {
+		t.Errorf("Handshake span is not a child of the connect span")
+	}
+	if handshake.Tag("error") != true {
+		t.Errorf("Failed handshake span is not tagged as an error")
+	}
+}
+
+// broker speaks just enough MQTT to accept connections and subscriptions,
+// which it reports.
+type broker struct {
+	ln         net.Listener
+	conns      chan net.Conn
+	subscribed chan string
+}
+
+func newBroker(t *testing.T) *broker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unable to listen")
+	}
+	b := &broker{ln: ln, conns: make(chan net.Conn, 10), subscribed: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b.conns <- conn
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return b
+}
+
+func (b *broker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := p.(type) {
+		case *packets.ConnectPacket:
+			packets.NewControlPacket(packets.Connack).Write(conn)
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = p.Qoss
+			ack.Write(conn)
+			for _, topic := range p.Topics {
+				b.subscribed <- topic
+			}
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	testCases := []struct {
+		name       string
+		brokerDown bool
+		state      client.State
+	}{
+		{"Broker back", false, client.StateConnected},
+		{"Broker gone", true, client.StateFailed},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			b := newBroker(t)
+			backoff := client.Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 1, MaxAttempts: 3}
+			mq := NewFactory(log.NewNopLogger(), nil, backoff)()
+			transitions := make(chan client.Transition, 10)
+			mq.OnStateChange(func(t client.Transition) { transitions <- t })
+
+			ctx := context.Background()
+			if err := mq.Connect(ctx, "tcp://"+b.ln.Addr().String(), "lamassu-client", nil); err != nil {
+				t.Fatalf("Unable to connect: %s", err)
+			}
+			defer mq.Disconnect(ctx)
+			if err := mq.Subscribe(ctx, "lamassu/cmd", 1, func(client.Message) {}); err != nil {
+				t.Fatalf("Unable to subscribe: %s", err)
+			}
+			<-b.subscribed
+
+			if tc.brokerDown {
+				b.ln.Close()
+			}
+			(<-b.conns).Close()
+
+			timeout := time.After(5 * time.Second)
+			for {
+				select {
+				case tr := <-transitions:
+					// Skip the transitions of the first connection.
+					if tr.State != tc.state || tr.Attempt == 0 {
+						continue
+					}
+				case <-timeout:
+					t.Fatalf("Got state %s; want %s", mq.State(), tc.state)
+				}
+				break
+			}
+			if tc.state != client.StateConnected {
+				return
+			}
+			select {
+			case topic := <-b.subscribed:
+				if topic != "lamassu/cmd" {
+					t.Errorf("Got subscription to %s; want lamassu/cmd", topic)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("Not subscribed again after reconnecting")
+			}
+		})
+	}
+}
+
+func TestImpairment(t *testing.T) {
+	b := newBroker(t)
+	backoff := client.Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 1}
+	mq := NewFactory(log.NewNopLogger(), nil, backoff)()
+	transitions := make(chan client.Transition, 10)
+	mq.OnStateChange(func(t client.Transition) { transitions <- t })
+
+	shaper := impairment.NewShaper()
+	shaper.Set(impairment.Profile{Latency: 50 * time.Millisecond})
+	ctx := impairment.NewContext(context.Background(), shaper)
+	begin := time.Now()
+	if err := mq.Connect(ctx, "tcp://"+b.ln.Addr().String(), "lamassu-client", nil); err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer mq.Disconnect(context.Background())
+	if took := time.Since(begin); took < 100*time.Millisecond {
+		t.Errorf("Got connected in %s; want the round trip delayed by the latency", took)
+	}
+
+	if n := shaper.Reset(); n != 1 {
+		t.Fatalf("Got %d connections reset; want 1", n)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case tr := <-transitions:
+			if tr.State != client.StateConnected || tr.Attempt == 0 {
+				continue
+			}
+		case <-timeout:
+			t.Fatalf("Got state %s; want reconnected after the reset", mq.State())
+		}
+		break
+	}
 }
 
 func TLSConf(t *testing.T, CAPath string, certPath string, keyPath string) *tls.Config {
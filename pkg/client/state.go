@@ -0,0 +1,140 @@
+package client
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// State is the state of the connection of a client to its broker.
+type State string
+
+const (
+	StateConnecting   State = "connecting"
+	StateConnected    State = "connected"
+	StateReconnecting State = "reconnecting"
+	StateDisconnected State = "disconnected"
+	StateFailed       State = "failed"
+)
+
+// transitions lists the states each state can move to. Reconnecting moves to
+// itself on every failed attempt.
+var transitions = map[State][]State{
+	StateDisconnected: {StateConnecting},
+	StateConnecting:   {StateConnected, StateFailed, StateDisconnected},
+	StateConnected:    {StateReconnecting, StateDisconnected},
+	StateReconnecting: {StateReconnecting, StateConnected, StateFailed, StateDisconnected},
+	StateFailed:       {StateConnecting, StateDisconnected},
+}
+
+// historySize is the number of transitions kept per connection.
+const historySize = 32
+
+// Transition is a change of the state of a connection. Attempt numbers the
+// reconnection attempts since the connection was lost.
+type Transition struct {
+	State   State     `json:"state"`
+	Time    time.Time `json:"time"`
+	Attempt int       `json:"attempt,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// StateHandler is called on every transition of a connection: with
+// StateConnected when it connects or reconnects, and with StateReconnecting
+// when it is lost. Like MessageHandler it must not block.
+type StateHandler func(Transition)
+
+// Connection is the state machine of a broker connection, which keeps its
+// recent transitions. Clients embed it to implement State, History and
+// OnStateChange.
+type Connection struct {
+	mtx     sync.Mutex
+	state   State
+	history []Transition
+	handler StateHandler
+}
+
+func (c *Connection) State() State {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.state == "" {
+		return StateDisconnected
+	}
+	return c.state
+}
+
+// History returns the recent transitions, oldest first.
+func (c *Connection) History() []Transition {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]Transition(nil), c.history...)
+}
+
+// OnStateChange sets the handler of the next transitions.
+func (c *Connection) OnStateChange(handler StateHandler) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.handler = handler
+}
+
+// Set moves the connection to state, caused by err if not nil, and reports
+// whether the transition is allowed. Transitions that are not, like a lost
+// connection after a disconnection, are ignored.
+func (c *Connection) Set(state State, attempt int, err error) bool {
+	t := Transition{State: state, Time: time.Now(), Attempt: attempt}
+	if err != nil {
+		t.Error = err.Error()
+	}
+
+	c.mtx.Lock()
+	from := c.state
+	if from == "" {
+		from = StateDisconnected
+	}
+	allowed := false
+	for _, to := range transitions[from] {
+		allowed = allowed || to == state
+	}
+	if !allowed {
+		c.mtx.Unlock()
+		return false
+	}
+	c.state = state
+	c.history = append(c.history, t)
+	if len(c.history) > historySize {
+		c.history = append([]Transition(nil), c.history[len(c.history)-historySize:]...)
+	}
+	handler := c.handler
+	c.mtx.Unlock()
+
+	if handler != nil {
+		handler(t)
+	}
+	return true
+}
+
+// Backoff spaces reconnection attempts. The delay before attempt n is
+// Initial * Multiplier^(n-1), up to Max, randomly spread by up to Jitter of
+// itself either way so that devices dropped together do not reconnect
+// together. Reconnection gives up after MaxAttempts, unless zero.
+type Backoff struct {
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64
+	Jitter      float64
+	MaxAttempts int
+}
+
+// DefaultBackoff retries forever, from one second up to two minutes apart.
+var DefaultBackoff = Backoff{Initial: time.Second, Max: 2 * time.Minute, Multiplier: 2, Jitter: 0.2}
+
+// Delay returns the delay before attempt, starting at 1.
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := float64(b.Initial) * math.Pow(math.Max(b.Multiplier, 1), float64(attempt-1))
+	if b.Max > 0 {
+		d = math.Min(d, float64(b.Max))
+	}
+	d *= 1 + b.Jitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
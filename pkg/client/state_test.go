@@ -0,0 +1,82 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestConnection(t *testing.T) {
+	var c Connection
+	var handled []State
+	c.OnStateChange(func(t Transition) { handled = append(handled, t.State) })
+
+	testCases := []struct {
+		name    string
+		state   State
+		attempt int
+		err     error
+		allowed bool
+	}{
+		{"Connect", StateConnecting, 0, nil, true},
+		{"Connected", StateConnected, 0, nil, true},
+		{"Connection lost", StateReconnecting, 0, errors.New("EOF"), true},
+		{"Attempt failed", StateReconnecting, 1, errors.New("connection refused"), true},
+		{"Reconnected", StateConnected, 2, nil, true},
+		{"Connect while connected", StateConnecting, 0, nil, false},
+		{"Disconnect", StateDisconnected, 0, nil, true},
+		{"Connection lost after disconnect", StateReconnecting, 0, errors.New("EOF"), false},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			before := c.State()
+			if allowed := c.Set(tc.state, tc.attempt, tc.err); allowed != tc.allowed {
+				t.Fatalf("Got transition from %s to %s allowed %t; want %t", before, tc.state, allowed, tc.allowed)
+			}
+			want := tc.state
+			if !tc.allowed {
+				want = before
+			}
+			if c.State() != want {
+				t.Errorf("Got state %s; want %s", c.State(), want)
+			}
+		})
+	}
+
+	history := c.History()
+	if len(history) != 6 || len(handled) != 6 {
+		t.Fatalf("Got %d transitions and %d handled; want 6", len(history), len(handled))
+	}
+	if last := history[4]; last.State != StateConnected || last.Attempt != 2 {
+		t.Errorf("Got transition %+v; want connected on attempt 2", last)
+	}
+	if history[2].Error != "EOF" {
+		t.Errorf("Got error %q; want the cause of the lost connection", history[2].Error)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2, Jitter: 0.1}
+
+	testCases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing attempt %d", tc.attempt), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				d := b.Delay(tc.attempt)
+				if d < tc.want*9/10 || d > tc.want*11/10 {
+					t.Fatalf("Got delay %s; want %s with 10%% jitter", d, tc.want)
+				}
+			}
+		})
+	}
+}
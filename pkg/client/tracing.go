@@ -0,0 +1,142 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// TracingMiddleware traces the connections and publishes of every client as
+// children of the span of their context, which also parents the TLS handshake
+// span of clients that support it.
+//
+// MQTT 3.1.1 messages have no headers, so with a non-empty envelopeField the
+// trace context of every publish is injected into JSON object payloads under
+// that field, for backends to continue the trace of the virtual device.
+// Other payloads, and objects already holding the field, are sent unchanged.
+func TracingMiddleware(tracer stdopentracing.Tracer, envelopeField string) Middleware {
+	return func(next Client) Client {
+		return &tracingClient{next: next, tracer: tracer, field: envelopeField}
+	}
+}
+
+type tracingClient struct {
+	next   Client
+	tracer stdopentracing.Tracer
+	field  string
+}
+
+func (c *tracingClient) Connect(ctx context.Context, URL string, clientID string, conf *tls.Config) error {
+	span, ctx := stdopentracing.StartSpanFromContextWithTracer(ctx, c.tracer, "mqtt.connect")
+	defer span.Finish()
+	ext.SpanKindRPCClient.Set(span)
+	ext.Component.Set(span, "mqtt")
+	ext.PeerAddress.Set(span, URL)
+	span.SetTag("mqtt.client_id", clientID)
+
+	err := c.next.Connect(ctx, URL, clientID, conf)
+	if err != nil {
+		tagError(span, err)
+	}
+	return err
+}
+
+func (c *tracingClient) Disconnect(ctx context.Context) {
+	c.next.Disconnect(ctx)
+}
+
+func (c *tracingClient) SendMessage(ctx context.Context, message string, topic string) error {
+	return c.publish(ctx, topic, []byte(message), 0, false, func(ctx context.Context, payload []byte) error {
+		return c.next.SendMessage(ctx, string(payload), topic)
+	})
+}
+
+func (c *tracingClient) Publish(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error {
+	return c.publish(ctx, topic, payload, qos, retained, func(ctx context.Context, payload []byte) error {
+		return c.next.Publish(ctx, topic, payload, qos, retained)
+	})
+}
+
+func (c *tracingClient) publish(ctx context.Context, topic string, payload []byte, qos byte, retained bool, send func(context.Context, []byte) error) error {
+	span, ctx := stdopentracing.StartSpanFromContextWithTracer(ctx, c.tracer, "mqtt.publish")
+	defer span.Finish()
+	ext.SpanKindProducer.Set(span)
+	ext.Component.Set(span, "mqtt")
+	ext.MessageBusDestination.Set(span, topic)
+	span.SetTag("mqtt.qos", int(qos))
+	span.SetTag("mqtt.retained", retained)
+
+	if c.field != "" {
+		payload = c.inject(span, payload)
+	}
+	span.SetTag("message.size", len(payload))
+
+	err := send(ctx, payload)
+	if err != nil {
+		tagError(span, err)
+	}
+	return err
+}
+
+// inject adds the context of span to payload when it is a JSON object without
+// the envelope field. The original bytes are kept, the field being spliced in
+// as the first member of the object.
+func (c *tracingClient) inject(span stdopentracing.Span, payload []byte) []byte {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &members); err != nil || members == nil {
+		return payload
+	}
+	if _, ok := members[c.field]; ok {
+		return payload
+	}
+
+	carrier := stdopentracing.TextMapCarrier{}
+	if err := c.tracer.Inject(span.Context(), stdopentracing.TextMap, carrier); err != nil || len(carrier) == 0 {
+		return payload
+	}
+	member, err := json.Marshal(map[string]stdopentracing.TextMapCarrier{c.field: carrier})
+	if err != nil {
+		return payload
+	}
+
+	// Both the payload and member are JSON objects, so they start with "{".
+	rest := bytes.TrimLeft(payload, " \t\r\n")[1:]
+	injected := append([]byte{}, member[:len(member)-1]...)
+	if trimmed := bytes.TrimLeft(rest, " \t\r\n"); trimmed[0] != '}' {
+		injected = append(injected, ',')
+	}
+	return append(injected, rest...)
+}
+
+func (c *tracingClient) Subscribe(ctx context.Context, topic string, qos byte, handler MessageHandler) error {
+	return c.next.Subscribe(ctx, topic, qos, handler)
+}
+
+func (c *tracingClient) Unsubscribe(ctx context.Context, topic string) error {
+	return c.next.Unsubscribe(ctx, topic)
+}
+
+func (c *tracingClient) IsConnected() bool {
+	return c.next.IsConnected()
+}
+
+func (c *tracingClient) State() State {
+	return c.next.State()
+}
+
+func (c *tracingClient) History() []Transition {
+	return c.next.History()
+}
+
+func (c *tracingClient) OnStateChange(handler StateHandler) {
+	c.next.OnStateChange(handler)
+}
+
+func tagError(span stdopentracing.Span, err error) {
+	ext.Error.Set(span, true)
+	span.LogKV("event", "error", "error.object", err)
+}
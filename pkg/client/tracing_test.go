@@ -0,0 +1,118 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+// sentClient records the payloads published through it.
+type sentClient struct {
+	fakeClient
+	sent [][]byte
+}
+
+func (c *sentClient) Publish(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error {
+	c.sent = append(c.sent, payload)
+	return nil
+}
+
+func (c *sentClient) SendMessage(ctx context.Context, message string, topic string) error {
+	return c.Publish(ctx, topic, []byte(message), 0, false)
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("request")
+	ctx := stdopentracing.ContextWithSpan(context.Background(), parent)
+
+	next := &fakeClient{}
+	c := TracingMiddleware(tracer, "")(next)
+	if err := c.Connect(ctx, "unreachable", "lamassu-client", nil); err == nil {
+		t.Fatalf("Connected to an unreachable broker")
+	}
+	c.Connect(ctx, "ssl://broker", "lamassu-client", nil)
+	c.Publish(ctx, "devices/lamassu-client/telemetry", []byte("hello"), 1, false)
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Got %d finished spans; want 3", len(spans))
+	}
+	testCases := []struct {
+		name      string
+		span      *mocktracer.MockSpan
+		operation string
+		err       bool
+	}{
+		{"Failed connect", spans[0], "mqtt.connect", true},
+		{"Connect", spans[1], "mqtt.connect", false},
+		{"Publish", spans[2], "mqtt.publish", false},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			if tc.span.OperationName != tc.operation {
+				t.Errorf("Got span %s; want %s", tc.span.OperationName, tc.operation)
+			}
+			if tc.span.ParentID != parent.(*mocktracer.MockSpan).SpanContext.SpanID {
+				t.Errorf("Span is not a child of the request span")
+			}
+			if tagged := tc.span.Tag("error") == true; tagged != tc.err {
+				t.Errorf("Got error tag %v; want %v", tagged, tc.err)
+			}
+		})
+	}
+}
+
+func TestTraceEnvelope(t *testing.T) {
+	testCases := []struct {
+		name     string
+		field    string
+		payload  string
+		injected bool
+	}{
+		{"Object", "trace", `{"temperature": 21.5}`, true},
+		{"Empty object", "trace", ` { } `, true},
+		{"Field already present", "trace", `{"trace": "device"}`, false},
+		{"Array", "trace", `[1, 2]`, false},
+		{"Not JSON", "trace", `hello`, false},
+		{"Injection disabled", "", `{"temperature": 21.5}`, false},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			tracer := mocktracer.New()
+			next := &sentClient{}
+			c := TracingMiddleware(tracer, tc.field)(next)
+			c.SendMessage(context.Background(), tc.payload, "lamassu-test")
+			c.Publish(context.Background(), "lamassu-test", []byte(tc.payload), 1, false)
+
+			for _, sent := range next.sent {
+				if !tc.injected {
+					if string(sent) != tc.payload {
+						t.Errorf("Got payload %s; want %s unchanged", sent, tc.payload)
+					}
+					continue
+				}
+				var members map[string]json.RawMessage
+				if err := json.Unmarshal(sent, &members); err != nil {
+					t.Fatalf("Injected payload %s is not JSON: %s", sent, err)
+				}
+				var carrier stdopentracing.TextMapCarrier
+				json.Unmarshal(members[tc.field], &carrier)
+				spanCtx, err := tracer.Extract(stdopentracing.TextMap, carrier)
+				if err != nil {
+					t.Fatalf("Unable to extract the trace context of %s: %s", sent, err)
+				}
+				if spanCtx.(mocktracer.MockSpanContext).SpanID == 0 {
+					t.Errorf("Injected trace context of %s has no span", sent)
+				}
+			}
+			if len(next.sent) != 2 {
+				t.Errorf("Got %d payloads sent; want 2", len(next.sent))
+			}
+		})
+	}
+}
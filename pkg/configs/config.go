@@ -1,30 +1,149 @@
 package configs
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
 
 type Config struct {
-	Port string
+	ConfigFile           string
+	ConfigReloadInterval time.Duration `default:"10s"`
+
+	LogLevel string `default:"info"`
+
+	Port     string
+	GRPCPort string `default:"8092"`
+
+	ShutdownTimeout time.Duration `default:"20s"`
 
 	UIHost     string
 	UIPort     string
 	UIProtocol string
 
+	CORSAllowedOrigins   []string
+	CORSAllowedMethods   []string `default:"GET,POST,PUT,DELETE"`
+	CORSAllowedHeaders   []string `default:"Origin,Content-Type,Authorization"`
+	CORSExposedHeaders   []string
+	CORSAllowCredentials bool
+	CORSMaxAge           time.Duration
+
+	Discovery     string `default:"consul"`
+	AdvertiseHost string
+
 	ConsulProtocol string
 	ConsulHost     string
 	ConsulPort     string
 	ConsulCA       string
+	ConsulTags     []string
+	ConsulTTL      time.Duration `default:"30s"`
+
+	DeviceRegistry        string
+	DeviceRegistryPrefix  string `default:"device-virtual/devices/"`
+	DeviceRegistryService string `default:"virtual-device"`
+
+	EtcdEndpoint string
+	EtcdCA       string
+	EtcdPrefix   string `default:"/services/device/"`
+
+	KubernetesService string `default:"device-virtual"`
 
 	CAPath string
 
-	CertFile string
-	KeyFile  string
+	ReconnectInitialDelay time.Duration `default:"1s"`
+	ReconnectMaxDelay     time.Duration `default:"2m"`
+	ReconnectMultiplier   float64       `default:"2"`
+	ReconnectJitter       float64       `default:"0.2"`
+	ReconnectMaxAttempts  int
+
+	OfflineQueue            string
+	OfflineQueueDir         string
+	OfflineQueueMaxMessages int           `default:"1000"`
+	OfflineQueueMaxBytes    int           `default:"1048576"`
+	OfflineQueueMaxAge      time.Duration `default:"1h"`
+
+	KeyBackend string
+
+	CertFile           string
+	KeyFile            string
+	CertReloadInterval time.Duration `default:"30s"`
+
+	CertExpiryWarningDays int `default:"30"`
+
+	APIAuth            string
+	APIClientCA        string
+	APIMTLSDefaultRole string `default:"read-only"`
+
+	OIDCJWKSFile   string
+	OIDCJWKSURL    string
+	OIDCIssuer     string
+	OIDCAudience   string
+	OIDCRolesClaim string `default:"roles"`
+
+	RateLimitGlobal       float64
+	RateLimitGlobalBurst  int
+	RateLimitSession      float64
+	RateLimitSessionBurst int
+
+	RecordingsDir string
+
+	ImpairmentScenariosDir string
+
+	MetricsTopicDepth int `default:"2"`
+	MetricsMaxTopics  int `default:"100"`
+	MetricsPerDevice  bool
+
+	TraceEnvelopeField string
+
+	TelemetryExporter   string `default:"jaeger"`
+	OTLPProtocol        string `default:"grpc"`
+	OTLPEndpoint        string
+	OTLPInsecure        bool
+	OTLPMetrics         bool
+	OTLPMetricsInterval time.Duration `default:"60s"`
 }
 
+// NewConfig reads the configuration from the environment variables named
+// after the fields with the given prefix. When the ConfigFile variable names a
+// YAML or TOML file, the file is read on top of the defaults and the
+// environment variables override it.
 func NewConfig(prefix string) (Config, error) {
 	var cfg Config
 	err := envconfig.Process(prefix, &cfg)
 	if err != nil {
 		return Config{}, err
 	}
-	return cfg, nil
+	if cfg.ConfigFile == "" {
+		return cfg, nil
+	}
+
+	fileCfg := cfg
+	if err := decodeFile(cfg.ConfigFile, &fileCfg); err != nil {
+		return Config{}, err
+	}
+	env, file := reflect.ValueOf(cfg), reflect.ValueOf(&fileCfg).Elem()
+	for i := 0; i < env.NumField(); i++ {
+		key := strings.ToUpper(prefix + "_" + env.Type().Field(i).Name)
+		if _, ok := os.LookupEnv(key); ok {
+			file.Field(i).Set(env.Field(i))
+		}
+	}
+	fileCfg.ConfigFile = cfg.ConfigFile
+	return fileCfg, nil
+}
+
+// Changed returns the names of the settings that differ between two
+// configurations.
+func Changed(old Config, new Config) []string {
+	o, n := reflect.ValueOf(old), reflect.ValueOf(new)
+	var names []string
+	for i := 0; i < o.NumField(); i++ {
+		if !reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+			names = append(names, o.Type().Field(i).Name)
+		}
+	}
+	return names
 }
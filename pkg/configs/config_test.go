@@ -0,0 +1,211 @@
+package configs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Unable to write configuration file: %s", err)
+	}
+	return path
+}
+
+func TestNewConfig(t *testing.T) {
+	yamlFile := writeFile(t, "config.yaml", `
+port: "8091"
+loglevel: debug
+consultags: [virtual, lab]
+consulttl: 1m
+ratelimitsession: 2.5
+`)
+	tomlFile := writeFile(t, "config.toml", `
+Port = "8091"
+LogLevel = "debug"
+ConsulTags = ["virtual", "lab"]
+ConsulTTL = "1m"
+RateLimitSession = 2.5
+`)
+
+	testCases := []struct {
+		name string
+		env  map[string]string
+		want func(cfg Config) bool
+	}{
+		{"YAML file", map[string]string{"DEVICETEST_CONFIGFILE": yamlFile}, func(cfg Config) bool {
+			return cfg.Port == "8091" && cfg.LogLevel == "debug" && cfg.ConsulTTL == time.Minute &&
+				reflect.DeepEqual(cfg.ConsulTags, []string{"virtual", "lab"}) && cfg.RateLimitSession == 2.5
+		}},
+		{"TOML file", map[string]string{"DEVICETEST_CONFIGFILE": tomlFile}, func(cfg Config) bool {
+			return cfg.Port == "8091" && cfg.LogLevel == "debug" && cfg.ConsulTTL == time.Minute &&
+				reflect.DeepEqual(cfg.ConsulTags, []string{"virtual", "lab"}) && cfg.RateLimitSession == 2.5
+		}},
+		{"Defaults kept", map[string]string{"DEVICETEST_CONFIGFILE": yamlFile}, func(cfg Config) bool {
+			return cfg.GRPCPort == "8092" && cfg.Discovery == "consul"
+		}},
+		{"Environment overrides", map[string]string{"DEVICETEST_CONFIGFILE": yamlFile, "DEVICETEST_LOGLEVEL": "warn", "DEVICETEST_CONSULTTL": "30s"}, func(cfg Config) bool {
+			return cfg.LogLevel == "warn" && cfg.ConsulTTL == 30*time.Second && cfg.Port == "8091"
+		}},
+		{"Environment only", map[string]string{"DEVICETEST_PORT": "8093"}, func(cfg Config) bool {
+			return cfg.Port == "8093" && cfg.LogLevel == "info"
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := NewConfig("devicetest")
+			if err != nil {
+				t.Fatalf("Got result is %s; want nil", err)
+			}
+			if !tc.want(cfg) {
+				t.Errorf("Got unexpected configuration %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestNewConfigErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		file string
+	}{
+		{"Unknown YAML key", writeFile(t, "config.yaml", "port: \"8091\"\nprot: \"8092\"\n")},
+		{"Unknown TOML key", writeFile(t, "config.toml", "Prot = \"8092\"\n")},
+		{"Invalid YAML", writeFile(t, "config.yml", "port: [\n")},
+		{"Unsupported format", writeFile(t, "config.json", "{}")},
+		{"Missing file", filepath.Join(t.TempDir(), "config.yaml")},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			t.Setenv("DEVICETEST_CONFIGFILE", tc.file)
+			if _, err := NewConfig("devicetest"); err == nil {
+				t.Errorf("Configuration read without error")
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := Config{
+		ConfigReloadInterval:  10 * time.Second,
+		LogLevel:              "info",
+		Port:                  "8091",
+		GRPCPort:              "8092",
+		ShutdownTimeout:       20 * time.Second,
+		Discovery:             "static",
+		ConsulTTL:             30 * time.Second,
+		CAPath:                "ca.crt",
+		ReconnectInitialDelay: time.Second,
+		ReconnectMaxDelay:     2 * time.Minute,
+		ReconnectMultiplier:   2,
+		CertFile:              "device.crt",
+		KeyFile:               "device.key",
+		CertReloadInterval:    30 * time.Second,
+		APIMTLSDefaultRole:    "read-only",
+		TelemetryExporter:     "none",
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Got result is %s for a valid configuration; want nil", err)
+	}
+
+	invalid := valid
+	invalid.LogLevel = "verbose"
+	invalid.Port = ""
+	invalid.CORSAllowedOrigins = []string{"https://[ui", "https://ui", "*"}
+	invalid.CORSAllowCredentials = true
+	invalid.Discovery = "consul"
+	invalid.APIAuth = "mtls,basic"
+	invalid.RateLimitGlobal = -1
+
+	err := invalid.Validate()
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Got result is %v; want a validation error", err)
+	}
+	want := []string{
+		`LogLevel must be one of debug, info, warn, error, not "verbose"`,
+		`Port must be a port number, not ""`,
+		`CORSAllowedOrigins pattern "https://[ui" is malformed`,
+		`CORSAllowCredentials requires CORSAllowedOrigins to list origins, not the pattern "*"`,
+		"ConsulProtocol is required",
+		"ConsulHost is required",
+		`ConsulPort must be a port number, not ""`,
+		"APIClientCA is required",
+		`APIAuth methods must be mtls or oidc, not "basic"`,
+		"rate limits must not be negative",
+	}
+	if !reflect.DeepEqual(verr.Problems, want) {
+		t.Errorf("Got problems %q; want %q", verr.Problems, want)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := writeFile(t, "config.yaml", "port: \"8091\"\nloglevel: info\n")
+	t.Setenv("DEVICETEST_CONFIGFILE", path)
+	t.Setenv("DEVICETEST_CAPATH", "ca.crt")
+	t.Setenv("DEVICETEST_CERTFILE", "device.crt")
+	t.Setenv("DEVICETEST_KEYFILE", "device.key")
+	t.Setenv("DEVICETEST_DISCOVERY", "static")
+	t.Setenv("DEVICETEST_TELEMETRYEXPORTER", "none")
+
+	type reload struct {
+		cfg Config
+		err error
+	}
+	reloads := make(chan reload, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Watch(ctx, "devicetest", path, 10*time.Millisecond, func(cfg Config, err error) {
+		reloads <- reload{cfg, err}
+	}, nil)
+
+	testCases := []struct {
+		name    string
+		content string
+		level   string
+		invalid bool
+	}{
+		{"Level changed", "port: \"8091\"\nloglevel: debug\n", "debug", false},
+		{"Invalid level", "port: \"8091\"\nloglevel: verbose\n", "", true},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			if err := os.WriteFile(path, []byte(tc.content), 0600); err != nil {
+				t.Fatalf("Unable to write configuration file: %s", err)
+			}
+			// The first poll may still read the previous content.
+			timeout := time.After(time.Second)
+			for {
+				select {
+				case r := <-reloads:
+					if tc.invalid && r.err != nil {
+						return
+					}
+					if !tc.invalid && r.err == nil && r.cfg.LogLevel == tc.level {
+						return
+					}
+				case <-timeout:
+					t.Fatalf("Configuration not reloaded")
+				}
+			}
+		})
+	}
+}
+
+func TestChanged(t *testing.T) {
+	old := Config{LogLevel: "info", ConsulTags: []string{"a"}}
+	new := Config{LogLevel: "debug", ConsulTags: []string{"a"}, Port: "8091"}
+	if got := Changed(old, new); !reflect.DeepEqual(got, []string{"LogLevel", "Port"}) {
+		t.Errorf("Got changed settings %v; want [LogLevel Port]", got)
+	}
+}
@@ -0,0 +1,99 @@
+package configs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+var ErrFileFormatUnsupported = errors.New("unsupported configuration file format, must be .yaml, .yml or .toml")
+
+// decodeFile sets the fields of cfg present in the file. Keys are the names
+// of the fields, like the environment variables without prefix, in lower case
+// for YAML and in any case for TOML. Unknown keys are errors.
+func decodeFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && err != io.EOF {
+			return fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+		return nil
+	case ".toml":
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, k := range undecoded {
+				keys[i] = k.String()
+			}
+			return fmt.Errorf("invalid configuration file %s: unknown keys %s", path, strings.Join(keys, ", "))
+		}
+		return nil
+	default:
+		return ErrFileFormatUnsupported
+	}
+}
+
+// Watch polls the configuration file every interval until ctx is done and
+// reads the configuration again when the file content changed, calling
+// reload with it or with the error reading or validating it. The first poll
+// always reads it, so that changes made since the service read it are not
+// missed. done, when not nil, is called after every poll with the error of
+// the last reload, so that a rejected file is reported until it is fixed.
+func Watch(ctx context.Context, prefix string, path string, interval time.Duration, reload func(Config, error), done func(error)) {
+	var last []byte
+	var lastErr error
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		hash := fileHash(path)
+		if hash != nil && !bytes.Equal(hash, last) {
+			last = hash
+			cfg, err := NewConfig(prefix)
+			if err == nil {
+				err = cfg.Validate()
+			}
+			reload(cfg, err)
+			lastErr = err
+		}
+		if done != nil {
+			done(lastErr)
+		}
+	}
+}
+
+// fileHash is nil while the file cannot be read, like during the update of a
+// Kubernetes ConfigMap.
+func fileHash(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
@@ -0,0 +1,159 @@
+package configs
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidationError lists every problem found in a configuration, so that they
+// can all be fixed at once.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks the settings the service cannot start without and the
+// values of the enumerated ones.
+func (c Config) Validate() error {
+	var problems []string
+	add := func(problem string) {
+		problems = append(problems, problem)
+	}
+	oneOf := func(name string, value string, values ...string) {
+		for _, v := range values {
+			if value == v {
+				return
+			}
+		}
+		add(name + " must be one of " + strings.Join(values, ", ") + ", not " + strconv.Quote(value))
+	}
+	required := func(name string, value string) {
+		if value == "" {
+			add(name + " is required")
+		}
+	}
+	port := func(name string, value string) {
+		if p, err := strconv.Atoi(value); err != nil || p <= 0 || p > 65535 {
+			add(name + " must be a port number, not " + strconv.Quote(value))
+		}
+	}
+
+	if c.ConfigFile != "" && c.ConfigReloadInterval <= 0 {
+		add("ConfigReloadInterval must be positive")
+	}
+	oneOf("LogLevel", c.LogLevel, "debug", "info", "warn", "error")
+
+	port("Port", c.Port)
+	port("GRPCPort", c.GRPCPort)
+	if c.ShutdownTimeout <= 0 {
+		add("ShutdownTimeout must be positive")
+	}
+	if c.UIPort != "" {
+		port("UIPort", c.UIPort)
+	}
+	for _, origin := range c.CORSAllowedOrigins {
+		if _, err := path.Match(origin, ""); err != nil {
+			add("CORSAllowedOrigins pattern " + strconv.Quote(origin) + " is malformed")
+		} else if c.CORSAllowCredentials && strings.ContainsAny(origin, `*?[\`) {
+			add("CORSAllowCredentials requires CORSAllowedOrigins to list origins, not the pattern " + strconv.Quote(origin))
+		}
+	}
+	if c.CORSMaxAge < 0 {
+		add("CORSMaxAge must not be negative")
+	}
+
+	oneOf("Discovery", c.Discovery, "consul", "etcd", "kubernetes", "static")
+	if c.Discovery == "consul" || c.DeviceRegistry != "" {
+		required("ConsulProtocol", c.ConsulProtocol)
+		required("ConsulHost", c.ConsulHost)
+		port("ConsulPort", c.ConsulPort)
+	}
+	if c.ConsulTTL <= 0 {
+		add("ConsulTTL must be positive")
+	}
+	if c.Discovery == "etcd" {
+		required("EtcdEndpoint", c.EtcdEndpoint)
+	}
+	if c.Discovery == "kubernetes" {
+		required("KubernetesService", c.KubernetesService)
+	}
+	oneOf("DeviceRegistry", c.DeviceRegistry, "", "kv", "catalog")
+	if c.DeviceRegistry == "kv" && c.ConsulTTL < 10*time.Second {
+		add("ConsulTTL must be at least 10s for the kv device registry")
+	}
+
+	required("CAPath", c.CAPath)
+	if c.ReconnectInitialDelay <= 0 || c.ReconnectMaxDelay < c.ReconnectInitialDelay {
+		add("ReconnectInitialDelay must be positive and not above ReconnectMaxDelay")
+	}
+	if c.ReconnectMultiplier < 1 {
+		add("ReconnectMultiplier must be at least 1")
+	}
+	if c.ReconnectJitter < 0 || c.ReconnectJitter > 1 {
+		add("ReconnectJitter must be between 0 and 1")
+	}
+	if c.ReconnectMaxAttempts < 0 {
+		add("ReconnectMaxAttempts must not be negative")
+	}
+	oneOf("OfflineQueue", c.OfflineQueue, "", "memory", "disk")
+	if c.OfflineQueue == "disk" {
+		required("OfflineQueueDir", c.OfflineQueueDir)
+	}
+	if c.OfflineQueueMaxMessages < 0 || c.OfflineQueueMaxBytes < 0 || c.OfflineQueueMaxAge < 0 {
+		add("OfflineQueueMaxMessages, OfflineQueueMaxBytes and OfflineQueueMaxAge must not be negative")
+	}
+	oneOf("KeyBackend", c.KeyBackend, "", "software", "tpm-simulator")
+	required("CertFile", c.CertFile)
+	required("KeyFile", c.KeyFile)
+	if c.CertReloadInterval <= 0 {
+		add("CertReloadInterval must be positive")
+	}
+	if c.CertExpiryWarningDays < 0 {
+		add("CertExpiryWarningDays must not be negative")
+	}
+
+	if c.APIAuth != "" {
+		for _, method := range strings.Split(c.APIAuth, ",") {
+			switch method = strings.TrimSpace(method); method {
+			case "mtls":
+				required("APIClientCA", c.APIClientCA)
+			case "oidc":
+				if c.OIDCJWKSFile == "" && c.OIDCJWKSURL == "" {
+					add("OIDCJWKSFile or OIDCJWKSURL is required")
+				}
+			default:
+				add("APIAuth methods must be mtls or oidc, not " + strconv.Quote(method))
+			}
+		}
+	}
+	oneOf("APIMTLSDefaultRole", c.APIMTLSDefaultRole, "read-only", "operator")
+
+	if c.RateLimitGlobal < 0 || c.RateLimitSession < 0 {
+		add("rate limits must not be negative")
+	}
+	if c.RateLimitGlobalBurst < 0 || c.RateLimitSessionBurst < 0 {
+		add("rate limit bursts must not be negative")
+	}
+
+	if c.MetricsTopicDepth < 0 || c.MetricsMaxTopics < 0 {
+		add("MetricsTopicDepth and MetricsMaxTopics must not be negative")
+	}
+
+	oneOf("TelemetryExporter", c.TelemetryExporter, "jaeger", "otlp", "none")
+	if c.TelemetryExporter == "otlp" {
+		oneOf("OTLPProtocol", c.OTLPProtocol, "grpc", "http")
+		if c.OTLPMetrics && c.OTLPMetricsInterval <= 0 {
+			add("OTLPMetricsInterval must be positive")
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -1,11 +1,15 @@
 package consul
 
 import (
+	"context"
+	"os"
 	"strconv"
-
-	"math/rand"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/lamassuiot/device-virtual/pkg/discovery"
+	"github.com/lamassuiot/device-virtual/pkg/health"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -13,49 +17,220 @@ import (
 	"github.com/hashicorp/consul/api"
 )
 
+const (
+	serviceName = "device"
+	defaultTTL  = 30 * time.Second
+	// deregisterAfter is the time Consul keeps a critical service before
+	// deregistering it, like when the instance died without deregistering.
+	deregisterAfter = "10m"
+	// requestTimeout bounds every call to the Consul agent, so that an
+	// unreachable agent cannot stall the heartbeats.
+	requestTimeout = 10 * time.Second
+)
+
+// Registration describes the instance registered in Consul.
+type Registration struct {
+	// ID identifies the instance, it defaults to the service name followed
+	// by the hostname, which is the pod name in Kubernetes, so that it is
+	// unique and stable across restarts.
+	ID   string
+	Tags []string
+	Meta map[string]string
+	// TTL is the time Consul waits for a heartbeat before reporting the
+	// service critical, 30 seconds when zero.
+	TTL time.Duration
+	// Ready is reported to Consul with every heartbeat.
+	Ready func(ctx context.Context) health.Report
+	// Heartbeat, when not nil, is called with the result of every heartbeat.
+	Heartbeat func(error)
+}
+
+// ServiceDiscovery registers the service with a TTL check kept alive by a
+// heartbeat, which reports the readiness of the service and registers it
+// again when the Consul agent lost it, like after a restart.
 type ServiceDiscovery struct {
-	client       consulsd.Client
-	logger       log.Logger
+	client consulsd.Client
+	agent  *api.Agent
+	logger log.Logger
+	ttl    time.Duration
+
+	mtx          sync.Mutex
+	reg          Registration
 	registration *api.AgentServiceRegistration
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+func NewServiceDiscovery(consulProtocol string, consulHost string, consulPort string, CA string, reg Registration, logger log.Logger) (discovery.Service, error) {
+	consulClient, err := newAPIClient(consulProtocol, consulHost, consulPort, CA)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not start Consul API Client")
+		return nil, err
+	}
+	return newServiceDiscovery(consulClient, reg, logger)
 }
 
-func NewServiceDiscovery(consulProtocol string, consulHost string, consulPort string, CA string, logger log.Logger) (discovery.Service, error) {
+func newAPIClient(consulProtocol string, consulHost string, consulPort string, CA string) (*api.Client, error) {
 	consulConfig := api.DefaultConfig()
 	consulConfig.Address = consulProtocol + "://" + consulHost + ":" + consulPort
 	tlsConf := &api.TLSConfig{CAFile: CA}
 	consulConfig.TLSConfig = *tlsConf
-	consulClient, err := api.NewClient(consulConfig)
+	httpClient, err := api.NewHttpClient(consulConfig.Transport, consulConfig.TLSConfig)
 	if err != nil {
-		level.Error(logger).Log("err", err, "msg", "Could not start Consul API Client")
 		return nil, err
 	}
-	client := consulsd.NewClient(consulClient)
-	return &ServiceDiscovery{client: client, logger: logger}, nil
+	httpClient.Timeout = requestTimeout
+	consulConfig.HttpClient = httpClient
+	return api.NewClient(consulConfig)
+}
+
+func newServiceDiscovery(consulClient *api.Client, reg Registration, logger log.Logger) (*ServiceDiscovery, error) {
+	if reg.ID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		reg.ID = serviceName + "-" + hostname
+	}
+	if reg.TTL <= 0 {
+		reg.TTL = defaultTTL
+	}
+	return &ServiceDiscovery{
+		client: consulsd.NewClient(consulClient),
+		agent:  consulClient.Agent(),
+		logger: logger,
+		ttl:    reg.TTL,
+		reg:    reg,
+	}, nil
 }
 
+func (sd *ServiceDiscovery) checkID() string {
+	return "service:" + sd.reg.ID
+}
+
+// Register registers the service and keeps its check updated. Registering
+// again replaces the registration, keeping the running heartbeat.
 func (sd *ServiceDiscovery) Register(advProtocol string, advHost string, advPort string) error {
-	check := api.AgentServiceCheck{
-		HTTP:          advProtocol + "://" + advHost + ":" + advPort + "/v1/health",
-		Interval:      "10s",
-		Timeout:       "1s",
-		TLSSkipVerify: true,
-		Notes:         "Basic health checks",
-	}
-
-	port, _ := strconv.Atoi(advPort)
-	num := rand.Intn(100)
-	asr := api.AgentServiceRegistration{
-		ID:      "device" + strconv.Itoa(num),
-		Name:    "device",
+	port, err := strconv.Atoi(advPort)
+	if err != nil {
+		return err
+	}
+	meta := map[string]string{"protocol": advProtocol}
+	for k, v := range sd.reg.Meta {
+		meta[k] = v
+	}
+
+	sd.mtx.Lock()
+	defer sd.mtx.Unlock()
+	sd.registration = &api.AgentServiceRegistration{
+		ID:      sd.reg.ID,
+		Name:    serviceName,
 		Address: advHost,
 		Port:    port,
-		Tags:    []string{"device"},
-		Check:   &check,
+		Tags:    append([]string{serviceName}, sd.reg.Tags...),
+		Meta:    meta,
+		Check: &api.AgentServiceCheck{
+			CheckID:                        sd.checkID(),
+			Name:                           "Readiness",
+			TTL:                            sd.ttl.String(),
+			DeregisterCriticalServiceAfter: deregisterAfter,
+			Notes:                          "Readiness checks reported by the service heartbeat",
+		},
+	}
+	if err := sd.client.Register(sd.registration); err != nil {
+		return err
+	}
+	if err := sd.heartbeat(); err != nil {
+		level.Warn(sd.logger).Log("err", err, "msg", "Could not report service readiness to Consul")
+	}
+
+	if sd.stop != nil {
+		return nil
+	}
+	sd.stop = make(chan struct{})
+	sd.done = make(chan struct{})
+	go sd.keepAlive(sd.stop, sd.done)
+	return nil
+}
+
+// heartbeat reports the readiness of the service, registering it again when
+// Consul does not know its check anymore.
+func (sd *ServiceDiscovery) heartbeat() error {
+	status, output := api.HealthPassing, "ready"
+	if sd.reg.Ready != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), sd.ttl/3)
+		status, output = checkStatus(sd.reg.Ready(ctx))
+		cancel()
+	}
+
+	err := sd.agent.UpdateTTL(sd.checkID(), output, status)
+	if err == nil {
+		return nil
+	}
+	level.Warn(sd.logger).Log("err", err, "msg", "Consul lost the service registration, registering again")
+	if err := sd.client.Register(sd.registration); err != nil {
+		return err
+	}
+	return sd.agent.UpdateTTL(sd.checkID(), output, status)
+}
+
+func (sd *ServiceDiscovery) keepAlive(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(sd.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		sd.mtx.Lock()
+		err := sd.heartbeat()
+		sd.mtx.Unlock()
+		if sd.reg.Heartbeat != nil {
+			sd.reg.Heartbeat(err)
+		}
+		if err != nil {
+			level.Error(sd.logger).Log("err", err, "msg", "Could not report service readiness to Consul")
+		}
+	}
+}
+
+// checkStatus maps a readiness report to a Consul check status, with the
+// checks that did not pass as output.
+func checkStatus(r health.Report) (string, string) {
+	var problems []string
+	for _, c := range r.Checks {
+		if c.Status != health.StatusPass {
+			problems = append(problems, c.Name+": "+c.Message)
+		}
+	}
+	output := "ready"
+	if len(problems) > 0 {
+		output = strings.Join(problems, "; ")
+	}
+	switch r.Status {
+	case health.StatusFail:
+		return api.HealthCritical, output
+	case health.StatusWarn:
+		return api.HealthWarning, output
+	default:
+		return api.HealthPassing, output
 	}
-	sd.registration = &asr
-	return sd.client.Register(sd.registration)
 }
 
 func (sd *ServiceDiscovery) Deregister() error {
+	sd.mtx.Lock()
+	stop, done := sd.stop, sd.done
+	sd.stop = nil
+	sd.mtx.Unlock()
+	if stop == nil {
+		return nil
+	}
+	close(stop)
+	<-done
+
+	sd.mtx.Lock()
+	defer sd.mtx.Unlock()
 	return sd.client.Deregister(sd.registration)
 }
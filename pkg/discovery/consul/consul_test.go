@@ -0,0 +1,262 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/health"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hashicorp/consul/api"
+)
+
+// fakeAgent implements the service registration and TTL check calls of the
+// Consul agent API, and the session and KV calls holding keys with sessions
+// that delete them.
+type fakeAgent struct {
+	mtx         sync.Mutex
+	services    map[string]api.AgentServiceRegistration
+	checks      map[string]string
+	outputs     map[string]string
+	sessions    map[string]bool
+	lastSession int
+	kv          map[string][]byte
+	holders     map[string]string
+}
+
+func newFakeAgent() *fakeAgent {
+	f := &fakeAgent{}
+	f.restart()
+	return f
+}
+
+// restart loses every registration, like an agent restarted without a data
+// directory.
+func (f *fakeAgent) restart() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.services = make(map[string]api.AgentServiceRegistration)
+	f.checks = make(map[string]string)
+	f.outputs = make(map[string]string)
+	f.sessions = make(map[string]bool)
+	f.kv = make(map[string][]byte)
+	f.holders = make(map[string]string)
+}
+
+func (f *fakeAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	switch {
+	case r.URL.Path == "/v1/agent/service/register":
+		var reg api.AgentServiceRegistration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.services[reg.ID] = reg
+		f.checks[reg.Check.CheckID] = api.HealthCritical
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		if reg, ok := f.services[id]; ok {
+			delete(f.checks, reg.Check.CheckID)
+		}
+		delete(f.services, id)
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/check/update/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/check/update/")
+		if _, ok := f.checks[id]; !ok {
+			http.Error(w, "Unknown check \""+id+"\"", http.StatusInternalServerError)
+			return
+		}
+		var update struct {
+			Status string
+			Output string
+		}
+		json.NewDecoder(r.Body).Decode(&update)
+		f.checks[id] = update.Status
+		f.outputs[id] = update.Output
+	case r.URL.Path == "/v1/session/create":
+		f.lastSession++
+		id := fmt.Sprintf("session-%d", f.lastSession)
+		f.sessions[id] = true
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")
+		if !f.sessions[id] {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode([]api.SessionEntry{{ID: id}})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/")
+		delete(f.sessions, id)
+		for key, holder := range f.holders {
+			if holder == id {
+				delete(f.kv, key)
+				delete(f.holders, key)
+			}
+		}
+		w.Write([]byte("true"))
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		if r.Method == http.MethodDelete {
+			delete(f.kv, key)
+			delete(f.holders, key)
+			w.Write([]byte("true"))
+			return
+		}
+		session := r.URL.Query().Get("acquire")
+		if holder, ok := f.holders[key]; !f.sessions[session] || (ok && holder != session) {
+			w.Write([]byte("false"))
+			return
+		}
+		f.kv[key], _ = io.ReadAll(r.Body)
+		f.holders[key] = session
+		w.Write([]byte("true"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeAgent) service(id string) (api.AgentServiceRegistration, string, string, bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	reg, ok := f.services[id]
+	if !ok {
+		return reg, "", "", false
+	}
+	return reg, f.checks[reg.Check.CheckID], f.outputs[reg.Check.CheckID], true
+}
+
+func newTestServiceDiscovery(t *testing.T, url string, reg Registration) *ServiceDiscovery {
+	conf := api.DefaultConfig()
+	conf.Address = strings.TrimPrefix(url, "http://")
+	conf.Scheme = "http"
+	client, err := api.NewClient(conf)
+	if err != nil {
+		t.Fatalf("Unable to create Consul client: %s", err)
+	}
+	sd, err := newServiceDiscovery(client, reg, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to create service discovery: %s", err)
+	}
+	return sd
+}
+
+func TestServiceDiscovery(t *testing.T) {
+	fake := newFakeAgent()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	var mtx sync.Mutex
+	report := health.Report{Status: health.StatusPass}
+	setReport := func(r health.Report) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		report = r
+	}
+	sd := newTestServiceDiscovery(t, srv.URL, Registration{
+		ID:   "device-virtual-0",
+		Tags: []string{"virtual"},
+		Meta: map[string]string{"version": "1.0.0"},
+		TTL:  300 * time.Millisecond,
+		Ready: func(ctx context.Context) health.Report {
+			mtx.Lock()
+			defer mtx.Unlock()
+			return report
+		},
+	})
+	if err := sd.Register("https", "10.0.0.1", "8091"); err != nil {
+		t.Fatalf("Unable to register: %s", err)
+	}
+
+	reg, _, _, _ := fake.service("device-virtual-0")
+	if reg.Address != "10.0.0.1" || reg.Port != 8091 {
+		t.Errorf("Got address %s:%d; want 10.0.0.1:8091", reg.Address, reg.Port)
+	}
+	if fmt.Sprint(reg.Tags) != "[device virtual]" {
+		t.Errorf("Got tags %v; want [device virtual]", reg.Tags)
+	}
+	if reg.Meta["version"] != "1.0.0" || reg.Meta["protocol"] != "https" {
+		t.Errorf("Got metadata %v; want the version and protocol", reg.Meta)
+	}
+
+	testCases := []struct {
+		name       string
+		prepare    func()
+		registered bool
+		status     string
+		output     string
+	}{
+		{"Registered", func() {}, true, api.HealthPassing, "ready"},
+		{"Warning", func() {
+			setReport(health.Report{Status: health.StatusWarn, Checks: []health.Check{
+				{Name: "server_certificate", Status: health.StatusWarn, Message: "certificate expires in 2 days"},
+			}})
+			time.Sleep(sd.ttl)
+		}, true, api.HealthWarning, "server_certificate: certificate expires in 2 days"},
+		{"Critical", func() {
+			setReport(health.Report{Status: health.StatusFail, Checks: []health.Check{
+				{Name: "trust_store", Status: health.StatusFail, Message: "no certificates found"},
+			}})
+			time.Sleep(sd.ttl)
+		}, true, api.HealthCritical, "trust_store: no certificates found"},
+		{"Registered again after Consul restarted", func() {
+			setReport(health.Report{Status: health.StatusPass})
+			fake.restart()
+			time.Sleep(sd.ttl)
+		}, true, api.HealthPassing, "ready"},
+		{"Registered twice", func() {
+			if err := sd.Register("https", "10.0.0.2", "8091"); err != nil {
+				t.Fatalf("Unable to register: %s", err)
+			}
+			if reg, _, _, _ := fake.service("device-virtual-0"); reg.Address != "10.0.0.2" {
+				t.Errorf("Got address %s; want 10.0.0.2", reg.Address)
+			}
+		}, true, api.HealthPassing, "ready"},
+		{"Deregistered", func() {
+			if err := sd.Deregister(); err != nil {
+				t.Fatalf("Unable to deregister: %s", err)
+			}
+			// No heartbeat is left to register the service again.
+			time.Sleep(sd.ttl)
+		}, false, "", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			tc.prepare()
+			_, status, output, ok := fake.service("device-virtual-0")
+			if ok != tc.registered {
+				t.Fatalf("Got registered %t; want %t", ok, tc.registered)
+			}
+			if status != tc.status || output != tc.output {
+				t.Errorf("Got check %s %q; want %s %q", status, output, tc.status, tc.output)
+			}
+		})
+	}
+}
+
+func TestRegisterError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	sd := newTestServiceDiscovery(t, srv.URL, Registration{})
+	if !strings.HasPrefix(sd.reg.ID, "device-") {
+		t.Errorf("Got ID %s; want it derived from the hostname", sd.reg.ID)
+	}
+	if err := sd.Register("https", "device", "8091"); err == nil {
+		t.Errorf("Registration succeeded with Consul denying it")
+	}
+	if err := sd.Deregister(); err != nil {
+		t.Errorf("Got result is %s deregistering an unregistered service; want nil", err)
+	}
+}
@@ -0,0 +1,379 @@
+package consul
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/discovery"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// StoreKV stores the devices as keys of the Consul KV store, held by a
+	// session of the instance so that they are deleted when it dies.
+	StoreKV = "kv"
+	// StoreCatalog registers the devices as catalog services whose TTL check
+	// follows the state of their MQTT connection.
+	StoreCatalog = "catalog"
+)
+
+const (
+	statusConnected    = "connected"
+	statusDisconnected = "disconnected"
+)
+
+var ErrStoreUnsupported = errors.New("unsupported device registry store, must be kv or catalog")
+
+// DeviceRegistryConfig configures where the devices are registered.
+type DeviceRegistryConfig struct {
+	Store string
+	// Prefix of the keys of the devices in the KV store.
+	Prefix string
+	// Service is the name of the catalog service of the devices.
+	Service string
+	// TTL is the time Consul keeps the devices of an instance that stopped
+	// its heartbeat, 30 seconds when zero. Consul requires sessions, which
+	// hold the keys of the KV store, to last at least 10 seconds.
+	TTL time.Duration
+}
+
+// DeviceRegistry registers the live device sessions in Consul. Register and
+// Deregister only record the devices, never waiting for Consul: a heartbeat
+// writes them, keeps the registrations alive, updates their status with the
+// state of the MQTT connections and registers them again when Consul lost
+// them.
+type DeviceRegistry struct {
+	client   *api.Client
+	cfg      DeviceRegistryConfig
+	instance string
+	logger   log.Logger
+
+	mtx     sync.Mutex
+	devices map[string]*device
+	removed map[string]struct{}
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+
+	// session is only used by the heartbeat, and by Close once it stopped.
+	session string
+}
+
+// device is a registered device with the status last written to Consul, empty
+// when it still has to be written.
+type device struct {
+	discovery.Device
+	status string
+}
+
+func NewDeviceRegistry(consulProtocol string, consulHost string, consulPort string, CA string, cfg DeviceRegistryConfig, logger log.Logger) (*DeviceRegistry, error) {
+	consulClient, err := newAPIClient(consulProtocol, consulHost, consulPort, CA)
+	if err != nil {
+		return nil, err
+	}
+	return newDeviceRegistry(consulClient, cfg, logger)
+}
+
+func newDeviceRegistry(consulClient *api.Client, cfg DeviceRegistryConfig, logger log.Logger) (*DeviceRegistry, error) {
+	if cfg.Store != StoreKV && cfg.Store != StoreCatalog {
+		return nil, ErrStoreUnsupported
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = defaultTTL
+	}
+	instance, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	r := &DeviceRegistry{
+		client:   consulClient,
+		cfg:      cfg,
+		instance: instance,
+		logger:   logger,
+		devices:  make(map[string]*device),
+		removed:  make(map[string]struct{}),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go r.heartbeat()
+	return r, nil
+}
+
+func (r *DeviceRegistry) Register(d discovery.Device) {
+	r.mtx.Lock()
+	r.devices[d.ClientID] = &device{Device: d}
+	delete(r.removed, d.ClientID)
+	r.mtx.Unlock()
+	r.notify()
+}
+
+func (r *DeviceRegistry) Deregister(clientID string) {
+	r.mtx.Lock()
+	if _, ok := r.devices[clientID]; !ok {
+		r.mtx.Unlock()
+		return
+	}
+	delete(r.devices, clientID)
+	r.removed[clientID] = struct{}{}
+	r.mtx.Unlock()
+	r.notify()
+}
+
+// notify wakes the heartbeat up to write the changes without waiting for
+// the next tick.
+func (r *DeviceRegistry) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the heartbeat and removes every device. The keys of the KV
+// store go with the session holding them.
+func (r *DeviceRegistry) Close() error {
+	close(r.stop)
+	<-r.done
+
+	r.mtx.Lock()
+	clientIDs := make([]string, 0, len(r.devices)+len(r.removed))
+	for clientID := range r.devices {
+		clientIDs = append(clientIDs, clientID)
+	}
+	for clientID := range r.removed {
+		clientIDs = append(clientIDs, clientID)
+	}
+	r.devices = make(map[string]*device)
+	r.removed = make(map[string]struct{})
+	r.mtx.Unlock()
+
+	var errs []error
+	if r.cfg.Store == StoreCatalog {
+		for _, clientID := range clientIDs {
+			errs = append(errs, r.remove(clientID))
+		}
+	}
+	if r.session != "" {
+		_, err := r.client.Session().Destroy(r.session, nil)
+		errs = append(errs, err)
+		r.session = ""
+	}
+	return errors.Join(errs...)
+}
+
+func (r *DeviceRegistry) heartbeat() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.cfg.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.flush(true)
+		case <-r.wake:
+			r.flush(false)
+		}
+	}
+}
+
+// flush writes the recorded devices to Consul, without holding the lock
+// during the calls. Removals come first, and those that failed are retried
+// unless the device was registered again meanwhile. On ticks, every device
+// is written, otherwise only those not written yet.
+func (r *DeviceRegistry) flush(tick bool) {
+	r.mtx.Lock()
+	removed := r.removed
+	r.removed = make(map[string]struct{})
+	devices := make([]*device, 0, len(r.devices))
+	for _, dev := range r.devices {
+		devices = append(devices, dev)
+	}
+	r.mtx.Unlock()
+
+	for clientID := range removed {
+		if err := r.remove(clientID); err != nil {
+			level.Error(r.logger).Log("err", err, "client_id", clientID, "msg", "Could not deregister device from Consul, retrying")
+			r.mtx.Lock()
+			if _, ok := r.devices[clientID]; !ok {
+				r.removed[clientID] = struct{}{}
+			}
+			r.mtx.Unlock()
+		}
+	}
+
+	if tick {
+		if err := r.renew(devices); err != nil {
+			level.Error(r.logger).Log("err", err, "msg", "Could not renew Consul session of the devices")
+		}
+	}
+	for _, dev := range devices {
+		if !tick && dev.status != "" {
+			continue
+		}
+		if err := r.sync(dev); err != nil {
+			level.Error(r.logger).Log("err", err, "client_id", dev.ClientID, "msg", "Could not update device in Consul, retrying")
+		}
+	}
+}
+
+// renew keeps the session holding the keys of the devices alive. When Consul
+// lost it, the devices are written again under a new session.
+func (r *DeviceRegistry) renew(devices []*device) error {
+	if r.cfg.Store != StoreKV || r.session == "" {
+		return nil
+	}
+	entry, _, err := r.client.Session().Renew(r.session, nil)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		level.Warn(r.logger).Log("msg", "Consul lost the session of the devices, registering them again")
+		r.session = ""
+		for _, dev := range devices {
+			dev.status = ""
+		}
+	}
+	return nil
+}
+
+func status(d discovery.Device) string {
+	if d.Connected != nil && !d.Connected() {
+		return statusDisconnected
+	}
+	return statusConnected
+}
+
+// sync writes the device when its status changed. Catalog checks are updated
+// on every call, since they expire without heartbeats.
+func (r *DeviceRegistry) sync(dev *device) error {
+	s := status(dev.Device)
+	if r.cfg.Store == StoreKV {
+		if s == dev.status {
+			return nil
+		}
+		if err := r.put(dev.Device, s); err != nil {
+			return err
+		}
+		dev.status = s
+		return nil
+	}
+
+	if dev.status == "" {
+		if err := r.registerService(dev.Device); err != nil {
+			return err
+		}
+		dev.status = s
+	}
+	checkStatus := api.HealthPassing
+	if s == statusDisconnected {
+		checkStatus = api.HealthCritical
+	}
+	err := r.client.Agent().UpdateTTL(r.checkID(dev.ClientID), s, checkStatus)
+	if err == nil {
+		return nil
+	}
+	level.Warn(r.logger).Log("err", err, "client_id", dev.ClientID, "msg", "Consul lost the device registration, registering again")
+	if err := r.registerService(dev.Device); err != nil {
+		dev.status = ""
+		return err
+	}
+	return r.client.Agent().UpdateTTL(r.checkID(dev.ClientID), s, checkStatus)
+}
+
+// put stores the device under a key held by the session of the instance.
+func (r *DeviceRegistry) put(d discovery.Device, s string) error {
+	if r.session == "" {
+		id, _, err := r.client.Session().Create(&api.SessionEntry{
+			Name:     "device-virtual-" + r.instance,
+			TTL:      r.cfg.TTL.String(),
+			Behavior: api.SessionBehaviorDelete,
+		}, nil)
+		if err != nil {
+			return err
+		}
+		r.session = id
+	}
+	value, err := json.Marshal(map[string]string{
+		"clientID":     d.ClientID,
+		"broker":       d.Broker,
+		"serialNumber": d.SerialNumber,
+		"status":       s,
+		"instance":     r.instance,
+	})
+	if err != nil {
+		return err
+	}
+	acquired, _, err := r.client.KV().Acquire(&api.KVPair{Key: r.key(d.ClientID), Value: value, Session: r.session}, nil)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return errors.New("key " + r.key(d.ClientID) + " is held by another session")
+	}
+	return nil
+}
+
+func (r *DeviceRegistry) registerService(d discovery.Device) error {
+	return r.client.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		ID:   r.serviceID(d.ClientID),
+		Name: r.cfg.Service,
+		Tags: []string{"virtual-device"},
+		Meta: map[string]string{
+			"client_id":     d.ClientID,
+			"broker":        d.Broker,
+			"serial_number": d.SerialNumber,
+			"instance":      r.instance,
+		},
+		Check: &api.AgentServiceCheck{
+			CheckID:                        r.checkID(d.ClientID),
+			Name:                           "MQTT connection",
+			TTL:                            r.cfg.TTL.String(),
+			DeregisterCriticalServiceAfter: deregisterAfter,
+		},
+	})
+}
+
+func (r *DeviceRegistry) remove(clientID string) error {
+	if r.cfg.Store == StoreCatalog {
+		return r.client.Agent().ServiceDeregister(r.serviceID(clientID))
+	}
+	_, err := r.client.KV().Delete(r.key(clientID), nil)
+	return err
+}
+
+func (r *DeviceRegistry) key(clientID string) string {
+	return r.cfg.Prefix + url.PathEscape(clientID)
+}
+
+// serviceID is the ID of the catalog service of a device, which is part of
+// the agent API paths. The characters of the client ID other than letters,
+// digits, '-' and '.' are escaped as '_' followed by their hex value, so that
+// distinct client IDs never share a service.
+func (r *DeviceRegistry) serviceID(clientID string) string {
+	var b strings.Builder
+	b.WriteString(r.cfg.Service + "-")
+	for i := 0; i < len(clientID); i++ {
+		c := clientID[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '.':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "_%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (r *DeviceRegistry) checkID(clientID string) string {
+	return "service:" + r.serviceID(clientID)
+}
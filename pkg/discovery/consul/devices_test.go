@@ -0,0 +1,226 @@
+package consul
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/discovery"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hashicorp/consul/api"
+)
+
+func newTestDeviceRegistry(t *testing.T, url string, cfg DeviceRegistryConfig) *DeviceRegistry {
+	conf := api.DefaultConfig()
+	conf.Address = strings.TrimPrefix(url, "http://")
+	conf.Scheme = "http"
+	client, err := api.NewClient(conf)
+	if err != nil {
+		t.Fatalf("Unable to create Consul client: %s", err)
+	}
+	r, err := newDeviceRegistry(client, cfg, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to create device registry: %s", err)
+	}
+	return r
+}
+
+// connection is the MQTT connection state of a test device.
+type connection struct {
+	mtx       sync.Mutex
+	connected bool
+}
+
+func (c *connection) set(connected bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.connected = connected
+}
+
+func (c *connection) IsConnected() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.connected
+}
+
+// waitFor polls cond until it holds, for at most a second, since the
+// registry writes to Consul in the background.
+func waitFor(cond func() bool) {
+	for deadline := time.Now().Add(time.Second); !cond() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (f *fakeAgent) key(key string) (map[string]string, bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	value, ok := f.kv[key]
+	if !ok {
+		return nil, false
+	}
+	var device map[string]string
+	json.Unmarshal(value, &device)
+	return device, true
+}
+
+func TestDeviceRegistryKV(t *testing.T) {
+	fake := newFakeAgent()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	r := newTestDeviceRegistry(t, srv.URL, DeviceRegistryConfig{Store: StoreKV, Prefix: "device-virtual/devices/", TTL: 300 * time.Millisecond})
+	conn := &connection{connected: true}
+	r.Register(discovery.Device{ClientID: "lamassu-client", Broker: "ssl://mosquitto:8883", SerialNumber: "1234", Connected: conn.IsConnected})
+	r.Register(discovery.Device{ClientID: "lamassu-other", Broker: "ssl://mosquitto:8883", SerialNumber: "5678"})
+
+	const key = "device-virtual/devices/lamassu-client"
+	testCases := []struct {
+		name       string
+		prepare    func()
+		registered bool
+		status     string
+	}{
+		{"Registered", func() {
+			waitFor(func() bool { _, ok := fake.key(key); return ok })
+		}, true, statusConnected},
+		{"Connection lost", func() {
+			conn.set(false)
+			time.Sleep(r.cfg.TTL)
+		}, true, statusDisconnected},
+		{"Registered again after Consul restarted", func() {
+			conn.set(true)
+			fake.restart()
+			time.Sleep(r.cfg.TTL)
+		}, true, statusConnected},
+		{"Deregistered", func() {
+			r.Deregister("lamassu-client")
+			waitFor(func() bool { _, ok := fake.key(key); return !ok })
+		}, false, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			tc.prepare()
+			device, ok := fake.key(key)
+			if ok != tc.registered {
+				t.Fatalf("Got registered %t; want %t", ok, tc.registered)
+			}
+			if ok && (device["status"] != tc.status || device["broker"] != "ssl://mosquitto:8883" || device["serialNumber"] != "1234") {
+				t.Errorf("Got device %v; want status %s", device, tc.status)
+			}
+		})
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Unable to close device registry: %s", err)
+	}
+	if _, ok := fake.key("device-virtual/devices/lamassu-other"); ok {
+		t.Errorf("Device is still registered after closing the registry")
+	}
+}
+
+func TestDeviceRegistryCatalog(t *testing.T) {
+	fake := newFakeAgent()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	r := newTestDeviceRegistry(t, srv.URL, DeviceRegistryConfig{Store: StoreCatalog, Service: "virtual-device", TTL: 300 * time.Millisecond})
+	conn := &connection{connected: true}
+	r.Register(discovery.Device{ClientID: "lamassu/client", Broker: "ssl://mosquitto:8883", SerialNumber: "1234", Connected: conn.IsConnected})
+
+	const id = "virtual-device-lamassu_2Fclient"
+	waitFor(func() bool { _, status, _, _ := fake.service(id); return status == api.HealthPassing })
+	reg, _, _, _ := fake.service(id)
+	if reg.Name != "virtual-device" || reg.Meta["client_id"] != "lamassu/client" || reg.Meta["serial_number"] != "1234" {
+		t.Errorf("Got registration %+v; want the device service", reg)
+	}
+
+	testCases := []struct {
+		name       string
+		prepare    func()
+		registered bool
+		status     string
+	}{
+		{"Registered", func() {}, true, api.HealthPassing},
+		{"Connection lost", func() {
+			conn.set(false)
+			time.Sleep(r.cfg.TTL)
+		}, true, api.HealthCritical},
+		{"Registered again after Consul restarted", func() {
+			conn.set(true)
+			fake.restart()
+			time.Sleep(r.cfg.TTL)
+		}, true, api.HealthPassing},
+		{"Closed", func() {
+			if err := r.Close(); err != nil {
+				t.Fatalf("Unable to close device registry: %s", err)
+			}
+		}, false, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			tc.prepare()
+			_, status, _, ok := fake.service(id)
+			if ok != tc.registered {
+				t.Fatalf("Got registered %t; want %t", ok, tc.registered)
+			}
+			if status != tc.status {
+				t.Errorf("Got check %s; want %s", status, tc.status)
+			}
+		})
+	}
+}
+
+func TestDeviceRegistryConsulUnresponsive(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	r := newTestDeviceRegistry(t, srv.URL, DeviceRegistryConfig{Store: StoreCatalog, Service: "virtual-device", TTL: 300 * time.Millisecond})
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		clientID := fmt.Sprintf("lamassu-client-%d", i)
+		r.Register(discovery.Device{ClientID: clientID})
+		r.Deregister(clientID)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Got Register and Deregister taking %s; want them not to wait for Consul", elapsed)
+	}
+}
+
+func TestDeviceRegistryServiceID(t *testing.T) {
+	r := &DeviceRegistry{cfg: DeviceRegistryConfig{Service: "virtual-device"}}
+	testCases := []struct {
+		clientID string
+		id       string
+	}{
+		{"lamassu-client", "virtual-device-lamassu-client"},
+		{"lamassu/client", "virtual-device-lamassu_2Fclient"},
+		{"lamassu_client", "virtual-device-lamassu_5Fclient"},
+		{"lamassu_2Fclient", "virtual-device-lamassu_5F2Fclient"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.clientID), func(t *testing.T) {
+			if id := r.serviceID(tc.clientID); id != tc.id {
+				t.Errorf("Got %s; want %s", id, tc.id)
+			}
+		})
+	}
+}
+
+func TestDeviceRegistryStoreUnsupported(t *testing.T) {
+	client, _ := api.NewClient(api.DefaultConfig())
+	_, err := newDeviceRegistry(client, DeviceRegistryConfig{Store: "zookeeper"}, log.NewNopLogger())
+	if !errors.Is(err, ErrStoreUnsupported) {
+		t.Errorf("Got result is %v; want %v", err, ErrStoreUnsupported)
+	}
+}
@@ -4,3 +4,22 @@ type Service interface {
 	Register(advProtocol string, advHost string, advPort string) error
 	Deregister() error
 }
+
+// Device is a live device session registered for monitoring.
+type Device struct {
+	ClientID     string
+	Broker       string
+	SerialNumber string
+	// Connected reports the state of the MQTT connection of the session.
+	Connected func() bool
+}
+
+// Devices registers the live device sessions next to the service, so that
+// monitoring sees each simulated device. Registration failures are logged
+// and retried in the background, they never fail the session.
+type Devices interface {
+	Register(d Device)
+	Deregister(clientID string)
+	// Close removes every registered device.
+	Close() error
+}
@@ -0,0 +1,182 @@
+package etcd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/discovery"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// defaultTTL is the time etcd keeps the registration of an instance that
+// stopped renewing its lease.
+const defaultTTL = 30 * time.Second
+
+// ServiceDiscovery registers the service in etcd under a key leased for a
+// short TTL and renewed in the background, so that the registration of an
+// instance that dies expires. It uses the JSON gateway of the etcd v3 API.
+type ServiceDiscovery struct {
+	client   *http.Client
+	endpoint string
+	prefix   string
+	ttl      time.Duration
+	logger   log.Logger
+
+	mtx   sync.Mutex
+	key   string
+	value string
+	lease int64
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewServiceDiscovery registers the service under prefix in the etcd cluster
+// at endpoint, trusting the certificates issued by CA when not empty.
+func NewServiceDiscovery(endpoint string, CA string, prefix string, logger log.Logger) (discovery.Service, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if CA != "" {
+		caCert, err := ioutil.ReadFile(CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificate found in %s", CA)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &ServiceDiscovery{
+		client:   &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		prefix:   prefix,
+		ttl:      defaultTTL,
+		logger:   logger,
+	}, nil
+}
+
+// Register stores the advertised URL of the service under the prefix
+// followed by its host and port. Registering again replaces the
+// registration, keeping the running lease renewal.
+func (sd *ServiceDiscovery) Register(advProtocol string, advHost string, advPort string) error {
+	sd.mtx.Lock()
+	defer sd.mtx.Unlock()
+
+	previous := sd.lease
+	sd.key = sd.prefix + advHost + ":" + advPort
+	sd.value = advProtocol + "://" + advHost + ":" + advPort
+	if err := sd.put(); err != nil {
+		return err
+	}
+	if sd.stop != nil {
+		// Revoking the previous lease deletes the previous key, unless
+		// it was stored again under the new lease.
+		if err := sd.call("/v3/lease/revoke", map[string]interface{}{"ID": previous}, nil); err != nil {
+			level.Warn(sd.logger).Log("err", err, "msg", "Could not revoke the previous service registration lease in etcd")
+		}
+		return nil
+	}
+	sd.stop = make(chan struct{})
+	sd.done = make(chan struct{})
+	go sd.keepAlive(sd.stop, sd.done)
+	return nil
+}
+
+// put grants a new lease and stores the registration under it.
+func (sd *ServiceDiscovery) put() error {
+	var grant struct {
+		ID int64 `json:"ID,string"`
+	}
+	if err := sd.call("/v3/lease/grant", map[string]interface{}{"TTL": int64(sd.ttl.Seconds())}, &grant); err != nil {
+		return err
+	}
+	sd.lease = grant.ID
+	return sd.call("/v3/kv/put", map[string]interface{}{
+		"key":   base64.StdEncoding.EncodeToString([]byte(sd.key)),
+		"value": base64.StdEncoding.EncodeToString([]byte(sd.value)),
+		"lease": sd.lease,
+	}, nil)
+}
+
+// keepAlive renews the lease three times per TTL, and registers the service
+// again when etcd lost it, like after the cluster was restored from scratch.
+func (sd *ServiceDiscovery) keepAlive(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(sd.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		sd.mtx.Lock()
+		var resp struct {
+			Result struct {
+				TTL int64 `json:"TTL,string"`
+			} `json:"result"`
+		}
+		err := sd.call("/v3/lease/keepalive", map[string]interface{}{"ID": sd.lease}, &resp)
+		if err == nil && resp.Result.TTL <= 0 {
+			level.Warn(sd.logger).Log("msg", "Service registration lease expired in etcd, registering again")
+			err = sd.put()
+		}
+		sd.mtx.Unlock()
+		if err != nil {
+			level.Error(sd.logger).Log("err", err, "msg", "Could not renew service registration in etcd")
+		}
+	}
+}
+
+// Deregister stops renewing the lease and revokes it, which deletes the
+// registration.
+func (sd *ServiceDiscovery) Deregister() error {
+	sd.mtx.Lock()
+	stop, done := sd.stop, sd.done
+	sd.stop = nil
+	sd.mtx.Unlock()
+	if stop == nil {
+		return nil
+	}
+	close(stop)
+	<-done
+
+	sd.mtx.Lock()
+	defer sd.mtx.Unlock()
+	return sd.call("/v3/lease/revoke", map[string]interface{}{"ID": sd.lease}, nil)
+}
+
+func (sd *ServiceDiscovery) call(path string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := sd.client.Post(sd.endpoint+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("etcd %s failed with status %d: %s", path, resp.StatusCode, e.Message)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
@@ -0,0 +1,173 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// fakeEtcd implements the lease and put calls of the etcd v3 JSON gateway,
+// which encodes bytes fields in base64 like encoding/json.
+type fakeEtcd struct {
+	mtx        sync.Mutex
+	nextLease  int64
+	leases     map[int64]bool
+	keys       map[string]string
+	keyLeases  map[string]int64
+	keepAlives int
+}
+
+func newFakeEtcd() *fakeEtcd {
+	f := &fakeEtcd{}
+	f.reset()
+	return f
+}
+
+// reset loses every lease and key, like a cluster restored from scratch.
+func (f *fakeEtcd) reset() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.leases = make(map[int64]bool)
+	f.keys = make(map[string]string)
+	f.keyLeases = make(map[string]int64)
+}
+
+func (f *fakeEtcd) get(key string) (string, bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	value, ok := f.keys[key]
+	return value, ok
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TTL   int64  `json:"TTL"`
+		ID    int64  `json:"ID"`
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+		Lease int64  `json:"lease"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message": "malformed request"}`, http.StatusBadRequest)
+		return
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	var resp interface{} = map[string]string{}
+	switch r.URL.Path {
+	case "/v3/lease/grant":
+		f.nextLease++
+		f.leases[f.nextLease] = true
+		resp = map[string]string{"ID": strconv.FormatInt(f.nextLease, 10), "TTL": strconv.FormatInt(req.TTL, 10)}
+	case "/v3/kv/put":
+		if !f.leases[req.Lease] {
+			http.Error(w, `{"message": "etcdserver: requested lease not found"}`, http.StatusBadRequest)
+			return
+		}
+		f.keys[string(req.Key)] = string(req.Value)
+		f.keyLeases[string(req.Key)] = req.Lease
+	case "/v3/lease/keepalive":
+		f.keepAlives++
+		result := map[string]string{"ID": strconv.FormatInt(req.ID, 10)}
+		if f.leases[req.ID] {
+			result["TTL"] = "30"
+		}
+		resp = map[string]interface{}{"result": result}
+	case "/v3/lease/revoke":
+		delete(f.leases, req.ID)
+		for key, lease := range f.keyLeases {
+			if lease == req.ID {
+				delete(f.keys, key)
+				delete(f.keyLeases, key)
+			}
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestServiceDiscovery(t *testing.T) {
+	fake := newFakeEtcd()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s, err := NewServiceDiscovery(srv.URL, "", "/services/device/", log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unable to create service discovery: %s", err)
+	}
+	sd := s.(*ServiceDiscovery)
+	sd.ttl = 300 * time.Millisecond
+
+	const key = "/services/device/device:8091"
+	if err := sd.Register("https", "device", "8091"); err != nil {
+		t.Fatalf("Unable to register: %s", err)
+	}
+
+	testCases := []struct {
+		name    string
+		prepare func()
+		want    string
+	}{
+		{"Registered", func() {}, "https://device:8091"},
+		{"Lease renewed", func() { time.Sleep(3 * sd.ttl) }, "https://device:8091"},
+		{"Registered again after etcd lost it", func() {
+			fake.reset()
+			time.Sleep(sd.ttl)
+		}, "https://device:8091"},
+		{"Registered twice", func() {
+			if err := sd.Register("https", "device", "8091"); err != nil {
+				t.Fatalf("Unable to register: %s", err)
+			}
+		}, "https://device:8091"},
+		{"Deregistered", func() {
+			if err := sd.Deregister(); err != nil {
+				t.Fatalf("Unable to deregister: %s", err)
+			}
+			// No lease renewal is left to register the service again.
+			time.Sleep(sd.ttl)
+		}, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			tc.prepare()
+			value, _ := fake.get(key)
+			if value != tc.want {
+				t.Errorf("Got registration %q; want %q", value, tc.want)
+			}
+		})
+	}
+
+	fake.mtx.Lock()
+	defer fake.mtx.Unlock()
+	if fake.keepAlives == 0 {
+		t.Errorf("Lease was never renewed")
+	}
+	if len(fake.leases) != 0 {
+		t.Errorf("Got %d leases left; want 0", len(fake.leases))
+	}
+}
+
+func TestRegisterError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "etcdserver: permission denied"}`, http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	sd, _ := NewServiceDiscovery(srv.URL, "", "/services/device/", log.NewNopLogger())
+	if err := sd.Register("https", "device", "8091"); err == nil {
+		t.Errorf("Registration succeeded with etcd denying it")
+	}
+	if err := sd.Deregister(); err != nil {
+		t.Errorf("Got result is %s deregistering an unregistered service; want nil", err)
+	}
+}
@@ -0,0 +1,403 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/discovery"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+
+// maxConflicts bounds the retries of updates that raced with another
+// instance updating the same Endpoints.
+const maxConflicts = 5
+
+var errConflict = errors.New("Endpoints were updated concurrently")
+
+// ServiceDiscovery registers the address of the pod in the Endpoints of a
+// Kubernetes Service, which must have no selector so that the endpoints
+// controller does not manage them. It talks to the API server with the
+// service account of the pod.
+//
+// Nothing removes the address of a pod that died without deregistering
+// until another instance registers, which prunes the addresses of the pods
+// that no longer exist or changed their IP.
+type ServiceDiscovery struct {
+	client    *http.Client
+	apiServer string
+	token     string
+	namespace string
+	service   string
+	pod       string
+	lookup    func(ctx context.Context, host string) ([]net.IPAddr, error)
+	logger    log.Logger
+
+	ip string
+}
+
+// NewServiceDiscovery registers the service in the Endpoints named service of
+// the namespace of the pod, using the in-cluster configuration.
+func NewServiceDiscovery(service string, logger log.Logger) (discovery.Service, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "token")
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := ioutil.ReadFile(serviceAccountDir + "namespace")
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := ioutil.ReadFile(serviceAccountDir + "ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("no certificate found in the service account CA")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+
+	sd := newServiceDiscovery(
+		&http.Client{Transport: transport, Timeout: 10 * time.Second},
+		"https://"+net.JoinHostPort(host, port),
+		strings.TrimSpace(string(token)),
+		strings.TrimSpace(string(namespace)),
+		service,
+		logger,
+	)
+	// The hostname of a pod is its name.
+	sd.pod, _ = os.Hostname()
+	return sd, nil
+}
+
+func newServiceDiscovery(client *http.Client, apiServer string, token string, namespace string, service string, logger log.Logger) *ServiceDiscovery {
+	return &ServiceDiscovery{
+		client:    client,
+		apiServer: apiServer,
+		token:     token,
+		namespace: namespace,
+		service:   service,
+		lookup:    net.DefaultResolver.LookupIPAddr,
+		logger:    logger,
+	}
+}
+
+// Register adds the IP address of advHost, which in a pod is usually its
+// hostname, to the Endpoints with advPort named after advProtocol, and
+// removes the addresses of pods that no longer exist.
+func (sd *ServiceDiscovery) Register(advProtocol string, advHost string, advPort string) error {
+	ip, err := sd.resolve(advHost)
+	if err != nil {
+		return err
+	}
+	portNum, err := strconv.Atoi(advPort)
+	if err != nil {
+		return fmt.Errorf("invalid port %s: %w", advPort, err)
+	}
+	p := port{Name: advProtocol, Port: int32(portNum), Protocol: "TCP"}
+	a := address{IP: ip, Hostname: hostname(advHost)}
+	if sd.pod != "" {
+		a.TargetRef, _ = json.Marshal(objectReference{Kind: "Pod", Namespace: sd.namespace, Name: sd.pod})
+	}
+	stale, err := sd.staleAddresses(ip)
+	if err != nil {
+		return err
+	}
+
+	err = sd.update(func(ep *endpoints) {
+		removeAddresses(ep, func(a address) bool { return stale[a.IP] })
+		for i, s := range ep.Subsets {
+			if len(s.Ports) != 1 || s.Ports[0].Name != p.Name || s.Ports[0].Port != p.Port {
+				continue
+			}
+			for _, a := range s.Addresses {
+				if a.IP == ip {
+					return
+				}
+			}
+			ep.Subsets[i].Addresses = append(s.Addresses, a)
+			return
+		}
+		ep.Subsets = append(ep.Subsets, subset{
+			Addresses: []address{a},
+			Ports:     []port{p},
+		})
+	})
+	if err != nil {
+		return err
+	}
+	sd.ip = ip
+	for staleIP := range stale {
+		level.Info(sd.logger).Log("msg", "Removed stale address "+staleIP+" from Kubernetes Endpoints "+sd.namespace+"/"+sd.service)
+	}
+	level.Info(sd.logger).Log("msg", "Registered "+ip+" in Kubernetes Endpoints "+sd.namespace+"/"+sd.service)
+	return nil
+}
+
+// Deregister removes the address of the pod from every subset of the
+// Endpoints.
+func (sd *ServiceDiscovery) Deregister() error {
+	if sd.ip == "" {
+		return nil
+	}
+	return sd.update(func(ep *endpoints) {
+		removeAddresses(ep, func(a address) bool { return a.IP == sd.ip })
+	})
+}
+
+// removeAddresses removes the addresses matching remove from every subset,
+// and the subsets left empty.
+func removeAddresses(ep *endpoints, remove func(address) bool) {
+	subsets := ep.Subsets[:0]
+	for _, s := range ep.Subsets {
+		addresses := s.Addresses[:0]
+		for _, a := range s.Addresses {
+			if !remove(a) {
+				addresses = append(addresses, a)
+			}
+		}
+		s.Addresses = addresses
+		if len(s.Addresses) > 0 || len(s.NotReadyAddresses) > 0 {
+			subsets = append(subsets, s)
+		}
+	}
+	ep.Subsets = subsets
+}
+
+// staleAddresses returns the IPs of the Endpoints, other than ip, that refer
+// to pods which no longer exist or have another IP. Addresses without a pod
+// reference, added by other means, are kept, and so are those whose pod
+// could not be read.
+func (sd *ServiceDiscovery) staleAddresses(ip string) (map[string]bool, error) {
+	ep, err := sd.get()
+	if err != nil || ep == nil {
+		return nil, err
+	}
+	stale := make(map[string]bool)
+	for _, s := range ep.Subsets {
+		for _, a := range s.Addresses {
+			var ref objectReference
+			if a.IP == ip || len(a.TargetRef) == 0 || json.Unmarshal(a.TargetRef, &ref) != nil || ref.Kind != "Pod" || ref.Name == "" {
+				continue
+			}
+			if ref.Namespace == "" {
+				ref.Namespace = sd.namespace
+			}
+			podIP, err := sd.podIP(ref.Namespace, ref.Name)
+			if err != nil {
+				level.Warn(sd.logger).Log("err", err, "msg", "Unable to check pod "+ref.Namespace+"/"+ref.Name+" of address "+a.IP)
+				continue
+			}
+			if podIP != a.IP {
+				stale[a.IP] = true
+			}
+		}
+	}
+	return stale, nil
+}
+
+// podIP returns the IP of a pod, empty when the pod does not exist.
+func (sd *ServiceDiscovery) podIP(namespace string, name string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, sd.apiServer+"/api/v1/namespaces/"+namespace+"/pods/"+name, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := sd.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp)
+	}
+	var pod struct {
+		Status struct {
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pod); err != nil {
+		return "", err
+	}
+	return pod.Status.PodIP, nil
+}
+
+func (sd *ServiceDiscovery) resolve(host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := sd.lookup(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no address found for %s", host)
+	}
+	return addrs[0].IP.String(), nil
+}
+
+// hostname returns host when it is a valid Endpoints hostname, a DNS label.
+func hostname(host string) string {
+	if net.ParseIP(host) != nil || strings.Contains(host, ".") || len(host) > 63 {
+		return ""
+	}
+	return host
+}
+
+// update applies modify to the Endpoints, creating them when missing, and
+// retries when another instance updated them first.
+func (sd *ServiceDiscovery) update(modify func(*endpoints)) error {
+	var err error
+	for i := 0; i < maxConflicts; i++ {
+		var ep *endpoints
+		ep, err = sd.get()
+		if err != nil {
+			return err
+		}
+		if ep == nil {
+			ep = &endpoints{APIVersion: "v1", Kind: "Endpoints"}
+			ep.Metadata, _ = json.Marshal(map[string]string{"name": sd.service, "namespace": sd.namespace})
+			modify(ep)
+			err = sd.write(http.MethodPost, sd.collectionPath(), ep)
+		} else {
+			modify(ep)
+			err = sd.write(http.MethodPut, sd.collectionPath()+"/"+sd.service, ep)
+		}
+		if !errors.Is(err, errConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+func (sd *ServiceDiscovery) collectionPath() string {
+	return "/api/v1/namespaces/" + sd.namespace + "/endpoints"
+}
+
+// get returns nil Endpoints when they do not exist.
+func (sd *ServiceDiscovery) get() (*endpoints, error) {
+	req, err := http.NewRequest(http.MethodGet, sd.apiServer+sd.collectionPath()+"/"+sd.service, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sd.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+	var ep endpoints
+	if err := json.NewDecoder(resp.Body).Decode(&ep); err != nil {
+		return nil, err
+	}
+	return &ep, nil
+}
+
+// write creates or replaces the Endpoints. Replacing them sends back their
+// resource version, so that concurrent updates conflict.
+func (sd *ServiceDiscovery) write(method string, path string, ep *endpoints) error {
+	body, err := json.Marshal(ep)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, sd.apiServer+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := sd.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		return errConflict
+	default:
+		return statusError(resp)
+	}
+}
+
+func (sd *ServiceDiscovery) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+sd.token)
+	req.Header.Set("Accept", "application/json")
+	return sd.client.Do(req)
+}
+
+func statusError(resp *http.Response) error {
+	var status struct {
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	return fmt.Errorf("Kubernetes API server answered with status %d: %s", resp.StatusCode, status.Message)
+}
+
+// endpoints is the subset of a Kubernetes Endpoints object the service
+// discovery needs. The metadata and unknown address fields are sent back as
+// they were read.
+type endpoints struct {
+	APIVersion string          `json:"apiVersion"`
+	Kind       string          `json:"kind"`
+	Metadata   json.RawMessage `json:"metadata"`
+	Subsets    []subset        `json:"subsets,omitempty"`
+}
+
+type subset struct {
+	Addresses         []address         `json:"addresses,omitempty"`
+	NotReadyAddresses []json.RawMessage `json:"notReadyAddresses,omitempty"`
+	Ports             []port            `json:"ports,omitempty"`
+}
+
+type address struct {
+	IP        string          `json:"ip"`
+	Hostname  string          `json:"hostname,omitempty"`
+	NodeName  *string         `json:"nodeName,omitempty"`
+	TargetRef json.RawMessage `json:"targetRef,omitempty"`
+}
+
+type objectReference struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+type port struct {
+	Name        string  `json:"name,omitempty"`
+	Port        int32   `json:"port"`
+	Protocol    string  `json:"protocol,omitempty"`
+	AppProtocol *string `json:"appProtocol,omitempty"`
+}
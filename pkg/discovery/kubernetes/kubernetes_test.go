@@ -0,0 +1,267 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+const endpointsPath = "/api/v1/namespaces/lamassu/endpoints"
+
+// fakeAPIServer stores Endpoints objects and rejects updates of stale
+// resource versions, like the Kubernetes API server.
+type fakeAPIServer struct {
+	mtx       sync.Mutex
+	objects   map[string]map[string]interface{}
+	version   int
+	conflicts int
+}
+
+type objectMeta struct {
+	Name            string            `json:"name"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels"`
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if r.Method == http.MethodGet {
+		obj, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(obj)
+		return
+	}
+
+	var obj map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&obj)
+	var meta objectMeta
+	raw, _ := json.Marshal(obj["metadata"])
+	json.Unmarshal(raw, &meta)
+
+	path := r.URL.Path
+	switch r.Method {
+	case http.MethodPost:
+		path = endpointsPath + "/" + meta.Name
+		if _, ok := f.objects[path]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+	case http.MethodPut:
+		current, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if f.conflicts > 0 {
+			// Another instance updated the Endpoints first.
+			f.conflicts--
+			f.version++
+			current["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(f.version)
+		}
+		if current["metadata"].(map[string]interface{})["resourceVersion"] != meta.ResourceVersion {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+	}
+	f.version++
+	obj["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(f.version)
+	f.objects[path] = obj
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(obj)
+}
+
+// addresses lists the IPs of the Endpoints by port.
+func (f *fakeAPIServer) addresses() (map[string][]string, objectMeta) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	obj, ok := f.objects[endpointsPath+"/device-virtual"]
+	if !ok {
+		return nil, objectMeta{}
+	}
+	raw, _ := json.Marshal(obj)
+	var ep endpoints
+	json.Unmarshal(raw, &ep)
+	var meta objectMeta
+	json.Unmarshal(ep.Metadata, &meta)
+
+	ips := make(map[string][]string)
+	for _, s := range ep.Subsets {
+		for _, p := range s.Ports {
+			for _, a := range s.Addresses {
+				key := p.Name + ":" + strconv.Itoa(int(p.Port))
+				ips[key] = append(ips[key], a.IP)
+			}
+		}
+	}
+	return ips, meta
+}
+
+func TestServiceDiscovery(t *testing.T) {
+	fake := &fakeAPIServer{objects: make(map[string]map[string]interface{})}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	newInstance := func(ip string) *ServiceDiscovery {
+		sd := newServiceDiscovery(srv.Client(), srv.URL, "token", "lamassu", "device-virtual", log.NewNopLogger())
+		sd.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+		}
+		return sd
+	}
+	first := newInstance("10.0.0.1")
+	second := newInstance("10.0.0.2")
+
+	testCases := []struct {
+		name   string
+		action func() error
+		want   map[string][]string
+	}{
+		{"Endpoints created", func() error { return first.Register("https", "device-virtual-0", "8091") }, map[string][]string{"https:8091": {"10.0.0.1"}}},
+		{"Registered twice", func() error { return first.Register("https", "device-virtual-0", "8091") }, map[string][]string{"https:8091": {"10.0.0.1"}}},
+		{"Second instance", func() error {
+			fake.mtx.Lock()
+			fake.conflicts = 2
+			fake.mtx.Unlock()
+			return second.Register("https", "device-virtual-1", "8091")
+		}, map[string][]string{"https:8091": {"10.0.0.1", "10.0.0.2"}}},
+		{"First deregistered", first.Deregister, map[string][]string{"https:8091": {"10.0.0.2"}}},
+		{"Second deregistered", second.Deregister, map[string][]string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			if err := tc.action(); err != nil {
+				t.Fatalf("Got result is %s; want nil", err)
+			}
+			got, _ := fake.addresses()
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Got addresses %v; want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMetadataKept(t *testing.T) {
+	fake := &fakeAPIServer{objects: map[string]map[string]interface{}{
+		endpointsPath + "/device-virtual": {
+			"apiVersion": "v1",
+			"kind":       "Endpoints",
+			"metadata": map[string]interface{}{
+				"name":            "device-virtual",
+				"resourceVersion": "0",
+				"labels":          map[string]interface{}{"app": "device-virtual"},
+			},
+		},
+	}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	sd := newServiceDiscovery(srv.Client(), srv.URL, "token", "lamassu", "device-virtual", log.NewNopLogger())
+	if err := sd.Register("https", "10.0.0.1", "8091"); err != nil {
+		t.Fatalf("Unable to register: %s", err)
+	}
+	_, meta := fake.addresses()
+	if meta.Labels["app"] != "device-virtual" {
+		t.Errorf("Got labels %v; want the original ones", meta.Labels)
+	}
+}
+
+func TestStaleAddressesPruned(t *testing.T) {
+	ref := func(name string) map[string]interface{} {
+		return map[string]interface{}{"kind": "Pod", "namespace": "lamassu", "name": name}
+	}
+	pod := func(ip string) map[string]interface{} {
+		return map[string]interface{}{"status": map[string]interface{}{"podIP": ip}}
+	}
+	fake := &fakeAPIServer{objects: map[string]map[string]interface{}{
+		endpointsPath + "/device-virtual": {
+			"apiVersion": "v1",
+			"kind":       "Endpoints",
+			"metadata":   map[string]interface{}{"name": "device-virtual", "resourceVersion": "0"},
+			"subsets": []interface{}{
+				map[string]interface{}{
+					"addresses": []interface{}{
+						map[string]interface{}{"ip": "10.0.0.1", "targetRef": ref("device-virtual-0")},
+						map[string]interface{}{"ip": "10.0.0.2", "targetRef": ref("device-virtual-1")},
+						map[string]interface{}{"ip": "10.0.0.3", "targetRef": ref("device-virtual-2")},
+						map[string]interface{}{"ip": "10.0.0.4"},
+					},
+					"ports": []interface{}{map[string]interface{}{"name": "https", "port": 8091}},
+				},
+				map[string]interface{}{
+					"addresses": []interface{}{
+						map[string]interface{}{"ip": "10.0.0.2", "targetRef": ref("device-virtual-1")},
+					},
+					"ports": []interface{}{map[string]interface{}{"name": "grpc", "port": 8092}},
+				},
+			},
+		},
+		"/api/v1/namespaces/lamassu/pods/device-virtual-0": pod("10.0.0.1"),
+		// Recreated with another IP.
+		"/api/v1/namespaces/lamassu/pods/device-virtual-2": pod("10.0.0.9"),
+	}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	sd := newServiceDiscovery(srv.Client(), srv.URL, "token", "lamassu", "device-virtual", log.NewNopLogger())
+	sd.pod = "device-virtual-3"
+	if err := sd.Register("https", "10.0.0.5", "8091"); err != nil {
+		t.Fatalf("Unable to register: %s", err)
+	}
+	got, _ := fake.addresses()
+	want := map[string][]string{"https:8091": {"10.0.0.1", "10.0.0.4", "10.0.0.5"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got addresses %v; want %v", got, want)
+	}
+
+	// The next instance prunes the address of this one once its pod is gone.
+	next := newServiceDiscovery(srv.Client(), srv.URL, "token", "lamassu", "device-virtual", log.NewNopLogger())
+	if err := next.Register("https", "10.0.0.6", "8091"); err != nil {
+		t.Fatalf("Unable to register: %s", err)
+	}
+	got, _ = fake.addresses()
+	want = map[string][]string{"https:8091": {"10.0.0.1", "10.0.0.4", "10.0.0.6"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got addresses %v; want %v", got, want)
+	}
+}
+
+func TestRegisterErrors(t *testing.T) {
+	fake := &fakeAPIServer{objects: make(map[string]map[string]interface{})}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	testCases := []struct {
+		name  string
+		token string
+		port  string
+	}{
+		{"Unauthorized", "expired", "8091"},
+		{"Invalid port", "token", "https"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			sd := newServiceDiscovery(srv.Client(), srv.URL, tc.token, "lamassu", "device-virtual", log.NewNopLogger())
+			if err := sd.Register("https", "10.0.0.1", tc.port); err == nil {
+				t.Errorf("Registration succeeded")
+			}
+		})
+	}
+}
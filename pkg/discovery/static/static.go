@@ -0,0 +1,27 @@
+package static
+
+import (
+	"github.com/lamassuiot/device-virtual/pkg/discovery"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// ServiceDiscovery registers the service nowhere, for environments where its
+// clients are configured with its address.
+type ServiceDiscovery struct {
+	logger log.Logger
+}
+
+func NewServiceDiscovery(logger log.Logger) discovery.Service {
+	return &ServiceDiscovery{logger: logger}
+}
+
+func (sd *ServiceDiscovery) Register(advProtocol string, advHost string, advPort string) error {
+	level.Info(sd.logger).Log("msg", "Service discovery disabled, clients must be configured with "+advProtocol+"://"+advHost+":"+advPort)
+	return nil
+}
+
+func (sd *ServiceDiscovery) Deregister() error {
+	return nil
+}
@@ -0,0 +1,146 @@
+// Package events broadcasts what happens to device sessions to any number of
+// listeners, such as the device UI.
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type Type string
+
+const (
+	SessionConnected     Type = "session.connected"
+	SessionConnectFailed Type = "session.connect_failed"
+	SessionDisconnected  Type = "session.disconnected"
+	SessionStateChanged  Type = "session.state_changed"
+	MessagePublished     Type = "message.published"
+	MessageQueued        Type = "message.queued"
+	MessagePublishFailed Type = "message.publish_failed"
+	MessageReceived      Type = "message.received"
+	CertificateRequested Type = "certificate.requested"
+	CertificateInstalled Type = "certificate.installed"
+	CertificateImported  Type = "certificate.imported"
+)
+
+var Types = []Type{
+	SessionConnected,
+	SessionConnectFailed,
+	SessionDisconnected,
+	SessionStateChanged,
+	MessagePublished,
+	MessageQueued,
+	MessagePublishFailed,
+	MessageReceived,
+	CertificateRequested,
+	CertificateInstalled,
+	CertificateImported,
+}
+
+// Event is something that happened to the session or identity of a device.
+type Event struct {
+	ID          uint64       `json:"id"`
+	Type        Type         `json:"type"`
+	ClientID    string       `json:"clientID"`
+	Time        time.Time    `json:"time"`
+	State       string       `json:"state,omitempty"`
+	Topic       string       `json:"topic,omitempty"`
+	Message     string       `json:"message,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Certificate *Certificate `json:"certificate,omitempty"`
+}
+
+// Certificate describes the certificate an event refers to.
+type Certificate struct {
+	Subject      string    `json:"subject"`
+	SerialNumber string    `json:"serialNumber"`
+	NotAfter     time.Time `json:"notAfter"`
+}
+
+// Filter selects events by client ID and type. Empty fields match everything.
+type Filter struct {
+	ClientIDs []string
+	Types     []Type
+}
+
+func (f Filter) Match(e Event) bool {
+	return matches(f.ClientIDs, e.ClientID) && matches(f.Types, e.Type)
+}
+
+func matches[T comparable](values []T, v T) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerBuffer is the number of events kept for a listener before new ones
+// are dropped.
+const listenerBuffer = 256
+
+type listener struct {
+	filter Filter
+	events chan Event
+}
+
+// Bus delivers published events to the listeners whose filter matches them.
+// Publishing never blocks: listeners that do not keep up lose events.
+type Bus struct {
+	mtx       sync.Mutex
+	lastID    uint64
+	listeners map[*listener]struct{}
+	now       func() time.Time
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		listeners: make(map[*listener]struct{}),
+		now:       time.Now,
+	}
+}
+
+// Publish assigns the event an ID and, if unset, a time before delivering it.
+func (b *Bus) Publish(e Event) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.lastID++
+	e.ID = b.lastID
+	if e.Time.IsZero() {
+		e.Time = b.now()
+	}
+	for l := range b.listeners {
+		if !l.filter.Match(e) {
+			continue
+		}
+		select {
+		case l.events <- e:
+		default:
+		}
+	}
+}
+
+// Listen returns the events matching filter until ctx is done, when the
+// returned channel is closed.
+func (b *Bus) Listen(ctx context.Context, filter Filter) <-chan Event {
+	l := &listener{filter: filter, events: make(chan Event, listenerBuffer)}
+
+	b.mtx.Lock()
+	b.listeners[l] = struct{}{}
+	b.mtx.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mtx.Lock()
+		delete(b.listeners, l)
+		close(l.events)
+		b.mtx.Unlock()
+	}()
+	return l.events
+}
@@ -0,0 +1,62 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	testCases := []struct {
+		name   string
+		filter Filter
+		want   []Type
+	}{
+		{"No filter", Filter{}, []Type{SessionConnected, MessagePublished, SessionConnected}},
+		{"Client ID", Filter{ClientIDs: []string{"lamassu-client"}}, []Type{SessionConnected, MessagePublished}},
+		{"Type", Filter{Types: []Type{SessionConnected}}, []Type{SessionConnected, SessionConnected}},
+		{"Client ID and type", Filter{ClientIDs: []string{"other-client"}, Types: []Type{MessagePublished}}, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			b := NewBus()
+			ctx, cancel := context.WithCancel(context.Background())
+			events := b.Listen(ctx, tc.filter)
+
+			b.Publish(Event{Type: SessionConnected, ClientID: "lamassu-client"})
+			b.Publish(Event{Type: MessagePublished, ClientID: "lamassu-client"})
+			b.Publish(Event{Type: SessionConnected, ClientID: "other-client"})
+			cancel()
+
+			var got []Type
+			var lastID uint64
+			for e := range events {
+				got = append(got, e.Type)
+				if e.ID <= lastID {
+					t.Errorf("Event IDs are not increasing: %d after %d", e.ID, lastID)
+				}
+				if e.Time.IsZero() {
+					t.Errorf("Event has no time")
+				}
+				lastID = e.ID
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("Got events %v; want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSlowListener(t *testing.T) {
+	b := NewBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := b.Listen(ctx, Filter{})
+
+	for i := 0; i < listenerBuffer+10; i++ {
+		b.Publish(Event{Type: MessageReceived, ClientID: "lamassu-client"})
+	}
+	if len(events) != listenerBuffer {
+		t.Errorf("Got %d buffered events; want %d", len(events), listenerBuffer)
+	}
+}
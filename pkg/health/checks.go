@@ -0,0 +1,62 @@
+package health
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"time"
+)
+
+// TrustStore checks that the CA bundle at path can be read and contains at
+// least one certificate.
+func TrustStore(path string) CheckFunc {
+	return func(ctx context.Context) Check {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Check{Status: StatusFail, Message: err.Error()}
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return Check{Status: StatusFail, Message: "no certificates found in " + path}
+		}
+		return Check{Status: StatusPass, Details: map[string]interface{}{"path": path}}
+	}
+}
+
+// CertificateExpiry checks the certificate at path, warning once it expires
+// within warnBefore and failing once it has expired.
+func CertificateExpiry(path string, warnBefore time.Duration) CheckFunc {
+	return func(ctx context.Context) Check {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Check{Status: StatusFail, Message: err.Error()}
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return Check{Status: StatusFail, Message: "no PEM certificate found in " + path}
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return Check{Status: StatusFail, Message: err.Error()}
+		}
+
+		left := time.Until(cert.NotAfter)
+		c := Check{
+			Status: StatusPass,
+			Details: map[string]interface{}{
+				"not_after":      cert.NotAfter.UTC().Format(time.RFC3339),
+				"days_to_expiry": int(left.Hours() / 24),
+			},
+		}
+		switch {
+		case left <= 0:
+			c.Status = StatusFail
+			c.Message = "certificate has expired"
+		case left < warnBefore:
+			c.Status = StatusWarn
+			c.Message = "certificate expires soon"
+		}
+		return c
+	}
+}
@@ -0,0 +1,160 @@
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status follows the pass/warn/fail convention used by Consul checks.
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	StatusWarn Status = "warn"
+	StatusFail Status = "fail"
+)
+
+type Check struct {
+	Name    string                 `json:"name"`
+	Status  Status                 `json:"status"`
+	Message string                 `json:"message,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+type CheckFunc func(ctx context.Context) Check
+
+type Report struct {
+	Status Status  `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+// Health aggregates the readiness checks registered by each component, along
+// with the status of background jobs.
+type Health struct {
+	mtx       sync.RWMutex
+	started   time.Time
+	readiness map[string]CheckFunc
+	jobs      map[string]*Job
+}
+
+func New() *Health {
+	return &Health{
+		started:   time.Now(),
+		readiness: make(map[string]CheckFunc),
+		jobs:      make(map[string]*Job),
+	}
+}
+
+func (h *Health) AddReadinessCheck(name string, fn CheckFunc) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.readiness[name] = fn
+}
+
+// Job registers a background job that is expected to report at least once
+// every interval. Jobs are part of the readiness report.
+func (h *Health) Job(name string, interval time.Duration) *Job {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	j := &Job{name: name, interval: interval, registered: time.Now()}
+	h.jobs[name] = j
+	return j
+}
+
+// Live reports whether the process is able to serve requests at all, which
+// it is as long as it answers.
+func (h *Health) Live(ctx context.Context) Report {
+	return newReport([]Check{{
+		Name:    "uptime",
+		Status:  StatusPass,
+		Details: map[string]interface{}{"seconds": int(time.Since(h.started).Seconds())},
+	}})
+}
+
+// Ready reports whether the service should receive traffic.
+func (h *Health) Ready(ctx context.Context) Report {
+	h.mtx.RLock()
+	checks := run(ctx, h.readiness)
+	names := make([]string, 0, len(h.jobs))
+	for name := range h.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		checks = append(checks, h.jobs[name].check())
+	}
+	h.mtx.RUnlock()
+
+	return newReport(checks)
+}
+
+func run(ctx context.Context, fns map[string]CheckFunc) []Check {
+	names := make([]string, 0, len(fns))
+	for name := range fns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	checks := make([]Check, 0, len(names))
+	for _, name := range names {
+		c := fns[name](ctx)
+		c.Name = name
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+func newReport(checks []Check) Report {
+	status := StatusPass
+	for _, c := range checks {
+		if c.Status == StatusFail {
+			status = StatusFail
+		} else if c.Status == StatusWarn && status == StatusPass {
+			status = StatusWarn
+		}
+	}
+	return Report{Status: status, Checks: checks}
+}
+
+// Job tracks the last run of a background job.
+type Job struct {
+	mtx        sync.Mutex
+	name       string
+	interval   time.Duration
+	registered time.Time
+	lastRun    time.Time
+	lastErr    error
+}
+
+// Done records a run of the job and its result.
+func (j *Job) Done(err error) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.lastRun = time.Now()
+	j.lastErr = err
+}
+
+func (j *Job) check() Check {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	c := Check{Name: "job:" + j.name, Status: StatusPass, Details: map[string]interface{}{}}
+	if !j.lastRun.IsZero() {
+		c.Details["last_run"] = j.lastRun.UTC().Format(time.RFC3339)
+	}
+	since := j.registered
+	if !j.lastRun.IsZero() {
+		since = j.lastRun
+	}
+	switch {
+	case j.lastErr != nil:
+		c.Status = StatusFail
+		c.Message = j.lastErr.Error()
+	case time.Since(since) > 3*j.interval:
+		c.Status = StatusFail
+		c.Message = "job has not run since " + since.UTC().Format(time.RFC3339)
+	}
+	return c
+}
@@ -0,0 +1,97 @@
+package health
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertificateExpiry(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name     string
+		notAfter time.Duration
+		status   Status
+	}{
+		{"Valid certificate", 90 * 24 * time.Hour, StatusPass},
+		{"Certificate near expiry", 10 * 24 * time.Hour, StatusWarn},
+		{"Expired certificate", -time.Hour, StatusFail},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			path := writeCertificate(t, time.Now().Add(tc.notAfter))
+			c := CertificateExpiry(path, 30*24*time.Hour)(ctx)
+			if c.Status != tc.status {
+				t.Errorf("Got status %s; want %s", c.Status, tc.status)
+			}
+		})
+	}
+
+	if c := CertificateExpiry("/nonexistent/server.crt", time.Hour)(ctx); c.Status != StatusFail {
+		t.Errorf("Got status %s; want %s", c.Status, StatusFail)
+	}
+	if c := TrustStore("/nonexistent/ca.crt")(ctx); c.Status != StatusFail {
+		t.Errorf("Got status %s; want %s", c.Status, StatusFail)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	ctx := context.Background()
+	h := New()
+
+	job := h.Job("telemetry", time.Minute)
+	if report := h.Ready(ctx); report.Status != StatusPass {
+		t.Errorf("Got readiness %s; want %s", report.Status, StatusPass)
+	}
+
+	job.Done(errors.New("broker unreachable"))
+	if report := h.Ready(ctx); report.Status != StatusFail {
+		t.Errorf("Got readiness %s; want %s", report.Status, StatusFail)
+	}
+
+	job.Done(nil)
+	job.lastRun = time.Now().Add(-5 * time.Minute)
+	if report := h.Ready(ctx); report.Status != StatusFail {
+		t.Errorf("Got readiness %s for a stale job; want %s", report.Status, StatusFail)
+	}
+
+	if report := h.Live(ctx); report.Status != StatusPass {
+		t.Errorf("Got liveness %s; want %s", report.Status, StatusPass)
+	}
+}
+
+func writeCertificate(t *testing.T, notAfter time.Time) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate key")
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatal("Unable to create certificate")
+	}
+	path := filepath.Join(t.TempDir(), "server.crt")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal("Unable to write certificate")
+	}
+	return path
+}
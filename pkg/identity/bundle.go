@@ -0,0 +1,198 @@
+package identity
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/pkg/errors"
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	privateKeyPEMBlockType          = "PRIVATE KEY"
+	encryptedPrivateKeyPEMBlockType = "ENCRYPTED PRIVATE KEY"
+	rsaPrivateKeyPEMBlockType       = "RSA PRIVATE KEY"
+	ecPrivateKeyPEMBlockType        = "EC PRIVATE KEY"
+)
+
+var (
+	ErrBundleDecoding    = errors.New("unable to decode credentials bundle")
+	ErrBundleKeyMissing  = errors.New("credentials bundle does not contain a private key")
+	ErrBundleCertMissing = errors.New("credentials bundle does not contain a certificate")
+	ErrIncorrectPassword = errors.New("incorrect credentials bundle password")
+	ErrKeyNotExportable  = errors.New("device key can not be exported")
+)
+
+// Import builds an identity from a PKCS#12 bundle or from PEM encoded key and
+// certificate blocks. PEM keys may be encrypted PKCS#8 or legacy encrypted
+// PEM, in which case password is used to decrypt them.
+func Import(clientID string, bundle []byte, password string) (*Identity, error) {
+	var (
+		key   crypto.Signer
+		chain []*x509.Certificate
+		err   error
+	)
+	if bytes.HasPrefix(bytes.TrimSpace(bundle), []byte("-----BEGIN")) {
+		key, chain, err = decodePEM(bundle, password)
+	} else {
+		key, chain, err = decodePKCS12(bundle, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyType, err := KeyTypeOf(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	if !publicKeyEqual(chain[0].PublicKey, key.Public()) {
+		return nil, ErrCertificateKey
+	}
+	return &Identity{ClientID: clientID, KeyType: keyType, Key: key, Certificate: chain[0], Chain: chain[1:]}, nil
+}
+
+// PKCS12 exports the identity as a PKCS#12 bundle encrypted with password.
+// Keys held by hardware backends can not be exported.
+func (i *Identity) PKCS12(password string) ([]byte, error) {
+	if i.Certificate == nil {
+		return nil, ErrBundleCertMissing
+	}
+	switch i.Key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+	default:
+		return nil, ErrKeyNotExportable
+	}
+	return pkcs12.Modern.Encode(i.Key, i.Certificate, i.Chain, password)
+}
+
+// KeyTypeOf returns the key type matching a public key.
+func KeyTypeOf(pub crypto.PublicKey) (KeyType, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		switch k.N.BitLen() {
+		case 2048:
+			return KeyTypeRSA2048, nil
+		case 3072:
+			return KeyTypeRSA3072, nil
+		case 4096:
+			return KeyTypeRSA4096, nil
+		}
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return KeyTypeECDSAP256, nil
+		case elliptic.P384():
+			return KeyTypeECDSAP384, nil
+		case elliptic.P521():
+			return KeyTypeECDSAP521, nil
+		}
+	case ed25519.PublicKey:
+		return KeyTypeEd25519, nil
+	}
+	return "", ErrKeyTypeUnsupported
+}
+
+func decodePKCS12(bundle []byte, password string) (crypto.Signer, []*x509.Certificate, error) {
+	key, cert, caCerts, err := pkcs12.DecodeChain(bundle, password)
+	if err == pkcs12.ErrIncorrectPassword {
+		return nil, nil, ErrIncorrectPassword
+	} else if err != nil {
+		return nil, nil, ErrBundleDecoding
+	}
+	signer, err := toSigner(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer, append([]*x509.Certificate{cert}, caCerts...), nil
+}
+
+func decodePEM(bundle []byte, password string) (crypto.Signer, []*x509.Certificate, error) {
+	var (
+		key   crypto.Signer
+		chain []*x509.Certificate
+	)
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case certificatePEMBlockType:
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, ErrCertificateParsing
+			}
+			chain = append(chain, cert)
+		case privateKeyPEMBlockType, encryptedPrivateKeyPEMBlockType, rsaPrivateKeyPEMBlockType, ecPrivateKeyPEMBlockType:
+			k, err := decodePEMKey(block, password)
+			if err != nil {
+				return nil, nil, err
+			}
+			key = k
+		}
+	}
+	if key == nil {
+		return nil, nil, ErrBundleKeyMissing
+	}
+	if len(chain) == 0 {
+		return nil, nil, ErrBundleCertMissing
+	}
+	return key, chain, nil
+}
+
+func decodePEMKey(block *pem.Block, password string) (crypto.Signer, error) {
+	der := block.Bytes
+	if block.Type == encryptedPrivateKeyPEMBlockType {
+		key, err := pkcs8.ParsePKCS8PrivateKey(der, []byte(password))
+		if err != nil {
+			return nil, ErrIncorrectPassword
+		}
+		return toSigner(key)
+	}
+	// Legacy encrypted PEM is deprecated but still produced by some
+	// manufacturing tools.
+	if x509.IsEncryptedPEMBlock(block) {
+		var err error
+		der, err = x509.DecryptPEMBlock(block, []byte(password))
+		if err != nil {
+			return nil, ErrIncorrectPassword
+		}
+	}
+
+	switch block.Type {
+	case rsaPrivateKeyPEMBlockType:
+		key, err := x509.ParsePKCS1PrivateKey(der)
+		if err != nil {
+			return nil, ErrBundleDecoding
+		}
+		return key, nil
+	case ecPrivateKeyPEMBlockType:
+		key, err := x509.ParseECPrivateKey(der)
+		if err != nil {
+			return nil, ErrBundleDecoding
+		}
+		return key, nil
+	default:
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, ErrBundleDecoding
+		}
+		return toSigner(key)
+	}
+}
+
+func toSigner(key interface{}) (crypto.Signer, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrKeyTypeUnsupported
+	}
+	return signer, nil
+}
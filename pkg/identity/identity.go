@@ -0,0 +1,120 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	certificatePEMBlockType = "CERTIFICATE"
+	csrPEMBlockType         = "CERTIFICATE REQUEST"
+)
+
+type KeyType string
+
+const (
+	KeyTypeRSA2048   KeyType = "RSA2048"
+	KeyTypeRSA3072   KeyType = "RSA3072"
+	KeyTypeRSA4096   KeyType = "RSA4096"
+	KeyTypeECDSAP256 KeyType = "ECDSAP256"
+	KeyTypeECDSAP384 KeyType = "ECDSAP384"
+	KeyTypeECDSAP521 KeyType = "ECDSAP521"
+	KeyTypeEd25519   KeyType = "Ed25519"
+)
+
+// KeyTypes lists every key type a device identity may use. Backends may only
+// support a subset of them.
+var KeyTypes = []KeyType{
+	KeyTypeRSA2048,
+	KeyTypeRSA3072,
+	KeyTypeRSA4096,
+	KeyTypeECDSAP256,
+	KeyTypeECDSAP384,
+	KeyTypeECDSAP521,
+	KeyTypeEd25519,
+}
+
+var (
+	ErrKeyTypeUnsupported = errors.New("unsupported key type")
+	ErrCertificateParsing = errors.New("unable to parse certificate")
+	ErrCertificateKey     = errors.New("certificate public key does not match device key")
+)
+
+// Backend creates device keys. Private key material never leaves the backend,
+// callers only get a crypto.Signer bound to it.
+type Backend interface {
+	Name() string
+	GenerateKey(keyType KeyType) (crypto.Signer, error)
+	Close() error
+}
+
+// Identity is the key and certificate a simulated device uses to authenticate
+// against the MQTT broker.
+type Identity struct {
+	ClientID    string
+	KeyType     KeyType
+	Key         crypto.Signer
+	Certificate *x509.Certificate
+	Chain       []*x509.Certificate
+}
+
+func New(backend Backend, clientID string, keyType KeyType) (*Identity, error) {
+	key, err := backend.GenerateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{ClientID: clientID, KeyType: keyType, Key: key}, nil
+}
+
+func (i *Identity) CSR(commonName string) (string, error) {
+	template := x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &template, i.Key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: csrPEMBlockType, Bytes: der})), nil
+}
+
+func (i *Identity) SetCertificate(crt string) error {
+	block, _ := pem.Decode([]byte(crt))
+	if block == nil || block.Type != certificatePEMBlockType {
+		return ErrCertificateParsing
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return ErrCertificateParsing
+	}
+	if !publicKeyEqual(cert.PublicKey, i.Key.Public()) {
+		return ErrCertificateKey
+	}
+	i.Certificate = cert
+	return nil
+}
+
+func (i *Identity) TLSCertificate() tls.Certificate {
+	cert := tls.Certificate{
+		Certificate: [][]byte{i.Certificate.Raw},
+		PrivateKey:  i.Key,
+		Leaf:        i.Certificate,
+	}
+	for _, c := range i.Chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert
+}
+
+func publicKeyEqual(a crypto.PublicKey, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return false
+	}
+	return k.Equal(b)
+}
@@ -0,0 +1,163 @@
+// Package identitytest provides a throwaway PKI to exercise device identities
+// in tests without relying on static certificate files.
+package identitytest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var serial int64
+
+type CA struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+}
+
+func NewCA(t testing.TB) *CA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate CA key")
+	}
+	template := x509.Certificate{
+		SerialNumber:          nextSerial(),
+		Subject:               pkix.Name{CommonName: "Lamassu Test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatal("Unable to create CA certificate")
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &CA{Certificate: cert, Key: key}
+}
+
+// Issue signs a client certificate for pub.
+func (ca *CA) Issue(t testing.TB, pub crypto.PublicKey, commonName string) *x509.Certificate {
+	t.Helper()
+
+	template := x509.Certificate{
+		SerialNumber: nextSerial(),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.Certificate, pub, ca.Key)
+	if err != nil {
+		t.Fatalf("Unable to issue certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+// SignCSR verifies a PEM encoded CSR and returns the issued PEM certificate.
+func (ca *CA) SignCSR(t testing.TB, csr string) string {
+	t.Helper()
+
+	block, _ := pem.Decode([]byte(csr))
+	if block == nil {
+		t.Fatal("CSR is not PEM encoded")
+	}
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatalf("Unable to parse CSR: %s", err)
+	}
+	if err := req.CheckSignature(); err != nil {
+		t.Fatalf("CSR signature is not valid: %s", err)
+	}
+	return CertificatePEM(ca.Issue(t, req.PublicKey, req.Subject.CommonName))
+}
+
+// WriteFile stores the CA certificate in a temporary file and returns its path.
+func (ca *CA) WriteFile(t testing.TB) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	if err := ioutil.WriteFile(path, []byte(CertificatePEM(ca.Certificate)), 0600); err != nil {
+		t.Fatal("Unable to write CA certificate")
+	}
+	return path
+}
+
+func CertificatePEM(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+func KeyPEM(t testing.TB, key crypto.Signer) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal("Unable to marshal private key")
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// Handshake runs a mutual TLS handshake with the given protocol version
+// against an in-memory server that requires a client certificate issued by ca.
+func Handshake(t testing.TB, cert tls.Certificate, ca *CA, version uint16) error {
+	t.Helper()
+
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Unable to generate server key")
+	}
+	serverCert := ca.Issue(t, serverKey.Public(), "mosquitto")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	server := tls.Server(s, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   version,
+		MaxVersion:   version,
+	})
+	client := tls.Client(c, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   "mosquitto",
+		MinVersion:   version,
+		MaxVersion:   version,
+	})
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Handshake()
+	}()
+	if err := client.Handshake(); err != nil {
+		return err
+	}
+	return <-errs
+}
+
+func nextSerial() *big.Int {
+	return big.NewInt(atomic.AddInt64(&serial, 1))
+}
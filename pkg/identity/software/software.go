@@ -0,0 +1,51 @@
+package software
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+
+	"github.com/lamassuiot/device-virtual/pkg/identity"
+)
+
+type software struct{}
+
+func NewBackend() identity.Backend {
+	return &software{}
+}
+
+func (s *software) Name() string {
+	return "software"
+}
+
+func (s *software) GenerateKey(keyType identity.KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case identity.KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case identity.KeyTypeRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case identity.KeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case identity.KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case identity.KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case identity.KeyTypeECDSAP521:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case identity.KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		return nil, identity.ErrKeyTypeUnsupported
+	}
+}
+
+func (s *software) Close() error {
+	return nil
+}
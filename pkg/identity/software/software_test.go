@@ -0,0 +1,57 @@
+package software
+
+import (
+	"crypto/tls"
+	"fmt"
+	"testing"
+
+	"github.com/lamassuiot/device-virtual/pkg/identity"
+	"github.com/lamassuiot/device-virtual/pkg/identity/identitytest"
+)
+
+func TestKeyTypes(t *testing.T) {
+	backend := NewBackend()
+	ca := identitytest.NewCA(t)
+
+	for _, keyType := range identity.KeyTypes {
+		t.Run(fmt.Sprintf("Testing %s", keyType), func(t *testing.T) {
+			id, err := identity.New(backend, "lamassu-client", keyType)
+			if err != nil {
+				t.Fatalf("Unable to generate key: %s", err)
+			}
+			if got, _ := identity.KeyTypeOf(id.Key.Public()); got != keyType {
+				t.Errorf("Got key type %s; want %s", got, keyType)
+			}
+
+			csr, err := id.CSR("lamassu-client")
+			if err != nil {
+				t.Fatalf("Unable to create CSR: %s", err)
+			}
+			if err := id.SetCertificate(ca.SignCSR(t, csr)); err != nil {
+				t.Fatalf("Unable to set certificate: %s", err)
+			}
+
+			for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+				if err := identitytest.Handshake(t, id.TLSCertificate(), ca, version); err != nil {
+					t.Errorf("TLS %x handshake failed: %s", version, err)
+				}
+			}
+
+			bundle, err := id.PKCS12("secret")
+			if err != nil {
+				t.Fatalf("Unable to export identity: %s", err)
+			}
+			imported, err := identity.Import("lamassu-client", bundle, "secret")
+			if err != nil {
+				t.Fatalf("Unable to import exported identity: %s", err)
+			}
+			if imported.KeyType != keyType {
+				t.Errorf("Got imported key type %s; want %s", imported.KeyType, keyType)
+			}
+		})
+	}
+
+	if _, err := backend.GenerateKey(identity.KeyType("DSA1024")); err != identity.ErrKeyTypeUnsupported {
+		t.Errorf("Got result is %s; want %s", err, identity.ErrKeyTypeUnsupported)
+	}
+}
@@ -0,0 +1,180 @@
+package tpm
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/lamassuiot/device-virtual/pkg/identity"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrSimulatorStart  = errors.New("unable to start TPM simulator")
+	ErrHashUnsupported = errors.New("unsupported signature hash")
+	ErrPSSSaltLength   = errors.New("unsupported PSS salt length")
+)
+
+// tpm keeps every device key as a child of a single storage root key. Keys are
+// only loaded into the TPM while signing, as the simulator has very few
+// transient object slots.
+type tpm struct {
+	mtx sync.Mutex
+	rw  io.ReadWriteCloser
+	srk tpmutil.Handle
+}
+
+// NewSimulatorBackend starts an in-process TPM 2.0 simulator. Only one
+// simulator may be running at a time.
+func NewSimulatorBackend() (identity.Backend, error) {
+	sim, err := simulator.Get()
+	if err != nil {
+		return nil, errors.Wrap(ErrSimulatorStart, err.Error())
+	}
+	return newBackend(sim)
+}
+
+func newBackend(rw io.ReadWriteCloser) (identity.Backend, error) {
+	srk, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", srkTemplate)
+	if err != nil {
+		rw.Close()
+		return nil, err
+	}
+	return &tpm{rw: rw, srk: srk}, nil
+}
+
+func (t *tpm) Name() string {
+	return "tpm"
+}
+
+func (t *tpm) GenerateKey(keyType identity.KeyType) (crypto.Signer, error) {
+	template, err := keyTemplate(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	private, public, _, _, _, err := tpm2.CreateKey(t.rw, t.srk, tpm2.PCRSelection{}, "", "", template)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := tpm2.DecodePublic(public)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := pub.Key()
+	if err != nil {
+		return nil, err
+	}
+	return &signer{tpm: t, private: private, public: public, pubKey: pubKey}, nil
+}
+
+func (t *tpm) Close() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	tpm2.FlushContext(t.rw, t.srk)
+	return t.rw.Close()
+}
+
+// signer is a crypto.Signer backed by a TPM-resident key. The private blob is
+// wrapped by the storage root key and cannot be used outside the TPM.
+type signer struct {
+	tpm     *tpm
+	private []byte
+	public  []byte
+	pubKey  crypto.PublicKey
+}
+
+func (s *signer) Public() crypto.PublicKey {
+	return s.pubKey
+}
+
+func (s *signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, err := tpm2.HashToAlgorithm(opts.HashFunc())
+	if err != nil {
+		return nil, ErrHashUnsupported
+	}
+
+	var scheme tpm2.SigScheme
+	switch s.pubKey.(type) {
+	case *rsa.PublicKey:
+		scheme = tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: hash}
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			// The TPM always uses a salt as long as the digest, which is what
+			// TLS 1.3 requires.
+			if pss.SaltLength != rsa.PSSSaltLengthAuto && pss.SaltLength != rsa.PSSSaltLengthEqualsHash && pss.SaltLength != len(digest) {
+				return nil, ErrPSSSaltLength
+			}
+			scheme.Alg = tpm2.AlgRSAPSS
+		}
+	default:
+		scheme = tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: hash}
+	}
+
+	s.tpm.mtx.Lock()
+	defer s.tpm.mtx.Unlock()
+
+	handle, _, err := tpm2.Load(s.tpm.rw, s.tpm.srk, "", s.public, s.private)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(s.tpm.rw, handle)
+
+	sig, err := tpm2.Sign(s.tpm.rw, handle, "", digest, nil, &scheme)
+	if err != nil {
+		return nil, err
+	}
+	if sig.RSA != nil {
+		return sig.RSA.Signature, nil
+	}
+	return asn1.Marshal(struct {
+		R *big.Int
+		S *big.Int
+	}{sig.ECC.R, sig.ECC.S})
+}
+
+var srkTemplate = tpm2.Public{
+	Type:    tpm2.AlgECC,
+	NameAlg: tpm2.AlgSHA256,
+	Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+		tpm2.FlagUserWithAuth | tpm2.FlagRestricted | tpm2.FlagDecrypt | tpm2.FlagNoDA,
+	ECCParameters: &tpm2.ECCParams{
+		Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+		CurveID:   tpm2.CurveNISTP256,
+	},
+}
+
+// keyTemplate returns an unrestricted signing key template with a null scheme,
+// so the hash and padding are chosen on every signature. The simulator is built
+// without RSA 3072/4096, P-521 and Ed25519 support.
+func keyTemplate(keyType identity.KeyType) (tpm2.Public, error) {
+	template := tpm2.Public{
+		NameAlg: tpm2.AlgSHA256,
+		Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+			tpm2.FlagUserWithAuth | tpm2.FlagSign | tpm2.FlagNoDA,
+	}
+	switch keyType {
+	case identity.KeyTypeRSA2048:
+		template.Type = tpm2.AlgRSA
+		template.RSAParameters = &tpm2.RSAParams{KeyBits: 2048}
+	case identity.KeyTypeECDSAP256:
+		template.Type = tpm2.AlgECC
+		template.ECCParameters = &tpm2.ECCParams{CurveID: tpm2.CurveNISTP256}
+	case identity.KeyTypeECDSAP384:
+		template.Type = tpm2.AlgECC
+		template.ECCParameters = &tpm2.ECCParams{CurveID: tpm2.CurveNISTP384}
+	default:
+		return tpm2.Public{}, identity.ErrKeyTypeUnsupported
+	}
+	return template, nil
+}
@@ -0,0 +1,62 @@
+package tpm
+
+import (
+	"crypto/tls"
+	"fmt"
+	"testing"
+
+	"github.com/lamassuiot/device-virtual/pkg/identity"
+	"github.com/lamassuiot/device-virtual/pkg/identity/identitytest"
+)
+
+func TestSimulatorBackend(t *testing.T) {
+	backend, err := NewSimulatorBackend()
+	if err != nil {
+		t.Fatalf("Unable to start TPM simulator: %s", err)
+	}
+	defer backend.Close()
+
+	ca := identitytest.NewCA(t)
+
+	testCases := []struct {
+		keyType identity.KeyType
+		retErr  error
+	}{
+		{identity.KeyTypeRSA2048, nil},
+		{identity.KeyTypeRSA3072, identity.ErrKeyTypeUnsupported},
+		{identity.KeyTypeRSA4096, identity.ErrKeyTypeUnsupported},
+		{identity.KeyTypeECDSAP256, nil},
+		{identity.KeyTypeECDSAP384, nil},
+		{identity.KeyTypeECDSAP521, identity.ErrKeyTypeUnsupported},
+		{identity.KeyTypeEd25519, identity.ErrKeyTypeUnsupported},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.keyType), func(t *testing.T) {
+			id, err := identity.New(backend, "lamassu-client", tc.keyType)
+			if err != tc.retErr {
+				t.Fatalf("Got result is %s; want %s", err, tc.retErr)
+			}
+			if err != nil {
+				return
+			}
+
+			csr, err := id.CSR("lamassu-client")
+			if err != nil {
+				t.Fatalf("Unable to create CSR: %s", err)
+			}
+			if err := id.SetCertificate(ca.SignCSR(t, csr)); err != nil {
+				t.Fatalf("Unable to set certificate: %s", err)
+			}
+
+			for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+				if err := identitytest.Handshake(t, id.TLSCertificate(), ca, version); err != nil {
+					t.Errorf("TLS %x handshake with TPM key failed: %s", version, err)
+				}
+			}
+
+			if _, err := id.PKCS12("secret"); err != identity.ErrKeyNotExportable {
+				t.Errorf("Got result is %s; want %s", err, identity.ErrKeyNotExportable)
+			}
+		})
+	}
+}
@@ -0,0 +1,444 @@
+package impairment
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// mtu bounds the packets data is split into, so that stalls and bandwidth
+	// caps apply packet by packet.
+	mtu = 1460
+	// sendBuffer is the number of packets written and not yet delivered
+	// before writes block, like a socket send buffer.
+	sendBuffer = 64
+	// lingerTimeout bounds the delivery of the packets written before a
+	// connection is closed.
+	lingerTimeout = 5 * time.Second
+)
+
+var ErrReset = errors.New("connection reset by network impairment")
+
+// packet is data in flight, delivered once due.
+type packet struct {
+	data []byte
+	due  time.Time
+	err  error
+}
+
+// direction paces the packets flowing one way.
+type direction struct {
+	lastDue time.Time
+	free    time.Time
+}
+
+// conn delays the data written to and read from a network connection, and
+// delivers it at the pace of the profile of its shaper. Two goroutines move
+// the data, so that latency does not reduce the throughput of the
+// connection.
+type conn struct {
+	net.Conn
+	shaper *Shaper
+
+	out     chan packet
+	in      chan packet
+	next    *packet
+	nextAt  time.Time
+	pending []byte
+	readErr error
+
+	mtx       sync.Mutex
+	outbound  direction
+	inbound   direction
+	nextStall time.Time
+	err       error
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+	closed        chan struct{}
+	broken        chan struct{}
+	closeOnce     sync.Once
+}
+
+func newConn(c net.Conn, s *Shaper) *conn {
+	wrapped := &conn{
+		Conn:          c,
+		shaper:        s,
+		out:           make(chan packet, sendBuffer),
+		in:            make(chan packet, sendBuffer),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		closed:        make(chan struct{}),
+		broken:        make(chan struct{}),
+	}
+	go wrapped.send()
+	go wrapped.receive()
+	go wrapped.watch()
+	return wrapped
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if err := c.failure(); err != nil {
+			return written, err
+		}
+		n := len(b)
+		if n > mtu {
+			n = mtu
+		}
+		p := packet{data: append([]byte(nil), b[:n]...), due: c.due(&c.outbound)}
+		select {
+		case c.out <- p:
+		case <-c.closed:
+			return written, c.failureOr(net.ErrClosed)
+		case <-c.broken:
+			return written, c.failure()
+		case <-c.writeDeadline.wait():
+			return written, os.ErrDeadlineExceeded
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if c.next == nil {
+			select {
+			case p := <-c.in:
+				if p.err != nil {
+					c.readErr = c.failureOr(p.err)
+					return 0, c.readErr
+				}
+				c.next = &p
+				c.nextAt = c.schedule(&c.inbound, p.due, len(p.data))
+			case <-c.closed:
+				return 0, c.failureOr(net.ErrClosed)
+			case <-c.broken:
+				return 0, c.failure()
+			case <-c.readDeadline.wait():
+				return 0, os.ErrDeadlineExceeded
+			}
+		}
+		// A packet held past the deadline is returned by the next read.
+		if !c.wait(&c.nextAt, c.readDeadline.wait()) {
+			return 0, c.failureOr(os.ErrDeadlineExceeded)
+		}
+		c.pending = c.next.data
+		c.next = nil
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Close delivers the data written before, like the kernel does with the send
+// buffer of a socket, then closes the connection.
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.shaper.remove(c)
+	})
+	return nil
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// send delivers the packets written, until the connection is closed or
+// broken.
+func (c *conn) send() {
+	defer c.Conn.Close()
+	for {
+		select {
+		case p := <-c.out:
+			if !c.deliver(p, nil) {
+				return
+			}
+		case <-c.closed:
+			linger := make(chan struct{})
+			t := time.AfterFunc(lingerTimeout, func() { close(linger) })
+			defer t.Stop()
+			for {
+				select {
+				case p := <-c.out:
+					if !c.deliver(p, linger) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-c.broken:
+			return
+		}
+	}
+}
+
+// deliver writes p to the network connection once due, unless the
+// connection breaks or stop is closed first.
+func (c *conn) deliver(p packet, stop <-chan struct{}) bool {
+	at := c.schedule(&c.outbound, p.due, len(p.data))
+	if !c.wait(&at, stop) {
+		return false
+	}
+	if _, err := c.Conn.Write(p.data); err != nil {
+		c.fail(err)
+		return false
+	}
+	return true
+}
+
+// receive reads the network connection packet by packet, until it fails.
+func (c *conn) receive() {
+	for {
+		buf := make([]byte, mtu)
+		n, err := c.Conn.Read(buf)
+		if n > 0 {
+			select {
+			case c.in <- packet{data: buf[:n], due: c.due(&c.inbound)}:
+			case <-c.closed:
+				return
+			case <-c.broken:
+				return
+			}
+		}
+		if err != nil {
+			select {
+			case c.in <- packet{err: err}:
+			case <-c.closed:
+			case <-c.broken:
+			}
+			return
+		}
+	}
+}
+
+// watch resets the connection at random, as often as the profile says.
+func (c *conn) watch() {
+	for {
+		p, changed := c.shaper.profile()
+		var reset <-chan time.Time
+		var t *time.Timer
+		if p.ResetInterval > 0 {
+			t = time.NewTimer(exponential(p.ResetInterval))
+			reset = t.C
+		}
+		select {
+		case <-reset:
+			c.reset()
+			return
+		case <-changed:
+		case <-c.closed:
+		case <-c.broken:
+		}
+		if t != nil {
+			t.Stop()
+		}
+		select {
+		case <-c.closed:
+			return
+		case <-c.broken:
+			return
+		default:
+		}
+	}
+}
+
+// reset breaks the connection at once, dropping the data in flight. The
+// peer is sent a TCP reset rather than a clean close.
+func (c *conn) reset() {
+	if tcp, ok := c.Conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	c.fail(fmt.Errorf("%w: %w", ErrReset, syscall.ECONNRESET))
+	c.Close()
+}
+
+// due returns when data sent now in direction d arrives.
+func (c *conn) due(d *direction) time.Time {
+	p, _ := c.shaper.profile()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	due := time.Now().Add(p.delay())
+	if due.Before(d.lastDue) {
+		due = d.lastDue
+	}
+	d.lastDue = due
+	return due
+}
+
+// wait waits until the packet scheduled at *at is delivered, later if a
+// stall started meanwhile, which moves *at. It returns false when the
+// connection breaks or stop is closed first.
+func (c *conn) wait(at *time.Time, stop <-chan struct{}) bool {
+	for {
+		wait := time.Until(*at)
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-c.broken:
+				t.Stop()
+				return false
+			case <-stop:
+				t.Stop()
+				return false
+			}
+		}
+		end := c.stallEnd(time.Now())
+		if !end.After(time.Now()) {
+			return true
+		}
+		*at = end
+	}
+}
+
+// schedule returns when a packet of n bytes due at due is delivered, and
+// reserves the bandwidth for it.
+func (c *conn) schedule(d *direction, due time.Time, n int) time.Time {
+	p, _ := c.shaper.profile()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	start := due
+	if now := time.Now(); start.Before(now) {
+		start = now
+	}
+	start = c.stalledUntil(p, start)
+	if start.Before(d.free) {
+		start = d.free
+	}
+	if p.Bandwidth > 0 {
+		start = start.Add(time.Duration(int64(n) * int64(time.Second) / int64(p.Bandwidth)))
+	}
+	d.free = start
+	return start
+}
+
+// stallEnd returns when the stall going on at t ends, or t when the
+// connection is not stalled.
+func (c *conn) stallEnd(t time.Time) time.Time {
+	p, _ := c.shaper.profile()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.stalledUntil(p, t)
+}
+
+// stalledUntil is stallEnd with c.mtx held.
+func (c *conn) stalledUntil(p Profile, t time.Time) time.Time {
+	if p.StallInterval <= 0 || p.StallDuration <= 0 {
+		c.nextStall = time.Time{}
+		return t
+	}
+	if c.nextStall.IsZero() {
+		c.nextStall = t.Add(exponential(p.StallInterval))
+	}
+	for !t.Before(c.nextStall) {
+		end := c.nextStall.Add(p.StallDuration)
+		if t.Before(end) {
+			return end
+		}
+		c.nextStall = end.Add(exponential(p.StallInterval))
+	}
+	return t
+}
+
+// fail breaks the connection with err, unless it already broke.
+func (c *conn) fail(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.broken)
+	}
+}
+
+func (c *conn) failure() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.err
+}
+
+func (c *conn) failureOr(err error) error {
+	if failure := c.failure(); failure != nil {
+		return failure
+	}
+	return err
+}
+
+// deadline is closed once it passes, like the deadlines of net.Pipe.
+type deadline struct {
+	mtx     sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{expired: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired, wait for it to close expired.
+		<-d.expired
+	}
+	d.timer = nil
+
+	closed := false
+	select {
+	case <-d.expired:
+		closed = true
+	default:
+	}
+	if t.IsZero() {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+	if wait := time.Until(t); wait > 0 {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		expired := d.expired
+		d.timer = time.AfterFunc(wait, func() { close(expired) })
+		return
+	}
+	if !closed {
+		close(d.expired)
+	}
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.expired
+}
@@ -0,0 +1,273 @@
+// Package impairment degrades the broker connections of device sessions, as
+// poor cellular links do, without root privileges or tc: connections are
+// wrapped to add latency and jitter, cap their bandwidth, stall and reset
+// them.
+package impairment
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrProfileInvalid = errors.New("invalid network impairment profile")
+
+// Profile describes how connections are impaired. The zero Profile leaves
+// them untouched.
+type Profile struct {
+	// Latency delays the data in each direction, so that round trips grow by
+	// twice the latency.
+	Latency time.Duration
+	// Jitter randomly adds up to itself to the latency, or removes it. Data
+	// is never reordered, as TCP would not deliver it out of order either.
+	Jitter time.Duration
+	// Bandwidth caps each direction, in bytes per second.
+	Bandwidth int
+	// Connections stall on average every StallInterval for StallDuration,
+	// when no data goes through in either direction.
+	StallInterval time.Duration
+	StallDuration time.Duration
+	// Connections are reset on average ResetInterval after they open.
+	ResetInterval time.Duration
+}
+
+// profileJSON is the JSON form of a profile, with durations in milliseconds
+// like the rest of the API.
+type profileJSON struct {
+	Latency       int64 `json:"latency"`
+	Jitter        int64 `json:"jitter"`
+	Bandwidth     int   `json:"bandwidth"`
+	StallInterval int64 `json:"stallInterval"`
+	StallDuration int64 `json:"stallDuration"`
+	ResetInterval int64 `json:"resetInterval"`
+}
+
+func (p Profile) MarshalJSON() ([]byte, error) {
+	return json.Marshal(profileJSON{
+		Latency:       p.Latency.Milliseconds(),
+		Jitter:        p.Jitter.Milliseconds(),
+		Bandwidth:     p.Bandwidth,
+		StallInterval: p.StallInterval.Milliseconds(),
+		StallDuration: p.StallDuration.Milliseconds(),
+		ResetInterval: p.ResetInterval.Milliseconds(),
+	})
+}
+
+func (p *Profile) UnmarshalJSON(b []byte) error {
+	var j profileJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	*p = Profile{
+		Latency:       time.Duration(j.Latency) * time.Millisecond,
+		Jitter:        time.Duration(j.Jitter) * time.Millisecond,
+		Bandwidth:     j.Bandwidth,
+		StallInterval: time.Duration(j.StallInterval) * time.Millisecond,
+		StallDuration: time.Duration(j.StallDuration) * time.Millisecond,
+		ResetInterval: time.Duration(j.ResetInterval) * time.Millisecond,
+	}
+	return nil
+}
+
+func (p Profile) Validate() error {
+	if p.Latency < 0 || p.Jitter < 0 || p.Bandwidth < 0 || p.StallInterval < 0 || p.StallDuration < 0 || p.ResetInterval < 0 {
+		return errors.Wrap(ErrProfileInvalid, "values must not be negative")
+	}
+	if p.StallInterval > 0 && p.StallDuration == 0 {
+		return errors.Wrap(ErrProfileInvalid, "stallDuration must be set with stallInterval")
+	}
+	return nil
+}
+
+// delay returns the latency of the next data, spread by the jitter.
+func (p Profile) delay() time.Duration {
+	d := p.Latency
+	if p.Jitter > 0 {
+		d += time.Duration((2*rand.Float64() - 1) * float64(p.Jitter))
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// exponential returns a random interval averaging mean, as for events that
+// happen independently of each other.
+func exponential(mean time.Duration) time.Duration {
+	return time.Duration(rand.ExpFloat64() * float64(mean))
+}
+
+// Status is the impairment of the connections of a shaper, and the scenario
+// setting it, if any, with the index of its current step.
+type Status struct {
+	Profile  Profile `json:"profile"`
+	Scenario string  `json:"scenario,omitempty"`
+	Step     int     `json:"step,omitempty"`
+}
+
+// Shaper impairs the connections of a session. Its profile can change at any
+// time and applies at once to the live connections.
+type Shaper struct {
+	mtx     sync.Mutex
+	status  Status
+	changed chan struct{}
+	conns   map[*conn]struct{}
+	stop    chan struct{}
+}
+
+func NewShaper() *Shaper {
+	return &Shaper{changed: make(chan struct{}), conns: make(map[*conn]struct{})}
+}
+
+// Set impairs the connections with p, ending the scenario running, if any.
+func (s *Shaper) Set(p Profile) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.stopScenario()
+	s.set(Status{Profile: p})
+}
+
+// set is called with s.mtx held.
+func (s *Shaper) set(status Status) {
+	s.status = status
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Run plays sc, replacing the profile or scenario set before. The first step
+// applies before Run returns. sc must be valid.
+func (s *Shaper) Run(sc Scenario) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.stopScenario()
+	stop := make(chan struct{})
+	s.stop = stop
+	s.play(sc, 0)
+	go s.run(sc, stop)
+}
+
+// play applies step i of sc. It is called with s.mtx held.
+func (s *Shaper) play(sc Scenario, i int) {
+	step := sc.Steps[i]
+	s.set(Status{Profile: step.Profile, Scenario: sc.Name, Step: i})
+	if step.Reset {
+		s.reset()
+	}
+}
+
+// run plays the steps following the first one, each after the duration of
+// the previous one, over again when the scenario loops. Otherwise the profile
+// of the last step stays once the scenario ends.
+func (s *Shaper) run(sc Scenario, stop chan struct{}) {
+	for i := 0; ; {
+		if d := sc.Steps[i].Duration; d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-stop:
+				t.Stop()
+				return
+			case <-t.C:
+			}
+		}
+		i++
+		if i == len(sc.Steps) {
+			if !sc.Loop {
+				break
+			}
+			i = 0
+		}
+
+		s.mtx.Lock()
+		select {
+		case <-stop:
+			s.mtx.Unlock()
+			return
+		default:
+		}
+		s.play(sc, i)
+		s.mtx.Unlock()
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.stop == stop {
+		s.stop = nil
+		s.status.Scenario, s.status.Step = "", 0
+	}
+}
+
+// Stop ends the scenario running, if any, keeping its current profile.
+func (s *Shaper) Stop() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.stopScenario()
+}
+
+func (s *Shaper) stopScenario() {
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+func (s *Shaper) Status() Status {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.status
+}
+
+// profile returns the current profile and a channel closed when it changes.
+func (s *Shaper) profile() (Profile, <-chan struct{}) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.status.Profile, s.changed
+}
+
+// Reset abruptly resets the live connections and returns how many were.
+func (s *Shaper) Reset() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.reset()
+}
+
+func (s *Shaper) reset() int {
+	for c := range s.conns {
+		go c.reset()
+	}
+	return len(s.conns)
+}
+
+// Wrap impairs c, which should be the network connection under TLS so that
+// handshakes are impaired too.
+func (s *Shaper) Wrap(c net.Conn) net.Conn {
+	wrapped := newConn(c, s)
+	s.mtx.Lock()
+	s.conns[wrapped] = struct{}{}
+	s.mtx.Unlock()
+	return wrapped
+}
+
+func (s *Shaper) remove(c *conn) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.conns, c)
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying s, for clients to impair the
+// connections they open.
+func NewContext(ctx context.Context, s *Shaper) context.Context {
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+// FromContext returns the shaper of ctx, or nil.
+func FromContext(ctx context.Context) *Shaper {
+	s, _ := ctx.Value(contextKey{}).(*Shaper)
+	return s
+}
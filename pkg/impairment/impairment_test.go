@@ -0,0 +1,197 @@
+package impairment
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// pipe returns both ends of a loopback TCP connection, the client end
+// impaired by s.
+func pipe(t *testing.T, s *Shaper) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	peer := <-accepted
+	impaired := s.Wrap(c)
+	t.Cleanup(func() {
+		impaired.Close()
+		peer.Close()
+	})
+	return impaired, peer
+}
+
+func TestConn(t *testing.T) {
+	testCases := []struct {
+		name    string
+		profile Profile
+		size    int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{"Unimpaired", Profile{}, 100, 0, 100 * time.Millisecond},
+		{"Latency", Profile{Latency: 100 * time.Millisecond}, 100, 100 * time.Millisecond, 300 * time.Millisecond},
+		{"Jitter", Profile{Latency: 100 * time.Millisecond, Jitter: 50 * time.Millisecond}, 100, 50 * time.Millisecond, 350 * time.Millisecond},
+		{"Bandwidth", Profile{Bandwidth: 20000}, 4000, 200 * time.Millisecond, 400 * time.Millisecond},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			s := NewShaper()
+			s.Set(tc.profile)
+			c, peer := pipe(t, s)
+
+			begin := time.Now()
+			if _, err := c.Write(make([]byte, tc.size)); err != nil {
+				t.Fatalf("Got error %v writing; want none", err)
+			}
+			if _, err := io.ReadFull(peer, make([]byte, tc.size)); err != nil {
+				t.Fatalf("Got error %v reading; want none", err)
+			}
+			if took := time.Since(begin); took < tc.min || took > tc.max {
+				t.Errorf("Got data sent in %s; want between %s and %s", took, tc.min, tc.max)
+			}
+
+			begin = time.Now()
+			peer.Write(make([]byte, tc.size))
+			if _, err := io.ReadFull(c, make([]byte, tc.size)); err != nil {
+				t.Fatalf("Got error %v reading; want none", err)
+			}
+			if took := time.Since(begin); took < tc.min || took > tc.max {
+				t.Errorf("Got data received in %s; want between %s and %s", took, tc.min, tc.max)
+			}
+		})
+	}
+}
+
+func TestConnStall(t *testing.T) {
+	s := NewShaper()
+	s.Set(Profile{StallInterval: time.Hour, StallDuration: 200 * time.Millisecond})
+	c, peer := pipe(t, s)
+
+	// Stall now rather than in an hour on average.
+	impaired := c.(*conn)
+	impaired.mtx.Lock()
+	impaired.nextStall = time.Now()
+	impaired.mtx.Unlock()
+
+	begin := time.Now()
+	c.Write([]byte("ping"))
+	io.ReadFull(peer, make([]byte, 4))
+	if took := time.Since(begin); took < 150*time.Millisecond {
+		t.Errorf("Got data sent in %s; want it held by the stall", took)
+	}
+}
+
+func TestConnReset(t *testing.T) {
+	s := NewShaper()
+	c, peer := pipe(t, s)
+
+	if n := s.Reset(); n != 1 {
+		t.Fatalf("Got %d connections reset; want 1", n)
+	}
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, ErrReset) || !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Got error %v reading; want %v", err, ErrReset)
+	}
+	if _, err := c.Write([]byte("ping")); !errors.Is(err, ErrReset) {
+		t.Errorf("Got error %v writing; want %v", err, ErrReset)
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Got error %v on the peer; want a TCP reset", err)
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	s := NewShaper()
+	s.Set(Profile{Latency: 50 * time.Millisecond})
+	c, peer := pipe(t, s)
+
+	c.Write([]byte("bye"))
+	c.Close()
+	b, err := io.ReadAll(peer)
+	if err != nil || string(b) != "bye" {
+		t.Errorf("Got %q and error %v; want the data written before closing", b, err)
+	}
+}
+
+func TestConnDeadline(t *testing.T) {
+	s := NewShaper()
+	s.Set(Profile{Latency: 200 * time.Millisecond})
+	c, peer := pipe(t, s)
+
+	peer.Write([]byte("late"))
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 4)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Got error %v; want %v", err, os.ErrDeadlineExceeded)
+	}
+	c.SetReadDeadline(time.Time{})
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "late" {
+		t.Errorf("Got %q and error %v; want the data held past the deadline", b, err)
+	}
+}
+
+func TestShaperRun(t *testing.T) {
+	s := NewShaper()
+	s.Run(Scenario{Name: "tunnel", Steps: []Step{
+		{Duration: 100 * time.Millisecond, Profile: Profile{Latency: time.Second}},
+		{Profile: Profile{Latency: 10 * time.Millisecond}},
+	}})
+
+	time.Sleep(20 * time.Millisecond)
+	if status := s.Status(); status.Scenario != "tunnel" || status.Step != 0 || status.Profile.Latency != time.Second {
+		t.Errorf("Got status %+v; want the first step", status)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if status := s.Status(); status.Scenario != "" || status.Profile.Latency != 10*time.Millisecond {
+		t.Errorf("Got status %+v; want the profile of the last step once the scenario ended", status)
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "tunnel.json"), []byte(`{"steps": [{"duration": 30000, "profile": {"latency": 300, "bandwidth": 2000}}, {"duration": 5000, "profile": {}, "reset": true}], "loop": true}`), 0600)
+	os.WriteFile(filepath.Join(dir, "endless.json"), []byte(`{"steps": [{"duration": 0, "profile": {}}], "loop": true}`), 0600)
+	os.WriteFile(filepath.Join(dir, "negative.json"), []byte(`{"steps": [{"duration": 1000, "profile": {"latency": -1}}]}`), 0600)
+	store := NewStore(dir)
+
+	testCases := []struct {
+		name string
+		ret  error
+	}{
+		{"tunnel", nil},
+		{"missing", ErrNotFound},
+		{"../tunnel", ErrNameInvalid},
+		{"endless", ErrDecoding},
+		{"negative", ErrDecoding},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			sc, err := store.Open(tc.name)
+			if !errors.Is(err, tc.ret) {
+				t.Fatalf("Got error %v; want %v", err, tc.ret)
+			}
+			if err == nil && (sc.Name != tc.name || len(sc.Steps) != 2 || sc.Steps[0].Profile.Latency != 300*time.Millisecond || !sc.Steps[1].Reset) {
+				t.Errorf("Got scenario %+v; want the one of the file", sc)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package impairment
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Extension is the file extension of scenarios.
+const Extension = ".json"
+
+var (
+	ErrNameInvalid = errors.New("invalid scenario name, use letters, digits, dots, dashes and underscores")
+	ErrNotFound    = errors.New("scenario not found")
+	ErrDecoding    = errors.New("unable to decode scenario")
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Step impairs connections with Profile for Duration, resetting them first
+// when Reset is set.
+type Step struct {
+	Duration time.Duration
+	Profile  Profile
+	Reset    bool
+}
+
+type stepJSON struct {
+	Duration int64   `json:"duration"`
+	Profile  Profile `json:"profile"`
+	Reset    bool    `json:"reset,omitempty"`
+}
+
+func (s Step) MarshalJSON() ([]byte, error) {
+	return json.Marshal(stepJSON{Duration: s.Duration.Milliseconds(), Profile: s.Profile, Reset: s.Reset})
+}
+
+func (s *Step) UnmarshalJSON(b []byte) error {
+	var j stepJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	*s = Step{Duration: time.Duration(j.Duration) * time.Millisecond, Profile: j.Profile, Reset: j.Reset}
+	return nil
+}
+
+// Scenario changes the impairment of connections over time, like a device
+// driving through areas of poor coverage. Its name is the one of its file.
+type Scenario struct {
+	Name  string `json:"-"`
+	Steps []Step `json:"steps"`
+	Loop  bool   `json:"loop,omitempty"`
+}
+
+// Validate requires every step to last, except the last one of a scenario
+// that does not loop, whose profile stays.
+func (sc Scenario) Validate() error {
+	if len(sc.Steps) == 0 {
+		return errors.Wrap(ErrDecoding, "a scenario has at least one step")
+	}
+	for i, step := range sc.Steps {
+		if err := step.Profile.Validate(); err != nil {
+			return errors.Wrapf(ErrDecoding, "steps[%d]: %s", i, err)
+		}
+		last := i == len(sc.Steps)-1 && !sc.Loop
+		if step.Duration < 0 || (step.Duration == 0 && !last) {
+			return errors.Wrapf(ErrDecoding, "steps[%d]: duration must be positive", i)
+		}
+	}
+	return nil
+}
+
+// Store keeps named scenarios as files of a directory.
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// Open reads and validates a scenario.
+func (s *Store) Open(name string) (Scenario, error) {
+	if !validName.MatchString(name) {
+		return Scenario{}, ErrNameInvalid
+	}
+	b, err := os.ReadFile(filepath.Join(s.dir, name+Extension))
+	if os.IsNotExist(err) {
+		return Scenario{}, ErrNotFound
+	} else if err != nil {
+		return Scenario{}, err
+	}
+	var sc Scenario
+	if err := json.Unmarshal(b, &sc); err != nil {
+		return Scenario{}, errors.Wrap(ErrDecoding, err.Error())
+	}
+	sc.Name = name
+	if err := sc.Validate(); err != nil {
+		return Scenario{}, err
+	}
+	return sc, nil
+}
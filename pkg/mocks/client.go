@@ -1,29 +1,75 @@
 package mocks
 
-import "crypto/tls"
+import (
+	"context"
+	"crypto/tls"
+	"sync"
 
+	"github.com/lamassuiot/device-virtual/pkg/client"
+)
+
+// MockClient embeds the connection state machine, which tests drive with Set.
 type MockClient struct {
-	ConnectFn      func(URL string, clientID string, conf *tls.Config) error
+	client.Connection
+
+	mtx sync.Mutex
+
+	ConnectFn      func(ctx context.Context, URL string, clientID string, conf *tls.Config) error
 	ConnectInvoked bool
 
-	DisconnectFn      func()
+	DisconnectFn      func(ctx context.Context)
 	DisconnectInvoked bool
 
-	SendMessageFn      func(message string, topic string) error
+	SendMessageFn      func(ctx context.Context, message string, topic string) error
 	SendMessageInvoked bool
+
+	PublishFn      func(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error
+	PublishInvoked bool
+
+	SubscribeFn      func(ctx context.Context, topic string, qos byte, handler client.MessageHandler) error
+	SubscribeInvoked bool
+
+	UnsubscribeFn      func(ctx context.Context, topic string) error
+	UnsubscribeInvoked bool
+
+	IsConnectedFn      func() bool
+	IsConnectedInvoked bool
 }
 
-func (mc *MockClient) Connect(URL string, clientID string, conf *tls.Config) error {
+func (mc *MockClient) Connect(ctx context.Context, URL string, clientID string, conf *tls.Config) error {
 	mc.ConnectInvoked = true
-	return mc.ConnectFn(URL, clientID, conf)
+	return mc.ConnectFn(ctx, URL, clientID, conf)
 }
 
-func (mc *MockClient) Disconnect() {
+func (mc *MockClient) Disconnect(ctx context.Context) {
 	mc.DisconnectInvoked = true
-	mc.DisconnectFn()
+	mc.DisconnectFn(ctx)
 }
 
-func (mc *MockClient) SendMessage(message string, topic string) error {
+func (mc *MockClient) SendMessage(ctx context.Context, message string, topic string) error {
 	mc.SendMessageInvoked = true
-	return mc.SendMessageFn(message, topic)
+	return mc.SendMessageFn(ctx, message, topic)
+}
+
+// Publish may be called concurrently by batches.
+func (mc *MockClient) Publish(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error {
+	mc.mtx.Lock()
+	defer mc.mtx.Unlock()
+	mc.PublishInvoked = true
+	return mc.PublishFn(ctx, topic, payload, qos, retained)
+}
+
+func (mc *MockClient) IsConnected() bool {
+	mc.IsConnectedInvoked = true
+	return mc.IsConnectedFn()
+}
+
+func (mc *MockClient) Subscribe(ctx context.Context, topic string, qos byte, handler client.MessageHandler) error {
+	mc.SubscribeInvoked = true
+	return mc.SubscribeFn(ctx, topic, qos, handler)
+}
+
+func (mc *MockClient) Unsubscribe(ctx context.Context, topic string) error {
+	mc.UnsubscribeInvoked = true
+	return mc.UnsubscribeFn(ctx, topic)
 }
@@ -0,0 +1,159 @@
+// Package disk persists offline queues, so that the messages devices
+// published while disconnected survive a restart of the service.
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lamassuiot/device-virtual/pkg/queue"
+
+	"github.com/pkg/errors"
+)
+
+// Store appends the messages of a queue to a JSON lines file and keeps the
+// offset of the oldest one in a head file next to it. The files are truncated
+// once the queue is empty. Messages are kept in memory too, the files are
+// only read when the store is opened.
+type Store struct {
+	log      *os.File
+	headPath string
+	head     int64
+	size     int64
+	messages []queue.Message
+	ends     []int64
+	bytes    int
+}
+
+// Open opens the store of clientID in dir, creating it if needed. A message
+// partially written when the service stopped is discarded.
+func Open(dir string, clientID string) (queue.Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "unable to create queue directory")
+	}
+	name := filepath.Join(dir, url.PathEscape(clientID))
+	s := &Store{headPath: name + ".head"}
+
+	if b, err := ioutil.ReadFile(s.headPath); err == nil {
+		s.head, err = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read queue head")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "unable to read queue head")
+	}
+
+	f, err := os.OpenFile(name+".jsonl", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open queue")
+	}
+	s.log = f
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the messages after the head.
+func (s *Store) load() error {
+	if _, err := s.log.Seek(s.head, io.SeekStart); err != nil {
+		return errors.Wrap(err, "unable to read queue")
+	}
+	r := bufio.NewReader(s.log)
+	offset := s.head
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "unable to read queue")
+		}
+		var m queue.Message
+		if err := json.Unmarshal(bytes.TrimSpace(line), &m); err != nil {
+			break
+		}
+		offset += int64(len(line))
+		s.messages = append(s.messages, m)
+		s.ends = append(s.ends, offset)
+		s.bytes += len(m.Payload)
+	}
+	s.size = offset
+	if err := s.log.Truncate(s.size); err != nil {
+		return errors.Wrap(err, "unable to truncate queue")
+	}
+	return nil
+}
+
+func (s *Store) Push(m queue.Message) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := s.log.WriteAt(line, s.size); err != nil {
+		return errors.Wrap(err, "unable to write queue")
+	}
+	s.size += int64(len(line))
+	s.messages = append(s.messages, m)
+	s.ends = append(s.ends, s.size)
+	s.bytes += len(m.Payload)
+	return nil
+}
+
+func (s *Store) Front() (queue.Message, bool) {
+	if len(s.messages) == 0 {
+		return queue.Message{}, false
+	}
+	return s.messages[0], true
+}
+
+func (s *Store) Pop() error {
+	if len(s.messages) == 0 {
+		return nil
+	}
+	s.bytes -= len(s.messages[0].Payload)
+	s.head = s.ends[0]
+	s.messages[0] = queue.Message{}
+	s.messages = s.messages[1:]
+	s.ends = s.ends[1:]
+
+	if len(s.messages) == 0 {
+		if err := s.log.Truncate(0); err != nil {
+			return errors.Wrap(err, "unable to truncate queue")
+		}
+		s.head, s.size = 0, 0
+	}
+	return s.writeHead()
+}
+
+func (s *Store) writeHead() error {
+	if err := ioutil.WriteFile(s.headPath, []byte(strconv.FormatInt(s.head, 10)), 0600); err != nil {
+		return errors.Wrap(err, "unable to write queue head")
+	}
+	return nil
+}
+
+func (s *Store) Len() int {
+	return len(s.messages)
+}
+
+func (s *Store) Bytes() int {
+	return s.bytes
+}
+
+func (s *Store) Close() error {
+	if err := s.log.Sync(); err != nil {
+		s.log.Close()
+		return errors.Wrap(err, "unable to sync queue")
+	}
+	return s.log.Close()
+}
@@ -0,0 +1,75 @@
+package disk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lamassuiot/device-virtual/pkg/queue"
+)
+
+func TestStore(t *testing.T) {
+	testCases := []struct {
+		name  string
+		push  int
+		pop   int
+		extra string
+		want  []string
+	}{
+		{"Reopened", 3, 0, "", []string{"m0", "m1", "m2"}},
+		{"Reopened after pops", 3, 2, "", []string{"m2"}},
+		{"Reopened empty", 2, 2, "", nil},
+		{"Partial write discarded", 2, 0, `{"topic":"m`, []string{"m0", "m1"}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := Open(dir, "device/1")
+			if err != nil {
+				t.Fatalf("Got error %v; want none", err)
+			}
+			for i := 0; i < tc.push; i++ {
+				if err := s.Push(queue.Message{Topic: fmt.Sprintf("m%d", i), Payload: []byte("payload")}); err != nil {
+					t.Fatalf("Got error %v; want none", err)
+				}
+			}
+			for i := 0; i < tc.pop; i++ {
+				s.Pop()
+			}
+			s.Close()
+
+			if tc.extra != "" {
+				f, err := os.OpenFile(filepath.Join(dir, "device%2F1.jsonl"), os.O_APPEND|os.O_WRONLY, 0600)
+				if err != nil {
+					t.Fatalf("Got error %v; want none", err)
+				}
+				f.WriteString(tc.extra)
+				f.Close()
+			}
+
+			s, err = Open(dir, "device/1")
+			if err != nil {
+				t.Fatalf("Got error %v reopening; want none", err)
+			}
+			defer s.Close()
+			if s.Bytes() != len(tc.want)*len("payload") {
+				t.Errorf("Got %d bytes; want %d", s.Bytes(), len(tc.want)*len("payload"))
+			}
+			var got []string
+			for m, ok := s.Front(); ok; m, ok = s.Front() {
+				got = append(got, m.Topic)
+				s.Pop()
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("Got messages %v; want %v", got, tc.want)
+			}
+
+			// Appends after a reopen follow the messages kept.
+			s.Push(queue.Message{Topic: "next"})
+			if m, _ := s.Front(); m.Topic != "next" {
+				t.Errorf("Got message %s; want next", m.Topic)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package memory
+
+import (
+	"github.com/lamassuiot/device-virtual/pkg/queue"
+)
+
+// Store keeps the messages in memory, so they are lost when the service
+// stops.
+type Store struct {
+	messages []queue.Message
+	bytes    int
+}
+
+func NewStore() queue.Store {
+	return &Store{}
+}
+
+func (s *Store) Push(m queue.Message) error {
+	s.messages = append(s.messages, m)
+	s.bytes += len(m.Payload)
+	return nil
+}
+
+func (s *Store) Front() (queue.Message, bool) {
+	if len(s.messages) == 0 {
+		return queue.Message{}, false
+	}
+	return s.messages[0], true
+}
+
+func (s *Store) Pop() error {
+	if len(s.messages) == 0 {
+		return nil
+	}
+	s.bytes -= len(s.messages[0].Payload)
+	s.messages[0] = queue.Message{}
+	s.messages = s.messages[1:]
+	return nil
+}
+
+func (s *Store) Len() int {
+	return len(s.messages)
+}
+
+func (s *Store) Bytes() int {
+	return s.bytes
+}
+
+func (s *Store) Close() error {
+	s.messages = nil
+	s.bytes = 0
+	return nil
+}
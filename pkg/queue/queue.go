@@ -0,0 +1,220 @@
+// Package queue stores the messages devices publish while their broker
+// connection is down, to be forwarded in order once they reconnect.
+package queue
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+var (
+	ErrClosed          = errors.New("queue closed")
+	ErrMessageTooLarge = errors.New("message larger than the queue")
+)
+
+// Message is a publish waiting for the connection of its device. Seq numbers
+// the messages of a queue in order.
+type Message struct {
+	Seq      uint64    `json:"seq"`
+	Topic    string    `json:"topic"`
+	Payload  []byte    `json:"payload"`
+	QoS      byte      `json:"qos"`
+	Retained bool      `json:"retained"`
+	QueuedAt time.Time `json:"queuedAt"`
+}
+
+// Store keeps the messages of a queue in order. Stores are not safe for
+// concurrent use, the queue serializes the calls.
+type Store interface {
+	Push(m Message) error
+	// Front returns the oldest message, if any.
+	Front() (Message, bool)
+	// Pop removes the oldest message.
+	Pop() error
+	Len() int
+	// Bytes is the size of the payloads stored.
+	Bytes() int
+	Close() error
+}
+
+// Limits bound a queue. Zero values do not bound anything.
+type Limits struct {
+	MaxMessages int
+	MaxBytes    int
+	MaxAge      time.Duration
+}
+
+// Metrics are shared by the queues of every device.
+type Metrics struct {
+	Depth   metrics.Gauge   // messages queued
+	Dropped metrics.Counter // by "reason", full or expired
+}
+
+// Stats describe the content of a queue.
+type Stats struct {
+	Messages int        `json:"messages"`
+	Bytes    int        `json:"bytes"`
+	Oldest   *time.Time `json:"oldest,omitempty"`
+	Dropped  int        `json:"dropped"`
+}
+
+// Queue is the offline queue of a device. When full, the oldest messages are
+// dropped to make room for new ones, as devices with a ring buffer do.
+type Queue struct {
+	mtx     sync.Mutex
+	store   Store
+	limits  Limits
+	metrics Metrics
+	next    uint64
+	dropped int
+	closed  bool
+}
+
+// Opener opens the queue of a device.
+type Opener func(clientID string) (*Queue, error)
+
+// New creates a queue over store, which may hold messages from a previous
+// run.
+func New(store Store, limits Limits, m Metrics) *Queue {
+	m.Depth.Add(float64(store.Len()))
+	q := &Queue{store: store, limits: limits, metrics: m}
+	if front, ok := store.Front(); ok {
+		q.next = front.Seq + uint64(store.Len())
+	}
+	return q
+}
+
+// Push appends m and returns the number of messages dropped to stay within
+// the limits.
+func (q *Queue) Push(m Message) (int, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.closed {
+		return 0, ErrClosed
+	}
+	if q.limits.MaxBytes > 0 && len(m.Payload) > q.limits.MaxBytes {
+		return 0, ErrMessageTooLarge
+	}
+	if m.QueuedAt.IsZero() {
+		m.QueuedAt = time.Now()
+	}
+
+	dropped, err := q.expire()
+	if err != nil {
+		return dropped, err
+	}
+	for q.store.Len() > 0 && q.full(m) {
+		if err := q.drop("full"); err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+	m.Seq = q.next
+	if err := q.store.Push(m); err != nil {
+		return dropped, err
+	}
+	q.next++
+	q.metrics.Depth.Add(1)
+	return dropped, nil
+}
+
+func (q *Queue) full(m Message) bool {
+	return (q.limits.MaxMessages > 0 && q.store.Len()+1 > q.limits.MaxMessages) ||
+		(q.limits.MaxBytes > 0 && q.store.Bytes()+len(m.Payload) > q.limits.MaxBytes)
+}
+
+// Front returns the oldest message queued, dropping the expired ones.
+func (q *Queue) Front() (Message, bool, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.closed {
+		return Message{}, false, ErrClosed
+	}
+	if _, err := q.expire(); err != nil {
+		return Message{}, false, err
+	}
+	m, ok := q.store.Front()
+	return m, ok, nil
+}
+
+// Remove removes the message returned by Front once it has been forwarded,
+// unless it was dropped meanwhile to make room for newer ones.
+func (q *Queue) Remove(seq uint64) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if m, ok := q.store.Front(); !ok || m.Seq != seq {
+		return nil
+	}
+	if err := q.store.Pop(); err != nil {
+		return err
+	}
+	q.metrics.Depth.Add(-1)
+	return nil
+}
+
+func (q *Queue) Len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.store.Len()
+}
+
+func (q *Queue) Stats() Stats {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	s := Stats{Messages: q.store.Len(), Bytes: q.store.Bytes(), Dropped: q.dropped}
+	if m, ok := q.store.Front(); ok {
+		s.Oldest = &m.QueuedAt
+	}
+	return s
+}
+
+// Close closes the store, which keeps the messages when it persists them.
+func (q *Queue) Close() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.metrics.Depth.Add(-float64(q.store.Len()))
+	return q.store.Close()
+}
+
+// expire drops the messages older than MaxAge.
+func (q *Queue) expire() (int, error) {
+	if q.limits.MaxAge <= 0 {
+		return 0, nil
+	}
+	dropped := 0
+	for {
+		m, ok := q.store.Front()
+		if !ok || time.Since(m.QueuedAt) <= q.limits.MaxAge {
+			return dropped, nil
+		}
+		if err := q.drop("expired"); err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+}
+
+func (q *Queue) drop(reason string) error {
+	if err := q.store.Pop(); err != nil {
+		return err
+	}
+	q.dropped++
+	q.metrics.Depth.Add(-1)
+	q.metrics.Dropped.With("reason", reason).Add(1)
+	return nil
+}
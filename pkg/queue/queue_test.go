@@ -0,0 +1,123 @@
+package queue
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/generic"
+)
+
+// sliceStore is the simplest store, the memory store lives in a subpackage.
+type sliceStore struct {
+	messages []Message
+}
+
+func (s *sliceStore) Push(m Message) error { s.messages = append(s.messages, m); return nil }
+func (s *sliceStore) Front() (Message, bool) {
+	if len(s.messages) == 0 {
+		return Message{}, false
+	}
+	return s.messages[0], true
+}
+func (s *sliceStore) Pop() error   { s.messages = s.messages[1:]; return nil }
+func (s *sliceStore) Len() int     { return len(s.messages) }
+func (s *sliceStore) Close() error { return nil }
+func (s *sliceStore) Bytes() int {
+	n := 0
+	for _, m := range s.messages {
+		n += len(m.Payload)
+	}
+	return n
+}
+
+func TestQueue(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+
+	testCases := []struct {
+		name    string
+		limits  Limits
+		push    []Message
+		want    []string
+		dropped int
+		err     error
+	}{
+		{"Unbounded", Limits{}, []Message{{Topic: "a"}, {Topic: "b"}, {Topic: "c"}}, []string{"a", "b", "c"}, 0, nil},
+		{"Oldest dropped when full", Limits{MaxMessages: 2}, []Message{{Topic: "a"}, {Topic: "b"}, {Topic: "c"}}, []string{"b", "c"}, 1, nil},
+		{"Oldest dropped over the size limit", Limits{MaxBytes: 4}, []Message{{Topic: "a", Payload: []byte("12")}, {Topic: "b", Payload: []byte("34")}, {Topic: "c", Payload: []byte("5")}}, []string{"b", "c"}, 1, nil},
+		{"Expired dropped", Limits{MaxAge: time.Hour}, []Message{{Topic: "a", QueuedAt: old}, {Topic: "b"}}, []string{"b"}, 1, nil},
+		{"Message too large", Limits{MaxBytes: 1}, []Message{{Topic: "a", Payload: []byte("12")}}, nil, 0, ErrMessageTooLarge},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			depth := generic.NewGauge("depth")
+			q := New(&sliceStore{}, tc.limits, Metrics{Depth: depth, Dropped: generic.NewCounter("dropped")})
+
+			var err error
+			for _, m := range tc.push {
+				if _, err = q.Push(m); err != nil {
+					break
+				}
+			}
+			if err != tc.err {
+				t.Fatalf("Got error %v; want %v", err, tc.err)
+			}
+			if depth.Value() != float64(len(tc.want)) {
+				t.Errorf("Got depth %v; want %d", depth.Value(), len(tc.want))
+			}
+			if s := q.Stats(); s.Dropped != tc.dropped {
+				t.Errorf("Got %d messages dropped; want %d", s.Dropped, tc.dropped)
+			}
+
+			var got []string
+			for {
+				m, ok, err := q.Front()
+				if err != nil {
+					t.Fatalf("Got error %v; want none", err)
+				}
+				if !ok {
+					break
+				}
+				got = append(got, m.Topic)
+				q.Remove(m.Seq)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("Got messages %v; want %v", got, tc.want)
+			}
+			if depth.Value() != 0 {
+				t.Errorf("Got depth %v once drained; want 0", depth.Value())
+			}
+		})
+	}
+}
+
+func TestQueueRemove(t *testing.T) {
+	q := New(&sliceStore{}, Limits{MaxMessages: 1}, Metrics{Depth: generic.NewGauge("depth"), Dropped: generic.NewCounter("dropped")})
+	q.Push(Message{Topic: "a"})
+	forwarding, _, _ := q.Front()
+
+	// Dropped while forwarded, making room for b which must stay queued.
+	q.Push(Message{Topic: "b"})
+	q.Remove(forwarding.Seq)
+	if m, ok, _ := q.Front(); !ok || m.Topic != "b" {
+		t.Errorf("Got message %+v; want b", m)
+	}
+}
+
+func TestQueueClosed(t *testing.T) {
+	depth := generic.NewGauge("depth")
+	q := New(&sliceStore{messages: []Message{{Seq: 7, Topic: "a"}}}, Limits{}, Metrics{Depth: depth, Dropped: generic.NewCounter("dropped")})
+	if depth.Value() != 1 {
+		t.Fatalf("Got depth %v; want the message of the previous run", depth.Value())
+	}
+	if q.next != 8 {
+		t.Errorf("Got next sequence %d; want 8 following the previous run", q.next)
+	}
+	q.Close()
+	if depth.Value() != 0 {
+		t.Errorf("Got depth %v after close; want 0", depth.Value())
+	}
+	if _, err := q.Push(Message{Topic: "b"}); err != ErrClosed {
+		t.Errorf("Got error %v; want %v", err, ErrClosed)
+	}
+}
@@ -0,0 +1,138 @@
+// Package recording captures the MQTT traffic of device sessions as JSON
+// lines, so that it can be replayed later through another virtual device.
+package recording
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Extension is the file extension of recordings.
+const Extension = ".jsonl"
+
+var (
+	ErrNameInvalid = errors.New("invalid recording name, use letters, digits, dots, dashes and underscores")
+	ErrExists      = errors.New("recording already exists")
+	ErrNotFound    = errors.New("recording not found")
+	ErrDecoding    = errors.New("unable to decode recording")
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+type Direction string
+
+const (
+	Published Direction = "publish"
+	Received  Direction = "receive"
+)
+
+// Record is a message published or received by a device session.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Direction Direction `json:"direction"`
+	ClientID  string    `json:"clientID"`
+	Topic     string    `json:"topic"`
+	Payload   []byte    `json:"payload"`
+	QoS       byte      `json:"qos"`
+	Retained  bool      `json:"retained,omitempty"`
+}
+
+// Recorder writes records as JSON lines. It is safe for concurrent use.
+type Recorder struct {
+	mtx sync.Mutex
+	enc *json.Encoder
+	w   io.Writer
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w), w: w}
+}
+
+func (r *Recorder) Record(rec Record) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.enc.Encode(rec)
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (r *Recorder) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if c, ok := r.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Read decodes every record of a recording.
+func Read(r io.Reader) ([]Record, error) {
+	var records []Record
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, errors.Wrapf(ErrDecoding, "record %d: %s", len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// Store keeps named recordings as files of a directory.
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// Create starts a new recording. Existing recordings are never overwritten.
+func (s *Store) Create(name string) (*Recorder, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if os.IsExist(err) {
+		return nil, ErrExists
+	} else if err != nil {
+		return nil, err
+	}
+	return NewRecorder(f), nil
+}
+
+// Open reads every record of a recording.
+func (s *Store) Open(name string) ([]Record, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+func (s *Store) path(name string) (string, error) {
+	if !validName.MatchString(name) {
+		return "", ErrNameInvalid
+	}
+	return filepath.Join(s.dir, name+Extension), nil
+}
@@ -0,0 +1,162 @@
+package recording
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAndRead(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewRecorder(&buf)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	want := []Record{
+		{Time: now, Direction: Published, ClientID: "lamassu-client", Topic: "lamassu-sample", Payload: []byte{0, 1, 2}, QoS: 1},
+		{Time: now.Add(time.Second), Direction: Received, ClientID: "lamassu-client", Topic: "lamassu-commands", Payload: []byte("reboot"), Retained: true},
+	}
+	for _, rec := range want {
+		if err := r.Record(rec); err != nil {
+			t.Fatalf("Unable to record: %s", err)
+		}
+	}
+	if n := strings.Count(buf.String(), "\n"); n != len(want) {
+		t.Errorf("Got %d lines; want %d", n, len(want))
+	}
+
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Unable to read recording: %s", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Got records %v; want %v", got, want)
+	}
+
+	if _, err := Read(strings.NewReader("{}\n{")); !errors.Is(err, ErrDecoding) {
+		t.Errorf("Got result is %v for a truncated recording; want %v", err, ErrDecoding)
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := NewStore(t.TempDir())
+
+	testCases := []struct {
+		name      string
+		recording string
+		create    error
+		open      error
+	}{
+		{"Valid name", "lamassu-sample_1.0", nil, nil},
+		{"Existing recording", "lamassu-sample_1.0", ErrExists, nil},
+		{"Path traversal", "../lamassu", ErrNameInvalid, ErrNameInvalid},
+		{"Empty name", "", ErrNameInvalid, ErrNameInvalid},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			r, err := s.Create(tc.recording)
+			if !errors.Is(err, tc.create) {
+				t.Fatalf("Got create result is %v; want %v", err, tc.create)
+			}
+			if r != nil {
+				r.Record(Record{Direction: Published, Topic: "lamassu-sample"})
+				r.Close()
+			}
+			if _, err := s.Open(tc.recording); !errors.Is(err, tc.open) {
+				t.Errorf("Got open result is %v; want %v", err, tc.open)
+			}
+		})
+	}
+
+	if _, err := s.Open("unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Got result is %v for an unknown recording; want %v", err, ErrNotFound)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	rec := Record{ClientID: "real-device", Topic: "devices/real-device/telemetry", Payload: []byte(`{"id": "real-device"}`)}
+
+	testCases := []struct {
+		name    string
+		opts    Options
+		topic   string
+		payload string
+	}{
+		{"No options", Options{}, "devices/real-device/telemetry", `{"id": "real-device"}`},
+		{"Client ID", Options{ClientID: "virtual-device"}, "devices/virtual-device/telemetry", `{"id": "virtual-device"}`},
+		{"Topic rewrite", Options{TopicRewrites: []TopicRewrite{{Pattern: `^devices/([^/]+)/`, Replacement: "staging/$1/"}}}, "staging/real-device/telemetry", `{"id": "real-device"}`},
+		{"Client ID and topic rewrite", Options{ClientID: "virtual-device", TopicRewrites: []TopicRewrite{{Pattern: `telemetry$`, Replacement: "metrics"}}}, "devices/virtual-device/metrics", `{"id": "virtual-device"}`},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			r, err := NewReplayer(tc.opts)
+			if err != nil {
+				t.Fatalf("Unable to create replayer: %s", err)
+			}
+			got := r.Rewrite(rec)
+			if got.Topic != tc.topic || string(got.Payload) != tc.payload {
+				t.Errorf("Got topic %q and payload %q; want %q and %q", got.Topic, got.Payload, tc.topic, tc.payload)
+			}
+		})
+	}
+
+	for _, opts := range []Options{{Speed: -1}, {TopicRewrites: []TopicRewrite{{Pattern: "("}}}} {
+		if _, err := NewReplayer(opts); !errors.Is(err, ErrOptionsInvalid) {
+			t.Errorf("Got result is %v for options %+v; want %v", err, opts, ErrOptionsInvalid)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	now := time.Now()
+	records := []Record{
+		{Time: now, Direction: Published, Topic: "lamassu-first"},
+		{Time: now.Add(50 * time.Millisecond), Direction: Received, Topic: "lamassu-commands"},
+		{Time: now.Add(100 * time.Millisecond), Direction: Published, Topic: "lamassu-denied"},
+		{Time: now.Add(200 * time.Millisecond), Direction: Published, Topic: "lamassu-last"},
+	}
+	publish := func(published *[]string) PublishFunc {
+		return func(rec Record) error {
+			if rec.Topic == "lamassu-denied" {
+				return errors.New("not authorized")
+			}
+			*published = append(*published, rec.Topic)
+			return nil
+		}
+	}
+
+	t.Run("Testing Scaled timing", func(t *testing.T) {
+		r, _ := NewReplayer(Options{Speed: 4})
+		var published []string
+		begin := time.Now()
+		report, err := r.Replay(context.Background(), records, publish(&published))
+		if err != nil {
+			t.Fatalf("Unable to replay: %s", err)
+		}
+		if took := time.Since(begin); took < 50*time.Millisecond {
+			t.Errorf("Replay took %s; want at least %s", took, 50*time.Millisecond)
+		}
+		if want := (Report{Published: 2, Failed: 1, Ignored: 1}); report != want {
+			t.Errorf("Got report %+v; want %+v", report, want)
+		}
+		if fmt.Sprint(published) != "[lamassu-first lamassu-last]" {
+			t.Errorf("Got published topics %v", published)
+		}
+	})
+
+	t.Run("Testing Canceled", func(t *testing.T) {
+		r, _ := NewReplayer(Options{})
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		var published []string
+		report, err := r.Replay(ctx, records, publish(&published))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Got result is %v; want %v", err, context.DeadlineExceeded)
+		}
+		if report.Published != 1 {
+			t.Errorf("Got %d records published before the deadline; want 1", report.Published)
+		}
+	})
+}
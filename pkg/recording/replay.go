@@ -0,0 +1,128 @@
+package recording
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrOptionsInvalid = errors.New("invalid replay options")
+
+// TopicRewrite replaces the matches of Pattern in replayed topics with
+// Replacement, which can refer to submatches like regexp.ReplaceAllString.
+type TopicRewrite struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+type Options struct {
+	// Speed scales the time between records, 2 replays twice as fast. Zero
+	// keeps the original timing.
+	Speed float64
+	// TopicRewrites are applied in order to every topic.
+	TopicRewrites []TopicRewrite
+	// ClientID, when set, replaces the recorded client ID in topics and
+	// payloads before the topics are rewritten.
+	ClientID string
+}
+
+// Report counts the records of a replay. Received records are not replayed.
+type Report struct {
+	Published int `json:"published"`
+	Failed    int `json:"failed"`
+	Ignored   int `json:"ignored"`
+}
+
+// PublishFunc publishes a record as it is replayed.
+type PublishFunc func(rec Record) error
+
+type rewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Replayer publishes recordings again with the same relative timing.
+type Replayer struct {
+	speed    float64
+	rewrites []rewrite
+	clientID string
+}
+
+func NewReplayer(opts Options) (*Replayer, error) {
+	if opts.Speed < 0 {
+		return nil, errors.Wrap(ErrOptionsInvalid, "speed must not be negative")
+	}
+	r := &Replayer{speed: opts.Speed, clientID: opts.ClientID}
+	if r.speed == 0 {
+		r.speed = 1
+	}
+	for _, tr := range opts.TopicRewrites {
+		pattern, err := regexp.Compile(tr.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(ErrOptionsInvalid, "topic rewrite %q: %s", tr.Pattern, err)
+		}
+		r.rewrites = append(r.rewrites, rewrite{pattern: pattern, replacement: tr.Replacement})
+	}
+	return r, nil
+}
+
+// Rewrite returns rec as it is replayed.
+func (r *Replayer) Rewrite(rec Record) Record {
+	if r.clientID != "" && rec.ClientID != "" && rec.ClientID != r.clientID {
+		rec.Topic = strings.ReplaceAll(rec.Topic, rec.ClientID, r.clientID)
+		rec.Payload = bytes.ReplaceAll(rec.Payload, []byte(rec.ClientID), []byte(r.clientID))
+		rec.ClientID = r.clientID
+	}
+	for _, rw := range r.rewrites {
+		rec.Topic = rw.pattern.ReplaceAllString(rec.Topic, rw.replacement)
+	}
+	return rec
+}
+
+// Replay publishes the published records of a recording, each one as long
+// after the first as it was recorded, scaled by the speed. Failed publishes
+// are counted and do not stop the replay, which ends early when ctx is done.
+func (r *Replayer) Replay(ctx context.Context, records []Record, publish PublishFunc) (Report, error) {
+	var report Report
+	var first time.Time
+	start := time.Now()
+	for _, rec := range records {
+		if rec.Direction != Published {
+			report.Ignored++
+			continue
+		}
+		if first.IsZero() {
+			first = rec.Time
+		}
+
+		offset := time.Duration(float64(rec.Time.Sub(first)) / r.speed)
+		if err := sleepUntil(ctx, start.Add(offset)); err != nil {
+			return report, err
+		}
+		if err := publish(r.Rewrite(rec)); err != nil {
+			report.Failed++
+			continue
+		}
+		report.Published++
+	}
+	return report, nil
+}
+
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,38 @@
+package jaeger
+
+import (
+	"context"
+	"io"
+
+	"github.com/lamassuiot/device-virtual/pkg/telemetry"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	jaegercfg "github.com/uber/jaeger-client-go/config"
+)
+
+type provider struct {
+	tracer stdopentracing.Tracer
+	closer io.Closer
+}
+
+// NewProvider creates a Jaeger tracer configured with the standard JAEGER_*
+// environment variables. It exports no metrics.
+func NewProvider() (telemetry.Provider, error) {
+	jcfg, err := jaegercfg.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	tracer, closer, err := jcfg.NewTracer()
+	if err != nil {
+		return nil, err
+	}
+	return &provider{tracer: tracer, closer: closer}, nil
+}
+
+func (p *provider) Tracer() stdopentracing.Tracer {
+	return p.tracer
+}
+
+func (p *provider) Shutdown(ctx context.Context) error {
+	return p.closer.Close()
+}
@@ -0,0 +1,158 @@
+package otlp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lamassuiot/device-virtual/pkg/telemetry"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	otelprometheus "go.opentelemetry.io/contrib/bridges/prometheus"
+	otelbridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http"
+)
+
+var ErrProtocolUnsupported = errors.New("unsupported OTLP protocol")
+
+type Config struct {
+	// Protocol is either ProtocolGRPC, the default, or ProtocolHTTP.
+	Protocol string
+	// Endpoint is the host and port of the collector. When empty, the
+	// standard OTEL_EXPORTER_OTLP_* environment variables or the default
+	// endpoint of the protocol are used.
+	Endpoint string
+	// Insecure disables TLS with the collector.
+	Insecure bool
+	// ServiceName is reported unless OTEL_SERVICE_NAME is set.
+	ServiceName string
+	// Metrics exports the metrics gathered from Metrics every
+	// MetricsInterval, nil exports none.
+	Metrics         prometheus.Gatherer
+	MetricsInterval time.Duration
+}
+
+type provider struct {
+	tracer *otelbridge.BridgeTracer
+	traces *sdktrace.TracerProvider
+	meters *sdkmetric.MeterProvider
+}
+
+// NewProvider exports traces, and the Prometheus metrics of the service when
+// configured, to an OpenTelemetry collector. Trace contexts are propagated
+// in the W3C Trace Context format.
+func NewProvider(ctx context.Context, cfg Config, logger log.Logger) (telemetry.Provider, error) {
+	switch cfg.Protocol {
+	case "", ProtocolGRPC, ProtocolHTTP:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrProtocolUnsupported, cfg.Protocol)
+	}
+
+	res, err := resource.Merge(
+		resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName)),
+		resource.Environment(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	spans, err := newTraceExporter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	p := &provider{
+		traces: sdktrace.NewTracerProvider(sdktrace.WithBatcher(spans), sdktrace.WithResource(res)),
+		tracer: otelbridge.NewBridgeTracer(),
+	}
+	p.tracer.SetOpenTelemetryTracer(p.traces.Tracer("github.com/lamassuiot/device-virtual"))
+	p.tracer.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	p.tracer.SetWarningHandler(func(msg string) {
+		level.Debug(logger).Log("msg", msg)
+	})
+
+	if cfg.Metrics != nil {
+		metrics, err := newMetricExporter(ctx, cfg)
+		if err != nil {
+			p.traces.Shutdown(ctx)
+			return nil, err
+		}
+		reader := sdkmetric.NewPeriodicReader(metrics,
+			sdkmetric.WithInterval(cfg.MetricsInterval),
+			sdkmetric.WithProducer(otelprometheus.NewMetricProducer(otelprometheus.WithGatherer(cfg.Metrics))),
+		)
+		p.meters = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithResource(res))
+	}
+	return p, nil
+}
+
+func newTraceExporter(ctx context.Context, cfg Config) (sdktrace.SpanExporter, error) {
+	if cfg.Protocol == ProtocolHTTP {
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+	var opts []otlptracegrpc.Option
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+func newMetricExporter(ctx context.Context, cfg Config) (sdkmetric.Exporter, error) {
+	if cfg.Protocol == ProtocolHTTP {
+		var opts []otlpmetrichttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlpmetrichttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+	var opts []otlpmetricgrpc.Option
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlpmetricgrpc.WithEndpoint(cfg.Endpoint))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+func (p *provider) Tracer() stdopentracing.Tracer {
+	return p.tracer
+}
+
+// Shutdown exports the pending spans and a last collection of metrics.
+func (p *provider) Shutdown(ctx context.Context) error {
+	err := p.traces.Shutdown(ctx)
+	if p.meters != nil {
+		err = errors.Join(err, p.meters.Shutdown(ctx))
+	}
+	return err
+}
@@ -0,0 +1,233 @@
+package otlp
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/tracing/opentracing"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is an in-process OTLP collector stub recording what it receives
+// over gRPC and HTTP.
+type collector struct {
+	mtx     sync.Mutex
+	spans   []exportedSpan
+	metrics []string
+}
+
+type exportedSpan struct {
+	service  string
+	name     string
+	traceID  string
+	parentID string
+}
+
+func (c *collector) exportTraces(req *collectortrace.ExportTraceServiceRequest) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, rs := range req.ResourceSpans {
+		var service string
+		for _, attr := range rs.Resource.Attributes {
+			if attr.Key == "service.name" {
+				service = attr.Value.GetStringValue()
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				c.spans = append(c.spans, exportedSpan{
+					service:  service,
+					name:     s.Name,
+					traceID:  hex.EncodeToString(s.TraceId),
+					parentID: hex.EncodeToString(s.ParentSpanId),
+				})
+			}
+		}
+	}
+}
+
+func (c *collector) exportMetrics(req *collectormetrics.ExportMetricsServiceRequest) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				c.metrics = append(c.metrics, m.Name)
+			}
+		}
+	}
+}
+
+type traceService struct {
+	collectortrace.UnimplementedTraceServiceServer
+	c *collector
+}
+
+func (s traceService) Export(ctx context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	s.c.exportTraces(req)
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+type metricsService struct {
+	collectormetrics.UnimplementedMetricsServiceServer
+	c *collector
+}
+
+func (s metricsService) Export(ctx context.Context, req *collectormetrics.ExportMetricsServiceRequest) (*collectormetrics.ExportMetricsServiceResponse, error) {
+	s.c.exportMetrics(req)
+	return &collectormetrics.ExportMetricsServiceResponse{}, nil
+}
+
+// serveGRPC starts the collector on a gRPC server and returns its endpoint.
+func (c *collector) serveGRPC(t *testing.T) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unable to listen")
+	}
+	srv := grpc.NewServer()
+	collectortrace.RegisterTraceServiceServer(srv, traceService{c: c})
+	collectormetrics.RegisterMetricsServiceServer(srv, metricsService{c: c})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+// serveHTTP starts the collector on an HTTP server and returns its endpoint.
+func (c *collector) serveHTTP(t *testing.T) string {
+	t.Helper()
+
+	handle := func(req proto.Message, resp proto.Message, export func()) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if err := proto.Unmarshal(body, req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			export()
+			out, _ := proto.Marshal(resp)
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.Write(out)
+		}
+	}
+	traces := &collectortrace.ExportTraceServiceRequest{}
+	metrics := &collectormetrics.ExportMetricsServiceRequest{}
+	mux := http.NewServeMux()
+	mux.Handle("/v1/traces", handle(traces, &collectortrace.ExportTraceServiceResponse{}, func() { c.exportTraces(traces) }))
+	mux.Handle("/v1/metrics", handle(metrics, &collectormetrics.ExportMetricsServiceResponse{}, func() { c.exportMetrics(metrics) }))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestProvider(t *testing.T) {
+	const upstreamTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const upstreamSpanID = "00f067aa0ba902b7"
+
+	testCases := []struct {
+		name     string
+		protocol string
+	}{
+		{"gRPC", ProtocolGRPC},
+		{"HTTP", ProtocolHTTP},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			c := &collector{}
+			endpoint := c.serveGRPC(t)
+			if tc.protocol == ProtocolHTTP {
+				endpoint = c.serveHTTP(t)
+			}
+
+			registry := prometheus.NewRegistry()
+			requests := prometheus.NewCounter(prometheus.CounterOpts{Name: "device_virtual_request_count"})
+			registry.MustRegister(requests)
+			requests.Inc()
+
+			ctx := context.Background()
+			p, err := NewProvider(ctx, Config{
+				Protocol:        tc.protocol,
+				Endpoint:        endpoint,
+				Insecure:        true,
+				ServiceName:     "device-virtual",
+				Metrics:         registry,
+				MetricsInterval: time.Hour,
+			}, log.NewNopLogger())
+			if err != nil {
+				t.Fatalf("Unable to create provider: %s", err)
+			}
+			tracer := p.Tracer()
+
+			// A request continuing an upstream trace goes through go-kit
+			// server tracing, and publishes a message within it.
+			r := httptest.NewRequest("POST", "/v1/device/message", nil)
+			r.Header.Set("traceparent", "00-"+upstreamTraceID+"-"+upstreamSpanID+"-01")
+			reqCtx := opentracing.HTTPToContext(tracer, "PostSendMessage", log.NewNopLogger())(ctx, r)
+			traced := opentracing.TraceServer(tracer, "PostSendMessage")(func(ctx context.Context, request interface{}) (interface{}, error) {
+				span, _ := stdopentracing.StartSpanFromContextWithTracer(ctx, tracer, "mqtt.publish")
+				defer span.Finish()
+				carrier := stdopentracing.TextMapCarrier{}
+				if err := tracer.Inject(span.Context(), stdopentracing.TextMap, carrier); err != nil {
+					t.Errorf("Unable to inject trace context: %s", err)
+				}
+				if !strings.Contains(carrier["traceparent"], upstreamTraceID) {
+					t.Errorf("Got traceparent %q; want trace %s", carrier["traceparent"], upstreamTraceID)
+				}
+				return nil, nil
+			})
+			traced(reqCtx, nil)
+
+			if err := p.Shutdown(ctx); err != nil {
+				t.Fatalf("Unable to flush telemetry: %s", err)
+			}
+
+			c.mtx.Lock()
+			defer c.mtx.Unlock()
+			if len(c.spans) != 2 {
+				t.Fatalf("Got %d spans exported; want 2", len(c.spans))
+			}
+			for _, s := range c.spans {
+				if s.traceID != upstreamTraceID {
+					t.Errorf("Got span %s in trace %s; want %s", s.name, s.traceID, upstreamTraceID)
+				}
+				if s.service != "device-virtual" {
+					t.Errorf("Got span %s of service %q; want device-virtual", s.name, s.service)
+				}
+			}
+			publish, server := c.spans[0], c.spans[1]
+			if server.name != "PostSendMessage" || server.parentID != upstreamSpanID {
+				t.Errorf("Got server span %s with parent %s; want PostSendMessage with parent %s", server.name, server.parentID, upstreamSpanID)
+			}
+			if publish.name != "mqtt.publish" {
+				t.Errorf("Got span %s; want mqtt.publish", publish.name)
+			}
+			if len(c.metrics) != 1 || c.metrics[0] != "device_virtual_request_count" {
+				t.Errorf("Got metrics %v exported; want device_virtual_request_count", c.metrics)
+			}
+		})
+	}
+}
+
+func TestProtocolUnsupported(t *testing.T) {
+	_, err := NewProvider(context.Background(), Config{Protocol: "udp"}, log.NewNopLogger())
+	if !errors.Is(err, ErrProtocolUnsupported) {
+		t.Errorf("Got result is %v; want %s", err, ErrProtocolUnsupported)
+	}
+}
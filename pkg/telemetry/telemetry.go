@@ -0,0 +1,26 @@
+package telemetry
+
+import (
+	"context"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+)
+
+// Provider exports the telemetry of the service. Its tracer traces the API
+// endpoints and the MQTT clients of the device sessions.
+type Provider interface {
+	Tracer() stdopentracing.Tracer
+	// Shutdown flushes the pending telemetry and stops exporting it.
+	Shutdown(ctx context.Context) error
+}
+
+// Nop returns a provider that exports nothing.
+func Nop() Provider {
+	return nop{}
+}
+
+type nop struct{}
+
+func (nop) Tracer() stdopentracing.Tracer { return stdopentracing.NoopTracer{} }
+
+func (nop) Shutdown(ctx context.Context) error { return nil }